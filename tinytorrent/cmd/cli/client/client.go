@@ -2,18 +2,32 @@ package client
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/connmgr"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/diskio"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/ipfilter"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/lsd"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/portmap"
 	"github.com/Despire/tinytorrent/cmd/cli/client/internal/status"
 	"github.com/Despire/tinytorrent/cmd/cli/client/internal/tracker"
+	"github.com/Despire/tinytorrent/p2p/mse"
+	"github.com/Despire/tinytorrent/p2p/peer"
+	"github.com/Despire/tinytorrent/p2p/proxy"
+	"github.com/Despire/tinytorrent/p2p/recorder"
+	"github.com/Despire/tinytorrent/p2p/transport"
+	"github.com/Despire/tinytorrent/p2p/utp"
 	"github.com/Despire/tinytorrent/torrent"
 )
 
@@ -34,6 +48,9 @@ func init() {
 	}
 }
 
+// errClientClosed is returned by WaitFor once the client is closed.
+var errClientClosed = errors.New("client shutting down")
+
 type Action string
 
 const (
@@ -46,6 +63,8 @@ const (
 type Client struct {
 	id   string
 	port int
+	// downloadDir is the directory the torrents are downloaded to.
+	downloadDir string
 
 	logger *slog.Logger
 
@@ -56,6 +75,70 @@ type Client struct {
 	action              Action
 	seedServer          net.Listener
 
+	lsdEnabled bool
+	lsd        *lsd.Service
+
+	encryption mse.Policy
+
+	utpEnabled bool
+	utp        *utp.Socket
+
+	// portmap maps the listen port on the gateway of the
+	// local network so that peers can connect to the client.
+	portMapping bool
+	portmap     *portmap.Service
+
+	// limiter caps the connections across all torrents.
+	limiter *connmgr.Limiter
+	// bans are the peers banned for sending corrupt data.
+	bans               *connmgr.BanList
+	maxConns           int
+	maxHalfOpen        int
+	maxConnsPerTorrent int
+
+	// filter blocks the peers in the address ranges
+	// of the blocklists at filterPaths, if any.
+	filterPaths []string
+	filter      *ipfilter.Filter
+
+	// blockedClients are the names of the client
+	// software whose peers are not connected to.
+	blockedClients []string
+
+	// proxy routes tracker announces and peer connections, if set.
+	// In strict mode no direct connections are made at all.
+	proxyURL    string
+	proxyStrict bool
+	proxy       *proxy.Proxy
+	// httpClient is used for announces to http trackers.
+	httpClient *http.Client
+
+	// ipv4 and ipv6 are the public addresses of the client, if any, announced
+	// to trackers so that the client is shared with peers of both families.
+	ipv4 *string
+	ipv6 *string
+
+	// metrics serves the statistics at metricsAddr, if set.
+	metricsAddr string
+	metrics     *http.Server
+
+	// watchDir is scanned for torrent files to add, which
+	// are moved to doneDir once added, if set.
+	watchDir string
+	doneDir  string
+
+	// recorder records the sessions with all peers
+	// to the file at recordPath, if set.
+	recordPath string
+	recorder   *recorder.Recorder
+
+	// sessionEnabled keeps the torrents worked on across restarts.
+	// finished are the torrents that stopped seeding once their
+	// share ratio reached ratioLimit, stored as math.Float64bits.
+	sessionEnabled bool
+	finished       sync.Map
+	ratioLimit     atomic.Uint64
+
 	wg sync.WaitGroup
 }
 
@@ -64,31 +147,229 @@ func New(opts ...Option) (*Client, error) {
 		handler: make(chan string),
 		done:    make(chan struct{}),
 	}
-	defaults(p)
+	if err := defaults(p); err != nil {
+		return nil, fmt.Errorf("failed to apply defaults: %w", err)
+	}
 
 	for _, o := range opts {
 		o(p)
 	}
 
-	if p.action != Leech {
+	p.httpClient = http.DefaultClient
+	switch {
+	case p.proxyURL != "":
+		var err error
+		if p.proxy, err = proxy.Parse(p.proxyURL); err != nil {
+			return nil, err
+		}
+		p.httpClient = p.proxy.HTTPClient()
+	case p.proxyStrict:
+		return nil, errors.New("strict proxy mode requires a proxy")
+	}
+
+	p.limiter = connmgr.NewLimiter(p.maxConns, p.maxHalfOpen)
+	p.bans = connmgr.NewBanList()
+
+	// the filter is created without blocklists as well,
+	// so that they can be set while the client runs.
+	var err error
+	if p.filter, err = ipfilter.Load(p.filterPaths...); err != nil {
+		return nil, fmt.Errorf("failed to load ip filter: %w", err)
+	}
+	if len(p.filterPaths) > 0 {
+		p.logger.Info("loaded ip filter", slog.Int("ranges", p.filter.Len()))
+	}
+
+	if p.recordPath != "" {
+		if p.recorder, err = recorder.Create(p.recordPath); err != nil {
+			return nil, err
+		}
+		p.logger.Info("recording peer sessions", slog.String("path", p.recordPath))
+	}
+
+	// incoming connections would bypass the proxy.
+	if p.proxyStrict && p.action != Leech {
+		p.logger.Info("not accepting incoming connections in strict proxy mode")
+	}
+
+	if p.action != Leech && !p.proxyStrict {
 		var err error
-		if p.seedServer, err = net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", p.port)); err != nil {
+		// binding the unspecified address listens on both
+		// IPv4 and IPv6 if the system supports it.
+		if p.seedServer, err = net.Listen("tcp", fmt.Sprintf(":%v", p.port)); err != nil {
 			return nil, fmt.Errorf("failed to announce listener server to the network: %w", err)
 		}
+		// port 0 picks a free port, which is the one announced.
+		p.port = p.seedServer.Addr().(*net.TCPAddr).Port
+		p.wg.Add(1)
+		go p.acceptLeechers(p.seedServer)
+	}
+
+	if p.utpEnabled {
+		if err := p.listenUTP(); err != nil {
+			p.logger.Warn("uTP transport unavailable, continuing with TCP only", slog.Any("err", err))
+		}
+	}
+
+	if p.portMapping && !p.proxyStrict {
+		var mappings []portmap.Mapping
+		if p.seedServer != nil {
+			mappings = append(mappings, portmap.Mapping{Protocol: portmap.TCP, Port: p.port})
+		}
+		if p.utp != nil && p.utp.Addr().(*net.UDPAddr).Port == p.port {
+			mappings = append(mappings, portmap.Mapping{Protocol: portmap.UDP, Port: p.port})
+		}
+		if len(mappings) > 0 && p.port != 0 {
+			p.portmap = portmap.New(p.logger, mappings)
+		}
+	}
+
+	if p.lsdEnabled && !p.proxyStrict {
+		var err error
+		if p.lsd, err = lsd.New(p.logger, p.port, p.discoveredLocalPeer); err != nil {
+			p.logger.Warn("local service discovery unavailable, continuing without it", slog.Any("err", err))
+		}
+	}
+
+	// the address of the client is not revealed when behind a strict proxy.
+	if !p.proxyStrict {
+		p.ipv4 = publicIPv4()
+		p.ipv6 = publicIPv6()
+	}
+
+	if p.metricsAddr != "" {
+		l, err := net.Listen("tcp", p.metricsAddr)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("failed to listen for metrics: %w", err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /metrics", p.serveMetrics)
+		p.metrics = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
 		p.wg.Add(1)
-		go p.acceptLeechers()
+		go func() {
+			defer p.wg.Done()
+			if err := p.metrics.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				p.logger.Error("failed to serve metrics", slog.Any("err", err))
+			}
+		}()
 	}
 
 	p.wg.Add(1)
 	go p.watch()
 
+	if p.sessionEnabled {
+		if err := p.resume(); err != nil {
+			p.logger.Warn("failed to resume previous session", slog.Any("err", err))
+		}
+	}
+	p.wg.Add(1)
+	go p.maintainSession()
+
+	if p.watchDir != "" {
+		if p.doneDir == "" {
+			p.doneDir = filepath.Join(p.watchDir, "done")
+		}
+		p.wg.Add(1)
+		go p.watchTorrents()
+	}
+
 	return p, nil
 }
 
+// publicIPv4 returns the first globally routable IPv4 address
+// of the local interfaces, or nil if there is none.
+func publicIPv4() *string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.To4() == nil {
+			continue
+		}
+		if n.IP.IsGlobalUnicast() && !n.IP.IsPrivate() {
+			return tracker.Optional(n.IP.String())
+		}
+	}
+	return nil
+}
+
+// publicIPv6 returns the first globally routable IPv6 address
+// of the local interfaces, or nil if there is none.
+func publicIPv6() *string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.To4() != nil {
+			continue
+		}
+		if n.IP.IsGlobalUnicast() && !n.IP.IsPrivate() {
+			return tracker.Optional(n.IP.String())
+		}
+	}
+	return nil
+}
+
+// externalIP returns the address of the gateway on the internet,
+// if known from mapping the listen port, announced to trackers.
+func (c *Client) externalIP() *string {
+	if c.portmap == nil {
+		return nil
+	}
+	if ip := c.portmap.ExternalIP(); ip.IsValid() {
+		return tracker.Optional(ip.String())
+	}
+	return nil
+}
+
+// announceIPv4 returns the IPv4 address announced to trackers, the address
+// of the gateway if known from mapping the listen port, as the client is
+// then behind a NAT, otherwise the public IPv4 address of the client.
+func (c *Client) announceIPv4() *string {
+	if c.portmap != nil {
+		if ip := c.portmap.ExternalIP(); ip.Is4() || ip.Is4In6() {
+			return tracker.Optional(ip.Unmap().String())
+		}
+	}
+	return c.ipv4
+}
+
+// announcePort returns the port announced to trackers, which is the
+// port the gateway forwards to the listen port, if it is mapped.
+func (c *Client) announcePort() int64 {
+	if c.portmap != nil {
+		if port, ok := c.portmap.ExternalPort(portmap.Mapping{Protocol: portmap.TCP, Port: c.port}); ok {
+			return int64(port)
+		}
+	}
+	return int64(c.port)
+}
+
 func (p *Client) Close() error {
 	if p.seedServer != nil {
 		p.seedServer.Close()
 	}
+	if p.utp != nil {
+		p.utp.Close()
+	}
+	if p.metrics != nil {
+		p.metrics.Close()
+	}
+	if p.lsd != nil {
+		if err := p.lsd.Close(); err != nil {
+			p.logger.Debug("failed to stop local service discovery", slog.Any("err", err))
+		}
+	}
+	if p.portmap != nil {
+		if err := p.portmap.Close(); err != nil {
+			p.logger.Warn("failed to remove port mappings", slog.Any("err", err))
+		}
+	}
 	close(p.done)
 	p.wg.Wait()
 
@@ -96,32 +377,195 @@ func (p *Client) Close() error {
 		id := key.(string)
 		tr := value.(*status.Tracker)
 		if err := tr.Close(); err != nil {
-			p.logger.Error("failed to stop torrent", slog.String("torrent", id))
+			p.logger.Error("failed to stop torrent", slog.String("torrent", id), slog.Any("err", err))
 		}
 		return true
 	})
+	if p.sessionEnabled {
+		if err := p.saveSession(); err != nil {
+			p.logger.Error("failed to save session", slog.Any("err", err))
+		}
+	}
 	p.torrentsDownloading.Clear()
 	return nil
 }
 
 func (p *Client) WorkOn(t *torrent.MetaInfoFile) (string, error) {
+	return p.WorkOnFiles(t, nil)
+}
+
+// WorkOnFiles starts work on the torrent, downloading only the files with
+// the paths relative to the directory of the torrent, or all files if none
+// are given. Once the files are downloaded the client is a partial seed,
+// uploading the pieces it has.
+func (p *Client) WorkOnFiles(t *torrent.MetaInfoFile, files []string) (string, error) {
 	h := string(t.Metadata.Hash[:])
 
 	if _, ok := p.torrentsDownloading.Load(h); ok {
 		return "", fmt.Errorf("torrent with hash %s is already tracked", h)
 	}
 
-	tr, err := status.NewTracker(p.id, p.logger, t, TorrentDir)
+	dialers := []transport.DialFunc{transport.TCP}
+	if p.proxy != nil {
+		dialers[0] = p.proxy.Dial
+	}
+	if p.utp != nil {
+		dialers = append(dialers, p.utp.DialContext)
+	}
+	peerOpts := []peer.Option{
+		peer.WithEncryption(p.encryption),
+		peer.WithDialer(transport.Race(dialers...)),
+	}
+	if p.seedServer != nil {
+		peerOpts = append(peerOpts, peer.WithListenPort(p.port))
+	}
+	if p.recorder != nil {
+		peerOpts = append(peerOpts, peer.WithRecorder(p.recorder))
+	}
+
+	trackerOpts := []status.Option{
+		status.WithPeerOptions(peerOpts...),
+		status.WithLimiter(p.limiter),
+		status.WithBanList(p.bans),
+		status.WithIPFilter(p.filter),
+		status.WithBlockedClients(p.blockedClients...),
+		status.WithMaxConnections(p.maxConnsPerTorrent),
+		status.WithFiles(files...),
+	}
+
+	// the statistics of a torrent worked on before are continued.
+	dir := filepath.Join(p.downloadDir, hex.EncodeToString(t.Metadata.Hash[:]))
+	var state *status.State
+	if p.sessionEnabled {
+		if state = p.savedState(dir); state != nil {
+			trackerOpts = append(trackerOpts, status.WithState(state))
+		}
+		// the torrent file is kept to resume the torrent once restarted.
+		if t.Raw != nil {
+			if err := diskio.WriteFile(filepath.Join(dir, torrentFile), t.Raw); err != nil {
+				return "", fmt.Errorf("failed to keep torrent file for the session: %w", err)
+			}
+		}
+	}
+
+	tr, err := status.NewTracker(p.id, p.logger, t, p.downloadDir, trackerOpts...)
 	if err != nil {
 		return "", err
 	}
 
 	p.torrentsDownloading.Store(h, tr)
+	p.finished.Delete(h)
+
+	if state != nil && state.SuperSeeding {
+		if err := tr.SetSuperSeeding(true); err != nil {
+			p.logger.Warn("failed to continue super seeding", slog.String("name", t.Name()), slog.Any("err", err))
+		}
+	}
+
+	// only announce on the local network if there is a listener
+	// that the discovered peers can connect to.
+	if p.lsd != nil && p.seedServer != nil && !t.IsPrivate() {
+		p.lsd.Add(h)
+	}
 
 	p.handler <- h
 	return h, nil
 }
 
+// Tracked reports whether the client works on the torrent with the id,
+// such as the torrents resumed from the previous session.
+func (p *Client) Tracked(id string) bool {
+	_, ok := p.torrentsDownloading.Load(id)
+	return ok
+}
+
+// CorruptBytes returns the number of bytes per peer ip that failed
+// the hash check. Peers that sent corrupt data are banned for the
+// rest of the session.
+func (p *Client) CorruptBytes() map[string]int64 { return p.bans.CorruptBytes() }
+
+// ReloadIPFilter reads the blocklists of the ip filter again and closes
+// the connections to the peers that are now blocked. On failure the
+// previously loaded blocklists stay in effect.
+func (p *Client) ReloadIPFilter() error {
+	if p.filter == nil {
+		return nil
+	}
+	if err := p.filter.Reload(); err != nil {
+		return err
+	}
+	p.logger.Info("reloaded ip filter", slog.Int("ranges", p.filter.Len()))
+	p.dropFiltered()
+	return nil
+}
+
+// SetIPFilter replaces the blocklists of the ip filter with the ones at
+// the paths and closes the connections to the peers that are now blocked.
+// On failure the previously loaded blocklists stay in effect.
+func (p *Client) SetIPFilter(paths ...string) error {
+	if err := p.filter.SetPaths(paths...); err != nil {
+		return err
+	}
+	p.logger.Info("loaded ip filter", slog.Int("ranges", p.filter.Len()))
+	p.dropFiltered()
+	return nil
+}
+
+func (p *Client) dropFiltered() {
+	p.torrentsDownloading.Range(func(_, value any) bool {
+		value.(*status.Tracker).DropFiltered()
+		return true
+	})
+}
+
+// SetConnectionLimits changes the number of peer connections across all
+// torrents and of the connections being established at the same time.
+// Connections exceeding the limits are kept until they are closed.
+func (p *Client) SetConnectionLimits(total, halfOpen int) {
+	p.limiter.SetLimits(total, halfOpen)
+}
+
+// SetSuperSeeding switches the super seeding mode of the torrent
+// with the id, which must be completely downloaded to be enabled.
+func (p *Client) SetSuperSeeding(id string, on bool) error {
+	v, ok := p.torrentsDownloading.Load(id)
+	if !ok {
+		return fmt.Errorf("torrent with hash %s is not tracked", id)
+	}
+	return v.(*status.Tracker).SetSuperSeeding(on)
+}
+
+// SuperSeeding reports whether the torrent with the id is super seeded.
+func (p *Client) SuperSeeding(id string) bool {
+	v, ok := p.torrentsDownloading.Load(id)
+	return ok && v.(*status.Tracker).SuperSeeding()
+}
+
+// infoHashes returns the hashes of all torrents the client works on.
+func (p *Client) infoHashes() []string {
+	var hashes []string
+	p.torrentsDownloading.Range(func(key, _ any) bool {
+		hashes = append(hashes, key.(string))
+		return true
+	})
+	return hashes
+}
+
+func (p *Client) discoveredLocalPeer(infoHash, addr string) {
+	v, ok := p.torrentsDownloading.Load(infoHash)
+	if !ok {
+		return
+	}
+
+	tr := v.(*status.Tracker)
+	if tr.Torrent.IsPrivate() {
+		return
+	}
+
+	p.logger.Debug("discovered local peer", slog.String("addr", addr), slog.String("infoHash", infoHash))
+	tr.AddSeeder(addr, connmgr.Local)
+}
+
 func (p *Client) WaitFor(id string) <-chan error {
 	r := make(chan error, 1)
 	p.wg.Add(1)
@@ -138,12 +582,12 @@ func (p *Client) WaitFor(id string) <-chan error {
 		for {
 			select {
 			case <-p.done:
-				r <- errors.New("client shutting down")
+				r <- errClientClosed
 				return
 			case <-tr.WaitUntilDownloaded():
 				switch {
 				case tr.Torrent.InfoSingleFile != nil:
-					final, err := os.Create(filepath.Join(tr.DownloadDir, tr.Torrent.InfoSingleFile.Name))
+					final, err := createFile(filepath.Join(tr.DownloadDir, tr.Torrent.InfoSingleFile.Name), tr.Torrent.InfoSingleFile.IsExecutable())
 					if err != nil {
 						r <- fmt.Errorf("failed to create torrent file for merging pieces: %w", err)
 						break
@@ -195,8 +639,15 @@ func (p *Client) WaitFor(id string) <-chan error {
 
 					// create torrent dir structure.
 					var errAll error
-					var files []io.WriteCloser
+					var files []io.Writer
 					for _, fi := range tr.Torrent.InfoMultiFile.Files {
+						// padding is not stored, its bytes are skipped
+						// as are the ones of the files not selected.
+						if fi.IsPadding() || !tr.Selected(fi.Path) {
+							files = append(files, nil)
+							continue
+						}
+
 						dir, filename := filepath.Split(fi.Path)
 						if dir != "" {
 							if err := os.MkdirAll(filepath.Join(parent, dir), os.ModePerm); err != nil {
@@ -205,7 +656,14 @@ func (p *Client) WaitFor(id string) <-chan error {
 							}
 						}
 
-						file, err := os.Create(filepath.Join(parent, dir, filename))
+						// symlinks are created once the files are written,
+						// so that no file is written through one of them.
+						if fi.IsSymlink() {
+							files = append(files, nil)
+							continue
+						}
+
+						file, err := createFile(filepath.Join(parent, dir, filename), fi.IsExecutable())
 						if err != nil {
 							errAll = errors.Join(errAll, fmt.Errorf("failed to create torrent file for merging pieces: %w", err))
 							continue
@@ -220,47 +678,33 @@ func (p *Client) WaitFor(id string) <-chan error {
 						break
 					}
 
-					// prepare handles to pieces.
-					pcs := tr.BitField.ExistingPieces()
-					pieces := make([]io.ReadCloser, 0, len(pcs))
-
-					for _, i := range pcs {
-						path := filepath.Join(tr.DownloadDir, fmt.Sprintf("%v.bin", i))
-						f, err := os.Open(path)
-						if err != nil {
-							errAll = errors.Join(errAll, fmt.Errorf("failed to open file for piece %v", i))
-							continue
+					offset := int64(0)
+					for i, fi := range tr.Torrent.InfoMultiFile.Files {
+						if files[i] != nil {
+							if err := copyPieces(files[i], tr.DownloadDir, tr.Torrent.PieceLength, offset, fi.Length); err != nil {
+								errAll = errors.Join(errAll, fmt.Errorf("failed to copy pieces to final merging file %s: %w", fi.Path, err))
+							}
 						}
-						defer f.Close()
-						pieces = append(pieces, f)
-
+						offset += fi.Length
 					}
 
-					if errAll != nil {
-						r <- fmt.Errorf("failed to reconstruct multi-file torrent: %w", errAll)
-						break
-					}
-
-					tc, cp, l := int64(0), 0, tr.Torrent.PieceLength
-					for i, fi := range tr.Torrent.InfoMultiFile.Files {
-						for c := int64(0); c < fi.Length; {
-							w, err := io.CopyN(files[i], pieces[cp], min(l, fi.Length-c))
-							if err != nil {
-								errAll = errors.Join(errAll, fmt.Errorf("failed to copy piece %v to final merging file %s: %w", i, fi.Path, err))
-								continue
+					for _, fi := range tr.Torrent.InfoMultiFile.Files {
+						if !fi.IsSymlink() || !tr.Selected(fi.Path) {
+							continue
+						}
+						link := filepath.Join(parent, fi.Path)
+						target, err := filepath.Rel(filepath.Dir(link), filepath.Join(parent, fi.SymlinkPath))
+						if err == nil {
+							if err = os.Remove(link); errors.Is(err, os.ErrNotExist) {
+								err = nil
 							}
-							l -= w
-							if l == 0 {
-								cp++ // move to next piece.
-								l = tr.Torrent.PieceLength
+							if err == nil {
+								err = os.Symlink(target, link)
 							}
-							c += w
 						}
-						tc += fi.Length
-					}
-
-					if tc != tr.Torrent.BytesToDownload() {
-						errAll = errors.Join(errAll, fmt.Errorf("failed to reconstruct torrent from downloaded pieces %d out of %d reconstructed", tc, tr.Torrent.BytesToDownload()))
+						if err != nil {
+							errAll = errors.Join(errAll, fmt.Errorf("failed to create symlink %s: %w", fi.Path, err))
+						}
 					}
 
 					if errAll != nil {
@@ -275,15 +719,93 @@ func (p *Client) WaitFor(id string) <-chan error {
 	return r
 }
 
-func (p *Client) acceptLeechers() {
+// copyPieces copies length bytes of the torrent data starting
+// at the offset from the files of the pieces holding them.
+func copyPieces(w io.Writer, dir string, pieceLength, offset, length int64) error {
+	for length > 0 {
+		index, begin := offset/pieceLength, offset%pieceLength
+		n := min(length, pieceLength-begin)
+
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%v.bin", index)))
+		if err != nil {
+			return fmt.Errorf("failed to open file for piece %v: %w", index, err)
+		}
+		_, err = io.Copy(w, io.NewSectionReader(f, begin, n))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy piece %v: %w", index, err)
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// createFile creates or truncates the file, executables
+// get the executable bits set.
+func createFile(path string, executable bool) (*os.File, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if executable {
+		if err := f.Chmod(0o755); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// listenUTP opens the UDP socket used for uTP connections. Incoming
+// connections are only accepted if the client also seeds, otherwise
+// the socket is bound to an ephemeral port and only used for dialing.
+// With a proxy the datagrams are relayed through it and the socket is
+// only used for dialing.
+func (p *Client) listenUTP() error {
+	if p.proxy != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		pc, err := p.proxy.ListenPacket(ctx)
+		if err == nil {
+			p.utp = utp.NewSocket(pc)
+			return nil
+		}
+		if p.proxyStrict {
+			return fmt.Errorf("failed to relay uTP through proxy: %w", err)
+		}
+		p.logger.Warn("proxy unable to relay uTP, continuing with direct uTP connections", slog.Any("err", err))
+	}
+
+	if p.action == Leech {
+		pc, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return fmt.Errorf("failed to open uTP socket: %w", err)
+		}
+		p.utp = utp.NewSocket(pc)
+		return nil
+	}
+
+	var err error
+	if p.utp, err = utp.Listen("udp", fmt.Sprintf(":%v", p.port)); err != nil {
+		return fmt.Errorf("failed to announce uTP listener to the network: %w", err)
+	}
+	p.wg.Add(1)
+	go p.acceptLeechers(p.utp)
+	return nil
+}
+
+func (p *Client) acceptLeechers(l net.Listener) {
 	defer p.wg.Done()
 	for {
-		conn, err := p.seedServer.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			p.logger.Error("failed to accept new incoming connections", slog.Any("err", err))
 			if errors.Is(err, net.ErrClosed) {
 				break
 			}
+			continue
 		}
 
 		p.wg.Add(1)
@@ -325,17 +847,21 @@ tracker:
 			logger.Debug("initiating communication with tracker")
 
 			var err error
-			start, err = tracker.CreateRequest(ctx, t.Torrent.Announce, &tracker.RequestParams{
+			start, err = tracker.CreateRequest(ctx, c.httpClient, t.Torrent.Announce, &tracker.RequestParams{
 				InfoHash:   infoHash,
 				PeerID:     c.id,
-				Port:       int64(c.port),
+				Port:       c.announcePort(),
 				Uploaded:   0,
 				Downloaded: 0,
 				Left:       t.Torrent.BytesToDownload(),
 				Compact:    tracker.Optional[int64](1),
 				Event:      tracker.Optional(tracker.EventStarted),
 				NumWant:    tracker.Optional[int64](defaultPeerCount),
+				IP:         c.externalIP(),
+				IPv4:       c.announceIPv4(),
+				IPv6:       c.ipv6,
 			})
+			t.Announced(start, err)
 			if err != nil {
 				logger.Error("failed to contact tracker", slog.Any("err", err))
 				time.Sleep(10 * time.Second)
@@ -364,17 +890,21 @@ tracker:
 		select {
 		case <-ctx.Done():
 			logger.Info("sending stop event on torrent")
-			_, err := tracker.CreateRequest(context.Background(), t.Torrent.Announce, &tracker.RequestParams{
+			resp, err := tracker.CreateRequest(context.Background(), c.httpClient, t.Torrent.Announce, &tracker.RequestParams{
 				InfoHash:   infoHash,
 				PeerID:     c.id,
-				Port:       int64(c.port),
+				Port:       c.announcePort(),
 				Uploaded:   t.Uploaded.Load(),
 				Downloaded: t.Downloaded.Load(),
 				Left:       t.Torrent.BytesToDownload() - t.Downloaded.Load(),
 				Compact:    tracker.Optional[int64](1),
 				Event:      tracker.Optional(tracker.EventStopped),
 				TrackerID:  start.TrackerID,
+				IP:         c.externalIP(),
+				IPv4:       c.announceIPv4(),
+				IPv6:       c.ipv6,
 			})
+			t.Announced(resp, err)
 			if err != nil {
 				logger.Error("failed announce stop to tracker", slog.Any("err", err))
 			}
@@ -386,16 +916,18 @@ tracker:
 			return
 		case <-t.WaitUntilDownloaded():
 			logger.Info("sending completed update, finished downloaded torrent")
-			_, err := tracker.CreateRequest(context.Background(), t.Torrent.Announce, &tracker.RequestParams{
+			_, err := c.announceDone(t, &tracker.RequestParams{
 				InfoHash:   infoHash,
 				PeerID:     c.id,
-				Port:       int64(c.port),
+				Port:       c.announcePort(),
 				Uploaded:   t.Uploaded.Load(),
 				Downloaded: t.Downloaded.Load(),
 				Left:       t.Torrent.BytesToDownload() - t.Downloaded.Load(),
 				Compact:    tracker.Optional[int64](1),
-				Event:      tracker.Optional(tracker.EventCompleted),
 				TrackerID:  start.TrackerID,
+				IP:         c.externalIP(),
+				IPv4:       c.announceIPv4(),
+				IPv6:       c.ipv6,
 			})
 			if err != nil {
 				logger.Error("failed announce completed event to tracker", slog.Any("err", err))
@@ -406,25 +938,32 @@ tracker:
 			return
 		case <-ticker.C:
 			logger.Info("sending regular update based on interval")
-			var event *tracker.Event
-			if completed := (t.Torrent.BytesToDownload() - t.Downloaded.Load()) == 0; completed {
-				event = tracker.Optional(tracker.EventCompleted)
-			}
-			update, err := tracker.CreateRequest(context.Background(), t.Torrent.Announce, &tracker.RequestParams{
+			params := &tracker.RequestParams{
 				InfoHash:   infoHash,
 				PeerID:     c.id,
-				Port:       int64(c.port),
+				Port:       c.announcePort(),
 				Uploaded:   t.Uploaded.Load(),
 				Downloaded: t.Downloaded.Load(),
 				Left:       t.Torrent.BytesToDownload() - t.Downloaded.Load(),
 				Compact:    tracker.Optional[int64](1),
-				Event:      event,
 				TrackerID:  start.TrackerID,
-			})
+				IP:         c.externalIP(),
+				IPv4:       c.announceIPv4(),
+				IPv6:       c.ipv6,
+			}
+			var update *tracker.Response
+			var err error
+			completed := t.UploadOnly()
+			if completed {
+				update, err = c.announceDone(t, params)
+			} else {
+				update, err = tracker.CreateRequest(context.Background(), c.httpClient, t.Torrent.Announce, params)
+				t.Announced(update, err)
+			}
 			if err != nil {
 				logger.Error("failed announce regular update to tracker", slog.Any("err", err))
 			}
-			if event != nil {
+			if completed {
 				logger.Info("completed downloading torrent file")
 				t.CancelDownload()
 				c.wg.Done()
@@ -436,3 +975,22 @@ tracker:
 		}
 	}
 }
+
+// announceDone announces that all the wanted pieces were downloaded. Partial
+// seeds announce the paused event, which is announced again without an event
+// if the tracker doesn't support it.
+func (c *Client) announceDone(t *status.Tracker, params *tracker.RequestParams) (*tracker.Response, error) {
+	params.Event = tracker.Optional(tracker.EventCompleted)
+	if t.PartialSeed() {
+		params.Event = tracker.Optional(tracker.EventPaused)
+	}
+
+	resp, err := tracker.CreateRequest(context.Background(), c.httpClient, t.Torrent.Announce, params)
+	if err != nil && *params.Event == tracker.EventPaused {
+		c.logger.Debug("tracker rejected paused event, announcing without it", slog.Any("err", err))
+		params.Event = nil
+		resp, err = tracker.CreateRequest(context.Background(), c.httpClient, t.Torrent.Announce, params)
+	}
+	t.Announced(resp, err)
+	return resp, err
+}
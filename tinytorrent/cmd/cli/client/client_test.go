@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/status"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/swarm"
+	"github.com/Despire/tinytorrent/torrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_StrictProxy(t *testing.T) {
+	// a proxy that refuses all connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("failed to listen on loopback: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c, err := New(
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithAction(Both),
+		WithPort(0),
+		WithProxy("socks5://"+addr, true),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	// nothing that would bypass the proxy is started.
+	assert.Nil(t, c.seedServer)
+	assert.Nil(t, c.utp)
+	assert.Nil(t, c.lsd)
+	assert.Nil(t, c.portmap)
+	assert.Nil(t, c.ipv4)
+	assert.Nil(t, c.ipv6)
+	assert.Nil(t, c.announceIPv4())
+	assert.NotNil(t, c.proxy)
+
+	_, err = New(WithProxy("", true))
+	assert.Error(t, err)
+}
+
+func TestClient_WatchDir(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping watch directory test in short mode, stopping the added torrent takes a while")
+	}
+
+	tr := httptest.NewServer(swarm.NewTracker(time.Second))
+	defer tr.Close()
+
+	content := filepath.Join(t.TempDir(), "file.bin")
+	require.NoError(t, os.WriteFile(content, []byte("content"), 0o644))
+	b, err := torrent.Create(content, torrent.WithAnnounce(tr.URL+"/announce"))
+	require.NoError(t, err)
+
+	watch := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(watch, "file.torrent"), b, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(watch, "broken.torrent"), []byte("d4:infoe"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(watch, "notes.txt"), nil, 0o644))
+
+	c, err := New(
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithAction(Both),
+		WithPort(0),
+		WithDownloadDir(t.TempDir()),
+		WithLocalServiceDiscovery(false),
+		WithPortMapping(false),
+		WithUTP(false),
+		WithWatchDir(watch, ""),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	done := filepath.Join(watch, "done", "file.torrent")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(done)
+		return err == nil
+	}, 5*WatchInterval, 100*time.Millisecond)
+	assert.Len(t, c.infoHashes(), 1)
+
+	// files that are not torrents or fail to be added are left in place.
+	assert.FileExists(t, filepath.Join(watch, "broken.torrent"))
+	assert.FileExists(t, filepath.Join(watch, "notes.txt"))
+}
+
+func TestClient_WatchDirFinished(t *testing.T) {
+	content := filepath.Join(t.TempDir(), "file.bin")
+	require.NoError(t, os.WriteFile(content, []byte("content"), 0o644))
+	b, err := torrent.Create(content, torrent.WithAnnounce("http://tracker/announce"))
+	require.NoError(t, err)
+	m, err := torrent.From(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	watch := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(watch, "file.torrent"), b, 0o644))
+
+	// the torrent stopped seeding after reaching the ratio limit.
+	c := &Client{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		watchDir: watch,
+		doneDir:  filepath.Join(watch, "done"),
+	}
+	c.finished.Store(string(m.Metadata.Hash[:]), struct{}{})
+
+	require.NoError(t, c.addWatched("file.torrent"))
+	assert.FileExists(t, filepath.Join(watch, "done", "file.torrent"))
+	assert.Empty(t, c.infoHashes())
+}
+
+func TestClient_Session(t *testing.T) {
+	tr := httptest.NewServer(swarm.NewTracker(time.Second))
+	defer tr.Close()
+
+	content := filepath.Join(t.TempDir(), "file.bin")
+	require.NoError(t, os.WriteFile(content, []byte("content"), 0o644))
+	b, err := torrent.Create(content, torrent.WithAnnounce(tr.URL+"/announce"))
+	require.NoError(t, err)
+	mf, err := torrent.From(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, swarm.Seed(dir, mf, content))
+
+	start := func(opts ...Option) *Client {
+		c, err := New(append([]Option{
+			WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+			WithAction(Both),
+			WithPort(0),
+			WithDownloadDir(dir),
+			WithLocalServiceDiscovery(false),
+			WithPortMapping(false),
+			WithUTP(false),
+			WithSession(true),
+		}, opts...)...)
+		require.NoError(t, err)
+		return c
+	}
+
+	c := start()
+	id, err := c.WorkOn(mf)
+	require.NoError(t, err)
+	v, _ := c.torrentsDownloading.Load(id)
+	v.(*status.Tracker).Uploaded.Add(mf.BytesToDownload())
+	added := c.Stats().Torrents[0].Added
+	require.NoError(t, c.Close())
+	assert.FileExists(t, filepath.Join(dir, SessionFile))
+
+	// the torrent is resumed with its statistics and stops
+	// seeding once it reached the ratio limit.
+	c = start(WithRatioLimit(1))
+	require.True(t, c.Tracked(id))
+	s := c.Stats().Torrents[0]
+	assert.Equal(t, mf.BytesToDownload(), s.Uploaded)
+	assert.True(t, added.Equal(s.Added))
+	assert.Equal(t, 1.0, s.Ratio)
+
+	c.checkRatios()
+	assert.False(t, c.Tracked(id))
+	require.NoError(t, c.Close())
+
+	// finished torrents are not seeded again.
+	c = start()
+	defer c.Close()
+	assert.False(t, c.Tracked(id))
+	assert.Empty(t, c.Stats().Torrents)
+}
@@ -0,0 +1,102 @@
+package connmgr
+
+import (
+	"maps"
+	"net"
+	"sync"
+)
+
+// MaxSuspicions is the number of failed pieces a peer may contribute
+// blocks to, without being proven to have sent corrupt data, before
+// it is banned.
+const MaxSuspicions = 5
+
+// BanList keeps the peers banned for the rest of the session. Peers
+// are banned by their ip, as they could reconnect from another port.
+// A nil BanList bans no one.
+type BanList struct {
+	l          sync.Mutex
+	banned     map[string]struct{}
+	suspicions map[string]int
+	corrupt    map[string]int64
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		banned:     make(map[string]struct{}),
+		suspicions: make(map[string]int),
+		corrupt:    make(map[string]int64),
+	}
+}
+
+// Ban bans the ip of the address.
+func (b *BanList) Ban(addr string) {
+	if b == nil {
+		return
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.banned[host(addr)] = struct{}{}
+}
+
+// Banned reports whether the ip of the address is banned.
+func (b *BanList) Banned(addr string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	_, ok := b.banned[host(addr)]
+	return ok
+}
+
+// Corrupt records that the peer at the address was proven
+// to have sent n bytes of corrupt data and bans it.
+func (b *BanList) Corrupt(addr string, n int64) {
+	if b == nil {
+		return
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.corrupt[host(addr)] += n
+	b.banned[host(addr)] = struct{}{}
+}
+
+// Suspect records that the peer at the address contributed to a piece
+// that failed the hash check, and reports whether it got banned for
+// being suspected too many times.
+func (b *BanList) Suspect(addr string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.suspicions[host(addr)]++
+	if b.suspicions[host(addr)] < MaxSuspicions {
+		return false
+	}
+	b.banned[host(addr)] = struct{}{}
+	return true
+}
+
+// CorruptBytes returns the number of corrupt bytes received per peer ip.
+func (b *BanList) CorruptBytes() map[string]int64 {
+	if b == nil {
+		return nil
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	return maps.Clone(b.corrupt)
+}
+
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
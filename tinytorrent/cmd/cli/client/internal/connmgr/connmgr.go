@@ -0,0 +1,328 @@
+// Package connmgr decides which peers a torrent connects to. Each torrent
+// keeps a Pool of candidate addresses ranked by score with an exponential
+// backoff on failed dials, while a Limiter shared by all torrents caps the
+// total number of connections and dials in progress and a BanList keeps
+// out the peers that sent corrupt data.
+package connmgr
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+//go:generate stringer -type=Source
+type Source uint8
+
+const (
+	// Tracker is a candidate returned in an announce response.
+	Tracker Source = iota
+	// Local is a candidate discovered on the local network.
+	Local
+	// Incoming is a candidate that connected to this client.
+	Incoming
+	// Pex is a candidate exchanged by a connected peer.
+	Pex
+	// Saved is a candidate known from a previous session.
+	Saved
+)
+
+const (
+	// InitialBackoff is the wait after the first failed dial,
+	// it doubles with every consecutive failure.
+	InitialBackoff = 15 * time.Second
+	// MaxBackoff caps the wait between dials to the same address.
+	MaxBackoff = 30 * time.Minute
+	// MaxFailures is the number of consecutive failed dials
+	// after which the candidate is dropped from the pool.
+	MaxFailures = 8
+)
+
+// Limiter caps the number of established and half-open
+// connections. A nil Limiter imposes no limits.
+type Limiter struct {
+	maxConns, maxHalfOpen int
+
+	l        sync.Mutex
+	conns    int
+	halfOpen int
+}
+
+// NewLimiter returns a limiter allowing at most maxConns established
+// connections and maxHalfOpen dials in progress at the same time.
+func NewLimiter(maxConns, maxHalfOpen int) *Limiter {
+	return &Limiter{maxConns: maxConns, maxHalfOpen: maxHalfOpen}
+}
+
+// SetLimits changes the limits, connections exceeding
+// them are kept until released.
+func (l *Limiter) SetLimits(maxConns, maxHalfOpen int) {
+	if l == nil {
+		return
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.maxConns, l.maxHalfOpen = maxConns, maxHalfOpen
+}
+
+// Dial reserves a slot for a new outgoing connection. On success the
+// returned function must be called with whether the dial succeeded,
+// after which the slot is either released or kept as established.
+func (l *Limiter) Dial() (done func(established bool), ok bool) {
+	if l == nil {
+		return func(bool) {}, true
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	if l.halfOpen >= l.maxHalfOpen || l.conns+l.halfOpen >= l.maxConns {
+		return nil, false
+	}
+	l.halfOpen++
+
+	var once sync.Once
+	return func(established bool) {
+		once.Do(func() {
+			l.l.Lock()
+			defer l.l.Unlock()
+			l.halfOpen--
+			if established {
+				l.conns++
+			}
+		})
+	}, true
+}
+
+// Accept reserves a slot for an established incoming connection.
+func (l *Limiter) Accept() bool {
+	if l == nil {
+		return true
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	if l.conns+l.halfOpen >= l.maxConns {
+		return false
+	}
+	l.conns++
+	return true
+}
+
+// Release frees the slot of an established connection.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.conns = max(0, l.conns-1)
+}
+
+// Connections returns the number of established and half-open connections.
+func (l *Limiter) Connections() (established, halfOpen int) {
+	if l == nil {
+		return 0, 0
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	return l.conns, l.halfOpen
+}
+
+type candidate struct {
+	addr   string
+	source Source
+
+	// successes counts the connections that ended up being useful
+	// while failures counts the consecutive failed dials.
+	successes int
+	failures  int
+
+	connected   bool
+	nextAttempt time.Time
+}
+
+func (c *candidate) score() int {
+	s := 10 * c.successes
+	s -= 5 * c.failures
+	if c.source == Local {
+		s += 5 // local peers are usually the fastest.
+	}
+	return s
+}
+
+// Pool is the set of candidate addresses a single torrent may connect to.
+type Pool struct {
+	l          sync.Mutex
+	candidates map[string]*candidate
+	banned     map[string]struct{}
+}
+
+func NewPool() *Pool {
+	return &Pool{
+		candidates: make(map[string]*candidate),
+		banned:     make(map[string]struct{}),
+	}
+}
+
+// Add adds the address as a candidate, if not already known.
+func (p *Pool) Add(addr string, source Source) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if _, ok := p.banned[addr]; ok {
+		return
+	}
+	if c, ok := p.candidates[addr]; ok {
+		if source == Local {
+			c.source = Local
+		}
+		return
+	}
+	p.candidates[addr] = &candidate{addr: addr, source: source}
+}
+
+// Next returns the best scored candidate that is not connected
+// and whose backoff already elapsed.
+func (p *Pool) Next(now time.Time) (string, bool) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	var best *candidate
+	for _, c := range p.candidates {
+		if c.connected || now.Before(c.nextAttempt) {
+			continue
+		}
+		if best == nil || c.score() > best.score() || (c.score() == best.score() && c.addr < best.addr) {
+			best = c
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+
+	// reserve the candidate until the dial finishes.
+	best.connected = true
+	return best.addr, true
+}
+
+// Ready returns the number of candidates that could be dialed now.
+func (p *Pool) Ready(now time.Time) int {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	n := 0
+	for _, c := range p.candidates {
+		if !c.connected && !now.Before(c.nextAttempt) {
+			n++
+		}
+	}
+	return n
+}
+
+// Connected marks the address as connected, resetting its backoff.
+func (p *Pool) Connected(addr string) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	c, ok := p.candidates[addr]
+	if !ok {
+		if _, banned := p.banned[addr]; banned {
+			return
+		}
+		c = &candidate{addr: addr, source: Incoming}
+		p.candidates[addr] = c
+	}
+	c.connected = true
+	c.failures = 0
+}
+
+// Failed records a failed dial and schedules the next attempt
+// with an exponential backoff. The candidate is dropped after
+// MaxFailures consecutive failures.
+func (p *Pool) Failed(addr string, now time.Time) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	c, ok := p.candidates[addr]
+	if !ok {
+		return
+	}
+	c.connected = false
+	c.failures++
+	if c.failures >= MaxFailures {
+		delete(p.candidates, addr)
+		return
+	}
+	c.nextAttempt = now.Add(Backoff(c.failures))
+}
+
+// Disconnected records that the connection to the address was closed.
+// Useful connections raise the score of the candidate, others are
+// retried only after a backoff.
+func (p *Pool) Disconnected(addr string, useful bool, now time.Time) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	c, ok := p.candidates[addr]
+	if !ok {
+		return
+	}
+	c.connected = false
+	if useful {
+		c.successes++
+		c.nextAttempt = now
+		return
+	}
+	c.failures++
+	c.nextAttempt = now.Add(Backoff(c.failures))
+}
+
+// Ban removes the address from the pool and never adds it again.
+func (p *Pool) Ban(addr string) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	delete(p.candidates, addr)
+	p.banned[addr] = struct{}{}
+}
+
+// Candidates returns the known addresses ordered by score.
+func (p *Pool) Candidates() []string {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	all := make([]*candidate, 0, len(p.candidates))
+	for _, c := range p.candidates {
+		all = append(all, c)
+	}
+	slices.SortFunc(all, func(a, b *candidate) int {
+		if s := cmp.Compare(b.score(), a.score()); s != 0 {
+			return s
+		}
+		return cmp.Compare(a.addr, b.addr)
+	})
+
+	addrs := make([]string, 0, len(all))
+	for _, c := range all {
+		addrs = append(addrs, c.addr)
+	}
+	return addrs
+}
+
+// Backoff returns the wait after the given number of consecutive failures.
+func Backoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	d := InitialBackoff
+	for i := 1; i < failures && d < MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, MaxBackoff)
+}
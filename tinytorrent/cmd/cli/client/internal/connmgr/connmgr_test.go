@@ -0,0 +1,141 @@
+package connmgr_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/connmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, time.Duration(0), connmgr.Backoff(0))
+	assert.Equal(t, 15*time.Second, connmgr.Backoff(1))
+	assert.Equal(t, 30*time.Second, connmgr.Backoff(2))
+	assert.Equal(t, 60*time.Second, connmgr.Backoff(3))
+	assert.Equal(t, connmgr.MaxBackoff, connmgr.Backoff(100))
+}
+
+func TestPool_Next(t *testing.T) {
+	now := time.Now()
+	p := connmgr.NewPool()
+
+	p.Add("10.0.0.1:1", connmgr.Tracker)
+	p.Add("10.0.0.2:1", connmgr.Local)
+	p.Add("10.0.0.3:1", connmgr.Tracker)
+
+	// local candidates are preferred, then ordered by address.
+	addr, ok := p.Next(now)
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.2:1", addr)
+
+	addr, ok = p.Next(now)
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1:1", addr)
+
+	// failed dials are retried after the backoff.
+	p.Failed("10.0.0.1:1", now)
+
+	addr, ok = p.Next(now)
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.3:1", addr)
+
+	_, ok = p.Next(now)
+	assert.False(t, ok)
+
+	addr, ok = p.Next(now.Add(connmgr.Backoff(1)))
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1:1", addr)
+}
+
+func TestPool_Scores(t *testing.T) {
+	now := time.Now()
+	p := connmgr.NewPool()
+
+	p.Add("a:1", connmgr.Tracker)
+	p.Add("b:1", connmgr.Tracker)
+
+	addr, _ := p.Next(now)
+	assert.Equal(t, "a:1", addr)
+	p.Connected(addr)
+	p.Disconnected(addr, false, now)
+
+	addr, _ = p.Next(now)
+	assert.Equal(t, "b:1", addr)
+	p.Connected(addr)
+	p.Disconnected(addr, true, now)
+
+	assert.Equal(t, []string{"b:1", "a:1"}, p.Candidates())
+	assert.Equal(t, 1, p.Ready(now))
+}
+
+func TestPool_DropAfterFailures(t *testing.T) {
+	now := time.Now()
+	p := connmgr.NewPool()
+	p.Add("a:1", connmgr.Tracker)
+
+	for i := 0; i < connmgr.MaxFailures; i++ {
+		now = now.Add(connmgr.MaxBackoff)
+		addr, ok := p.Next(now)
+		assert.True(t, ok)
+		p.Failed(addr, now)
+	}
+
+	assert.Empty(t, p.Candidates())
+}
+
+func TestPool_Ban(t *testing.T) {
+	p := connmgr.NewPool()
+	p.Add("a:1", connmgr.Tracker)
+	p.Ban("a:1")
+	p.Add("a:1", connmgr.Tracker)
+	p.Connected("a:1")
+
+	assert.Empty(t, p.Candidates())
+	_, ok := p.Next(time.Now())
+	assert.False(t, ok)
+}
+
+func TestLimiter(t *testing.T) {
+	l := connmgr.NewLimiter(3, 2)
+
+	d1, ok := l.Dial()
+	assert.True(t, ok)
+	d2, ok := l.Dial()
+	assert.True(t, ok)
+
+	// half-open limit reached.
+	_, ok = l.Dial()
+	assert.False(t, ok)
+
+	d1(true)
+	d1(true) // calling done more than once has no effect.
+	d2(false)
+
+	established, halfOpen := l.Connections()
+	assert.Equal(t, 1, established)
+	assert.Equal(t, 0, halfOpen)
+
+	assert.True(t, l.Accept())
+	_, ok = l.Dial()
+	assert.True(t, ok)
+
+	// total limit reached.
+	assert.False(t, l.Accept())
+
+	l.Release()
+	assert.True(t, l.Accept())
+
+	// lowering the limits keeps the connections.
+	l.SetLimits(1, 1)
+	established, _ = l.Connections()
+	assert.Equal(t, 2, established)
+	assert.False(t, l.Accept())
+	l.SetLimits(4, 2)
+	assert.True(t, l.Accept())
+
+	var unlimited *connmgr.Limiter
+	assert.True(t, unlimited.Accept())
+	_, ok = unlimited.Dial()
+	assert.True(t, ok)
+}
@@ -0,0 +1,65 @@
+package diskio
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cache keeps the most recently used pieces up to size bytes.
+type cache struct {
+	l sync.Mutex
+
+	size, used int64
+	order      *list.List // front is the most recently used.
+	pieces     map[uint32]*list.Element
+}
+
+type cached struct {
+	index uint32
+	data  []byte
+}
+
+func newCache(size int64) *cache {
+	return &cache{
+		size:   size,
+		order:  list.New(),
+		pieces: make(map[uint32]*list.Element),
+	}
+}
+
+func (c *cache) get(index uint32) ([]byte, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	e, ok := c.pieces[index]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cached).data, true
+}
+
+func (c *cache) put(index uint32, data []byte) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if int64(len(data)) > c.size {
+		return
+	}
+
+	if e, ok := c.pieces[index]; ok {
+		c.used -= int64(len(e.Value.(*cached).data))
+		e.Value = &cached{index: index, data: data}
+		c.order.MoveToFront(e)
+	} else {
+		c.pieces[index] = c.order.PushFront(&cached{index: index, data: data})
+	}
+	c.used += int64(len(data))
+
+	for c.used > c.size {
+		e := c.order.Back()
+		v := c.order.Remove(e).(*cached)
+		delete(c.pieces, v.index)
+		c.used -= int64(len(v.data))
+	}
+}
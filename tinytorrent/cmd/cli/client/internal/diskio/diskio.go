@@ -0,0 +1,436 @@
+// Package diskio performs the disk I/O of a torrent on dedicated workers,
+// off the goroutines talking to the peers. Pieces are verified on hashing
+// workers and written in a single write on I/O workers, and the pieces
+// read for uploads are kept in a LRU cache.
+package diskio
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// DefaultWorkers is the number of workers reading and writing pieces.
+	DefaultWorkers = 4
+	// DefaultHashers is the number of workers verifying pieces.
+	DefaultHashers = 2
+	// DefaultCacheSize is the size of the read cache in bytes.
+	DefaultCacheSize = 32 << 20
+	// DefaultMaxPending is the number of bytes queued for verifying
+	// and writing after which submitting pieces blocks.
+	DefaultMaxPending = 64 << 20
+)
+
+var (
+	ErrHashMismatch = errors.New("piece failed the hash check")
+	ErrClosed       = errors.New("disk io pool closed")
+)
+
+// Check reports whether the data of a piece matches its hash.
+type Check func(data []byte) bool
+
+// Done is called with the verified data of the piece once it was
+// written to disk, or with the error that occurred otherwise.
+type Done func(data []byte, err error)
+
+type hashJob struct {
+	index  uint32
+	blocks [][]byte
+	check  Check
+	size   int64
+	done   Done
+}
+
+type ioJob struct {
+	run func()
+}
+
+// Pool stores the pieces of a torrent as files named
+// by the index of the piece within the directory.
+type Pool struct {
+	dir string
+
+	workers, hashers int
+
+	hashes chan *hashJob
+	jobs   chan ioJob
+
+	cache *cache
+
+	// pending are the bytes submitted and not yet written, limited
+	// to maxPending so that the network waits for the disk.
+	l          sync.Mutex
+	cond       *sync.Cond
+	pending    int64
+	maxPending int64
+
+	// stop refuses new jobs, once the jobs being submitted under
+	// submitting are queued the workers are told to quit.
+	stop       chan struct{}
+	submitting sync.RWMutex
+	quit       chan struct{}
+	wg         sync.WaitGroup
+	once       sync.Once
+}
+
+type Option func(p *Pool)
+
+// WithWorkers sets the number of workers reading and writing pieces.
+func WithWorkers(n int) Option {
+	return func(p *Pool) {
+		p.workers = max(1, n)
+	}
+}
+
+// WithHashers sets the number of workers verifying pieces.
+func WithHashers(n int) Option {
+	return func(p *Pool) {
+		p.hashers = max(1, n)
+	}
+}
+
+// WithCacheSize sets the size of the read cache in bytes,
+// 0 disables the cache.
+func WithCacheSize(n int64) Option {
+	return func(p *Pool) {
+		p.cache = newCache(n)
+	}
+}
+
+// WithMaxPending sets the number of bytes queued
+// for verifying and writing before Verify blocks.
+func WithMaxPending(n int64) Option {
+	return func(p *Pool) {
+		p.maxPending = n
+	}
+}
+
+// New starts the workers storing the pieces within dir.
+func New(dir string, opts ...Option) *Pool {
+	p := &Pool{
+		dir:        dir,
+		workers:    DefaultWorkers,
+		hashers:    DefaultHashers,
+		cache:      newCache(DefaultCacheSize),
+		maxPending: DefaultMaxPending,
+		stop:       make(chan struct{}),
+		quit:       make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.l)
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	p.hashes = make(chan *hashJob, 2*p.hashers)
+	p.jobs = make(chan ioJob, 2*p.workers)
+
+	for range p.hashers {
+		p.wg.Add(1)
+		go p.hash()
+	}
+	for range p.workers {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Close waits for the submitted pieces to be written and stops the workers.
+func (p *Pool) Close() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() {
+		close(p.stop)
+
+		// wake up the ones waiting to submit.
+		p.l.Lock()
+		p.cond.Broadcast()
+		p.l.Unlock()
+
+		p.submitting.Lock()
+		close(p.quit)
+		p.submitting.Unlock()
+
+		p.wg.Wait()
+	})
+}
+
+// Backlogged reports whether more bytes are waiting to be
+// verified and written than the pool accepts without blocking.
+func (p *Pool) Backlogged() bool {
+	if p == nil {
+		return false
+	}
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.pending >= p.maxPending
+}
+
+// Verify checks the blocks of the piece, in order, with the check and
+// writes them as a single piece. The result is passed to done on one
+// of the workers. If too many bytes are already pending Verify blocks
+// until the disk catches up.
+func (p *Pool) Verify(index uint32, blocks [][]byte, check Check, done Done) {
+	var size int64
+	for _, b := range blocks {
+		size += int64(len(b))
+	}
+
+	if !p.reserve(size) {
+		done(nil, ErrClosed)
+		return
+	}
+
+	p.submitting.RLock()
+	defer p.submitting.RUnlock()
+
+	j := &hashJob{index: index, blocks: blocks, check: check, size: size, done: done}
+	select {
+	case <-p.stop:
+		p.release(size)
+		done(nil, ErrClosed)
+		return
+	default:
+	}
+	select {
+	case p.hashes <- j:
+	case <-p.stop:
+		p.release(size)
+		done(nil, ErrClosed)
+	}
+}
+
+// Write writes the piece and waits until it is written.
+func (p *Pool) Write(index uint32, data []byte) error {
+	errc := make(chan error, 1)
+	if !p.submit(func() { errc <- p.write(index, data) }) {
+		return ErrClosed
+	}
+	return <-errc
+}
+
+// Read returns length bytes at the offset begin within the piece,
+// reading the piece from the cache or from disk on a worker.
+func (p *Pool) Read(index, begin, length uint32) ([]byte, error) {
+	data, ok := p.cache.get(index)
+	if !ok {
+		type result struct {
+			data []byte
+			err  error
+		}
+		r := make(chan result, 1)
+		if !p.submit(func() {
+			data, err := os.ReadFile(p.path(index))
+			r <- result{data, err}
+		}) {
+			return nil, ErrClosed
+		}
+
+		res := <-r
+		if res.err != nil {
+			return nil, res.err
+		}
+		data = res.data
+		p.cache.put(index, data)
+	}
+
+	if err := validate(int64(len(data)), begin, length); err != nil {
+		return nil, err
+	}
+	return data[begin : begin+length], nil
+}
+
+// Open opens the piece for reading length bytes at the offset begin,
+// so that the block can be sent straight from the file without being
+// read into memory. The caller closes the file.
+func (p *Pool) Open(index, begin, length uint32) (*os.File, error) {
+	f, err := os.Open(p.path(index))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := validate(fi.Size(), begin, length); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// validate checks that the block is within the piece of the size.
+func validate(size int64, begin, length uint32) error {
+	if int64(begin) >= size {
+		return fmt.Errorf("invalid request, offset within piece larger than piece size")
+	}
+	if int64(length) > size-int64(begin) {
+		return fmt.Errorf("invalid request, offset + length tries to request larger block than possible")
+	}
+	return nil
+}
+
+func (p *Pool) hash() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.quit:
+			p.drainHashes()
+			return
+		case j := <-p.hashes:
+			p.verify(j)
+		}
+	}
+}
+
+// drainHashes verifies and writes the pieces still queued on shutdown.
+func (p *Pool) drainHashes() {
+	for {
+		select {
+		case j := <-p.hashes:
+			p.verify(j)
+		default:
+			return
+		}
+	}
+}
+
+func (p *Pool) verify(j *hashJob) {
+	// the blocks are coalesced into a single write.
+	data := make([]byte, 0, j.size)
+	for _, b := range j.blocks {
+		data = append(data, b...)
+	}
+
+	if !j.check(data) {
+		p.release(j.size)
+		j.done(nil, ErrHashMismatch)
+		return
+	}
+
+	write := func() {
+		err := p.write(j.index, data)
+		p.release(j.size)
+		if err != nil {
+			j.done(nil, err)
+			return
+		}
+		j.done(data, nil)
+	}
+	// once closed the remaining pieces are written by the hashers.
+	if !p.submit(write) {
+		write()
+	}
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.quit:
+			// finish the jobs still queued.
+			for {
+				select {
+				case j := <-p.jobs:
+					j.run()
+				default:
+					return
+				}
+			}
+		case j := <-p.jobs:
+			j.run()
+		}
+	}
+}
+
+func (p *Pool) submit(run func()) bool {
+	p.submitting.RLock()
+	defer p.submitting.RUnlock()
+
+	select {
+	case <-p.stop:
+		return false
+	default:
+	}
+	select {
+	case p.jobs <- ioJob{run: run}:
+		return true
+	case <-p.stop:
+		return false
+	}
+}
+
+func (p *Pool) write(index uint32, data []byte) error {
+	if err := os.MkdirAll(p.dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p.path(index), data, 0o644); err != nil {
+		return err
+	}
+	// freshly verified pieces are likely requested by other peers.
+	p.cache.put(index, data)
+	return nil
+}
+
+func (p *Pool) path(index uint32) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%v.bin", index))
+}
+
+func (p *Pool) reserve(n int64) bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+	for {
+		select {
+		case <-p.stop:
+			return false
+		default:
+		}
+		if p.pending == 0 || p.pending+n <= p.maxPending {
+			break
+		}
+		p.cond.Wait()
+	}
+	p.pending += n
+	return true
+}
+
+func (p *Pool) release(n int64) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.pending = max(0, p.pending-n)
+	p.cond.Broadcast()
+}
+
+// WriteFile replaces the file at path with the data at once, by renaming
+// a temporary file over it, so that a crash while writing leaves the
+// previous file in place. The parent directories are created as needed.
+func WriteFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,137 @@
+package diskio
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Verify(t *testing.T) {
+	dir := t.TempDir()
+	p := New(dir)
+	defer p.Close()
+
+	blocks := [][]byte{[]byte("hello "), []byte("world")}
+	sum := sha1.Sum([]byte("hello world"))
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+
+	p.Verify(3, blocks, sha1Check(sum[:]), func(data []byte, err error) { done <- result{data, err} })
+	r := <-done
+	require.NoError(t, r.err)
+	assert.Equal(t, "hello world", string(r.data))
+
+	onDisk, err := os.ReadFile(filepath.Join(dir, "3.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(onDisk))
+
+	// served from the cache, even once the file is gone.
+	require.NoError(t, os.Remove(filepath.Join(dir, "3.bin")))
+	b, err := p.Read(3, 6, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+
+	p.Verify(4, blocks[:1], sha1Check(sum[:]), func(data []byte, err error) { done <- result{data, err} })
+	r = <-done
+	assert.ErrorIs(t, r.err, ErrHashMismatch)
+	assert.NoFileExists(t, filepath.Join(dir, "4.bin"))
+}
+
+func TestPool_Read(t *testing.T) {
+	dir := t.TempDir()
+	p := New(dir, WithCacheSize(0))
+	defer p.Close()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.bin"), []byte{0x0, 0x1}, 0o644))
+
+	b, err := p.Read(0, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x1}, b)
+
+	_, err = p.Read(0, 2, 0)
+	assert.Error(t, err)
+	_, err = p.Read(0, 1, 2)
+	assert.Error(t, err)
+	_, err = p.Read(1, 0, 1)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	f, err := p.Open(0, 1, 1)
+	require.NoError(t, err)
+	f.Close()
+
+	_, err = p.Open(0, 1, 2)
+	assert.Error(t, err)
+	_, err = p.Open(1, 0, 1)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPool_Backpressure(t *testing.T) {
+	p := New(t.TempDir(), WithMaxPending(10))
+
+	block := []byte("0123456789")
+	sum := sha1.Sum(block)
+	written := make(chan error, 2)
+
+	// a piece still being written.
+	require.True(t, p.reserve(10))
+	assert.True(t, p.Backlogged())
+
+	submitted := make(chan struct{})
+	go func() {
+		defer close(submitted)
+		p.Verify(0, [][]byte{block}, sha1Check(sum[:]), func(_ []byte, err error) { written <- err })
+	}()
+
+	select {
+	case <-submitted:
+		t.Fatal("expected to wait for the pending piece to be written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.release(10)
+	<-submitted
+
+	p.Close()
+	require.NoError(t, <-written, "pieces submitted before close are written")
+	assert.False(t, p.Backlogged())
+
+	p.Verify(1, [][]byte{block}, sha1Check(sum[:]), func(_ []byte, err error) { written <- err })
+	assert.ErrorIs(t, <-written, ErrClosed)
+}
+
+func TestCache(t *testing.T) {
+	c := newCache(4)
+
+	c.put(0, []byte("ab"))
+	c.put(1, []byte("cd"))
+	_, ok := c.get(0) // 0 is now the most recently used.
+	assert.True(t, ok)
+
+	c.put(2, []byte("ef"))
+	_, ok = c.get(1)
+	assert.False(t, ok, "least recently used piece evicted")
+	_, ok = c.get(0)
+	assert.True(t, ok)
+
+	c.put(3, []byte("too large"))
+	_, ok = c.get(3)
+	assert.False(t, ok)
+	assert.Equal(t, int64(4), c.used)
+}
+
+func sha1Check(expected []byte) Check {
+	return func(data []byte) bool {
+		sum := sha1.Sum(data)
+		return bytes.Equal(sum[:], expected)
+	}
+}
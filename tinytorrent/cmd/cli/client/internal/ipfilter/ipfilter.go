@@ -0,0 +1,315 @@
+// Package ipfilter keeps the client away from blocked address ranges.
+// Blocklists in the P2P (PeerGuardian), eMule DAT and CIDR formats are
+// merged into sorted non-overlapping ranges looked up with a binary search.
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MinAllowedLevel is the eMule DAT access level from which
+// the range is allowed rather than blocked.
+const MinAllowedLevel = 128
+
+// Range is an inclusive range of blocked addresses.
+type Range struct {
+	First, Last netip.Addr
+	// Reason is the description of the range in the blocklist.
+	Reason string
+}
+
+func (r Range) Contains(addr netip.Addr) bool {
+	return r.First.Compare(addr) <= 0 && addr.Compare(r.Last) <= 0
+}
+
+// Filter decides whether connecting to an address is allowed.
+// A nil Filter allows all addresses.
+type Filter struct {
+	// l serializes reloads.
+	l     sync.Mutex
+	paths []string
+
+	ranges atomic.Pointer[[]Range]
+}
+
+// New returns a filter blocking the ranges.
+func New(ranges []Range) *Filter {
+	f := new(Filter)
+	f.Set(ranges)
+	return f
+}
+
+// Load returns a filter blocking the ranges of the blocklists
+// at the paths. The blocklists may be gzip compressed.
+func Load(paths ...string) (*Filter, error) {
+	f := &Filter{paths: paths}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the blocklists again. On failure the
+// previously loaded ranges are kept.
+func (f *Filter) Reload() error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.load(f.paths)
+}
+
+// SetPaths reads the blocklists at the paths, which replace the
+// ones read so far. On failure the filter is left unchanged.
+func (f *Filter) SetPaths(paths ...string) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if err := f.load(paths); err != nil {
+		return err
+	}
+	f.paths = paths
+	return nil
+}
+
+func (f *Filter) load(paths []string) error {
+	var all []Range
+	for _, path := range paths {
+		ranges, err := parseFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to load blocklist %q: %w", path, err)
+		}
+		all = append(all, ranges...)
+	}
+
+	f.Set(all)
+	return nil
+}
+
+// Set replaces the blocked ranges.
+func (f *Filter) Set(ranges []Range) {
+	merged := merge(ranges)
+	f.ranges.Store(&merged)
+}
+
+// Len returns the number of non-overlapping blocked ranges.
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	if r := f.ranges.Load(); r != nil {
+		return len(*r)
+	}
+	return 0
+}
+
+// Blocked reports whether the address, either an ip or in the host:port
+// format, is blocked and the reason of the range blocking it.
+func (f *Filter) Blocked(addr string) (reason string, blocked bool) {
+	if f == nil {
+		return "", false
+	}
+
+	r := f.ranges.Load()
+	if r == nil || len(*r) == 0 {
+		return "", false
+	}
+
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", false
+	}
+	ip = ip.Unmap().WithZone("")
+
+	ranges := *r
+	i := sort.Search(len(ranges), func(i int) bool { return ip.Less(ranges[i].First) })
+	if i == 0 || !ranges[i-1].Contains(ip) {
+		return "", false
+	}
+	return ranges[i-1].Reason, true
+}
+
+// merge sorts the ranges and joins the overlapping or adjacent ones.
+func merge(ranges []Range) []Range {
+	ranges = slices.Clone(ranges)
+	slices.SortFunc(ranges, func(a, b Range) int { return a.First.Compare(b.First) })
+
+	var merged []Range
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := last.Last.Next()
+			if r.First.Compare(last.Last) <= 0 || (next.IsValid() && next == r.First) {
+				if r.Last.Compare(last.Last) > 0 {
+					last.Last = r.Last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func parseFile(path string) ([]Range, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if magic, err := r.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return Parse(gz)
+	}
+	return Parse(r)
+}
+
+// Parse reads a blocklist. The format is detected for each line, so lists
+// in different formats may be concatenated. Empty lines and lines starting
+// with '#' or "//" are ignored. Supported formats are:
+//
+//	10.0.0.0/8                                    CIDR
+//	10.0.0.1                                      single address
+//	Some description:10.0.0.0-10.255.255.255      P2P
+//	010.000.000.000 - 010.255.255.255 , 000 , Some description   eMule DAT
+//
+// eMule DAT entries with an access level of at least MinAllowedLevel are
+// not blocked.
+func Parse(r io.Reader) ([]Range, error) {
+	var ranges []Range
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		rng, blocked, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if blocked {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return ranges, nil
+}
+
+func parseLine(line string) (Range, bool, error) {
+	if p, err := netip.ParsePrefix(line); err == nil {
+		p = p.Masked()
+		return Range{First: p.Addr(), Last: lastAddr(p), Reason: line}, true, nil
+	}
+	if a, err := parseAddr(line); err == nil {
+		return Range{First: a, Last: a, Reason: line}, true, nil
+	}
+
+	// eMule DAT: first - last , level , description
+	// the description of P2P entries could also contain
+	// commas, so the first field needs to be a range.
+	parts := strings.SplitN(line, ",", 3)
+	if rng, err := parseRange(parts[0]); err == nil && len(parts) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return Range{}, false, fmt.Errorf("invalid access level %q", parts[1])
+		}
+		if len(parts) == 3 {
+			rng.Reason = strings.TrimSpace(parts[2])
+		}
+		return rng, level < MinAllowedLevel, nil
+	}
+
+	// P2P: description:first-last
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		rng, err := parseRange(line[i+1:])
+		if err != nil {
+			return Range{}, false, err
+		}
+		rng.Reason = strings.TrimSpace(line[:i])
+		return rng, true, nil
+	}
+
+	return Range{}, false, fmt.Errorf("unrecognized blocklist entry %q", line)
+}
+
+func parseRange(s string) (Range, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return Range{}, fmt.Errorf("invalid address range %q", s)
+	}
+
+	var r Range
+	var err error
+	if r.First, err = parseAddr(first); err != nil {
+		return Range{}, err
+	}
+	if r.Last, err = parseAddr(last); err != nil {
+		return Range{}, err
+	}
+	if r.First.Is4() != r.Last.Is4() || r.Last.Less(r.First) {
+		return Range{}, fmt.Errorf("invalid address range %q", s)
+	}
+	return r, nil
+}
+
+// parseAddr parses the address, allowing the zero padded
+// IPv4 octets used by the eMule DAT format.
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+
+	if octets := strings.Split(s, "."); len(octets) == 4 {
+		for i, o := range octets {
+			if t := strings.TrimLeft(o, "0"); t != "" {
+				octets[i] = t
+			} else if o != "" {
+				octets[i] = "0"
+			}
+		}
+		s = strings.Join(octets, ".")
+	}
+
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if a.Zone() != "" {
+		return netip.Addr{}, errors.New("addresses with zones are not supported")
+	}
+	return a.Unmap(), nil
+}
+
+// lastAddr returns the last address of the prefix.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
@@ -0,0 +1,139 @@
+package ipfilter_test
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/ipfilter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const blocklist = `# production subnets
+10.0.0.0/16
+2001:db8::/32
+192.168.1.7
+
+// PeerGuardian
+Some Corp, Inc:172.16.0.0-172.16.255.255
+
+001.002.003.000 - 001.002.003.255 , 000 , Bad Peers
+005.006.007.000 - 005.006.007.255 , 200 , Allowed Peers
+`
+
+func TestParse(t *testing.T) {
+	ranges, err := ipfilter.Parse(strings.NewReader(blocklist))
+	require.NoError(t, err)
+	assert.Len(t, ranges, 5)
+
+	f := ipfilter.New(ranges)
+
+	tests := []struct {
+		addr    string
+		blocked bool
+		reason  string
+	}{
+		{addr: "10.0.0.1:6881", blocked: true, reason: "10.0.0.0/16"},
+		{addr: "10.0.255.255", blocked: true, reason: "10.0.0.0/16"},
+		{addr: "10.1.0.0:6881", blocked: false},
+		{addr: "[2001:db8::1]:6881", blocked: true, reason: "2001:db8::/32"},
+		{addr: "[2001:db9::1]:6881", blocked: false},
+		{addr: "[::ffff:192.168.1.7]:1", blocked: true, reason: "192.168.1.7"},
+		{addr: "192.168.1.8:1", blocked: false},
+		{addr: "172.16.8.8:1", blocked: true, reason: "Some Corp, Inc"},
+		{addr: "1.2.3.4:1", blocked: true, reason: "Bad Peers"},
+		{addr: "5.6.7.8:1", blocked: false},
+		{addr: "not-an-ip:1", blocked: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			reason, blocked := f.Blocked(tt.addr)
+			assert.Equal(t, tt.blocked, blocked)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, line := range []string{
+		"garbage",
+		"desc:10.0.0.9-10.0.0.1",
+		"10.0.0.0 - 10.0.0.255 , abc , desc",
+		"desc:10.0.0.1-::1",
+	} {
+		_, err := ipfilter.Parse(strings.NewReader(line))
+		assert.Error(t, err, line)
+	}
+}
+
+func TestFilter_Merge(t *testing.T) {
+	ranges, err := ipfilter.Parse(strings.NewReader("10.0.0.0/24\n10.0.1.0/24\n10.0.0.128/25\n10.0.3.0/24\n"))
+	require.NoError(t, err)
+
+	f := ipfilter.New(ranges)
+	assert.Equal(t, 2, f.Len())
+
+	_, blocked := f.Blocked("10.0.1.255")
+	assert.True(t, blocked)
+	_, blocked = f.Blocked("10.0.2.0")
+	assert.False(t, blocked)
+	_, blocked = f.Blocked("10.0.3.1")
+	assert.True(t, blocked)
+
+	var none *ipfilter.Filter
+	_, blocked = none.Blocked("10.0.0.1")
+	assert.False(t, blocked)
+}
+
+func TestFilter_Reload(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "list.txt")
+	compressed := filepath.Join(dir, "list.gz")
+
+	require.NoError(t, os.WriteFile(plain, []byte("10.0.0.0/8\n"), 0o644))
+
+	gz, err := os.Create(compressed)
+	require.NoError(t, err)
+	w := gzip.NewWriter(gz)
+	_, err = w.Write([]byte("desc:192.168.0.0-192.168.0.255\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, gz.Close())
+
+	f, err := ipfilter.Load(plain, compressed)
+	require.NoError(t, err)
+
+	_, blocked := f.Blocked("10.1.2.3:1")
+	assert.True(t, blocked)
+	_, blocked = f.Blocked("192.168.0.10:1")
+	assert.True(t, blocked)
+
+	require.NoError(t, os.WriteFile(plain, []byte("11.0.0.0/8\n"), 0o644))
+	require.NoError(t, f.Reload())
+
+	_, blocked = f.Blocked("10.1.2.3:1")
+	assert.False(t, blocked)
+	_, blocked = f.Blocked("11.1.2.3:1")
+	assert.True(t, blocked)
+
+	// a broken blocklist keeps the previous ranges.
+	require.NoError(t, os.WriteFile(plain, []byte("garbage\n"), 0o644))
+	assert.Error(t, f.Reload())
+
+	_, blocked = f.Blocked("11.1.2.3:1")
+	assert.True(t, blocked)
+
+	// the blocklists are replaced by the ones at the paths.
+	require.NoError(t, f.SetPaths(compressed))
+	_, blocked = f.Blocked("11.1.2.3:1")
+	assert.False(t, blocked)
+	_, blocked = f.Blocked("192.168.0.10:1")
+	assert.True(t, blocked)
+	assert.Error(t, f.SetPaths(plain))
+	_, blocked = f.Blocked("192.168.0.10:1")
+	assert.True(t, blocked)
+}
@@ -0,0 +1,362 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MulticastIPv4 is the IPv4 multicast group used for Local Service Discovery.
+	// BEP14: https://www.bittorrent.org/beps/bep_0014.html
+	MulticastIPv4 = "239.192.152.143:6771"
+	// MulticastIPv6 is the IPv6 multicast group used for Local Service Discovery.
+	MulticastIPv6 = "[ff15::efc0:988f]:6771"
+)
+
+const (
+	// AnnounceInterval is the interval at which every tracked
+	// info-hash is re-announced on the local network.
+	AnnounceInterval = 5 * time.Minute
+	// MinAnnounceInterval is the minimum time between two
+	// announces of the same info-hash.
+	MinAnnounceInterval = 1 * time.Minute
+)
+
+// MaxPacketSize is the upper bound of a single BT-SEARCH datagram,
+// announces of more info-hashes are split into several datagrams.
+const MaxPacketSize = 1400
+
+// PeerFunc is called for every peer discovered on the local network that
+// announced the info-hash. The info-hash is the raw 20 byte SHA1 hash and
+// the addr is in the host:port format.
+type PeerFunc func(infoHash string, addr string)
+
+// Announce is a decoded BT-SEARCH message.
+type Announce struct {
+	// Host is the multicast group the message was sent to.
+	Host string
+	// Port on which the announcing peer listens for connections.
+	Port int
+	// InfoHashes are the raw 20 byte SHA1 hashes announced by the peer.
+	InfoHashes []string
+	// Cookie is an opaque value used to filter out our own announces.
+	Cookie string
+}
+
+func (a *Announce) Serialize() []byte {
+	b := new(bytes.Buffer)
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(b, "Host: %s\r\n", a.Host)
+	fmt.Fprintf(b, "Port: %d\r\n", a.Port)
+	for _, h := range a.InfoHashes {
+		fmt.Fprintf(b, "Infohash: %s\r\n", hex.EncodeToString([]byte(h)))
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(b, "cookie: %s\r\n", a.Cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// infoHashLine is the length of an Infohash header of a serialized announce.
+const infoHashLine = len("Infohash: ") + 2*20 + len("\r\n")
+
+// Split splits the info-hashes of the announce into announces
+// whose serialized messages are at most size bytes each.
+func (a *Announce) Split(size int) []*Announce {
+	header := *a
+	header.InfoHashes = nil
+	perAnnounce := max(1, (size-len(header.Serialize()))/infoHashLine)
+
+	var all []*Announce
+	for hashes := a.InfoHashes; len(hashes) > 0; {
+		n := min(perAnnounce, len(hashes))
+		next := header
+		next.InfoHashes = hashes[:n]
+		all = append(all, &next)
+		hashes = hashes[n:]
+	}
+	return all
+}
+
+func (a *Announce) Deserialize(data []byte) error {
+	s := bufio.NewScanner(bytes.NewReader(data))
+
+	if !s.Scan() {
+		return errors.New("empty announce message")
+	}
+	if line := strings.TrimSpace(s.Text()); line != "BT-SEARCH * HTTP/1.1" {
+		return fmt.Errorf("unexpected announce request line %q", line)
+	}
+
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("malformed header %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "host":
+			a.Host = value
+		case "port":
+			p, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid port %q: %w", value, err)
+			}
+			a.Port = int(p)
+		case "infohash":
+			h, err := hex.DecodeString(value)
+			if err != nil || len(h) != 20 {
+				return fmt.Errorf("invalid infohash %q", value)
+			}
+			a.InfoHashes = append(a.InfoHashes, string(h))
+		case "cookie":
+			a.Cookie = value
+		}
+	}
+
+	return a.Validate()
+}
+
+func (a *Announce) Validate() error {
+	if a.Port == 0 {
+		return errors.New("missing port in announce")
+	}
+	if len(a.InfoHashes) == 0 {
+		return errors.New("missing infohash in announce")
+	}
+	return nil
+}
+
+type group struct {
+	addr   *net.UDPAddr
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+// Service announces tracked info-hashes on the local network
+// and reports peers that announce the same info-hashes.
+type Service struct {
+	logger *slog.Logger
+	port   int
+	cookie string
+	found  PeerFunc
+
+	groups []*group
+
+	l        sync.Mutex
+	torrents map[string]time.Time
+
+	trigger chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New joins the passed in multicast groups, or MulticastIPv4 and MulticastIPv6
+// if none are passed, and starts listening for announces. Groups that cannot be
+// joined are skipped, an error is returned only if no group could be joined.
+func New(logger *slog.Logger, port int, found PeerFunc, groups ...string) (*Service, error) {
+	if len(groups) == 0 {
+		groups = []string{MulticastIPv4, MulticastIPv6}
+	}
+
+	var cookie [8]byte
+	if _, err := rand.Read(cookie[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate lsd cookie: %w", err)
+	}
+
+	s := &Service{
+		logger:   logger.With(slog.String("component", "lsd")),
+		port:     port,
+		cookie:   hex.EncodeToString(cookie[:]),
+		found:    found,
+		torrents: make(map[string]time.Time),
+		trigger:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	var errAll error
+	for _, g := range groups {
+		joined, err := join(g)
+		if err != nil {
+			errAll = errors.Join(errAll, err)
+			continue
+		}
+		s.groups = append(s.groups, joined)
+	}
+
+	if len(s.groups) == 0 {
+		return nil, fmt.Errorf("failed to join any multicast group: %w", errAll)
+	}
+	if errAll != nil {
+		s.logger.Debug("failed to join some of the multicast groups", slog.Any("err", errAll))
+	}
+
+	for _, g := range s.groups {
+		s.wg.Add(1)
+		go s.receive(g)
+	}
+
+	s.wg.Add(1)
+	go s.announce()
+
+	return s, nil
+}
+
+func join(addr string) (*group, error) {
+	gaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve multicast group %s: %w", addr, err)
+	}
+
+	listen, err := net.ListenMulticastUDP("udp", nil, gaddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join multicast group %s: %w", addr, err)
+	}
+
+	send, err := net.DialUDP("udp", nil, gaddr)
+	if err != nil {
+		listen.Close()
+		return nil, fmt.Errorf("failed to create announce socket for group %s: %w", addr, err)
+	}
+
+	return &group{addr: gaddr, listen: listen, send: send}, nil
+}
+
+// Add starts announcing the info-hash on the local network.
+func (s *Service) Add(infoHash string) {
+	s.l.Lock()
+	if _, ok := s.torrents[infoHash]; !ok {
+		s.torrents[infoHash] = time.Time{}
+	}
+	s.l.Unlock()
+
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Remove stops announcing the info-hash on the local network.
+func (s *Service) Remove(infoHash string) {
+	s.l.Lock()
+	delete(s.torrents, infoHash)
+	s.l.Unlock()
+}
+
+func (s *Service) Close() error {
+	close(s.done)
+
+	var errAll error
+	for _, g := range s.groups {
+		if err := g.listen.Close(); err != nil {
+			errAll = errors.Join(errAll, err)
+		}
+		if err := g.send.Close(); err != nil {
+			errAll = errors.Join(errAll, err)
+		}
+	}
+
+	s.wg.Wait()
+	return errAll
+}
+
+func (s *Service) announce() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(AnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			s.logger.Debug("shutting down lsd announcer")
+			return
+		case <-ticker.C:
+		case <-s.trigger:
+		}
+
+		now := time.Now()
+
+		var hashes []string
+		s.l.Lock()
+		for h, last := range s.torrents {
+			if now.Sub(last) < MinAnnounceInterval {
+				continue
+			}
+			s.torrents[h] = now
+			hashes = append(hashes, h)
+		}
+		s.l.Unlock()
+
+		if len(hashes) == 0 {
+			continue
+		}
+
+		for _, g := range s.groups {
+			msg := Announce{
+				Host:       g.addr.String(),
+				Port:       s.port,
+				InfoHashes: hashes,
+				Cookie:     s.cookie,
+			}
+			// each datagram has to fit in a single packet.
+			for _, part := range msg.Split(MaxPacketSize) {
+				if _, err := g.send.Write(part.Serialize()); err != nil {
+					s.logger.Debug("failed to send lsd announce", slog.String("group", g.addr.String()), slog.Any("err", err))
+				}
+			}
+		}
+	}
+}
+
+func (s *Service) receive(g *group) {
+	defer s.wg.Done()
+
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, from, err := g.listen.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.logger.Debug("shutting down lsd listener", slog.String("group", g.addr.String()))
+				return
+			}
+			s.logger.Debug("failed to read lsd announce", slog.Any("err", err))
+			continue
+		}
+
+		var a Announce
+		if err := a.Deserialize(buf[:n]); err != nil {
+			s.logger.Debug("received invalid lsd announce", slog.String("from", from.String()), slog.Any("err", err))
+			continue
+		}
+
+		if a.Cookie == s.cookie {
+			continue // our own announce.
+		}
+
+		host := from.IP.String()
+		if from.Zone != "" {
+			host += "%" + from.Zone // link-local IPv6 peers.
+		}
+
+		addr := net.JoinHostPort(host, strconv.Itoa(a.Port))
+		for _, h := range a.InfoHashes {
+			s.found(h, addr)
+		}
+	}
+}
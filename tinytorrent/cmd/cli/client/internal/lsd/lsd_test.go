@@ -0,0 +1,107 @@
+package lsd_test
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/lsd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnounce_SerializeDeserialize(t *testing.T) {
+	hash := strings.Repeat("\xab", 20)
+
+	a := lsd.Announce{
+		Host:       lsd.MulticastIPv4,
+		Port:       6882,
+		InfoHashes: []string{hash},
+		Cookie:     "cafe",
+	}
+
+	msg := a.Serialize()
+	assert.True(t, strings.HasPrefix(string(msg), "BT-SEARCH * HTTP/1.1\r\n"))
+	assert.Contains(t, string(msg), "Infohash: "+strings.Repeat("ab", 20)+"\r\n")
+
+	var got lsd.Announce
+	assert.Nil(t, got.Deserialize(msg))
+	assert.Equal(t, a, got)
+
+	for _, invalid := range []string{
+		"NOTIFY * HTTP/1.1\r\nPort: 1\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: abc\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nInfohash: " + strings.Repeat("ab", 20) + "\r\n\r\n\r\n",
+	} {
+		assert.NotNil(t, new(lsd.Announce).Deserialize([]byte(invalid)))
+	}
+}
+
+func TestAnnounce_Split(t *testing.T) {
+	a := lsd.Announce{
+		Host:   lsd.MulticastIPv6,
+		Port:   6882,
+		Cookie: "cafe",
+	}
+	for i := range 100 {
+		a.InfoHashes = append(a.InfoHashes, fmt.Sprintf("%020d", i))
+	}
+	assert.Greater(t, len(a.Serialize()), lsd.MaxPacketSize)
+
+	var hashes []string
+	parts := a.Split(lsd.MaxPacketSize)
+	assert.Greater(t, len(parts), 1)
+	for _, part := range parts {
+		msg := part.Serialize()
+		assert.LessOrEqual(t, len(msg), lsd.MaxPacketSize)
+
+		var got lsd.Announce
+		assert.Nil(t, got.Deserialize(msg))
+		assert.Equal(t, a.Port, got.Port)
+		assert.Equal(t, a.Cookie, got.Cookie)
+		hashes = append(hashes, got.InfoHashes...)
+	}
+	assert.Equal(t, a.InfoHashes, hashes)
+}
+
+func TestService_DiscoverOverLoopback(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	// pick a port that is very likely unused for the test multicast group.
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	group := fmt.Sprintf("239.192.152.143:%d", port)
+	hash := strings.Repeat("\x01", 20)
+
+	type found struct{ hash, addr string }
+	discovered := make(chan found, 4)
+
+	receiver, err := lsd.New(logger, 7000, func(h, addr string) { discovered <- found{h, addr} }, group)
+	if err != nil {
+		t.Skipf("multicast not available: %v", err)
+	}
+	t.Cleanup(func() { receiver.Close() })
+
+	announcer, err := lsd.New(logger, 7001, func(string, string) { t.Error("announcer discovered its own announce") }, group)
+	assert.Nil(t, err)
+	t.Cleanup(func() { announcer.Close() })
+
+	announcer.Add(hash)
+
+	select {
+	case f := <-discovered:
+		assert.Equal(t, hash, f.hash)
+		_, p, err := net.SplitHostPort(f.addr)
+		assert.Nil(t, err)
+		assert.Equal(t, strconv.Itoa(7001), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no multicast announce received")
+	}
+}
@@ -0,0 +1,51 @@
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// defaultGateway returns the IPv4 address of the default gateway as
+// listed in the routing table of the kernel, which is only available
+// on Linux.
+func defaultGateway() (netip.Addr, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to read routing table: %w", err)
+	}
+	defer f.Close()
+	return parseRoutes(f)
+}
+
+// parseRoutes returns the gateway of the default route in the format of
+// /proc/net/route, where the addresses are hex encoded in host byte order.
+func parseRoutes(r io.Reader) (netip.Addr, error) {
+	s := bufio.NewScanner(r)
+	s.Scan() // header.
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		var ip [4]byte
+		binary.BigEndian.PutUint32(ip[:], binary.LittleEndian.Uint32(b))
+		if gw := netip.AddrFrom4(ip); !gw.IsUnspecified() {
+			return gw, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to read routing table: %w", err)
+	}
+	return netip.Addr{}, errors.New("no default gateway in routing table")
+}
@@ -0,0 +1,296 @@
+package portmap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// NATPMPPort is the port gateways listen on for NAT-PMP and PCP requests.
+// NAT-PMP: https://www.rfc-editor.org/rfc/rfc6886
+// PCP: https://www.rfc-editor.org/rfc/rfc6887
+const NATPMPPort = 5351
+
+const (
+	natpmpVersion = 0
+	pcpVersion    = 2
+
+	natpmpOpExternalAddr = 0
+	natpmpOpMapUDP       = 1
+	natpmpOpMapTCP       = 2
+
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	// opResponse is set in the opcode of the responses.
+	opResponse = 0x80
+
+	// resultUnsupportedVersion is sent by NAT-PMP gateways in
+	// response to PCP requests, as PCP is the next version of it.
+	resultUnsupportedVersion = 1
+)
+
+const (
+	// natpmpAttempts is the number of times a request is sent before
+	// giving up, the first retransmission is sent after natpmpTimeout
+	// and the timeout doubles on every retransmission.
+	natpmpAttempts = 4
+	natpmpTimeout  = 250 * time.Millisecond
+	// maxResponseSize is the upper bound of a NAT-PMP or PCP response.
+	maxResponseSize = 1100
+)
+
+// natpmp maps ports with PCP or, if the gateway only
+// supports the older protocol, with NAT-PMP.
+type natpmp struct {
+	gateway string
+	pcp     bool
+	// client is the address of the client as seen by the gateway, which
+	// is part of PCP requests so that the gateway can detect a NAT in
+	// between.
+	client netip.Addr
+
+	// nonces identify the PCP mappings, which are renewed
+	// and deleted with the same nonce they were created with.
+	nonces map[Mapping][12]byte
+	// ports are the external ports assigned to the mappings,
+	// requested again when the mappings are renewed.
+	ports map[Mapping]uint16
+}
+
+// discoverPCP returns the mapper of the gateway at the address if it
+// responds to PCP, or to NAT-PMP as a fallback.
+func discoverPCP(ctx context.Context, gateway string) (*natpmp, error) {
+	m := &natpmp{
+		gateway: gateway,
+		nonces:  make(map[Mapping][12]byte),
+		ports:   make(map[Mapping]uint16),
+	}
+
+	client, err := localAddr(gateway)
+	if err != nil {
+		return nil, err
+	}
+	m.client = client
+
+	req := m.pcpHeader(pcpOpAnnounce, 0)
+	resp, err := m.request(ctx, req, pcpOpAnnounce)
+	if err != nil {
+		return nil, fmt.Errorf("no PCP or NAT-PMP gateway at %s: %w", gateway, err)
+	}
+	switch {
+	case resp[0] == pcpVersion && len(resp) >= 4 && resp[3] == 0:
+		m.pcp = true
+		return m, nil
+	case resp[0] == natpmpVersion && len(resp) >= 4 && binary.BigEndian.Uint16(resp[2:4]) == resultUnsupportedVersion:
+		if _, err := m.externalAddr(ctx); err != nil {
+			return nil, fmt.Errorf("no NAT-PMP gateway at %s: %w", gateway, err)
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unexpected response of gateway %s to PCP announce", gateway)
+	}
+}
+
+func (m *natpmp) String() string {
+	if m.pcp {
+		return "PCP " + m.gateway
+	}
+	return "NAT-PMP " + m.gateway
+}
+
+func (m *natpmp) addMapping(ctx context.Context, mapping Mapping, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	port, ok := m.ports[mapping]
+	if !ok {
+		port = uint16(mapping.Port)
+	}
+	if m.pcp {
+		return m.pcpMap(ctx, mapping, port, lifetime)
+	}
+
+	ip, err := m.externalAddr(ctx)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	external, granted, err := m.natpmpMap(ctx, mapping, port, lifetime)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	return netip.AddrPortFrom(ip, external), granted, nil
+}
+
+func (m *natpmp) deleteMapping(ctx context.Context, mapping Mapping) error {
+	defer delete(m.ports, mapping)
+	if m.pcp {
+		_, _, err := m.pcpMap(ctx, mapping, 0, 0)
+		delete(m.nonces, mapping)
+		return err
+	}
+	_, _, err := m.natpmpMap(ctx, mapping, 0, 0)
+	return err
+}
+
+// natpmpMap sends a NAT-PMP mapping request, which
+// deletes the mapping if the lifetime is zero.
+func (m *natpmp) natpmpMap(ctx context.Context, mapping Mapping, port uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	op := byte(natpmpOpMapTCP)
+	if mapping.Protocol == UDP {
+		op = natpmpOpMapUDP
+	}
+
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(mapping.Port))
+	binary.BigEndian.PutUint16(req[6:8], port)
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+
+	resp, err := m.request(ctx, req, op)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(resp) < 16 {
+		return 0, 0, fmt.Errorf("short NAT-PMP mapping response of %d bytes", len(resp))
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return 0, 0, fmt.Errorf("NAT-PMP mapping failed with result code %d", code)
+	}
+
+	external := binary.BigEndian.Uint16(resp[10:12])
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	if lifetime > 0 {
+		m.ports[mapping] = external
+	}
+	return external, granted, nil
+}
+
+// externalAddr asks the NAT-PMP gateway for its address on the internet.
+func (m *natpmp) externalAddr(ctx context.Context) (netip.Addr, error) {
+	resp, err := m.request(ctx, []byte{natpmpVersion, natpmpOpExternalAddr}, natpmpOpExternalAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(resp) < 12 {
+		return netip.Addr{}, fmt.Errorf("short NAT-PMP external address response of %d bytes", len(resp))
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return netip.Addr{}, fmt.Errorf("NAT-PMP external address request failed with result code %d", code)
+	}
+	return netip.AddrFrom4([4]byte(resp[8:12])), nil
+}
+
+// pcpMap sends a PCP MAP request, which deletes the mapping if the lifetime is zero.
+func (m *natpmp) pcpMap(ctx context.Context, mapping Mapping, port uint16, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	nonce, ok := m.nonces[mapping]
+	if !ok {
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return netip.AddrPort{}, 0, fmt.Errorf("failed to generate PCP nonce: %w", err)
+		}
+		m.nonces[mapping] = nonce
+	}
+
+	protocol := byte(6)
+	if mapping.Protocol == UDP {
+		protocol = 17
+	}
+
+	req := m.pcpHeader(pcpOpMap, lifetime)
+	req = append(req, nonce[:]...)
+	req = append(req, protocol, 0, 0, 0)
+	req = binary.BigEndian.AppendUint16(req, uint16(mapping.Port))
+	req = binary.BigEndian.AppendUint16(req, port)
+	// no external address is suggested, IPv4 addresses are IPv4-mapped.
+	ip := netip.IPv6Unspecified().As16()
+	if m.client.Is4() {
+		ip = netip.IPv4Unspecified().As16()
+	}
+	req = append(req, ip[:]...)
+
+	resp, err := m.request(ctx, req, pcpOpMap)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	if len(resp) < 60 {
+		return netip.AddrPort{}, 0, fmt.Errorf("short PCP mapping response of %d bytes", len(resp))
+	}
+	if resp[0] != pcpVersion {
+		return netip.AddrPort{}, 0, fmt.Errorf("unexpected PCP version %d", resp[0])
+	}
+	if code := resp[3]; code != 0 {
+		return netip.AddrPort{}, 0, fmt.Errorf("PCP mapping failed with result code %d", code)
+	}
+	if [12]byte(resp[24:36]) != nonce {
+		return netip.AddrPort{}, 0, errors.New("PCP mapping response with mismatched nonce")
+	}
+
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	external := netip.AddrPortFrom(netip.AddrFrom16([16]byte(resp[44:60])).Unmap(), binary.BigEndian.Uint16(resp[42:44]))
+	if lifetime > 0 {
+		m.ports[mapping] = external.Port()
+	}
+	return external, granted, nil
+}
+
+// pcpHeader returns the common header of the PCP requests.
+func (m *natpmp) pcpHeader(op byte, lifetime time.Duration) []byte {
+	req := make([]byte, 24)
+	req[0] = pcpVersion
+	req[1] = op
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	ip := m.client.As16()
+	copy(req[8:24], ip[:])
+	return req
+}
+
+// request sends the request to the gateway, retransmitting it until the
+// response to the opcode is received or all attempts timed out.
+func (m *natpmp) request(ctx context.Context, req []byte, op byte) ([]byte, error) {
+	conn, err := net.Dial("udp", m.gateway)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial gateway %s: %w", m.gateway, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	buf := make([]byte, maxResponseSize)
+	timeout := natpmpTimeout
+	for range natpmpAttempts {
+		if _, err := conn.Write(req); err != nil {
+			return nil, errors.Join(ctx.Err(), fmt.Errorf("failed to send request to gateway %s: %w", m.gateway, err))
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				break
+			}
+			if n >= 4 && buf[1] == op|opResponse {
+				return buf[:n:n], nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("gateway %s did not respond", m.gateway)
+}
+
+// localAddr returns the address of the interface
+// the host at the address is reached through.
+func localAddr(addr string) (netip.Addr, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to find route to %s: %w", addr, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
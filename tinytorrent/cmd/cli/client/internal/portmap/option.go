@@ -0,0 +1,28 @@
+package portmap
+
+import "time"
+
+type Option func(s *Service)
+
+// WithGateway sets the host:port address NAT-PMP and PCP requests are sent
+// to, instead of port 5351 of the default gateway of the system.
+func WithGateway(addr string) Option {
+	return func(s *Service) {
+		s.gateway = addr
+	}
+}
+
+// WithSSDPAddr sets the address UPnP IGD discovery requests
+// are sent to, instead of the SSDP multicast group.
+func WithSSDPAddr(addr string) Option {
+	return func(s *Service) {
+		s.ssdpAddr = addr
+	}
+}
+
+// WithLifetime sets the lease requested for the mappings.
+func WithLifetime(lifetime time.Duration) Option {
+	return func(s *Service) {
+		s.lifetime = lifetime
+	}
+}
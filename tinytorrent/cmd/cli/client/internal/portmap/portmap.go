@@ -0,0 +1,236 @@
+package portmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLifetime is the lease requested for the mappings,
+	// which are renewed once half of the lease expired.
+	DefaultLifetime = 2 * time.Hour
+	// RetryInterval is the time to wait before discovering
+	// the gateway again after mapping the ports failed.
+	RetryInterval = 5 * time.Minute
+	// permanentRenewal is how often mappings without a lease are added
+	// again, in case the gateway was restarted and forgot about them.
+	permanentRenewal = 30 * time.Minute
+	// deleteTimeout bounds removing the mappings on Close.
+	deleteTimeout = 3 * time.Second
+)
+
+// Protocol is the transport protocol of a port mapping.
+type Protocol string
+
+const (
+	TCP Protocol = "TCP"
+	UDP Protocol = "UDP"
+)
+
+// Mapping is a port of the client to be reachable from the internet.
+type Mapping struct {
+	Protocol Protocol
+	Port     int
+}
+
+// mapper maps ports of the client on the gateway with one of the
+// supported protocols.
+type mapper interface {
+	fmt.Stringer
+	// addMapping maps the port on the gateway for the lifetime and returns
+	// the external address the port is reachable at and the granted
+	// lifetime, zero meaning the mapping is permanent.
+	addMapping(ctx context.Context, m Mapping, lifetime time.Duration) (netip.AddrPort, time.Duration, error)
+	// deleteMapping removes the mapping of the port from the gateway.
+	deleteMapping(ctx context.Context, m Mapping) error
+}
+
+// Service maps the ports of the client on the gateway of the local network
+// with NAT-PMP/PCP or UPnP IGD, whichever the gateway supports, and keeps
+// renewing the mappings until closed.
+type Service struct {
+	logger   *slog.Logger
+	mappings []Mapping
+
+	gateway  string
+	ssdpAddr string
+	lifetime time.Duration
+
+	l        sync.Mutex
+	mapper   mapper
+	external map[Mapping]netip.AddrPort
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New starts mapping the ports in the background.
+func New(logger *slog.Logger, mappings []Mapping, opts ...Option) *Service {
+	s := &Service{
+		logger:   logger.With(slog.String("component", "portmap")),
+		mappings: mappings,
+		ssdpAddr: SSDPMulticast,
+		lifetime: DefaultLifetime,
+		external: make(map[Mapping]netip.AddrPort),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s
+}
+
+// ExternalIP returns the address of the gateway on the internet,
+// which is invalid until a port was mapped.
+func (s *Service) ExternalIP() netip.Addr {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for _, addr := range s.external {
+		return addr.Addr()
+	}
+	return netip.Addr{}
+}
+
+// ExternalPort returns the port the mapping is reachable at from the
+// internet, which may differ from the mapped port of the client.
+func (s *Service) ExternalPort(m Mapping) (int, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	addr, ok := s.external[m]
+	return int(addr.Port()), ok
+}
+
+// Close stops renewing the mappings and removes them from the gateway.
+func (s *Service) Close() error {
+	s.cancel()
+	s.wg.Wait()
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.mapper == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+	defer cancel()
+
+	var errAll error
+	for _, m := range s.mappings {
+		if _, ok := s.external[m]; !ok {
+			continue
+		}
+		if err := s.mapper.deleteMapping(ctx, m); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("failed to delete %s mapping of port %d: %w", m.Protocol, m.Port, err))
+		}
+	}
+	clear(s.external)
+	return errAll
+}
+
+func (s *Service) run() {
+	defer s.wg.Done()
+
+	for {
+		wait := RetryInterval
+		renew, err := s.mapAll()
+		switch {
+		case s.ctx.Err() != nil:
+			// the mappings made so far are removed by Close.
+			s.logger.Debug("shutting down port mapping")
+			return
+		case err != nil:
+			s.logger.Info("failed to map ports, retrying later", slog.Any("err", err))
+			s.l.Lock()
+			s.mapper = nil
+			clear(s.external)
+			s.l.Unlock()
+		default:
+			wait = renew
+		}
+
+		select {
+		case <-s.ctx.Done():
+			s.logger.Debug("shutting down port mapping")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// mapAll maps the ports, discovering the gateway first if needed,
+// and returns when the mappings are to be renewed.
+func (s *Service) mapAll() (time.Duration, error) {
+	s.l.Lock()
+	m := s.mapper
+	s.l.Unlock()
+
+	if m == nil {
+		var err error
+		if m, err = s.discover(); err != nil {
+			return 0, err
+		}
+		s.logger.Info("discovered gateway supporting port mapping", slog.String("gateway", m.String()))
+	}
+
+	renew := permanentRenewal
+	for _, mapping := range s.mappings {
+		external, lifetime, err := m.addMapping(s.ctx, mapping, s.lifetime)
+		if err != nil {
+			return 0, fmt.Errorf("failed to map %s port %d with %s: %w", mapping.Protocol, mapping.Port, m, err)
+		}
+		if lifetime > 0 {
+			renew = min(renew, lifetime/2)
+		}
+
+		s.l.Lock()
+		s.mapper = m
+		s.external[mapping] = external
+		s.l.Unlock()
+
+		s.logger.Debug("mapped port",
+			slog.String("protocol", string(mapping.Protocol)),
+			slog.Int("port", mapping.Port),
+			slog.String("external", external.String()),
+			slog.Duration("lifetime", lifetime),
+		)
+	}
+	return renew, nil
+}
+
+// discover returns the mapper of the first protocol the gateway
+// responds to, trying NAT-PMP/PCP before UPnP IGD.
+func (s *Service) discover() (mapper, error) {
+	var errAll error
+
+	gateway := s.gateway
+	if gateway == "" {
+		if gw, err := defaultGateway(); err == nil {
+			gateway = netip.AddrPortFrom(gw, NATPMPPort).String()
+		} else {
+			errAll = errors.Join(errAll, err)
+		}
+	}
+	if gateway != "" {
+		m, err := discoverPCP(s.ctx, gateway)
+		if err == nil {
+			return m, nil
+		}
+		errAll = errors.Join(errAll, err)
+	}
+
+	m, err := discoverUPnP(s.ctx, s.ssdpAddr)
+	if err == nil {
+		return m, nil
+	}
+	return nil, errors.Join(errAll, err)
+}
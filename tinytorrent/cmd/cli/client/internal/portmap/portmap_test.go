@@ -0,0 +1,322 @@
+package portmap_test
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/portmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// request is a mapping request received by a fake gateway.
+type request struct {
+	protocol portmap.Protocol
+	internal int
+	external int
+	lifetime time.Duration
+}
+
+// fakeGateway records the mapping requests it received.
+type fakeGateway struct {
+	l        sync.Mutex
+	requests []request
+}
+
+func (g *fakeGateway) record(r request) {
+	g.l.Lock()
+	defer g.l.Unlock()
+	g.requests = append(g.requests, r)
+}
+
+func (g *fakeGateway) received() []request {
+	g.l.Lock()
+	defer g.l.Unlock()
+	return append([]request(nil), g.requests...)
+}
+
+// serveUDP answers the datagrams received at a local address with
+// the responses of handle and returns the address.
+func serveUDP(t *testing.T, handle func(req []byte) []byte) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := handle(buf[:n]); resp != nil {
+				conn.WriteTo(resp, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// closedPort returns a local address nothing listens at.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+// fakeNATPMP is a NAT-PMP gateway not supporting PCP, mapping
+// the ports to the port 1000 higher than the internal port.
+func fakeNATPMP(t *testing.T, g *fakeGateway) string {
+	return serveUDP(t, func(req []byte) []byte {
+		resp := make([]byte, 16)
+		resp[1] = 0x80 | req[1]
+		switch {
+		case req[0] != 0:
+			binary.BigEndian.PutUint16(resp[2:4], 1) // unsupported version.
+			return resp[:8]
+		case req[1] == 0:
+			copy(resp[8:12], []byte{203, 0, 113, 7})
+			return resp[:12]
+		default:
+			protocol := portmap.UDP
+			if req[1] == 2 {
+				protocol = portmap.TCP
+			}
+			internal := binary.BigEndian.Uint16(req[4:6])
+			lifetime := binary.BigEndian.Uint32(req[8:12])
+			g.record(request{
+				protocol: protocol,
+				internal: int(internal),
+				external: int(binary.BigEndian.Uint16(req[6:8])),
+				lifetime: time.Duration(lifetime) * time.Second,
+			})
+			binary.BigEndian.PutUint16(resp[8:10], internal)
+			if lifetime > 0 {
+				binary.BigEndian.PutUint16(resp[10:12], internal+1000)
+			}
+			binary.BigEndian.PutUint32(resp[12:16], lifetime)
+			return resp
+		}
+	})
+}
+
+// fakePCP is a PCP gateway mapping the ports as requested.
+func fakePCP(t *testing.T, g *fakeGateway) string {
+	return serveUDP(t, func(req []byte) []byte {
+		if req[0] != 2 || len(req) < 24 {
+			return nil
+		}
+		resp := make([]byte, len(req))
+		resp[0], resp[1] = 2, 0x80|req[1]
+		copy(resp[4:8], req[4:8])
+		if req[1] != 1 || len(req) < 60 {
+			return resp[:24]
+		}
+
+		protocol := portmap.UDP
+		if req[36] == 6 {
+			protocol = portmap.TCP
+		}
+		g.record(request{
+			protocol: protocol,
+			internal: int(binary.BigEndian.Uint16(req[40:42])),
+			external: int(binary.BigEndian.Uint16(req[42:44])),
+			lifetime: time.Duration(binary.BigEndian.Uint32(req[4:8])) * time.Second,
+		})
+		copy(resp[24:44], req[24:44])
+		ip := netip.MustParseAddr("203.0.113.8").As16()
+		copy(resp[44:60], ip[:])
+		return resp
+	})
+}
+
+// fakeIGD is an UPnP gateway only supporting permanent mappings
+// and returns the address it is discovered at.
+func fakeIGD(t *testing.T, g *fakeGateway) string {
+	const service = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList><device>
+      <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+      <deviceList><device>
+        <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+        <serviceList><service>
+          <serviceType>%s</serviceType>
+          <controlURL>/ctl/IPConn</controlURL>
+        </service></serviceList>
+      </device></deviceList>
+    </device></deviceList>
+  </device>
+</root>`, service)
+	})
+	mux.HandleFunc("POST /ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Protocol string `xml:"Body>AddPortMapping>NewProtocol"`
+			Internal int    `xml:"Body>AddPortMapping>NewInternalPort"`
+			External int    `xml:"Body>AddPortMapping>NewExternalPort"`
+			Client   string `xml:"Body>AddPortMapping>NewInternalClient"`
+			Lease    int    `xml:"Body>AddPortMapping>NewLeaseDuration"`
+
+			DeleteProtocol string `xml:"Body>DeletePortMapping>NewProtocol"`
+			DeleteExternal int    `xml:"Body>DeletePortMapping>NewExternalPort"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, xml.Unmarshal(body, &req))
+
+		switch action := r.Header.Get("SOAPAction"); action {
+		case `"` + service + `#AddPortMapping"`:
+			assert.Equal(t, "127.0.0.1", req.Client)
+			if req.Lease != 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+				return
+			}
+			g.record(request{protocol: portmap.Protocol(req.Protocol), internal: req.Internal, external: req.External, lifetime: -1})
+		case `"` + service + `#DeletePortMapping"`:
+			g.record(request{protocol: portmap.Protocol(req.DeleteProtocol), external: req.DeleteExternal})
+		case `"` + service + `#GetExternalIPAddress"`:
+			fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="%s"><NewExternalIPAddress>203.0.113.9</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`, service)
+			return
+		default:
+			t.Errorf("unexpected soap action %s", action)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body/></s:Envelope>`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return serveUDP(t, func(req []byte) []byte {
+		if !strings.HasPrefix(string(req), "M-SEARCH * HTTP/1.1\r\n") || !strings.Contains(string(req), "InternetGatewayDevice:1") {
+			return nil
+		}
+		return []byte("HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=120\r\n" +
+			"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+			"LOCATION: " + srv.URL + "/desc.xml\r\n\r\n")
+	})
+}
+
+func TestService_NATPMP(t *testing.T) {
+	g := new(fakeGateway)
+	gateway := fakeNATPMP(t, g)
+
+	s := portmap.New(logger, []portmap.Mapping{{Protocol: portmap.TCP, Port: 6882}, {Protocol: portmap.UDP, Port: 6882}},
+		portmap.WithGateway(gateway),
+		portmap.WithSSDPAddr(closedPort(t)),
+		portmap.WithLifetime(2*time.Second),
+	)
+
+	require.Eventually(t, func() bool { return s.ExternalIP().IsValid() }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, netip.MustParseAddr("203.0.113.7"), s.ExternalIP())
+	port, ok := s.ExternalPort(portmap.Mapping{Protocol: portmap.TCP, Port: 6882})
+	assert.True(t, ok)
+	assert.Equal(t, 7882, port)
+
+	// the mappings are renewed before half of the lease
+	// expired, asking for the port assigned before.
+	require.Eventually(t, func() bool { return len(g.received()) >= 4 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []request{
+		{portmap.TCP, 6882, 6882, 2 * time.Second},
+		{portmap.UDP, 6882, 6882, 2 * time.Second},
+		{portmap.TCP, 6882, 7882, 2 * time.Second},
+		{portmap.UDP, 6882, 7882, 2 * time.Second},
+	}, g.received()[:4])
+
+	require.NoError(t, s.Close())
+	requests := g.received()
+	assert.ElementsMatch(t, []request{
+		{portmap.TCP, 6882, 0, 0},
+		{portmap.UDP, 6882, 0, 0},
+	}, requests[len(requests)-2:])
+	assert.False(t, s.ExternalIP().IsValid())
+}
+
+func TestService_PCP(t *testing.T) {
+	g := new(fakeGateway)
+	gateway := fakePCP(t, g)
+
+	s := portmap.New(logger, []portmap.Mapping{{Protocol: portmap.TCP, Port: 6882}},
+		portmap.WithGateway(gateway),
+		portmap.WithSSDPAddr(closedPort(t)),
+	)
+
+	require.Eventually(t, func() bool { return s.ExternalIP().IsValid() }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, netip.MustParseAddr("203.0.113.8"), s.ExternalIP())
+	port, ok := s.ExternalPort(portmap.Mapping{Protocol: portmap.TCP, Port: 6882})
+	assert.True(t, ok)
+	assert.Equal(t, 6882, port)
+
+	require.NoError(t, s.Close())
+	assert.Equal(t, []request{
+		{portmap.TCP, 6882, 6882, portmap.DefaultLifetime},
+		{portmap.TCP, 6882, 0, 0},
+	}, g.received())
+}
+
+func TestService_UPnP(t *testing.T) {
+	g := new(fakeGateway)
+	ssdp := fakeIGD(t, g)
+
+	// the gateway doesn't speak NAT-PMP nor PCP.
+	s := portmap.New(logger, []portmap.Mapping{{Protocol: portmap.TCP, Port: 6882}, {Protocol: portmap.UDP, Port: 6882}},
+		portmap.WithGateway(closedPort(t)),
+		portmap.WithSSDPAddr(ssdp),
+	)
+
+	require.Eventually(t, func() bool {
+		_, ok := s.ExternalPort(portmap.Mapping{Protocol: portmap.UDP, Port: 6882})
+		return ok
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, netip.MustParseAddr("203.0.113.9"), s.ExternalIP())
+
+	require.NoError(t, s.Close())
+	assert.Equal(t, []request{
+		{portmap.TCP, 6882, 6882, -1},
+		{portmap.UDP, 6882, 6882, -1},
+		{portmap.TCP, 0, 6882, 0},
+		{portmap.UDP, 0, 6882, 0},
+	}, g.received())
+}
+
+func TestService_NoGateway(t *testing.T) {
+	s := portmap.New(logger, []portmap.Mapping{{Protocol: portmap.TCP, Port: 6882}},
+		portmap.WithGateway(closedPort(t)),
+		portmap.WithSSDPAddr(closedPort(t)),
+	)
+
+	// closing while discovering the gateway doesn't block.
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan error)
+	go func() { done <- s.Close() }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked")
+	}
+	assert.False(t, s.ExternalIP().IsValid())
+}
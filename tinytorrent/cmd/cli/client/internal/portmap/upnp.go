@@ -0,0 +1,316 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSDPMulticast is the multicast group UPnP devices are discovered at.
+// UPnP IGD: https://openconnectivity.org/developer/specifications/upnp-resources/upnp/internet-gateway-device-igd-v-2-0/
+const SSDPMulticast = "239.255.255.250:1900"
+
+const (
+	// ssdpTimeout is how long to wait for gateways
+	// to respond to the discovery requests.
+	ssdpTimeout = 3 * time.Second
+	// soapTimeout bounds a single request to the gateway.
+	soapTimeout = 10 * time.Second
+	// maxDescriptionSize is the upper bound of a device description.
+	maxDescriptionSize = 1 << 20
+
+	// errOnlyPermanentLeases is the UPnP error code of gateways
+	// that don't support mappings with a lease duration.
+	errOnlyPermanentLeases = 725
+
+	mappingDescription = "tinytorrent"
+)
+
+// igdDevices are the device types searched for, IGDv2 is backwards
+// compatible but not all IGDv2 gateways respond to IGDv1 searches.
+var igdDevices = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+// wanServices are the prefixes of the service types that map ports.
+var wanServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:",
+	"urn:schemas-upnp-org:service:WANPPPConnection:",
+}
+
+// upnp maps ports with the WAN connection service of an UPnP gateway.
+type upnp struct {
+	controlURL  string
+	serviceType string
+	// client is the address of the client on the local network
+	// which the incoming connections are forwarded to.
+	client netip.Addr
+}
+
+// soapError is the error returned by the control url of a gateway.
+type soapError struct {
+	Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+}
+
+func (e *soapError) Error() string {
+	return fmt.Sprintf("upnp error %d: %s", e.Code, e.Description)
+}
+
+// discoverUPnP searches for gateways at the SSDP address and returns the
+// mapper of the first one with a WAN connection service.
+func discoverUPnP(ctx context.Context, ssdpAddr string) (*upnp, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve ssdp address %s: %w", ssdpAddr, err)
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ssdp socket: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for _, device := range igdDevices {
+		msg := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + SSDPMulticast + "\r\n" +
+			"ST: " + device + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n\r\n"
+		if _, err := conn.WriteToUDP([]byte(msg), raddr); err != nil {
+			return nil, fmt.Errorf("failed to send ssdp search: %w", err)
+		}
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(ssdpTimeout)); err != nil {
+		return nil, err
+	}
+
+	var errAll error
+	seen := make(map[string]bool)
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, errors.Join(errors.New("no upnp gateway found"), errAll)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		location := resp.Header.Get("Location")
+		if location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+
+		m, err := describe(ctx, location)
+		if err != nil {
+			errAll = errors.Join(errAll, err)
+			continue
+		}
+		return m, nil
+	}
+}
+
+// description is the device description of an UPnP gateway.
+type description struct {
+	URLBase string `xml:"URLBase"`
+	Device  device `xml:"device"`
+}
+
+type device struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []device `xml:"deviceList>device"`
+}
+
+// wanService returns the type and control url of
+// the first WAN connection service of the device.
+func (d *device) wanService() (string, string, bool) {
+	for _, s := range d.Services {
+		for _, prefix := range wanServices {
+			if strings.HasPrefix(s.ServiceType, prefix) {
+				return s.ServiceType, s.ControlURL, true
+			}
+		}
+	}
+	for i := range d.Devices {
+		if typ, control, ok := d.Devices[i].wanService(); ok {
+			return typ, control, true
+		}
+	}
+	return "", "", false
+}
+
+// describe fetches the device description at the location
+// and returns the mapper of its WAN connection service.
+func describe(ctx context.Context, location string) (*upnp, error) {
+	ctx, cancel := context.WithTimeout(ctx, soapTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device location %q: %w", location, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch device description: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch device description at %s: %s", location, resp.Status)
+	}
+
+	var d description
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxDescriptionSize)).Decode(&d); err != nil {
+		return nil, fmt.Errorf("failed to decode device description at %s: %w", location, err)
+	}
+	typ, control, ok := d.Device.wanService()
+	if !ok {
+		return nil, fmt.Errorf("device at %s has no WAN connection service", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if d.URLBase != "" {
+		if base, err = url.Parse(d.URLBase); err != nil {
+			return nil, fmt.Errorf("invalid url base %q: %w", d.URLBase, err)
+		}
+	}
+	controlURL, err := base.Parse(control)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control url %q: %w", control, err)
+	}
+
+	port := controlURL.Port()
+	if port == "" {
+		port = "80"
+	}
+	client, err := localAddr(net.JoinHostPort(controlURL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	return &upnp{controlURL: controlURL.String(), serviceType: typ, client: client}, nil
+}
+
+func (m *upnp) String() string { return "UPnP " + m.controlURL }
+
+func (m *upnp) addMapping(ctx context.Context, mapping Mapping, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	add := func(lifetime time.Duration) error {
+		_, err := m.soap(ctx, "AddPortMapping",
+			"NewRemoteHost", "",
+			"NewExternalPort", strconv.Itoa(mapping.Port),
+			"NewProtocol", string(mapping.Protocol),
+			"NewInternalPort", strconv.Itoa(mapping.Port),
+			"NewInternalClient", m.client.String(),
+			"NewEnabled", "1",
+			"NewPortMappingDescription", mappingDescription,
+			"NewLeaseDuration", strconv.Itoa(int(lifetime/time.Second)),
+		)
+		return err
+	}
+
+	err := add(lifetime)
+	if serr := (*soapError)(nil); errors.As(err, &serr) && serr.Code == errOnlyPermanentLeases {
+		lifetime = 0
+		err = add(lifetime)
+	}
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+
+	resp, err := m.soap(ctx, "GetExternalIPAddress")
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	var ip struct {
+		Addr string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(resp, &ip); err != nil {
+		return netip.AddrPort{}, 0, fmt.Errorf("failed to decode external ip address: %w", err)
+	}
+	addr, err := netip.ParseAddr(ip.Addr)
+	if err != nil {
+		return netip.AddrPort{}, 0, fmt.Errorf("invalid external ip address %q: %w", ip.Addr, err)
+	}
+	return netip.AddrPortFrom(addr, uint16(mapping.Port)), lifetime, nil
+}
+
+func (m *upnp) deleteMapping(ctx context.Context, mapping Mapping) error {
+	_, err := m.soap(ctx, "DeletePortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(mapping.Port),
+		"NewProtocol", string(mapping.Protocol),
+	)
+	return err
+}
+
+// soap invokes the action of the service with the arguments,
+// passed as name value pairs, and returns the response envelope.
+func (m *upnp) soap(ctx context.Context, action string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, soapTimeout)
+	defer cancel()
+
+	body := new(bytes.Buffer)
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(body, `<u:%s xmlns:u="%s">`, action, m.serviceType)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(body, "<%s>", args[i])
+		if err := xml.EscapeText(body, []byte(args[i+1])); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(body, "</%s>", args[i])
+	}
+	fmt.Fprintf(body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.controlURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, m.serviceType, action))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to invoke %s: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxDescriptionSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		serr := new(soapError)
+		if xml.Unmarshal(b, serr) == nil && serr.Code != 0 {
+			return nil, fmt.Errorf("failed to invoke %s: %w", action, serr)
+		}
+		return nil, fmt.Errorf("failed to invoke %s: %s", action, resp.Status)
+	}
+	return b, nil
+}
@@ -0,0 +1,485 @@
+package status
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/peer"
+	"github.com/Despire/tinytorrent/p2p/peerid"
+)
+
+const (
+	// DefaultMaxConnections is the default number of
+	// peers a single torrent is connected to.
+	DefaultMaxConnections = 50
+
+	// How often closed connections are pruned and new candidates dialed.
+	manageTick = 1 * time.Second
+	// How often keep alives are sent to connected peers.
+	keepAliveTick = 2 * time.Minute
+
+	// snubTimeout is how long a peer that unchoked this client
+	// may go without sending a piece before it is considered snubbing.
+	snubTimeout = 60 * time.Second
+	// idleTimeout is how long a peer may keep this client
+	// choked before it is considered idle.
+	idleTimeout = 2 * time.Minute
+)
+
+var (
+	ErrSelfConnection = errors.New("connected to self")
+	ErrDuplicatePeer  = errors.New("already connected to peer with the same id")
+	ErrTooManyPeers   = errors.New("connection limit reached")
+	ErrBannedPeer     = errors.New("peer is banned")
+	ErrFilteredPeer   = errors.New("peer is blocked by ip filter")
+	ErrBlockedClient  = errors.New("peer client is blocked")
+)
+
+// manageConnections keeps the torrent connected to at most maxConnections
+// peers while downloading. Idle or snubbing peers are replaced once better
+// candidates are available and free slots are filled with the best scored
+// candidates from the pool.
+func (t *Tracker) manageConnections() {
+	defer t.download.wg.Done()
+
+	tick := time.NewTicker(manageTick)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			t.logger.Debug("shutting down connection manager, stopped tracker")
+			return
+		case <-t.download.cancel:
+			t.logger.Debug("shutting down connection manager, canceled download")
+			t.stopDownloading()
+			return
+		case <-t.download.completed:
+			t.logger.Debug("shutting down connection manager, as torrent was downloaded")
+			t.stopDownloading()
+			return
+		case now := <-tick.C:
+			t.replaceUnproductive(now)
+			t.dialCandidates(now)
+		}
+	}
+}
+
+// maintainPeers prunes closed connections and keeps the
+// remaining ones alive until the tracker is stopped.
+func (t *Tracker) maintainPeers() {
+	defer t.wg.Done()
+
+	tick := time.NewTicker(manageTick)
+	defer tick.Stop()
+
+	keepAlive := time.NewTicker(keepAliveTick)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			t.logger.Debug("shutting down peer maintenance, stopped tracker")
+			t.dropPeers()
+			return
+		case <-keepAlive.C:
+			t.peers.Range(func(_, value any) bool {
+				p := value.(*peer.Peer)
+				if p.ConnectionStatus() != peer.ConnectionEstablished {
+					return true
+				}
+				if err := p.SendKeepAlive(); err != nil {
+					t.logger.Error("failed to keep alive, closing", slog.String("peer_ip", p.Addr), slog.Any("err", err))
+					if err := p.Close(); err != nil {
+						t.logger.Error("failed to close peer", slog.String("peer_ip", p.Addr), slog.Any("err", err))
+					}
+				}
+				return true
+			})
+		case now := <-tick.C:
+			t.peers.Range(func(key, value any) bool {
+				if p := value.(*peer.Peer); p.ConnectionStatus() == peer.ConnectionKilled {
+					t.dropPeer(key.(string), p, now)
+				}
+				return true
+			})
+			t.dropUploadOnly(now)
+			t.refreshOffers()
+			t.exchangePeers(now)
+		}
+	}
+}
+
+// stopDownloading tells all peers this client is no longer interested
+// and closes the connections to the ones not downloading from it.
+// Once all wanted pieces are downloaded the peers are told that
+// this client only uploads.
+func (t *Tracker) stopDownloading() {
+	now := time.Now()
+	uploadOnly := t.UploadOnly()
+	t.peers.Range(func(key, value any) bool {
+		p := value.(*peer.Peer)
+		if p.Interest.Remote.Load() == uint32(peer.NotInterested) || (uploadOnly && p.UploadOnly()) {
+			t.dropPeer(key.(string), p, now)
+			return true
+		}
+		if p.Interest.This.Load() == uint32(peer.Interested) {
+			if err := p.SendNotInterested(); err != nil {
+				t.logger.Debug("failed to send not-interested msg", slog.String("peer_ip", p.Addr), slog.Any("err", err))
+			}
+		}
+		if uploadOnly && p.SupportsExtensions() {
+			if err := p.SendExtendedHandshake(); err != nil {
+				t.logger.Debug("failed to send extended handshake msg", slog.String("peer_ip", p.Addr), slog.Any("err", err))
+			}
+		}
+		return true
+	})
+}
+
+// dropUploadOnly closes the connections to the peers that only upload
+// while this client only uploads as well, as neither has anything the
+// other wants.
+func (t *Tracker) dropUploadOnly(now time.Time) {
+	if !t.UploadOnly() {
+		return
+	}
+	t.peers.Range(func(key, value any) bool {
+		if p := value.(*peer.Peer); p.UploadOnly() {
+			t.logger.Debug("dropping upload only peer", slog.String("peer_ip", p.Addr), slog.String("pid", p.Id))
+			t.dropPeer(key.(string), p, now)
+		}
+		return true
+	})
+}
+
+// replaceUnproductive closes unproductive peers, that are not downloading
+// from this client, if there are no free slots left but ready candidates.
+func (t *Tracker) replaceUnproductive(now time.Time) {
+	ready := t.pool.Ready(now)
+	if ready == 0 || t.peerCount()+int(t.download.dialing.Load()) < t.maxConnections {
+		return
+	}
+
+	t.peers.Range(func(key, value any) bool {
+		addr, p := key.(string), value.(*peer.Peer)
+		if p.Interest.Remote.Load() == uint32(peer.NotInterested) && unproductive(p, now) {
+			t.logger.Debug("replacing unproductive peer", slog.String("peer_ip", addr), slog.String("pid", p.Id))
+			t.dropPeer(addr, p, now)
+			ready--
+		}
+		return ready > 0
+	})
+}
+
+// unproductive reports whether the peer is snubbing this client by
+// not sending any pieces after unchoking it, or is idle by keeping
+// this client choked for too long.
+func unproductive(p *peer.Peer, now time.Time) bool {
+	last := p.LastPiece()
+	if last.IsZero() {
+		last = p.EstablishedAt()
+	}
+	if p.Status.Remote.Load() == uint32(peer.UnChoked) {
+		return now.Sub(last) > snubTimeout
+	}
+	return now.Sub(last) > idleTimeout
+}
+
+func (t *Tracker) dialCandidates(now time.Time) {
+	for t.peerCount()+int(t.download.dialing.Load()) < t.maxConnections {
+		done, ok := t.limiter.Dial()
+		if !ok {
+			return
+		}
+		addr, ok := t.pool.Next(now)
+		if !ok {
+			done(false)
+			return
+		}
+		if _, connected := t.peers.Load(addr); connected {
+			done(false)
+			t.pool.Connected(addr)
+			continue
+		}
+
+		t.download.dialing.Add(1)
+		t.download.wg.Add(1)
+		go t.connectPeer(addr, done)
+	}
+}
+
+func (t *Tracker) connectPeer(addr string, done func(established bool)) {
+	defer t.download.wg.Done()
+	defer t.download.dialing.Add(-1)
+
+	logger := t.logger.With(slog.String("peer_ip", addr))
+
+	// the filter could have been reloaded since the candidate was added.
+	if reason, blocked := t.filter.Blocked(addr); blocked {
+		done(false)
+		t.pool.Failed(addr, time.Now())
+		logger.Info("rejected dial to peer blocked by ip filter", slog.String("reason", reason))
+		return
+	}
+
+	logger.Debug("initiating connection to peer")
+
+	p, err := peer.NewOutgoingConnection(
+		logger,
+		addr,
+		t.Torrent.NumPieces(),
+		string(t.Torrent.Metadata.Hash[:]),
+		t.clientID,
+		t.connectionOptions()...,
+	)
+	if err != nil {
+		done(false)
+		t.pool.Failed(addr, time.Now())
+		logger.Error("failed to initiating handshake", slog.Any("err", err))
+		// the peer could be behind a NAT.
+		t.rendezvous(addr)
+		return
+	}
+
+	err = t.admit(p.Id, addr)
+	if err == nil {
+		err = t.addPeer(logger, addr, p)
+	}
+	if err != nil {
+		done(false)
+		if refused(err) {
+			t.pool.Ban(addr)
+		} else {
+			t.pool.Failed(addr, time.Now())
+		}
+		if err := p.Close(); err != nil {
+			logger.Error("failed to close peer", slog.Any("err", err))
+		}
+		logger.Info("dropped peer connection", slog.Any("err", err))
+		return
+	}
+
+	done(true)
+	t.pool.Connected(addr)
+	t.startPeer(logger, addr, p)
+}
+
+// refused reports whether the peer was refused for who it is, rather
+// than for the state of the connections, and is not to be dialed again.
+func refused(err error) bool {
+	return errors.Is(err, ErrSelfConnection) ||
+		errors.Is(err, ErrBannedPeer) ||
+		errors.Is(err, ErrFilteredPeer) ||
+		errors.Is(err, ErrBlockedClient)
+}
+
+// AddPeer completes the handshake with a peer that connected to this
+// client. The handshake of the remote peer was already read from conn.
+func (t *Tracker) AddPeer(remote *messagesv1.Handshake, conn net.Conn) error {
+	addr := conn.RemoteAddr().String()
+	if err := t.admit(remote.PeerID, addr); err != nil {
+		return err
+	}
+	if !t.limiter.Accept() {
+		return ErrTooManyPeers
+	}
+
+	logger := t.logger.With(slog.String("peer_ip", addr))
+
+	p, err := peer.NewIncomingConnection(
+		logger,
+		remote, addr,
+		t.Torrent.NumPieces(),
+		conn,
+		string(t.Torrent.Metadata.Hash[:]), t.clientID,
+		t.connectionOptions()...,
+	)
+	if err != nil {
+		t.limiter.Release()
+		return fmt.Errorf("failed to establish peer connection: %w", err)
+	}
+	if err := t.addPeer(logger, addr, p); err != nil {
+		t.limiter.Release()
+		if err := p.Close(); err != nil {
+			logger.Error("failed to close peer", slog.Any("err", err))
+		}
+		return err
+	}
+
+	t.startPeer(logger, addr, p)
+	return nil
+}
+
+// addPeer adds the peer to the peer table, unless a peer with the same
+// id connected meanwhile or the torrent is connected to as many peers
+// as allowed. A previous peer at the address is replaced.
+func (t *Tracker) addPeer(logger *slog.Logger, addr string, p *peer.Peer) error {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+
+	if t.connected(p.Id) {
+		return ErrDuplicatePeer
+	}
+	if _, replaced := t.peers.Load(addr); !replaced && t.peerCount() >= t.maxConnections {
+		return ErrTooManyPeers
+	}
+	if old, loaded := t.peers.Swap(addr, p); loaded {
+		old := old.(*peer.Peer)
+		if err := old.Close(); err != nil {
+			logger.Debug("failed to close replaced peer", slog.Any("err", err))
+		}
+		t.limiter.Release()
+	}
+	return nil
+}
+
+// startPeer starts downloading from and uploading
+// to the peer added to the peer table.
+func (t *Tracker) startPeer(logger *slog.Logger, addr string, p *peer.Peer) {
+	// the tracker could have stopped while connecting.
+	select {
+	case <-t.stop:
+		t.dropPeer(addr, p, time.Now())
+		return
+	default:
+	}
+
+	logger = logger.With(slog.String("pid", p.Id), slog.String("client", peerid.Name(p.Id)))
+
+	r, c := p.Requests()
+
+	t.wg.Add(2)
+	go t.recvPieces(logger, p)
+	go t.handleRequests(p, r, c)
+
+	// while super seeding the pieces are offered one by one.
+	if !t.SuperSeeding() {
+		if err := p.SendBitfield(t.BitField.Clone()); err != nil {
+			logger.Error("failed to send bitfield msg", slog.Any("err", err))
+		}
+	}
+
+	if p.SupportsExtensions() {
+		if err := p.SendExtendedHandshake(); err != nil {
+			logger.Error("failed to send extended handshake msg", slog.Any("err", err))
+		}
+	}
+
+	t.offerPiece(p)
+
+	if !t.UploadOnly() {
+		if err := p.SendInterested(); err != nil {
+			logger.Error("failed to send interested msg", slog.Any("err", err))
+		}
+	}
+}
+
+// connectionOptions returns the options of a new peer connection,
+// advertising as many requests as there are upload slots.
+func (t *Tracker) connectionOptions() []peer.Option {
+	opts := append(slices.Clone(t.peerOpts),
+		peer.WithRequestQueue(len(t.upload.requests)),
+		peer.WithHaves(t.peerHas),
+		peer.WithUploadOnly(t.UploadOnly),
+	)
+	if !t.Torrent.IsPrivate() {
+		opts = append(opts, peer.WithPex(t.recvPex), peer.WithHolepunch(t.recvHolepunch))
+	}
+	if t.Torrent.IsV2() {
+		opts = append(opts, peer.WithHashes(func(req *messagesv1.HashRequest) ([][32]byte, error) {
+			return t.Torrent.Hashes(req.PiecesRoot, req.BaseLayer, req.Index, req.Length, req.ProofLayers)
+		}))
+	}
+	return opts
+}
+
+// admit checks that the peer with the id is neither this client,
+// banned, blocked by the filter or its client software nor
+// already connected.
+func (t *Tracker) admit(id, addr string) error {
+	if id == t.clientID {
+		return ErrSelfConnection
+	}
+	if t.bans.Banned(addr) {
+		return ErrBannedPeer
+	}
+	if reason, blocked := t.filter.Blocked(addr); blocked {
+		return fmt.Errorf("%w: %s", ErrFilteredPeer, reason)
+	}
+	if c, ok := peerid.Parse(id); ok && slices.Contains(t.blockedClients, strings.ToLower(c.Name)) {
+		return fmt.Errorf("%w: %s", ErrBlockedClient, c)
+	}
+
+	if t.connected(id) {
+		return ErrDuplicatePeer
+	}
+	return nil
+}
+
+// connected reports whether a peer with the id is connected.
+func (t *Tracker) connected(id string) bool {
+	found := false
+	t.peers.Range(func(_, value any) bool {
+		p := value.(*peer.Peer)
+		found = p.Id == id && p.ConnectionStatus() == peer.ConnectionEstablished
+		return !found
+	})
+	return found
+}
+
+func (t *Tracker) dropPeer(addr string, p *peer.Peer, now time.Time) {
+	if !t.peers.CompareAndDelete(addr, p) {
+		return
+	}
+
+	if p.ConnectionStatus() == peer.ConnectionEstablished && p.Interest.This.Load() == uint32(peer.Interested) {
+		if err := p.SendNotInterested(); err != nil {
+			t.logger.Debug("failed to send not-interested msg", slog.String("peer_ip", addr), slog.Any("err", err))
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.logger.Error("failed to close peer", slog.String("peer_ip", addr), slog.Any("err", err))
+	}
+
+	if s := t.superSeed.Load(); s != nil {
+		s.remove(addr)
+	}
+
+	t.limiter.Release()
+	t.pool.Disconnected(addr, !p.LastPiece().IsZero(), now)
+}
+
+// DropFiltered closes the connections to the peers blocked by the
+// ip filter, to be called once the filter is reloaded.
+func (t *Tracker) DropFiltered() {
+	now := time.Now()
+	t.peers.Range(func(key, value any) bool {
+		addr := key.(string)
+		if reason, blocked := t.filter.Blocked(addr); blocked {
+			t.logger.Info("dropping peer blocked by ip filter", slog.String("peer_ip", addr), slog.String("reason", reason))
+			t.dropPeer(addr, value.(*peer.Peer), now)
+		}
+		return true
+	})
+}
+
+func (t *Tracker) dropPeers() {
+	now := time.Now()
+	t.peers.Range(func(key, value any) bool {
+		t.dropPeer(key.(string), value.(*peer.Peer), now)
+		return true
+	})
+}
+
+func (t *Tracker) peerCount() int {
+	n := 0
+	t.peers.Range(func(_, _ any) bool { n++; return true })
+	return n
+}
@@ -0,0 +1,112 @@
+package status
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/peer"
+)
+
+// hashFailed records which peers contributed to the piece that failed
+// the hash check. If a single peer sent all of the blocks it is proven
+// to have sent corrupt data and is banned, otherwise the blocks are kept
+// to be compared against the piece once it verifies and the piece is
+// re-downloaded from a single peer. Expects the piece to be locked.
+func (t *Tracker) hashFailed(logger *slog.Logger, piece *pendingPiece) {
+	contributors := make(map[string]struct{})
+	for _, from := range piece.From {
+		contributors[from] = struct{}{}
+	}
+
+	if len(contributors) == 1 {
+		for addr := range contributors {
+			logger.Warn("banning peer that sent a corrupt piece",
+				slog.String("peer_ip", addr),
+				slog.String("piece", fmt.Sprint(piece.Index)),
+			)
+			t.ban(addr, piece.Size)
+		}
+	} else {
+		piece.Failed = piece.Failed[:0]
+		for _, b := range piece.Received {
+			piece.Failed = append(piece.Failed, failedBlock{
+				Begin:  b.Begin,
+				Digest: sha1.Sum(b.Block),
+				From:   piece.From[b.Begin],
+			})
+		}
+		for addr := range contributors {
+			if t.bans.Suspect(addr) {
+				logger.Warn("banning peer that contributed to too many corrupt pieces", slog.String("peer_ip", addr))
+				t.dropBanned(addr)
+			}
+		}
+	}
+
+	piece.SinglePeer = true
+	piece.Exclusive = ""
+}
+
+// verified compares the verified piece against the blocks of the
+// previous failed attempt and bans the peers whose blocks differ.
+// Expects the piece to be locked.
+func (t *Tracker) verified(logger *slog.Logger, piece *pendingPiece, data []byte) {
+	for _, b := range piece.Failed {
+		valid := piece.blockAt(b.Begin, data)
+		if valid == nil || sha1.Sum(valid) == b.Digest {
+			continue
+		}
+		logger.Warn("banning peer that sent a corrupt block",
+			slog.String("peer_ip", b.From),
+			slog.String("piece", fmt.Sprint(piece.Index)),
+			slog.String("offset", fmt.Sprint(b.Begin)),
+		)
+		t.ban(b.From, int64(len(valid)))
+	}
+	piece.Failed = nil
+}
+
+// blockAt returns the block of the verified piece data at the offset.
+func (p *pendingPiece) blockAt(begin uint32, data []byte) []byte {
+	for _, r := range p.Received {
+		if r.Begin == begin {
+			return data[begin : int(begin)+len(r.Block)]
+		}
+	}
+	return nil
+}
+
+// ban bans the peer for the rest of the session, recording
+// the corrupt bytes it sent, and closes its connection.
+func (t *Tracker) ban(addr string, corrupt int64) {
+	t.bans.Corrupt(addr, corrupt)
+	t.dropBanned(addr)
+}
+
+// dropBanned closes the connections to the banned peer. The connections
+// are closed asynchronously as the caller could be the one receiving
+// the pieces of the banned peer. Once the tracker is closed the
+// connections are left to be closed along with all the others.
+func (t *Tracker) dropBanned(addr string) {
+	t.pool.Ban(addr)
+
+	t.closedL.Lock()
+	defer t.closedL.Unlock()
+	if t.closed {
+		return
+	}
+
+	now := time.Now()
+	t.peers.Range(func(key, value any) bool {
+		if key.(string) == addr || t.bans.Banned(key.(string)) {
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				t.dropPeer(key.(string), value.(*peer.Peer), now)
+			}()
+		}
+		return true
+	})
+}
@@ -1,16 +1,18 @@
 package status
 
 import (
-	"bytes"
 	"cmp"
-	"crypto/sha1"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand/v2"
 	"net"
+	"net/netip"
 	"slices"
 	"time"
 
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/connmgr"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/diskio"
 	"github.com/Despire/tinytorrent/cmd/cli/client/internal/tracker"
 	"github.com/Despire/tinytorrent/p2p/messagesv1"
 	"github.com/Despire/tinytorrent/p2p/peer"
@@ -20,32 +22,57 @@ func (t *Tracker) CancelDownload()                      { close(t.download.cance
 func (t *Tracker) WaitUntilDownloaded() <-chan struct{} { return t.download.completed }
 
 func (t *Tracker) UpdateSeeders(resp *tracker.Response) error {
-	if t.Downloaded.Load() == t.Torrent.BytesToDownload() {
+	if t.UploadOnly() {
 		return nil
 	}
 
 	var errAll error
 
 	for _, r := range resp.Peers {
-		addr := net.JoinHostPort(r.IP, fmt.Sprint(r.Port))
-		t.logger.Debug("initiating connection to peer", slog.String("addr", addr))
-		if _, ok := t.peers.seeders.Load(addr); ok {
-			continue
+		host := r.IP
+		// IPv4-mapped IPv6 addresses are dialed as plain IPv4 so
+		// that the same peer is not tracked under two addresses.
+		if ip, err := netip.ParseAddr(host); err == nil {
+			host = ip.Unmap().String()
 		}
-
-		t.download.wg.Add(1)
-		go t.keepAliveSeeders(addr)
+		t.AddSeeder(net.JoinHostPort(host, fmt.Sprint(r.Port)), connmgr.Tracker)
 	}
 
 	return errAll
 }
 
+// AddSeeder adds the peer at addr as a candidate to download pieces
+// from. The connection manager dials it once there is a free slot.
+func (t *Tracker) AddSeeder(addr string, source connmgr.Source) {
+	if t.UploadOnly() {
+		return
+	}
+
+	if t.bans.Banned(addr) {
+		return
+	}
+
+	if reason, blocked := t.filter.Blocked(addr); blocked {
+		t.logger.Info("rejected peer candidate blocked by ip filter",
+			slog.String("addr", addr),
+			slog.String("source", source.String()),
+			slog.String("reason", reason),
+		)
+		return
+	}
+
+	t.logger.Debug("adding peer candidate", slog.String("addr", addr), slog.String("source", source.String()))
+	t.pool.Add(addr, source)
+}
+
 func (t *Tracker) downloadScheduler() {
 	defer t.download.wg.Done()
 
 	unverified := make(map[uint32]struct{})
 	for _, i := range t.BitField.MissingPieces() {
-		unverified[i] = struct{}{}
+		if t.Wanted(i) {
+			unverified[i] = struct{}{}
+		}
 	}
 
 	currentRate := int64(0)
@@ -65,6 +92,9 @@ func (t *Tracker) downloadScheduler() {
 			currentRate = newRate
 		default:
 			freeSlots := 0
+			// saturated says whether there are requests that could not be
+			// sent as all peers having the piece have their queues full.
+			saturated := false
 			for i := range t.download.requests {
 				p := t.download.requests[i].Load()
 				if p == nil {
@@ -74,39 +104,7 @@ func (t *Tracker) downloadScheduler() {
 
 				p.l.Lock()
 
-				// reschedule long running requests.
-				for send := 0; send < len(p.InFlight); send++ {
-					if req := p.InFlight[send]; !req.received && time.Since(req.send) > 8*time.Second {
-						t.peers.seeders.Range(func(_, value any) bool {
-							p := value.(*peer.Peer)
-							canCancel := p.ConnectionStatus() == peer.ConnectionEstablished
-							canCancel = canCancel && p.Status.Remote.Load() == uint32(peer.UnChoked)
-							if canCancel {
-								err := p.SendCancel(&messagesv1.Cancel{
-									Index:  req.request.Index,
-									Begin:  req.request.Begin,
-									Length: req.request.Length,
-								})
-								if err != nil {
-									t.logger.Error("failed to cancel request",
-										slog.Any("err", err),
-										slog.String("end_peer", p.Id),
-										slog.String("req", fmt.Sprintf("%#v", req)),
-									)
-								}
-							}
-							return true
-						})
-
-						p.Pending = append(p.Pending, &messagesv1.Request{
-							Index:  req.request.Index,
-							Begin:  req.request.Begin,
-							Length: req.request.Length,
-						})
-						p.InFlight[send] = nil
-					}
-				}
-				p.InFlight = slices.DeleteFunc(p.InFlight, func(r *timedDownloadRequest) bool { return r == nil })
+				t.requeueTimedOut(p)
 
 				// schedule pending requests to peers.
 				for send := 0; send < len(p.Pending); send++ {
@@ -114,11 +112,17 @@ func (t *Tracker) downloadScheduler() {
 					// select peer to contact for piece.
 					var peers []*peer.Peer
 
-					t.peers.seeders.Range(func(_, value any) bool {
+					busy := false
+
+					t.peers.Range(func(_, value any) bool {
 						p := value.(*peer.Peer)
 						canRequest := p.ConnectionStatus() == peer.ConnectionEstablished
 						canRequest = canRequest && p.Status.Remote.Load() == uint32(peer.UnChoked)
 						canRequest = canRequest && p.Bitfield.Check(piece.Index)
+						if canRequest && p.Outstanding() >= p.RequestQueue() {
+							// the request queue of the peer is full.
+							busy, canRequest = true, false
+						}
 						if canRequest {
 							peers = append(peers, p)
 						}
@@ -126,6 +130,10 @@ func (t *Tracker) downloadScheduler() {
 					})
 
 					if len(peers) == 0 {
+						if busy {
+							saturated = true
+							continue
+						}
 						t.logger.Debug("no peers online that contain needed piece",
 							slog.String("piece", fmt.Sprint(piece.Index)),
 							slog.String("req", fmt.Sprintf("%#v", piece)),
@@ -133,7 +141,24 @@ func (t *Tracker) downloadScheduler() {
 						continue
 					}
 
+					// prefer the peer with the most room left in its request queue.
 					chosen := rand.IntN(len(peers))
+					for i, c := range peers {
+						if free(c) > free(peers[chosen]) {
+							chosen = i
+						}
+					}
+					if p.SinglePeer {
+						// after a hash failure the piece is requested from a single peer, which is
+						// only replaced once it disconnects, so that corrupt blocks can be attributed.
+						if i := slices.IndexFunc(peers, func(c *peer.Peer) bool { return c.Addr == p.Exclusive }); i >= 0 {
+							chosen = i
+						} else if v, ok := t.peers.Load(p.Exclusive); ok && v.(*peer.Peer).ConnectionStatus() == peer.ConnectionEstablished {
+							continue
+						} else {
+							p.Exclusive = peers[chosen].Addr
+						}
+					}
 					t.logger.Debug("sending request for piece",
 						slog.String("end_peer", peers[chosen].Id),
 						slog.String("req", fmt.Sprintf("%#v", piece)),
@@ -148,10 +173,12 @@ func (t *Tracker) downloadScheduler() {
 						continue
 					}
 
+					peers[chosen].RequestSent()
 					p.Pending[send] = nil
 					p.InFlight = append(p.InFlight, &timedDownloadRequest{
 						request: *piece,
 						send:    time.Now(),
+						to:      peers[chosen],
 					})
 				}
 				p.Pending = slices.DeleteFunc(p.Pending, func(r *messagesv1.Request) bool { return r == nil })
@@ -168,6 +195,13 @@ func (t *Tracker) downloadScheduler() {
 				continue
 			}
 
+			if saturated || t.disk.Backlogged() {
+				// peers have no capacity left for a new piece
+				// or the disk is behind writing the pieces.
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+
 			slot := -1
 			for i := range t.download.requests {
 				if t.download.requests[i].Load() == nil {
@@ -184,7 +218,7 @@ func (t *Tracker) downloadScheduler() {
 			index := int64(-1)
 			// find the next missing piece that can be downloaded
 			for unverified := range unverified {
-				t.peers.seeders.Range(func(_, value any) bool {
+				t.peers.Range(func(_, value any) bool {
 					p := value.(*peer.Peer)
 					if p.Bitfield.Check(unverified) {
 						index = int64(unverified)
@@ -238,11 +272,53 @@ func (t *Tracker) downloadScheduler() {
 	}
 }
 
-func (t *Tracker) recvPieces(logger *slog.Logger, pieces <-chan *messagesv1.Piece) {
-	defer t.download.wg.Done()
+// requeueTimedOut moves the requests of the piece that timed out or whose
+// peer disconnected back to the pending requests, the timeout is derived
+// from the round trip times to the peer. Must be called with p.l held.
+func (t *Tracker) requeueTimedOut(p *pendingPiece) {
+	for send := 0; send < len(p.InFlight); send++ {
+		req := p.InFlight[send]
+		if req.received {
+			continue
+		}
+		disconnected := req.to.ConnectionStatus() != peer.ConnectionEstablished
+		if disconnected || time.Since(req.send) > req.to.RequestTimeout() {
+			req.to.RequestDropped(!disconnected)
+			if !disconnected && req.to.Status.Remote.Load() == uint32(peer.UnChoked) {
+				err := req.to.SendCancel(&messagesv1.Cancel{
+					Index:  req.request.Index,
+					Begin:  req.request.Begin,
+					Length: req.request.Length,
+				})
+				if err != nil {
+					t.logger.Error("failed to cancel request",
+						slog.Any("err", err),
+						slog.String("end_peer", req.to.Id),
+						slog.String("req", fmt.Sprintf("%#v", req)),
+					)
+				}
+			}
+
+			if p.Resent == nil {
+				p.Resent = make(map[uint32]bool)
+			}
+			p.Resent[req.request.Begin] = true
+			p.Pending = append(p.Pending, &messagesv1.Request{
+				Index:  req.request.Index,
+				Begin:  req.request.Begin,
+				Length: req.request.Length,
+			})
+			p.InFlight[send] = nil
+		}
+	}
+	p.InFlight = slices.DeleteFunc(p.InFlight, func(r *timedDownloadRequest) bool { return r == nil })
+}
+
+func (t *Tracker) recvPieces(logger *slog.Logger, from *peer.Peer) {
+	defer t.wg.Done()
 	for {
 		select {
-		case recv, ok := <-pieces:
+		case recv, ok := <-from.Pieces():
 			if !ok {
 				logger.Debug("shutting piece downloader, channel closed")
 				return
@@ -259,6 +335,7 @@ func (t *Tracker) recvPieces(logger *slog.Logger, pieces <-chan *messagesv1.Piec
 			}
 			if piece == nil {
 				logger.Debug("received piece for untracked piece index", slog.String("piece_idx", fmt.Sprint(recv.Index)))
+				t.stats.wastedBytes.Add(int64(len(recv.Block)))
 				continue
 			}
 
@@ -279,6 +356,7 @@ func (t *Tracker) recvPieces(logger *slog.Logger, pieces <-chan *messagesv1.Piec
 					slog.String("piece_length", fmt.Sprint(len(recv.Block))),
 				)
 				piece.l.Unlock()
+				t.stats.wastedBytes.Add(int64(len(recv.Block)))
 				continue
 			}
 
@@ -295,6 +373,7 @@ func (t *Tracker) recvPieces(logger *slog.Logger, pieces <-chan *messagesv1.Piec
 			}
 			if skip {
 				piece.l.Unlock()
+				t.stats.wastedBytes.Add(int64(len(recv.Block)))
 				continue
 			}
 
@@ -303,10 +382,14 @@ func (t *Tracker) recvPieces(logger *slog.Logger, pieces <-chan *messagesv1.Piec
 				piece.l.Unlock()
 				panic(fmt.Sprintf("recieved more data than expected for piece %v", recv.Index))
 			}
-			total := t.Downloaded.Add(int64(len(recv.Block)))
+			t.Downloaded.Add(int64(len(recv.Block)))
 
 			piece.Received = append(piece.Received, recv)
-			piece.InFlight[req].received = true // mark as received to it won't be rescheduled again.
+			if piece.From == nil {
+				piece.From = make(map[uint32]string)
+			}
+			piece.From[recv.Begin] = from.Addr
+			t.blockReceived(logger, piece, piece.InFlight[req], from, len(recv.Block))
 
 			status := float64(piece.Downloaded) / float64(piece.Size)
 			status *= 100
@@ -318,73 +401,19 @@ func (t *Tracker) recvPieces(logger *slog.Logger, pieces <-chan *messagesv1.Piec
 
 			if piece.Downloaded == piece.Size {
 				slices.SortFunc(piece.Received, func(a, b *messagesv1.Piece) int { return cmp.Compare(a.Begin, b.Begin) })
-				var data []byte
+				blocks := make([][]byte, 0, len(piece.Received))
 				for _, d := range piece.Received {
-					data = append(data, d.Block...)
-				}
-				digest := sha1.Sum(data)
-
-				if !bytes.Equal(digest[:], t.Torrent.PieceHash(recv.Index)) {
-					logger.Error("invalid piece sha1 hash, retrying", slog.String("piece", fmt.Sprint(recv.Index)))
-					// TODO: mark peer as malicious and close connection.
-					t.Downloaded.Add(-piece.Size)
-					if err := piece.Retry(); err != nil {
-						piece.l.Unlock()
-						panic("malformed state, expected no pending requests when rescheduling piece for retry download")
-					}
-					piece.l.Unlock()
-					continue
+					blocks = append(blocks, d.Block)
 				}
+				piece.l.Unlock()
 
-				if err := t.Flush(recv.Index, data); err != nil {
-					logger.Error("failed to flush piece", slog.Any("err", err), slog.String("piece", fmt.Sprint(recv.Index)))
-					t.Downloaded.Add(-piece.Size)
-					if err := piece.Retry(); err != nil {
-						piece.l.Unlock()
-						panic("malformed state, expected no pending requests when rescheduling piece for retry download")
-					}
-					piece.l.Unlock()
-					continue
-				}
-
-				t.BitField.Set(recv.Index)
-
-				logger.Debug("sending have message for verified piece", slog.String("piece", fmt.Sprint(recv.Index)))
-
-				// send have message to all peers.
-				t.peers.seeders.Range(func(_, value any) bool {
-					if p := value.(*peer.Peer); p.ConnectionStatus() == peer.ConnectionEstablished {
-						if err := p.SendHave(&messagesv1.Have{Index: recv.Index}); err != nil {
-							logger.Error("failed to send have piece, after verifying", slog.Any("err", err),
-								slog.String("end_peer", p.Id),
-								slog.String("piece", fmt.Sprint(recv.Index)),
-							)
-						}
-					}
-					return true
-				})
-				t.peers.leechers.Range(func(_, value any) bool {
-					if p := value.(*peer.Peer); p.ConnectionStatus() == peer.ConnectionEstablished {
-						if err := p.SendHave(&messagesv1.Have{Index: recv.Index}); err != nil {
-							logger.Error("failed to send have piece, after verifying", slog.Any("err", err),
-								slog.String("end_peer", p.Id),
-								slog.String("piece", fmt.Sprint(recv.Index)),
-							)
-						}
-					}
-					return true
+				// blocks while the disk falls behind, which stops reading
+				// from the peer until the pending pieces are written.
+				check := func(data []byte) bool { return t.Torrent.VerifyPiece(recv.Index, data) }
+				t.disk.Verify(recv.Index, blocks, check, func(data []byte, err error) {
+					t.pieceWritten(logger, pieceIdx, piece, data, err)
 				})
-
-				logger.Info("piece verified successfully",
-					slog.String("status", fmt.Sprintf("%.2f%%", (float64(total)/float64(t.Torrent.BytesToDownload()))*100)),
-					slog.String("kbps", fmt.Sprintf("%.2f", (float64(t.download.rate.Load())/1000.0)*100)),
-					slog.String("piece", fmt.Sprint(recv.Index)),
-				)
-
-				// make place for a new piece to be scheduled.
-				if !t.download.requests[pieceIdx].CompareAndSwap(piece, nil) {
-					logger.Warn("two go-routines verified same piece", slog.String("piece", fmt.Sprint(recv.Index)))
-				}
+				continue
 			}
 
 			piece.l.Unlock()
@@ -392,77 +421,109 @@ func (t *Tracker) recvPieces(logger *slog.Logger, pieces <-chan *messagesv1.Piec
 	}
 }
 
-func (t *Tracker) keepAliveSeeders(addr string) {
-	logger := t.logger.With(slog.String("peer_ip", addr))
+// blockReceived marks the request in flight as answered by the block of n
+// bytes from the peer, so that it won't be rescheduled again. A block sent
+// by another peer than the request was last sent to, after the request to
+// it timed out, cancels the request. Must be called with piece.l held.
+func (t *Tracker) blockReceived(logger *slog.Logger, piece *pendingPiece, inFlight *timedDownloadRequest, from *peer.Peer, n int) {
+	if inFlight.received {
+		return
+	}
+	inFlight.received = true
+
+	switch {
+	case inFlight.to != from:
+		inFlight.to.RequestDropped(false)
+		if inFlight.to.ConnectionStatus() == peer.ConnectionEstablished && inFlight.to.Status.Remote.Load() == uint32(peer.UnChoked) {
+			err := inFlight.to.SendCancel(&messagesv1.Cancel{
+				Index:  inFlight.request.Index,
+				Begin:  inFlight.request.Begin,
+				Length: inFlight.request.Length,
+			})
+			if err != nil {
+				logger.Error("failed to cancel request",
+					slog.Any("err", err),
+					slog.String("end_peer", inFlight.to.Id),
+					slog.String("req", fmt.Sprintf("%#v", inFlight)),
+				)
+			}
+		}
+	case piece.Resent[inFlight.request.Begin]:
+		// the round trip time is not sampled as the block could answer
+		// any of the requests sent for it (Karn's algorithm).
+		from.BlockReceived(0, n)
+	default:
+		from.BlockReceived(time.Since(inFlight.send), n)
+	}
+}
 
-	var p *peer.Peer
-	defer func() {
-		if err := p.SendNotInterested(); err != nil {
-			logger.Error("failed to send not-interested msg", slog.Any("err", err))
+// pieceWritten completes the piece once it was verified and written
+// to disk, or schedules it to be downloaded again on failure.
+func (t *Tracker) pieceWritten(logger *slog.Logger, slot int, piece *pendingPiece, data []byte, err error) {
+	piece.l.Lock()
+
+	switch {
+	case errors.Is(err, diskio.ErrHashMismatch):
+		logger.Error("invalid piece hash, retrying from a single peer", slog.String("piece", fmt.Sprint(piece.Index)))
+		t.hashFailed(logger, piece)
+		t.Downloaded.Add(-piece.Size)
+		t.stats.piecesFailed.Add(1)
+		t.stats.wastedBytes.Add(piece.Size)
+		if err := piece.Retry(); err != nil {
+			piece.l.Unlock()
+			panic("malformed state, expected no pending requests when rescheduling piece for retry download")
 		}
-		if err := p.Close(); err != nil {
-			logger.Error("failed to close peer", slog.Any("err", err))
+		piece.l.Unlock()
+		return
+	case err != nil:
+		logger.Error("failed to flush piece", slog.Any("err", err), slog.String("piece", fmt.Sprint(piece.Index)))
+		t.Downloaded.Add(-piece.Size)
+		if err := piece.Retry(); err != nil {
+			piece.l.Unlock()
+			panic("malformed state, expected no pending requests when rescheduling piece for retry download")
 		}
+		piece.l.Unlock()
+		return
+	}
 
-		t.download.wg.Done()
-	}()
+	t.verified(logger, piece, data)
+	index := piece.Index
+	piece.l.Unlock()
 
-	refresh := time.NewTicker(1 * time.Nanosecond) // first tick happens immediately.
-	for {
-		select {
-		case <-t.stop:
-			logger.Debug("shutting down peer refresher, stopped tracker")
-			return
-		case <-t.download.cancel:
-			logger.Debug("shutting down peer refresher, canceled download")
-			return
-		case <-t.download.completed:
-			logger.Debug("shutting down peer refresher, as torrent was downloaded")
-			return
-		case <-refresh.C:
-			refresh.Reset(2 * time.Minute)
-			switch p.ConnectionStatus() {
-			case peer.ConnectionKilled:
-				if err := p.Close(); err != nil {
-					logger.Error("failed to close peer", slog.Any("err", err))
-				}
-				t.peers.seeders.Delete(addr)
-
-				var err error
-				p, err = peer.NewSeederConnection(
-					logger,
-					addr,
-					t.Torrent.NumPieces(),
-					string(t.Torrent.Metadata.Hash[:]),
-					t.clientID,
-				)
-				if err != nil {
-					logger.Error("failed to initiating handshake", slog.Any("err", err))
-					continue
-				}
+	t.BitField.Set(index)
+	t.stats.piecesVerified.Add(1)
 
-				t.peers.seeders.Store(addr, p)
+	logger.Debug("sending have message for verified piece", slog.String("piece", fmt.Sprint(index)))
 
-				// Listen for incoming pieces.
-				t.download.wg.Add(1)
-				go t.recvPieces(logger.With(slog.String("pid", p.Id)), p.Pieces())
+	// send have message to all peers, without holding the lock of the
+	// piece as a slow peer would otherwise stall scheduling requests.
+	var peers []*peer.Peer
+	t.peers.Range(func(_, value any) bool {
+		if p := value.(*peer.Peer); p.ConnectionStatus() == peer.ConnectionEstablished {
+			peers = append(peers, p)
+		}
+		return true
+	})
+	for _, p := range peers {
+		if err := p.SendHave(&messagesv1.Have{Index: index}); err != nil {
+			logger.Error("failed to send have piece, after verifying", slog.Any("err", err),
+				slog.String("end_peer", p.Id),
+				slog.String("piece", fmt.Sprint(index)),
+			)
+		}
+	}
 
-				if err := p.SendBitfield(t.BitField.Clone()); err != nil {
-					logger.Error("failed to send bitfield msg")
-				}
+	logger.Info("piece verified successfully",
+		slog.String("status", fmt.Sprintf("%.2f%%", (float64(t.Downloaded.Load())/float64(t.Torrent.BytesToDownload()))*100)),
+		slog.String("kbps", fmt.Sprintf("%.2f", (float64(t.download.rate.Load())/1000.0)*100)),
+		slog.String("piece", fmt.Sprint(index)),
+	)
 
-				if err := p.SendInterested(); err != nil {
-					logger.Error("failed to send interested msg")
-				}
-			case peer.ConnectionEstablished:
-				logger.Debug("sending keep alive event on torrent peer")
-				if err := p.SendKeepAlive(); err != nil {
-					logger.Error("failed to keep alive, closing", slog.Any("err", err))
-					if err := p.Close(); err != nil {
-						logger.Error("failed to close peer", slog.Any("err", err))
-					}
-				}
-			}
-		}
+	// make place for a new piece to be scheduled.
+	if !t.download.requests[slot].CompareAndSwap(piece, nil) {
+		logger.Warn("two go-routines verified same piece", slog.String("piece", fmt.Sprint(index)))
 	}
 }
+
+// free returns the room left in the request queue of the peer.
+func free(p *peer.Peer) int { return p.RequestQueue() - p.Outstanding() }
@@ -0,0 +1,86 @@
+package status
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Despire/tinytorrent/p2p/peer/bitfield"
+)
+
+// selectPieces marks the pieces holding data of the selected files
+// as wanted, all pieces are wanted if no files were selected.
+func (t *Tracker) selectPieces() error {
+	if len(t.files) == 0 {
+		return nil
+	}
+
+	selected := make(map[string]bool, len(t.files))
+	for _, f := range t.files {
+		selected[filepath.Clean(f)] = false
+	}
+
+	t.wanted = bitfield.NewBitfield(t.Torrent.NumPieces())
+	if t.Torrent.InfoSingleFile != nil {
+		if _, ok := selected[t.Torrent.InfoSingleFile.Name]; !ok || len(selected) > 1 {
+			return fmt.Errorf("selected files %v are not part of the torrent", t.files)
+		}
+		t.wanted = nil
+		return nil
+	}
+
+	offset := int64(0)
+	for _, f := range t.Torrent.InfoMultiFile.Files {
+		if _, ok := selected[f.Path]; ok && !f.IsPadding() {
+			selected[f.Path] = true
+			for i := offset / t.Torrent.PieceLength; i*t.Torrent.PieceLength < offset+f.Length; i++ {
+				t.wanted.Set(uint32(i))
+			}
+		}
+		offset += f.Length
+	}
+	for f, found := range selected {
+		if !found {
+			return fmt.Errorf("selected file %s is not part of the torrent", f)
+		}
+	}
+	return nil
+}
+
+// Wanted reports whether the piece is to be downloaded,
+// as it holds data of one of the selected files.
+func (t *Tracker) Wanted(index uint32) bool { return t.wanted == nil || t.wanted.Check(index) }
+
+// Left returns the number of bytes of the wanted pieces not downloaded yet.
+func (t *Tracker) Left() int64 {
+	left := int64(0)
+	for _, i := range t.BitField.MissingPieces() {
+		if t.Wanted(i) {
+			start := int64(i) * t.Torrent.PieceLength
+			left += min(start+t.Torrent.PieceLength, t.Torrent.BytesToDownload()) - start
+		}
+	}
+	return left
+}
+
+// UploadOnly reports whether the client has all the wanted
+// pieces and only uploads, being a seed or a partial seed.
+func (t *Tracker) UploadOnly() bool { return t.Left() == 0 }
+
+// PartialSeed reports whether the client has all the pieces of the
+// selected files but not the complete torrent.
+func (t *Tracker) PartialSeed() bool {
+	return t.UploadOnly() && len(t.BitField.MissingPieces()) > 0
+}
+
+// Selected reports whether the file is to be downloaded.
+func (t *Tracker) Selected(path string) bool {
+	if len(t.files) == 0 {
+		return true
+	}
+	for _, f := range t.files {
+		if filepath.Clean(f) == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package status
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Despire/tinytorrent/p2p/peer/bitfield"
+	"github.com/Despire/tinytorrent/torrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker_WithFiles(t *testing.T) {
+	// a spans pieces 0-1, b piece 2 only after the padding and c piece 3.
+	mf := &torrent.MetaInfoFile{Info: torrent.Info{
+		InfoMultiFile: &torrent.InfoMultiFile{Name: "dir", Files: []torrent.FileInfo{
+			{Path: "a", Length: 15},
+			{Path: ".pad/5", Length: 5, Attr: "p"},
+			{Path: "b", Length: 10},
+			{Path: "c", Length: 5},
+		}},
+		PieceLength: 10,
+		Pieces:      strings.Repeat("00", 4*20),
+	}}
+	newTracker := func(files ...string) (*Tracker, error) {
+		tr := &Tracker{Torrent: mf, BitField: bitfield.NewBitfield(mf.NumPieces())}
+		WithFiles(files...)(tr)
+		return tr, tr.selectPieces()
+	}
+
+	tr, err := newTracker()
+	require.NoError(t, err)
+	assert.True(t, tr.Wanted(3))
+	assert.True(t, tr.Selected("c"))
+	assert.Equal(t, int64(35), tr.Left())
+
+	tr, err = newTracker("a", "c")
+	require.NoError(t, err)
+	assert.True(t, tr.Wanted(0))
+	assert.True(t, tr.Wanted(1))
+	assert.False(t, tr.Wanted(2))
+	assert.True(t, tr.Wanted(3))
+	assert.False(t, tr.Selected("b"))
+	assert.Equal(t, int64(25), tr.Left())
+	assert.False(t, tr.UploadOnly())
+
+	for _, i := range []uint32{0, 1, 3} {
+		tr.BitField.Set(i)
+	}
+	assert.Zero(t, tr.Left())
+	assert.True(t, tr.UploadOnly())
+	assert.True(t, tr.PartialSeed())
+
+	tr.BitField.Set(2)
+	assert.False(t, tr.PartialSeed())
+
+	_, err = newTracker("a", "missing")
+	assert.ErrorContains(t, err, "missing")
+	_, err = newTracker(".pad/5")
+	assert.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package status
+
+import (
+	"log/slog"
+	"net/netip"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/peer"
+)
+
+// recvHolepunch handles the messages of the holepunch extension (BEP55).
+// Peers behind NATs that can't be dialed are connected to through a relay,
+// a peer both ends are connected to, which tells them to dial each other
+// at the same time so that the connection gets through their NATs.
+func (t *Tracker) recvHolepunch(from *peer.Peer, h *messagesv1.Holepunch) {
+	switch h.Type {
+	case messagesv1.HolepunchRendezvous:
+		t.relay(from, h.Addr)
+	case messagesv1.HolepunchConnect:
+		t.holepunch(h.Addr)
+	case messagesv1.HolepunchError:
+		t.logger.Debug("holepunch rendezvous failed",
+			slog.String("relay", from.Addr),
+			slog.String("peer_ip", h.Addr.String()),
+			slog.Any("code", h.Err),
+		)
+	}
+}
+
+// relay tells the peer and the target of its rendezvous
+// to connect to each other, or the peer why it can't.
+func (t *Tracker) relay(from *peer.Peer, target netip.AddrPort) {
+	reject := func(code uint32) {
+		t.logger.Debug("rejected holepunch rendezvous", slog.String("peer_ip", from.Addr), slog.String("target", target.String()), slog.Any("code", code))
+		if err := from.SendHolepunch(&messagesv1.Holepunch{Type: messagesv1.HolepunchError, Addr: target, Err: code}); err != nil {
+			t.logger.Debug("failed to send holepunch error", slog.String("peer_ip", from.Addr), slog.Any("err", err))
+		}
+	}
+
+	if !target.IsValid() || target.Port() == 0 {
+		reject(messagesv1.HolepunchNoSuchPeer)
+		return
+	}
+	if sameAddr(from.ListenAddr(), target) || sameAddr(from.Addr, target) {
+		reject(messagesv1.HolepunchNoSelf)
+		return
+	}
+
+	var to *peer.Peer
+	t.peers.Range(func(_, value any) bool {
+		p := value.(*peer.Peer)
+		if p.ConnectionStatus() == peer.ConnectionEstablished && (sameAddr(p.ListenAddr(), target) || sameAddr(p.Addr, target)) {
+			to = p
+			return false
+		}
+		return true
+	})
+	if to == nil {
+		reject(messagesv1.HolepunchNotConnected)
+		return
+	}
+	if !to.SupportsExtension(messagesv1.HolepunchExtension) {
+		reject(messagesv1.HolepunchNoSupport)
+		return
+	}
+
+	fromAddr, err := netip.ParseAddrPort(from.ListenAddr())
+	if err != nil {
+		reject(messagesv1.HolepunchNoSuchPeer)
+		return
+	}
+	if err := to.SendHolepunch(&messagesv1.Holepunch{Type: messagesv1.HolepunchConnect, Addr: fromAddr}); err != nil {
+		t.logger.Debug("failed to send holepunch connect", slog.String("peer_ip", to.Addr), slog.Any("err", err))
+		return
+	}
+	if err := from.SendHolepunch(&messagesv1.Holepunch{Type: messagesv1.HolepunchConnect, Addr: target}); err != nil {
+		t.logger.Debug("failed to send holepunch connect", slog.String("peer_ip", from.Addr), slog.Any("err", err))
+	}
+	t.logger.Debug("relayed holepunch rendezvous", slog.String("peer_ip", from.Addr), slog.String("target", to.Addr))
+}
+
+// rendezvous asks the peer that exchanged the address, if any, to
+// connect this client with the peer at the address. Each relay is
+// asked at most once so that failed dials don't loop.
+func (t *Tracker) rendezvous(addr string) {
+	relay, ok := t.relays.LoadAndDelete(addr)
+	if !ok {
+		return
+	}
+	target, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return
+	}
+	v, ok := t.peers.Load(relay)
+	if !ok {
+		return
+	}
+
+	p := v.(*peer.Peer)
+	if err := p.SendHolepunch(&messagesv1.Holepunch{Type: messagesv1.HolepunchRendezvous, Addr: target}); err != nil {
+		t.logger.Debug("failed to send holepunch rendezvous", slog.String("relay", p.Addr), slog.Any("err", err))
+		return
+	}
+	t.logger.Debug("sent holepunch rendezvous", slog.String("relay", p.Addr), slog.String("peer_ip", addr))
+}
+
+// holepunch dials the peer at the address, as told by a relay,
+// while the peer dials this client at the same time.
+func (t *Tracker) holepunch(addr netip.AddrPort) {
+	target := netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()).String()
+	if _, connected := t.peers.Load(target); connected {
+		return
+	}
+	select {
+	case <-t.stop:
+		return
+	case <-t.download.cancel:
+		return
+	default:
+	}
+
+	done, ok := t.limiter.Dial()
+	if !ok {
+		return
+	}
+	t.download.dialing.Add(1)
+	t.download.wg.Add(1)
+	go t.connectPeer(target, done)
+}
+
+// sameAddr reports whether the address is the one of the target.
+func sameAddr(addr string, target netip.AddrPort) bool {
+	a, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return false
+	}
+	return a.Addr().Unmap() == target.Addr().Unmap() && a.Port() == target.Port()
+}
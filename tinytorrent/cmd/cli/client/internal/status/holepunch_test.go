@@ -0,0 +1,225 @@
+package status
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/peer"
+	"github.com/Despire/tinytorrent/p2p/peer/bitfield"
+	"github.com/Despire/tinytorrent/torrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// relayPeer is a peer connected to the relay,
+// recording the extension messages it receives.
+type relayPeer struct {
+	*peer.Peer
+	pex         chan *messagesv1.Pex
+	holepunches chan *messagesv1.Holepunch
+}
+
+func (p *relayPeer) holepunch(t *testing.T) *messagesv1.Holepunch {
+	t.Helper()
+	select {
+	case h := <-p.holepunches:
+		return h
+	case <-time.After(5 * time.Second):
+		t.Fatal("holepunch message not received")
+		return nil
+	}
+}
+
+// seedTracker returns a tracker of a complete torrent accepting
+// connections at the returned address.
+func seedTracker(t *testing.T, logger *slog.Logger) (*Tracker, *torrent.MetaInfoFile, string) {
+	t.Helper()
+
+	mf := &torrent.MetaInfoFile{Info: torrent.Info{
+		InfoSingleFile: &torrent.InfoSingleFile{Name: "file", Length: 30},
+		PieceLength:    10,
+		Pieces:         strings.Repeat("00", 3*20),
+	}}
+	mf.Metadata.Hash = [20]byte{1}
+
+	dir := t.TempDir()
+	torrentDir := filepath.Join(dir, hex.EncodeToString(mf.Metadata.Hash[:]))
+	require.NoError(t, os.MkdirAll(torrentDir, os.ModePerm))
+	bf := bitfield.NewBitfield(mf.NumPieces())
+	for i := range uint32(3) {
+		bf.Set(i)
+	}
+	f, err := os.Create(filepath.Join(torrentDir, "bitfield.bin"))
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(f, binary.LittleEndian, bf.Clone()))
+	require.NoError(t, f.Close())
+
+	tr, err := NewTracker(strings.Repeat("r", 20), logger, mf, dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { tr.Close() })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var b [messagesv1.HandshakeLength]byte
+			if _, err := io.ReadFull(conn, b[:]); err != nil {
+				conn.Close()
+				continue
+			}
+			h := new(messagesv1.Handshake)
+			if err := h.Deserialize(b[:]); err != nil {
+				conn.Close()
+				continue
+			}
+			if err := tr.AddPeer(h, conn); err != nil {
+				conn.Close()
+			}
+		}
+	}()
+	return tr, mf, l.Addr().String()
+}
+
+func TestTracker_Holepunch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	relay, mf, relayAddr := seedTracker(t, logger)
+
+	connect := func(id string, port int, holepunch bool) *relayPeer {
+		p := &relayPeer{pex: make(chan *messagesv1.Pex, 10), holepunches: make(chan *messagesv1.Holepunch, 10)}
+		opts := []peer.Option{
+			peer.WithListenPort(port),
+			peer.WithPex(func(_ *peer.Peer, pex *messagesv1.Pex) { p.pex <- pex }),
+		}
+		if holepunch {
+			opts = append(opts, peer.WithHolepunch(func(_ *peer.Peer, h *messagesv1.Holepunch) { p.holepunches <- h }))
+		}
+
+		var err error
+		p.Peer, err = peer.NewOutgoingConnection(logger, relayAddr, mf.NumPieces(), string(mf.Metadata.Hash[:]), strings.Repeat(id, 20), opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { p.Close() })
+		require.NoError(t, p.SendExtendedHandshake())
+		require.Eventually(t, func() bool { return p.SupportsExtension(messagesv1.HolepunchExtension) }, 5*time.Second, 10*time.Millisecond)
+		return p
+	}
+
+	b := connect("b", 7001, true)
+	c := connect("c", 7002, true)
+	connect("d", 7003, false)
+	bAddr, cAddr, dAddr := netip.MustParseAddrPort("127.0.0.1:7001"), netip.MustParseAddrPort("127.0.0.1:7002"), netip.MustParseAddrPort("127.0.0.1:7003")
+
+	// the relay exchanges the peers at their listen addresses
+	// along with whether they support holepunching.
+	exchanged := make(map[netip.AddrPort]uint8)
+	for len(exchanged) < 2 {
+		select {
+		case pex := <-b.pex:
+			for _, a := range pex.Added {
+				exchanged[a.Addr] = a.Flags
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("pex message not received")
+		}
+	}
+	assert.NotZero(t, exchanged[cAddr]&messagesv1.PexHolepunch)
+	assert.Zero(t, exchanged[dAddr]&messagesv1.PexHolepunch)
+	assert.NotContains(t, exchanged, bAddr)
+
+	t.Run("rendezvous", func(t *testing.T) {
+		require.NoError(t, b.SendHolepunch(&messagesv1.Holepunch{Type: messagesv1.HolepunchRendezvous, Addr: cAddr}))
+
+		// both ends are told to connect to each other.
+		assert.Equal(t, &messagesv1.Holepunch{Type: messagesv1.HolepunchConnect, Addr: cAddr}, b.holepunch(t))
+		assert.Equal(t, &messagesv1.Holepunch{Type: messagesv1.HolepunchConnect, Addr: bAddr}, c.holepunch(t))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for target, code := range map[string]uint32{
+			"127.0.0.1:7001": messagesv1.HolepunchNoSelf,
+			"127.0.0.1:7003": messagesv1.HolepunchNoSupport,
+			"127.0.0.1:7004": messagesv1.HolepunchNotConnected,
+			"127.0.0.1:0":    messagesv1.HolepunchNoSuchPeer,
+		} {
+			addr := netip.MustParseAddrPort(target)
+			require.NoError(t, b.SendHolepunch(&messagesv1.Holepunch{Type: messagesv1.HolepunchRendezvous, Addr: addr}))
+			assert.Equal(t, &messagesv1.Holepunch{Type: messagesv1.HolepunchError, Addr: addr, Err: code}, b.holepunch(t), target)
+		}
+		assert.Empty(t, c.holepunches)
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+
+		// the relay dials the address it is told to connect to.
+		require.NoError(t, c.SendHolepunch(&messagesv1.Holepunch{Type: messagesv1.HolepunchConnect, Addr: netip.MustParseAddrPort(l.Addr().String())}))
+
+		accepted := make(chan *messagesv1.Handshake, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			var b [messagesv1.HandshakeLength]byte
+			if _, err := io.ReadFull(conn, b[:]); err != nil {
+				return
+			}
+			h := new(messagesv1.Handshake)
+			if h.Deserialize(b[:]) == nil {
+				accepted <- h
+			}
+		}()
+
+		select {
+		case h := <-accepted:
+			assert.Equal(t, relay.clientID, h.PeerID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay did not connect")
+		}
+	})
+
+	t.Run("initiate", func(t *testing.T) {
+		// the peer exchanged by b is dialed through it once.
+		var key string
+		relay.peers.Range(func(k, value any) bool {
+			if value.(*peer.Peer).Id == strings.Repeat("b", 20) {
+				key = k.(string)
+			}
+			return key == ""
+		})
+		require.NotEmpty(t, key)
+		relay.recvPex(relay.peerAt(t, key), &messagesv1.Pex{Added: []messagesv1.PexPeer{
+			{Addr: netip.MustParseAddrPort("127.0.0.1:7005"), Flags: messagesv1.PexHolepunch},
+		}})
+
+		relay.rendezvous("127.0.0.1:7005")
+		assert.Equal(t, &messagesv1.Holepunch{Type: messagesv1.HolepunchRendezvous, Addr: netip.MustParseAddrPort("127.0.0.1:7005")}, b.holepunch(t))
+
+		relay.rendezvous("127.0.0.1:7005")
+		assert.Empty(t, b.holepunches)
+	})
+}
+
+func (t *Tracker) peerAt(tb testing.TB, addr string) *peer.Peer {
+	tb.Helper()
+	v, ok := t.peers.Load(addr)
+	require.True(tb, ok)
+	return v.(*peer.Peer)
+}
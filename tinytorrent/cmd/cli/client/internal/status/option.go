@@ -0,0 +1,78 @@
+package status
+
+import (
+	"strings"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/connmgr"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/ipfilter"
+	"github.com/Despire/tinytorrent/p2p/peer"
+)
+
+type Option func(t *Tracker)
+
+// WithFiles restricts the download to the files with the paths, relative
+// to the directory of the torrent. By default all files are downloaded.
+func WithFiles(paths ...string) Option {
+	return func(t *Tracker) {
+		t.files = paths
+	}
+}
+
+// WithState continues from the state of a previous session of the
+// torrent, restoring when it was added, the bytes uploaded and the
+// known peers. The files to download are set with WithFiles.
+func WithState(s *State) Option {
+	return func(t *Tracker) {
+		t.restored = s
+	}
+}
+
+// WithPeerOptions sets the options used when establishing
+// connections with the peers of the torrent.
+func WithPeerOptions(opts ...peer.Option) Option {
+	return func(t *Tracker) {
+		t.peerOpts = append(t.peerOpts, opts...)
+	}
+}
+
+// WithLimiter shares the limits on the number of connections
+// with other torrents. By default there is no shared limit.
+func WithLimiter(l *connmgr.Limiter) Option {
+	return func(t *Tracker) {
+		t.limiter = l
+	}
+}
+
+// WithMaxConnections caps the number of peers the
+// torrent downloads from at the same time.
+func WithMaxConnections(n int) Option {
+	return func(t *Tracker) {
+		t.maxConnections = n
+	}
+}
+
+// WithBanList shares the peers banned for sending corrupt
+// data with other torrents. By default no one is banned.
+func WithBanList(b *connmgr.BanList) Option {
+	return func(t *Tracker) {
+		t.bans = b
+	}
+}
+
+// WithIPFilter keeps the torrent away from the peers blocked
+// by the filter. By default all peers are allowed.
+func WithIPFilter(f *ipfilter.Filter) Option {
+	return func(t *Tracker) {
+		t.filter = f
+	}
+}
+
+// WithBlockedClients refuses the peers whose peer id identifies
+// them as one of the named clients. By default all are allowed.
+func WithBlockedClients(names ...string) Option {
+	return func(t *Tracker) {
+		for _, n := range names {
+			t.blockedClients = append(t.blockedClients, strings.ToLower(strings.TrimSpace(n)))
+		}
+	}
+}
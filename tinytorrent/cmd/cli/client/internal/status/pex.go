@@ -0,0 +1,133 @@
+package status
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/connmgr"
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/peer"
+)
+
+const (
+	// pexInterval is how often the connected peers are exchanged with a peer.
+	pexInterval = 1 * time.Minute
+	// maxPexPeers caps the peers added by a single pex message.
+	maxPexPeers = 50
+)
+
+// exchangePeers sends the peers connected and disconnected since the last
+// exchange to the peers supporting the peer exchange extension (BEP11).
+func (t *Tracker) exchangePeers(now time.Time) {
+	if t.Torrent.IsPrivate() {
+		return
+	}
+	if t.pexSent == nil {
+		t.pexSent = make(map[string]*pexState)
+	}
+
+	current := make(map[netip.AddrPort]messagesv1.PexPeer)
+	connected := make(map[string]bool)
+	t.peers.Range(func(key, value any) bool {
+		p := value.(*peer.Peer)
+		connected[key.(string)] = true
+		if p.ConnectionStatus() != peer.ConnectionEstablished {
+			return true
+		}
+		addr, err := netip.ParseAddrPort(p.ListenAddr())
+		if err != nil {
+			return true
+		}
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+		var flags uint8
+		if p.SupportsExtension(messagesv1.HolepunchExtension) {
+			flags |= messagesv1.PexHolepunch
+		}
+		if p.Outgoing() {
+			flags |= messagesv1.PexReachable
+		}
+		if p.UploadOnly() {
+			flags |= messagesv1.PexSeed
+		}
+		current[addr] = messagesv1.PexPeer{Addr: addr, Flags: flags}
+		return true
+	})
+
+	for addr := range t.pexSent {
+		if !connected[addr] {
+			delete(t.pexSent, addr)
+		}
+	}
+
+	t.peers.Range(func(key, value any) bool {
+		p := value.(*peer.Peer)
+		if p.ConnectionStatus() != peer.ConnectionEstablished || !p.SupportsExtension(messagesv1.PexExtension) {
+			return true
+		}
+		st, ok := t.pexSent[key.(string)]
+		if !ok {
+			st = &pexState{sent: make(map[netip.AddrPort]bool)}
+			t.pexSent[key.(string)] = st
+		}
+		if !st.last.IsZero() && now.Sub(st.last) < pexInterval {
+			return true
+		}
+
+		pex := new(messagesv1.Pex)
+		for addr, a := range current {
+			if addr.String() != p.ListenAddr() && !st.sent[addr] && len(pex.Added) < maxPexPeers {
+				pex.Added = append(pex.Added, a)
+			}
+		}
+		for addr := range st.sent {
+			if _, ok := current[addr]; !ok {
+				pex.Dropped = append(pex.Dropped, addr)
+			}
+		}
+		st.last = now
+		if len(pex.Added) == 0 && len(pex.Dropped) == 0 {
+			return true
+		}
+
+		if err := p.SendPex(pex); err != nil {
+			t.logger.Debug("failed to send pex msg", slog.String("peer_ip", p.Addr), slog.Any("err", err))
+			return true
+		}
+		for _, a := range pex.Added {
+			st.sent[a.Addr] = true
+		}
+		for _, addr := range pex.Dropped {
+			delete(st.sent, addr)
+		}
+		return true
+	})
+}
+
+// pexState is what was exchanged with a peer.
+type pexState struct {
+	sent map[netip.AddrPort]bool
+	last time.Time
+}
+
+// recvPex adds the exchanged peers as candidates. The sender is remembered
+// as the relay for the ones supporting the holepunch extension.
+func (t *Tracker) recvPex(from *peer.Peer, pex *messagesv1.Pex) {
+	if t.Torrent.IsPrivate() {
+		return
+	}
+	for _, a := range pex.Added {
+		if !a.Addr.IsValid() || a.Addr.Port() == 0 {
+			continue
+		}
+		addr := netip.AddrPortFrom(a.Addr.Addr().Unmap(), a.Addr.Port()).String()
+		if a.Flags&messagesv1.PexHolepunch != 0 {
+			t.relays.Store(addr, from.Addr)
+		}
+		t.AddSeeder(addr, connmgr.Pex)
+	}
+	for _, a := range pex.Dropped {
+		t.relays.CompareAndDelete(netip.AddrPortFrom(a.Addr().Unmap(), a.Port()).String(), from.Addr)
+	}
+}
@@ -0,0 +1,82 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/connmgr"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/diskio"
+)
+
+// StateFile is the name of the file within the download directory
+// of the torrent the state is kept in across restarts.
+const StateFile = "state.json"
+
+// maxSavedPeers caps the number of known peers kept in the state.
+const maxSavedPeers = 50
+
+// State is the state of the torrent kept across restarts of the client,
+// the pieces the client has are kept in the bitfield.bin file.
+type State struct {
+	// Added is when the torrent was first worked on.
+	Added time.Time `json:"added"`
+	// Uploaded are the bytes uploaded over all sessions.
+	Uploaded int64 `json:"uploaded"`
+	// Files are the paths of the files to download, all if empty.
+	Files []string `json:"files,omitempty"`
+	// Peers are the best known peer addresses.
+	Peers        []string `json:"peers,omitempty"`
+	SuperSeeding bool     `json:"super_seeding,omitempty"`
+}
+
+// ReadState reads the state of the torrent from the download directory
+// of the torrent. The error wraps os.ErrNotExist if there is none.
+func ReadState(dir string) (*State, error) {
+	b, err := os.ReadFile(filepath.Join(dir, StateFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read torrent state: %w", err)
+	}
+	s := new(State)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("failed to decode torrent state: %w", err)
+	}
+	return s, nil
+}
+
+// State returns the current state of the torrent.
+func (t *Tracker) State() *State {
+	peers := t.pool.Candidates()
+	return &State{
+		Added:        t.added,
+		Uploaded:     t.Uploaded.Load(),
+		Files:        t.files,
+		Peers:        peers[:min(len(peers), maxSavedPeers)],
+		SuperSeeding: t.SuperSeeding(),
+	}
+}
+
+// SaveState writes the current state of the torrent to its download directory.
+func (t *Tracker) SaveState() error {
+	b, err := json.MarshalIndent(t.State(), "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode torrent state: %w", err)
+	}
+	if err := diskio.WriteFile(filepath.Join(t.DownloadDir, StateFile), b); err != nil {
+		return fmt.Errorf("failed to write torrent state: %w", err)
+	}
+	return nil
+}
+
+// restoreState continues from the state of a previous session.
+func (t *Tracker) restoreState(s *State) {
+	if !s.Added.IsZero() {
+		t.added = s.Added
+	}
+	t.Uploaded.Add(s.Uploaded)
+	for _, addr := range s.Peers {
+		t.AddSeeder(addr, connmgr.Saved)
+	}
+}
@@ -0,0 +1,280 @@
+package status
+
+import (
+	"cmp"
+	"encoding/hex"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/tracker"
+	"github.com/Despire/tinytorrent/p2p/peer"
+	"github.com/Despire/tinytorrent/p2p/peerid"
+)
+
+// counters are the statistics accumulated over the lifetime of the tracker.
+type counters struct {
+	piecesVerified atomic.Int64
+	piecesFailed   atomic.Int64
+	// wastedBytes are the bytes received that were discarded, either
+	// being duplicates, not requested or part of a corrupt piece.
+	wastedBytes atomic.Int64
+
+	announcesSucceeded atomic.Int64
+	announcesFailed    atomic.Int64
+	lastAnnounce       atomic.Pointer[announce]
+}
+
+type announce struct {
+	at    time.Time
+	peers int
+	err   error
+}
+
+// Stats is a snapshot of the statistics of a torrent.
+type Stats struct {
+	InfoHash string
+	Name     string
+	Size     int64
+	// Added is when the torrent was first worked on.
+	Added time.Time
+
+	Downloaded int64
+	Uploaded   int64
+	Left       int64
+	// Ratio is the share ratio, see Tracker.Ratio.
+	Ratio float64
+	// DownloadRate and UploadRate are in bytes per second.
+	DownloadRate int64
+	UploadRate   int64
+
+	Pieces         int64
+	PiecesHave     int64
+	PiecesVerified int64
+	PiecesFailed   int64
+	WastedBytes    int64
+
+	Peers     PeerStats
+	Announces AnnounceStats
+
+	// Connections are the connected peers ordered by their address.
+	Connections []PeerInfo
+	// Have says for each piece whether it was verified and
+	// Availability by how many connected peers it is available.
+	Have         []bool
+	Availability []int
+}
+
+// PeerInfo describes a connected peer.
+type PeerInfo struct {
+	Addr string
+	ID   string
+	// Client is the name and version of the client software of the
+	// peer, as advertised in the extension handshake or derived from
+	// its peer id. Empty if unknown.
+	Client   string
+	Incoming bool
+
+	// Choked says whether this client chokes the peer, ChokedBy
+	// whether the peer chokes this client. Interested says whether
+	// the peer is interested in the pieces of this client,
+	// Interesting whether this client is interested in its pieces.
+	Choked      bool
+	ChokedBy    bool
+	Interested  bool
+	Interesting bool
+
+	// Downloaded and Uploaded are the bytes of the
+	// blocks received from and sent to the peer.
+	Downloaded int64
+	Uploaded   int64
+	// Pieces is the number of pieces the peer has.
+	Pieces int
+}
+
+// Flags returns the state of the peer in the
+// notation popularized by uTorrent:
+//
+//	D downloading from the peer
+//	d interested in the peer, but choked by it
+//	U uploading to the peer
+//	u the peer is interested, but choked
+//	K unchoked by the peer, but not interested
+//	? unchoked the peer, but it is not interested
+//	I incoming connection
+func (p *PeerInfo) Flags() string {
+	var b []byte
+	switch {
+	case p.Interesting && !p.ChokedBy:
+		b = append(b, 'D')
+	case p.Interesting:
+		b = append(b, 'd')
+	case !p.ChokedBy:
+		b = append(b, 'K')
+	}
+	switch {
+	case p.Interested && !p.Choked:
+		b = append(b, 'U')
+	case p.Interested:
+		b = append(b, 'u')
+	case !p.Choked:
+		b = append(b, '?')
+	}
+	if p.Incoming {
+		b = append(b, 'I')
+	}
+	return string(b)
+}
+
+// PeerStats counts the peers of a torrent by their state.
+type PeerStats struct {
+	Connected  int
+	Incoming   int
+	Outgoing   int
+	Dialing    int
+	Candidates int
+
+	// Unchoked are the peers this client uploads to,
+	// UnchokedBy the peers this client downloads from.
+	Unchoked   int
+	UnchokedBy int
+	// Interested are the peers interested in the pieces of this client,
+	// Interesting the peers having pieces this client is interested in.
+	Interested  int
+	Interesting int
+}
+
+// AnnounceStats are the results of the announces to the tracker.
+type AnnounceStats struct {
+	Succeeded int64
+	Failed    int64
+	// Last is the time of the last announce, zero if there was none.
+	Last time.Time
+	// LastPeers is the number of peers returned by the last
+	// successful announce, LastError the error of the last
+	// announce, if it failed.
+	LastPeers int
+	LastError string
+}
+
+// Announced records the result of an announce to the tracker.
+func (t *Tracker) Announced(resp *tracker.Response, err error) {
+	a := &announce{at: time.Now(), err: err}
+	if err != nil {
+		t.stats.announcesFailed.Add(1)
+	} else {
+		t.stats.announcesSucceeded.Add(1)
+		if resp != nil {
+			a.peers = len(resp.Peers)
+		}
+	}
+	t.stats.lastAnnounce.Store(a)
+}
+
+// Ratio returns the share ratio of the torrent, the bytes uploaded over
+// all sessions per byte downloaded. The pieces the client already had
+// count as downloaded, so that seeds have a ratio too.
+func (t *Tracker) Ratio() float64 {
+	downloaded := t.Downloaded.Load()
+	if downloaded == 0 {
+		return 0
+	}
+	return float64(t.Uploaded.Load()) / float64(downloaded)
+}
+
+// Stats returns a snapshot of the statistics of the torrent.
+func (t *Tracker) Stats() Stats {
+	have := t.BitField.ExistingPieces()
+	s := Stats{
+		InfoHash:       hex.EncodeToString(t.Torrent.Metadata.Hash[:]),
+		Name:           t.Torrent.Name(),
+		Size:           t.Torrent.BytesToDownload(),
+		Added:          t.added,
+		Downloaded:     t.Downloaded.Load(),
+		Uploaded:       t.Uploaded.Load(),
+		Ratio:          t.Ratio(),
+		DownloadRate:   t.download.rate.Load(),
+		UploadRate:     t.upload.rate.Load(),
+		Pieces:         t.Torrent.NumPieces(),
+		PiecesHave:     int64(len(have)),
+		PiecesVerified: t.stats.piecesVerified.Load(),
+		PiecesFailed:   t.stats.piecesFailed.Load(),
+		WastedBytes:    t.stats.wastedBytes.Load(),
+	}
+	s.Left = max(0, s.Size-s.Downloaded)
+
+	s.Have = make([]bool, s.Pieces)
+	for _, i := range have {
+		s.Have[i] = true
+	}
+	s.Availability = make([]int, s.Pieces)
+
+	s.Peers.Dialing = int(t.download.dialing.Load())
+	s.Peers.Candidates = len(t.pool.Candidates())
+	t.peers.Range(func(_, value any) bool {
+		p := value.(*peer.Peer)
+		if p.ConnectionStatus() != peer.ConnectionEstablished {
+			return true
+		}
+
+		info := PeerInfo{
+			Addr:        p.Addr,
+			ID:          p.Id,
+			Incoming:    !p.Outgoing(),
+			Choked:      p.Status.This.Load() == uint32(peer.Choked),
+			ChokedBy:    p.Status.Remote.Load() == uint32(peer.Choked),
+			Interested:  p.Interest.Remote.Load() == uint32(peer.Interested),
+			Interesting: p.Interest.This.Load() == uint32(peer.Interested),
+			Downloaded:  p.Downloaded(),
+			Uploaded:    p.Uploaded(),
+		}
+		if ext := p.RemoteExtensions(); ext != nil && ext.V != "" {
+			info.Client = ext.V
+		} else if c, ok := peerid.Parse(p.Id); ok {
+			info.Client = c.String()
+		}
+		if p.Bitfield != nil {
+			pieces := p.Bitfield.ExistingPieces()
+			info.Pieces = len(pieces)
+			for _, i := range pieces {
+				if int64(i) < s.Pieces {
+					s.Availability[i]++
+				}
+			}
+		}
+		s.Connections = append(s.Connections, info)
+
+		s.Peers.Connected++
+		if p.Outgoing() {
+			s.Peers.Outgoing++
+		} else {
+			s.Peers.Incoming++
+		}
+		if p.Status.This.Load() == uint32(peer.UnChoked) {
+			s.Peers.Unchoked++
+		}
+		if p.Status.Remote.Load() == uint32(peer.UnChoked) {
+			s.Peers.UnchokedBy++
+		}
+		if p.Interest.Remote.Load() == uint32(peer.Interested) {
+			s.Peers.Interested++
+		}
+		if p.Interest.This.Load() == uint32(peer.Interested) {
+			s.Peers.Interesting++
+		}
+		return true
+	})
+
+	slices.SortFunc(s.Connections, func(a, b PeerInfo) int { return cmp.Compare(a.Addr, b.Addr) })
+
+	s.Announces.Succeeded = t.stats.announcesSucceeded.Load()
+	s.Announces.Failed = t.stats.announcesFailed.Load()
+	if a := t.stats.lastAnnounce.Load(); a != nil {
+		s.Announces.Last = a.at
+		s.Announces.LastPeers = a.peers
+		if a.err != nil {
+			s.Announces.LastError = a.err.Error()
+		}
+	}
+	return s
+}
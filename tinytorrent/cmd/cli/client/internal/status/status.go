@@ -1,6 +1,7 @@
 package status
 
 import (
+	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -13,7 +14,11 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/connmgr"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/diskio"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/ipfilter"
 	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/peer"
 	"github.com/Despire/tinytorrent/p2p/peer/bitfield"
 	"github.com/Despire/tinytorrent/torrent"
 )
@@ -21,6 +26,7 @@ import (
 type timedDownloadRequest struct {
 	request  messagesv1.Request
 	send     time.Time
+	to       *peer.Peer
 	received bool
 }
 
@@ -41,6 +47,28 @@ type pendingPiece struct {
 	Received   []*messagesv1.Piece
 	Pending    []*messagesv1.Request
 	InFlight   []*timedDownloadRequest
+	// Resent are the offsets of the blocks requested again after
+	// a request for them timed out or its peer disconnected.
+	Resent map[uint32]bool
+	// From maps the offset of each received block
+	// to the address of the peer that sent it.
+	From map[uint32]string
+	// Failed are the blocks of a previous attempt that failed
+	// the hash check, compared against the verified piece to
+	// find the peers that sent corrupt blocks.
+	Failed []failedBlock
+	// Exclusive is set after a hash failure, all remaining blocks
+	// are then requested from this single peer only.
+	Exclusive string
+	// SinglePeer says whether the piece is downloaded from a single
+	// peer, as it failed the hash check in a previous attempt.
+	SinglePeer bool
+}
+
+type failedBlock struct {
+	Begin  uint32
+	Digest [sha1.Size]byte
+	From   string
 }
 
 func (p *pendingPiece) Retry() error {
@@ -57,23 +85,22 @@ func (p *pendingPiece) Retry() error {
 	}
 	p.InFlight = nil
 	p.Received = nil
+	p.From = nil
+	p.Resent = nil
 	p.Downloaded = 0
 	return nil
 }
 
-type peers struct {
-	seeders  sync.Map
-	leechers sync.Map
-}
-
 // How often the rate of bytes downloaded is updated.
 const rateTick = 1 * time.Second
 
 type Download struct {
 	// Requests are the number of pieces concurrently
 	// downloaded. No more than len(requests) pieces
-	// are downloaded at a time.
-	requests [4]atomic.Pointer[pendingPiece]
+	// are downloaded at a time, new pieces are only
+	// started once the peers have capacity for more
+	// requests.
+	requests [16]atomic.Pointer[pendingPiece]
 	// The wait group is used when spawning download related goroutines.
 	wg sync.WaitGroup
 	// Download related signaling. When the torrent
@@ -85,6 +112,8 @@ type Download struct {
 	cancel, completed chan struct{}
 	// Rate is the number of bytes downloaded for the last 1 seconds.
 	rate atomic.Int64
+	// Dialing is the number of peer connections being established.
+	dialing atomic.Int32
 }
 
 type Upload struct {
@@ -107,9 +136,39 @@ type Tracker struct {
 	clientID string
 	logger   *slog.Logger
 
-	// Peers are the seeders and leechers that are known
-	// to this torrent tracker.
-	peers peers
+	// peerOpts are applied to every peer connection.
+	peerOpts []peer.Option
+
+	// Peers are the connected peers keyed by their address. Every
+	// peer session both downloads from and uploads to the peer.
+	peers sync.Map
+	// peersMu makes checking for a duplicate peer id
+	// and adding the peer to the peers atomic.
+	peersMu sync.Mutex
+	// The wait group is used when spawning goroutines that
+	// live as long as the peer connections.
+	wg sync.WaitGroup
+	// closed is set once the tracker waits for the goroutines
+	// of the wait group, after which no more are spawned.
+	closedL sync.Mutex
+	closed  bool
+
+	// pool are the candidates to download pieces from,
+	// of which at most maxConnections are connected.
+	pool           *connmgr.Pool
+	maxConnections int
+	// limiter, bans and filter are shared with all torrents.
+	limiter *connmgr.Limiter
+	bans    *connmgr.BanList
+	filter  *ipfilter.Filter
+	// blockedClients are the lower-cased names of the
+	// client software whose peers are refused.
+	blockedClients []string
+
+	// files are the paths of the files to download and wanted the pieces
+	// holding their data, nil if the whole torrent is downloaded.
+	files  []string
+	wanted *bitfield.BitField
 
 	// download wraps all download related information.
 	download Download
@@ -117,6 +176,28 @@ type Tracker struct {
 	// upload wraps all upload related information.
 	upload Upload
 
+	// disk verifies, writes and reads the pieces.
+	disk *diskio.Pool
+
+	// stats are the counters reported by Stats.
+	stats counters
+
+	// added is when the torrent was first worked on, restored
+	// with the rest of the state of a previous session, if any.
+	added    time.Time
+	restored *State
+
+	// superSeed reveals the pieces to the peers
+	// while super seeding, nil otherwise.
+	superSeed atomic.Pointer[superSeeder]
+
+	// pexSent are the peers exchanged with each peer, only
+	// accessed from maintainPeers. relays map the addresses
+	// of the peers supporting holepunching to the address of
+	// the peer that exchanged them.
+	pexSent map[string]*pexState
+	relays  sync.Map
+
 	// Stop channel indicates the application was shutdown
 	// By closing this channel all workflows will finish
 	// and the tracker will no longer do any work.
@@ -129,7 +210,7 @@ type Tracker struct {
 	DownloadDir string
 }
 
-func NewTracker(clientID string, logger *slog.Logger, t *torrent.MetaInfoFile, downloadDir string) (*Tracker, error) {
+func NewTracker(clientID string, logger *slog.Logger, t *torrent.MetaInfoFile, downloadDir string, opts ...Option) (*Tracker, error) {
 	tr := Tracker{
 		clientID:    clientID,
 		logger:      logger.With(slog.String("url", t.Announce), slog.String("infoHash", string(t.Metadata.Hash[:]))),
@@ -139,6 +220,18 @@ func NewTracker(clientID string, logger *slog.Logger, t *torrent.MetaInfoFile, d
 		Uploaded:    atomic.Int64{},
 		Downloaded:  atomic.Int64{},
 		DownloadDir: path.Join(downloadDir, hex.EncodeToString(t.Info.Metadata.Hash[:])),
+
+		pool:           connmgr.NewPool(),
+		maxConnections: DefaultMaxConnections,
+		added:          time.Now(),
+	}
+
+	for _, o := range opts {
+		o(&tr)
+	}
+
+	if err := tr.selectPieces(); err != nil {
+		return nil, err
 	}
 
 	tr.download.cancel = make(chan struct{})
@@ -164,20 +257,49 @@ func NewTracker(clientID string, logger *slog.Logger, t *torrent.MetaInfoFile, d
 		}
 	}
 
+	tr.disk = diskio.New(tr.DownloadDir)
+
 	tr.download.wg.Add(1)
 	go tr.downloadScheduler()
 
+	tr.download.wg.Add(1)
+	go tr.manageConnections()
+
+	tr.wg.Add(1)
+	go tr.maintainPeers()
+
 	tr.upload.wg.Add(1)
 	go tr.processUploadRequests()
 
 	tr.upload.wg.Add(1)
 	go tr.optimisticUnchoke()
 
+	if tr.restored != nil {
+		tr.restoreState(tr.restored)
+	}
+
 	return &tr, nil
 }
 
 func (t *Tracker) Close() error {
+	close(t.stop)
+	t.download.wg.Wait()
+	t.upload.wg.Wait()
+	t.closedL.Lock()
+	t.closed = true
+	t.closedL.Unlock()
+	t.wg.Wait()
+
+	// pieces still being verified are written and
+	// recorded in the bitfield before it is saved.
+	t.disk.Close()
+
+	// saving the state also creates the download
+	// directory if no piece was downloaded yet.
 	var errAll error
+	if err := t.SaveState(); err != nil {
+		errAll = errors.Join(errAll, err)
+	}
 	b, err := os.Create(filepath.Join(t.DownloadDir, "bitfield.bin"))
 	if err != nil {
 		errAll = errors.Join(errAll, fmt.Errorf("failed creating bitfiled file: %w", err))
@@ -189,45 +311,19 @@ func (t *Tracker) Close() error {
 			errAll = errors.Join(errAll, fmt.Errorf("failed to close bitfield file: %w", err))
 		}
 	}
-	close(t.stop)
-	t.download.wg.Wait()
-	t.upload.wg.Wait()
-	return nil
+	return errAll
 }
 
 func (t *Tracker) Flush(idx uint32, pieceBytes []byte) error {
-	if _, err := os.Stat(t.DownloadDir); errors.Is(err, os.ErrNotExist) {
-		if err := os.Mkdir(t.DownloadDir, os.ModePerm); err != nil {
-			return err
-		}
-	}
-
-	f, err := os.Create(filepath.Join(t.DownloadDir, fmt.Sprintf("%v.bin", idx)))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	return binary.Write(f, binary.LittleEndian, pieceBytes)
+	return t.disk.Write(idx, pieceBytes)
 }
 
 func (t *Tracker) ReadRequest(req *messagesv1.Request) ([]byte, error) {
-	if _, err := os.Stat(t.DownloadDir); errors.Is(err, os.ErrNotExist) {
-		return nil, fmt.Errorf("cannot construct request: %w", err)
-	}
-
-	b, err := os.ReadFile(filepath.Join(t.DownloadDir, fmt.Sprintf("%v.bin", req.Index)))
-	if err != nil {
-		return nil, err
-	}
-
-	if int(req.Begin) >= len(b) {
-		return nil, fmt.Errorf("invalid request, offset within piece larger than piece size")
-	}
-
-	if l := len(b) - int(req.Begin); int(req.Length) > l {
-		return nil, fmt.Errorf("invalid request, offset + length tries to request larger block than possible")
-	}
+	return t.disk.Read(req.Index, req.Begin, req.Length)
+}
 
-	return b[int(req.Begin):(int(req.Begin + req.Length))], nil
+// OpenRequest opens the piece of the request for sending the
+// block straight from the file. The caller closes the file.
+func (t *Tracker) OpenRequest(req *messagesv1.Request) (*os.File, error) {
+	return t.disk.Open(req.Index, req.Begin, req.Length)
 }
@@ -1,11 +1,29 @@
 package status
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/connmgr"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/diskio"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/ipfilter"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/tracker"
 	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/peer"
+	"github.com/Despire/tinytorrent/p2p/peer/bitfield"
+	"github.com/Despire/tinytorrent/torrent"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTracker_FlushRead(t *testing.T) {
@@ -17,7 +35,8 @@ func TestTracker_FlushRead(t *testing.T) {
 		os.RemoveAll(downloadDir)
 	})
 
-	tr := &Tracker{DownloadDir: downloadDir}
+	tr := &Tracker{DownloadDir: downloadDir, disk: diskio.New(downloadDir)}
+	defer tr.disk.Close()
 
 	err = tr.Flush(0, []byte{0x0, 0x1})
 	assert.Nil(t, err)
@@ -90,3 +109,325 @@ func TestTracker_FlushRead(t *testing.T) {
 	})
 	assert.NotNil(t, err)
 }
+
+func TestTracker_Admit(t *testing.T) {
+	tr := &Tracker{clientID: "self"}
+
+	tr.peers.Store("10.0.0.1:1", &peer.Peer{Id: "other"})
+
+	assert.ErrorIs(t, tr.admit("self", "10.0.0.2:1"), ErrSelfConnection)
+	assert.ErrorIs(t, tr.admit("other", "10.0.0.2:1"), ErrDuplicatePeer)
+	assert.Nil(t, tr.admit("new", "10.0.0.2:1"))
+
+	tr.bans = connmgr.NewBanList()
+	tr.bans.Ban("10.0.0.2:1")
+	assert.ErrorIs(t, tr.admit("new", "10.0.0.2:2"), ErrBannedPeer)
+
+	tr.filter = ipfilter.New([]ipfilter.Range{{
+		First:  netip.MustParseAddr("10.0.1.0"),
+		Last:   netip.MustParseAddr("10.0.1.255"),
+		Reason: "production",
+	}})
+	err := tr.admit("new", "10.0.1.7:1")
+	assert.ErrorIs(t, err, ErrFilteredPeer)
+	assert.ErrorContains(t, err, "production")
+	assert.Nil(t, tr.admit("new", "10.0.2.7:1"))
+
+	WithBlockedClients("Xunlei")(tr)
+	err = tr.admit("-XL0012-abcdefghijkl", "10.0.2.7:1")
+	assert.ErrorIs(t, err, ErrBlockedClient)
+	assert.ErrorContains(t, err, "Xunlei 0.0.1.2")
+	assert.Nil(t, tr.admit("-qB4630-abcdefghijkl", "10.0.2.7:1"))
+}
+
+func TestTracker_AddPeer(t *testing.T) {
+	tr := &Tracker{clientID: "self", maxConnections: 2}
+	tr.peers.Store("10.0.0.1:1", &peer.Peer{Id: "other"})
+
+	// a peer with the same id connected while the handshake was made.
+	assert.ErrorIs(t, tr.addPeer(slog.Default(), "10.0.0.2:1", &peer.Peer{Id: "other"}), ErrDuplicatePeer)
+	_, ok := tr.peers.Load("10.0.0.2:1")
+	assert.False(t, ok)
+	assert.NoError(t, tr.addPeer(slog.Default(), "10.0.0.2:1", &peer.Peer{Id: "new"}))
+
+	// the torrent is connected to as many peers as allowed,
+	// only the peer at the same address is replaced.
+	assert.ErrorIs(t, tr.addPeer(slog.Default(), "10.0.0.3:1", &peer.Peer{Id: "third"}), ErrTooManyPeers)
+	assert.NoError(t, tr.addPeer(slog.Default(), "10.0.0.2:1", &peer.Peer{Id: "third"}))
+}
+
+// barrierConn holds back its first write until all
+// the connections sharing the barrier are written to.
+type barrierConn struct {
+	net.Conn
+	once    sync.Once
+	barrier *sync.WaitGroup
+}
+
+func (c *barrierConn) Write(b []byte) (int, error) {
+	c.once.Do(func() { c.barrier.Done(); c.barrier.Wait() })
+	return c.Conn.Write(b)
+}
+
+func TestTracker_AddPeerConcurrent(t *testing.T) {
+	const maxConns, incoming = 3, 10
+
+	tr, mf, _ := seedTracker(t, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tr.maxConnections = maxConns
+	limiter := connmgr.NewLimiter(incoming, incoming)
+	tr.limiter = limiter
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// all the handshakes are made at the same time.
+	var barrier sync.WaitGroup
+	barrier.Add(incoming)
+
+	var conns []net.Conn
+	for range incoming {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		go io.Copy(io.Discard, c)
+
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		conns = append(conns, &barrierConn{Conn: conn, barrier: &barrier})
+	}
+
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := &messagesv1.Handshake{InfoHash: string(mf.Metadata.Hash[:]), PeerID: fmt.Sprintf("%020d", i)}
+			if err := tr.AddPeer(h, conn); err != nil {
+				assert.ErrorIs(t, err, ErrTooManyPeers)
+				conn.Close()
+				return
+			}
+			added.Add(1)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(maxConns), added.Load())
+	assert.Equal(t, maxConns, tr.peerCount())
+	established, _ := limiter.Connections()
+	assert.Equal(t, maxConns, established)
+}
+
+func TestRefused(t *testing.T) {
+	assert.True(t, refused(ErrSelfConnection))
+	assert.True(t, refused(fmt.Errorf("%w: production", ErrFilteredPeer)))
+	assert.True(t, refused(ErrBannedPeer))
+	assert.False(t, refused(ErrDuplicatePeer))
+}
+
+func TestTracker_LateBlock(t *testing.T) {
+	tr := &Tracker{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	a, b := &peer.Peer{Id: "a"}, &peer.Peer{Id: "b"}
+	req := messagesv1.Request{Index: 0, Begin: 0, Length: messagesv1.RequestSize}
+
+	// the request to a times out and is requested again from b.
+	a.RequestSent()
+	piece := &pendingPiece{InFlight: []*timedDownloadRequest{{request: req, send: time.Now().Add(-time.Minute), to: a}}}
+	tr.requeueTimedOut(piece)
+	assert.Empty(t, piece.InFlight)
+	assert.Equal(t, []*messagesv1.Request{&req}, piece.Pending)
+	assert.Zero(t, a.Outstanding())
+
+	b.RequestSent()
+	piece.Pending = nil
+	piece.InFlight = append(piece.InFlight, &timedDownloadRequest{request: req, send: time.Now(), to: b})
+
+	// the late block of a answers the request, the one to b is dropped.
+	tr.blockReceived(tr.logger, piece, piece.InFlight[0], a, int(req.Length))
+	assert.True(t, piece.InFlight[0].received)
+	assert.Zero(t, b.Outstanding())
+
+	// the block of b is then ignored.
+	tr.blockReceived(tr.logger, piece, piece.InFlight[0], b, int(req.Length))
+	assert.Zero(t, b.Outstanding())
+	assert.Equal(t, peer.InitialRequestTimeout, b.RequestTimeout())
+
+	// the round trip time of a block requested again is not sampled.
+	c := &peer.Peer{Id: "c"}
+	c.RequestSent()
+	piece.InFlight = []*timedDownloadRequest{{request: req, send: time.Now().Add(-30 * time.Second), to: c}}
+	tr.blockReceived(tr.logger, piece, piece.InFlight[0], c, int(req.Length))
+	assert.Zero(t, c.Outstanding())
+	assert.Equal(t, peer.InitialRequestTimeout, c.RequestTimeout())
+
+	// the blocks are sampled again once the piece is retried.
+	require.NoError(t, piece.Retry())
+	assert.Nil(t, piece.Resent)
+}
+
+func TestTracker_DropBannedClosed(t *testing.T) {
+	tr := &Tracker{pool: connmgr.NewPool(), bans: connmgr.NewBanList(), closed: true}
+	p := &peer.Peer{Id: "corrupt"}
+	tr.peers.Store("10.0.0.1:1", p)
+
+	// no goroutine is spawned once the tracker waits for them.
+	tr.bans.Corrupt("10.0.0.1:1", 10)
+	tr.dropBanned("10.0.0.1:1")
+	tr.wg.Wait()
+	v, ok := tr.peers.Load("10.0.0.1:1")
+	assert.True(t, ok)
+	assert.Same(t, p, v)
+}
+
+func TestUnproductive(t *testing.T) {
+	p := new(peer.Peer)
+	assert.True(t, unproductive(p, time.Now()))
+}
+
+func TestTracker_HashFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	newTracker := func() *Tracker {
+		return &Tracker{logger: logger, pool: connmgr.NewPool(), bans: connmgr.NewBanList()}
+	}
+
+	good := []byte("aaaabbbb")
+	corrupt := &messagesv1.Piece{Index: 0, Begin: 4, Block: []byte("xxxx")}
+
+	t.Run("multiple-contributors", func(t *testing.T) {
+		tr := newTracker()
+		piece := &pendingPiece{
+			Size:     8,
+			Received: []*messagesv1.Piece{{Index: 0, Begin: 0, Block: good[:4]}, corrupt},
+			From:     map[uint32]string{0: "10.0.0.1:1", 4: "10.0.0.2:1"},
+		}
+
+		tr.hashFailed(logger, piece)
+
+		// not proven yet which of them sent the corrupt block.
+		assert.True(t, piece.SinglePeer)
+		assert.Len(t, piece.Failed, 2)
+		assert.False(t, tr.bans.Banned("10.0.0.1:1"))
+		assert.False(t, tr.bans.Banned("10.0.0.2:1"))
+
+		// re-downloaded from a single peer and verified.
+		piece.Received = []*messagesv1.Piece{{Index: 0, Begin: 0, Block: good[:4]}, {Index: 0, Begin: 4, Block: good[4:]}}
+		tr.verified(logger, piece, good)
+
+		assert.False(t, tr.bans.Banned("10.0.0.1:1"))
+		assert.True(t, tr.bans.Banned("10.0.0.2:9"))
+		assert.Equal(t, map[string]int64{"10.0.0.2": 4}, tr.bans.CorruptBytes())
+		assert.Empty(t, piece.Failed)
+	})
+
+	t.Run("single-contributor", func(t *testing.T) {
+		tr := newTracker()
+		piece := &pendingPiece{
+			Size:     8,
+			Received: []*messagesv1.Piece{{Index: 0, Begin: 0, Block: good[:4]}, corrupt},
+			From:     map[uint32]string{0: "10.0.0.3:1", 4: "10.0.0.3:1"},
+		}
+
+		tr.hashFailed(logger, piece)
+
+		assert.True(t, tr.bans.Banned("10.0.0.3:1"))
+		assert.Equal(t, map[string]int64{"10.0.0.3": 8}, tr.bans.CorruptBytes())
+		assert.Empty(t, piece.Failed)
+	})
+
+	t.Run("suspected-too-often", func(t *testing.T) {
+		tr := newTracker()
+		for range connmgr.MaxSuspicions {
+			piece := &pendingPiece{
+				Size:     8,
+				Received: []*messagesv1.Piece{{Index: 0, Begin: 0, Block: good[:4]}, corrupt},
+				From:     map[uint32]string{0: "10.0.0.4:1", 4: "10.0.0.5:1"},
+			}
+			tr.hashFailed(logger, piece)
+		}
+
+		assert.True(t, tr.bans.Banned("10.0.0.4:1"))
+		assert.True(t, tr.bans.Banned("10.0.0.5:1"))
+		assert.Empty(t, tr.bans.CorruptBytes())
+	})
+}
+
+func TestTracker_Stats(t *testing.T) {
+	mf := &torrent.MetaInfoFile{Info: torrent.Info{
+		InfoSingleFile: &torrent.InfoSingleFile{Name: "file", Length: 30},
+		PieceLength:    10,
+		Pieces:         strings.Repeat("00", 3*20),
+	}}
+	tr := &Tracker{Torrent: mf, BitField: bitfield.NewBitfield(mf.NumPieces()), pool: connmgr.NewPool()}
+
+	tr.BitField.Set(1)
+	tr.Downloaded.Store(10)
+	tr.Uploaded.Store(25)
+	tr.stats.piecesVerified.Add(1)
+	tr.stats.piecesFailed.Add(1)
+	tr.stats.wastedBytes.Add(10)
+	tr.pool.Add("10.0.0.1:1", connmgr.Tracker)
+
+	tr.Announced(nil, errors.New("timeout"))
+	s := tr.Stats()
+	assert.Equal(t, "file", s.Name)
+	assert.Equal(t, int64(20), s.Left)
+	assert.Equal(t, 2.5, s.Ratio)
+	assert.Equal(t, int64(3), s.Pieces)
+	assert.Equal(t, int64(1), s.PiecesHave)
+	assert.Equal(t, int64(1), s.PiecesVerified)
+	assert.Equal(t, int64(1), s.PiecesFailed)
+	assert.Equal(t, int64(10), s.WastedBytes)
+	assert.Equal(t, 1, s.Peers.Candidates)
+	assert.Equal(t, int64(1), s.Announces.Failed)
+	assert.Equal(t, "timeout", s.Announces.LastError)
+
+	resp := new(tracker.Response)
+	resp.Peers = make([]struct {
+		PeerID string
+		IP     string
+		Port   int64
+	}, 2)
+	tr.Announced(resp, nil)
+	s = tr.Stats()
+	assert.Equal(t, int64(1), s.Announces.Succeeded)
+	assert.Equal(t, 2, s.Announces.LastPeers)
+	assert.Empty(t, s.Announces.LastError)
+}
+
+func TestTracker_State(t *testing.T) {
+	mf := &torrent.MetaInfoFile{Info: torrent.Info{
+		InfoSingleFile: &torrent.InfoSingleFile{Name: "file", Length: 30},
+		PieceLength:    10,
+		Pieces:         strings.Repeat("00", 3*20),
+	}}
+	mf.Metadata.Hash = [20]byte{2}
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tr, err := NewTracker(strings.Repeat("r", 20), logger, mf, dir)
+	require.NoError(t, err)
+	_, err = ReadState(tr.DownloadDir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	added := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tr.Close()
+	tr, err = NewTracker(strings.Repeat("r", 20), logger, mf, dir, WithState(&State{
+		Added:    added,
+		Uploaded: 100,
+		Peers:    []string{"127.0.0.1:1"},
+	}))
+	require.NoError(t, err)
+	tr.Uploaded.Add(5)
+	assert.Equal(t, added, tr.Stats().Added)
+	require.NoError(t, tr.Close())
+
+	s, err := ReadState(tr.DownloadDir)
+	require.NoError(t, err)
+	assert.True(t, added.Equal(s.Added))
+	assert.Equal(t, int64(105), s.Uploaded)
+	assert.Equal(t, []string{"127.0.0.1:1"}, s.Peers)
+	assert.False(t, s.SuperSeeding)
+}
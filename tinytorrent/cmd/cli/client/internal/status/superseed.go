@@ -0,0 +1,258 @@
+package status
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/peer"
+)
+
+// ErrNotSeeding is returned when super seeding
+// is enabled for an incomplete torrent.
+var ErrNotSeeding = errors.New("super seeding requires the complete torrent")
+
+// superSeeder decides which pieces are revealed to which peers in the
+// super seeding mode. Every peer is offered a single piece at a time,
+// the next one only after the offered piece was seen at another peer,
+// so that the pieces uploaded by the seeder spread through the swarm.
+// BEP16: https://www.bittorrent.org/beps/bep_0016.html
+type superSeeder struct {
+	l sync.Mutex
+	// offers are the pieces offered to each peer.
+	offers map[string]*offer
+	// spread is the number of peers that were
+	// offered or were seen having each piece.
+	spread []int
+}
+
+type offer struct {
+	// pieces are all the pieces offered to the peer,
+	// the last being the one currently offered.
+	pieces []uint32
+	// announced says whether the peer announced
+	// to have completed the current piece.
+	announced bool
+}
+
+func newSuperSeeder(pieces int64) *superSeeder {
+	return &superSeeder{
+		offers: make(map[string]*offer),
+		spread: make([]int, pieces),
+	}
+}
+
+// offer picks the least spread piece the peer doesn't have and records
+// it as offered to the peer, false is returned if there is none.
+func (s *superSeeder) offer(addr string, has func(index uint32) bool) (uint32, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	best := -1
+	for i, n := range s.spread {
+		if has(uint32(i)) {
+			continue
+		}
+		if best < 0 || n < s.spread[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+
+	o, ok := s.offers[addr]
+	if !ok {
+		o = new(offer)
+		s.offers[addr] = o
+	}
+	o.pieces = append(o.pieces, uint32(best))
+	o.announced = false
+	s.spread[best]++
+	return uint32(best), true
+}
+
+// current returns the piece currently offered to the peer and whether
+// the peer announced to have completed it.
+func (s *superSeeder) current(addr string) (index uint32, announced, ok bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	o, ok := s.offers[addr]
+	if !ok || len(o.pieces) == 0 {
+		return 0, false, false
+	}
+	return o.pieces[len(o.pieces)-1], o.announced, true
+}
+
+// allowed reports whether the piece was offered to the peer,
+// only the offered pieces are uploaded.
+func (s *superSeeder) allowed(addr string, index uint32) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	o, ok := s.offers[addr]
+	if !ok {
+		return false
+	}
+	for _, p := range o.pieces {
+		if p == index {
+			return true
+		}
+	}
+	return false
+}
+
+// have records that the peer announced to have the piece and returns the
+// peers that are to be offered a new piece. These are the other peers the
+// piece was offered to, as it has propagated, and the peer itself if the
+// piece was offered to it and no other peer lacks the piece.
+func (s *superSeeder) have(addr string, index uint32, othersLack bool) []string {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.spread[index]++
+
+	var next []string
+	for a, o := range s.offers {
+		if len(o.pieces) == 0 || o.pieces[len(o.pieces)-1] != index {
+			continue
+		}
+		if a != addr {
+			next = append(next, a)
+			continue
+		}
+		o.announced = true
+		if !othersLack {
+			next = append(next, a)
+		}
+	}
+	slices.Sort(next)
+	return next
+}
+
+// remove forgets the pieces offered to the peer.
+func (s *superSeeder) remove(addr string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	delete(s.offers, addr)
+}
+
+// SetSuperSeeding switches the super seeding mode of the torrent, which
+// reveals the pieces to the peers one by one instead of announcing all of
+// them, reducing the data uploaded by the only seeder of a swarm. Only
+// complete torrents can be super seeded. Once switched off the peers are
+// told about all the pieces they were not offered.
+func (t *Tracker) SetSuperSeeding(on bool) error {
+	if !on {
+		s := t.superSeed.Swap(nil)
+		if s == nil {
+			return nil
+		}
+		t.logger.Info("stopped super seeding")
+		t.peers.Range(func(_, value any) bool {
+			t.announceAll(value.(*peer.Peer))
+			return true
+		})
+		return nil
+	}
+
+	if int64(len(t.BitField.ExistingPieces())) != t.Torrent.NumPieces() {
+		return ErrNotSeeding
+	}
+	if !t.superSeed.CompareAndSwap(nil, newSuperSeeder(t.Torrent.NumPieces())) {
+		return nil
+	}
+	t.logger.Info("started super seeding")
+
+	// the connected peers already know about all pieces,
+	// from now on only the offered pieces are uploaded.
+	t.peers.Range(func(_, value any) bool {
+		t.offerPiece(value.(*peer.Peer))
+		return true
+	})
+	return nil
+}
+
+// SuperSeeding reports whether the torrent is super seeded.
+func (t *Tracker) SuperSeeding() bool { return t.superSeed.Load() != nil }
+
+// offerPiece reveals the next piece to the peer.
+func (t *Tracker) offerPiece(p *peer.Peer) {
+	s := t.superSeed.Load()
+	if s == nil || p.ConnectionStatus() != peer.ConnectionEstablished {
+		return
+	}
+
+	index, ok := s.offer(p.Addr, p.Bitfield.Check)
+	if !ok {
+		return
+	}
+	if err := p.SendHave(&messagesv1.Have{Index: index}); err != nil {
+		t.logger.Debug("failed to offer piece", slog.String("peer_ip", p.Addr), slog.Any("err", err))
+		return
+	}
+	t.logger.Debug("offered piece", slog.String("peer_ip", p.Addr), slog.Any("piece", index))
+}
+
+// peerHas is notified of the pieces the peers complete, which
+// reveals new pieces to the peers while super seeding.
+func (t *Tracker) peerHas(from *peer.Peer, index uint32) {
+	s := t.superSeed.Load()
+	if s == nil {
+		return
+	}
+
+	othersLack := false
+	t.peers.Range(func(_, value any) bool {
+		p := value.(*peer.Peer)
+		if p != from && p.ConnectionStatus() == peer.ConnectionEstablished && !p.Bitfield.Check(index) {
+			othersLack = true
+			return false
+		}
+		return true
+	})
+
+	for _, addr := range s.have(from.Addr, index, othersLack) {
+		if p, ok := t.peers.Load(addr); ok {
+			t.offerPiece(p.(*peer.Peer))
+		}
+	}
+}
+
+// refreshOffers offers a new piece to the peers that already
+// had the offered piece, which is only known once their
+// bitfield was received after the piece was offered.
+func (t *Tracker) refreshOffers() {
+	s := t.superSeed.Load()
+	if s == nil {
+		return
+	}
+	t.peers.Range(func(_, value any) bool {
+		p := value.(*peer.Peer)
+		index, announced, ok := s.current(p.Addr)
+		if !ok || (!announced && p.Bitfield.Check(index)) {
+			t.offerPiece(p)
+		}
+		return true
+	})
+}
+
+// announceAll tells the peer about all the pieces
+// it doesn't have, after super seeding was switched off.
+func (t *Tracker) announceAll(p *peer.Peer) {
+	if p.ConnectionStatus() != peer.ConnectionEstablished {
+		return
+	}
+	for _, i := range t.BitField.ExistingPieces() {
+		if p.Bitfield.Check(i) {
+			continue
+		}
+		if err := p.SendHave(&messagesv1.Have{Index: i}); err != nil {
+			t.logger.Debug("failed to announce piece", slog.String("peer_ip", p.Addr), slog.Any("err", err))
+			return
+		}
+	}
+}
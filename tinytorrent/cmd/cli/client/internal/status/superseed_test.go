@@ -0,0 +1,180 @@
+package status
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/Despire/tinytorrent/p2p/peer/bitfield"
+	"github.com/Despire/tinytorrent/torrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// swarm simulates a seeder and leechers that download a piece per round
+// from a random peer having a piece they lack, as the download scheduler
+// does, and returns the number of pieces uploaded by the seeder until all
+// leechers completed.
+func swarm(t *testing.T, pieces, leechers int, super bool) int {
+	t.Helper()
+
+	r := rand.New(rand.NewPCG(1, 2))
+	have := make([][]bool, leechers)
+	for i := range have {
+		have[i] = make([]bool, pieces)
+	}
+	addr := func(i int) string { return fmt.Sprintf("10.0.0.%d:1", i) }
+	index := make(map[string]int)
+	for i := range leechers {
+		index[addr(i)] = i
+	}
+	complete := func(i int) bool {
+		for _, h := range have[i] {
+			if !h {
+				return false
+			}
+		}
+		return true
+	}
+
+	s := newSuperSeeder(int64(pieces))
+	offer := func(i int) {
+		s.offer(addr(i), func(index uint32) bool { return have[i][index] })
+	}
+	if super {
+		for i := range leechers {
+			offer(i)
+		}
+	}
+
+	uploaded := 0
+	for round := 0; ; round++ {
+		require.Less(t, round, 100*pieces, "swarm did not complete")
+
+		type download struct{ leecher, piece int }
+		var downloads []download
+		for i := range leechers {
+			// the missing pieces and their sources, -1 being the seeder.
+			var missing []int
+			sources := make(map[int][]int)
+			for piece := range pieces {
+				if have[i][piece] {
+					continue
+				}
+				if !super || s.allowed(addr(i), uint32(piece)) {
+					sources[piece] = append(sources[piece], -1)
+				}
+				for j := range leechers {
+					if j != i && have[j][piece] {
+						sources[piece] = append(sources[piece], j)
+					}
+				}
+				if len(sources[piece]) > 0 {
+					missing = append(missing, piece)
+				}
+			}
+			if len(missing) == 0 {
+				continue
+			}
+			piece := missing[r.IntN(len(missing))]
+			if from := sources[piece]; from[r.IntN(len(from))] == -1 {
+				uploaded++
+			}
+			downloads = append(downloads, download{leecher: i, piece: piece})
+		}
+		if len(downloads) == 0 {
+			break
+		}
+
+		for _, d := range downloads {
+			have[d.leecher][d.piece] = true
+		}
+		if !super {
+			continue
+		}
+		for _, d := range downloads {
+			othersLack := false
+			for j := range leechers {
+				othersLack = othersLack || (j != d.leecher && !have[j][d.piece])
+			}
+			for _, next := range s.have(addr(d.leecher), uint32(d.piece), othersLack) {
+				offer(index[next])
+			}
+		}
+	}
+
+	for i := range leechers {
+		require.True(t, complete(i), "leecher %d", i)
+	}
+	return uploaded
+}
+
+func TestSuperSeeder_Swarm(t *testing.T) {
+	const pieces, leechers = 64, 8
+
+	normal := swarm(t, pieces, leechers, false)
+	super := swarm(t, pieces, leechers, true)
+
+	// while super seeding every piece is uploaded
+	// about once and then spread by the leechers.
+	assert.Less(t, super, normal)
+	assert.LessOrEqual(t, super, pieces+2*leechers)
+	t.Logf("seeder uploaded %d pieces, %d while super seeding", normal, super)
+}
+
+func TestSuperSeeder(t *testing.T) {
+	s := newSuperSeeder(3)
+	none := func(uint32) bool { return false }
+
+	a, ok := s.offer("a", none)
+	require.True(t, ok)
+	b, ok := s.offer("b", none)
+	require.True(t, ok)
+	assert.NotEqual(t, a, b)
+
+	assert.True(t, s.allowed("a", a))
+	assert.False(t, s.allowed("a", b))
+	assert.False(t, s.allowed("c", a))
+
+	// b completing its piece is not enough as a lacks it.
+	assert.Empty(t, s.have("b", b, true))
+	_, announced, _ := s.current("b")
+	assert.True(t, announced)
+
+	// once a has the piece of b, b gets a new one.
+	assert.Equal(t, []string{"b"}, s.have("a", b, false))
+
+	_, ok = s.offer("c", func(uint32) bool { return true })
+	assert.False(t, ok)
+
+	s.remove("a")
+	assert.False(t, s.allowed("a", a))
+}
+
+func TestTracker_SetSuperSeeding(t *testing.T) {
+	mf := &torrent.MetaInfoFile{Info: torrent.Info{
+		InfoSingleFile: &torrent.InfoSingleFile{Name: "file", Length: 30},
+		PieceLength:    10,
+		Pieces:         strings.Repeat("00", 3*20),
+	}}
+	tr := &Tracker{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Torrent:  mf,
+		BitField: bitfield.NewBitfield(mf.NumPieces()),
+	}
+
+	assert.ErrorIs(t, tr.SetSuperSeeding(true), ErrNotSeeding)
+	assert.False(t, tr.SuperSeeding())
+
+	for i := range uint32(3) {
+		tr.BitField.Set(i)
+	}
+	assert.NoError(t, tr.SetSuperSeeding(true))
+	assert.True(t, tr.SuperSeeding())
+
+	assert.NoError(t, tr.SetSuperSeeding(false))
+	assert.False(t, tr.SuperSeeding())
+}
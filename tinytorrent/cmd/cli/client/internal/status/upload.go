@@ -3,7 +3,6 @@ package status
 import (
 	"fmt"
 	"log/slog"
-	"net"
 	"time"
 
 	"github.com/Despire/tinytorrent/p2p/messagesv1"
@@ -12,35 +11,6 @@ import (
 
 func (t *Tracker) CancelUpload() { close(t.upload.cancel); t.upload.wg.Wait() }
 
-func (t *Tracker) AddLeecher(id string, conn net.Conn) error {
-	np, err := peer.NewLeecherConnection(
-		t.logger,
-		id, conn.RemoteAddr().String(),
-		t.Torrent.NumPieces(),
-		conn,
-		string(t.Torrent.Metadata.Hash[:]), t.clientID,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to establish leecher connection")
-	}
-
-	t.peers.leechers.Delete(conn.RemoteAddr().String())
-	t.peers.leechers.Store(conn.RemoteAddr().String(), np)
-
-	if err := np.SendBitfield(t.BitField.Clone()); err != nil {
-		t.peers.leechers.Delete(conn.RemoteAddr().String())
-		return fmt.Errorf("failed to send bitfield: %w", err)
-	}
-
-	r, c := np.Requests()
-
-	t.upload.wg.Add(2)
-	go t.keepAliveLeechers(np)
-	go t.handleRequests(np, r, c)
-
-	return nil
-}
-
 func (t *Tracker) processUploadRequests() {
 	defer t.upload.wg.Done()
 	currentRate := int64(0)
@@ -64,27 +34,17 @@ func (t *Tracker) processUploadRequests() {
 				if req == nil {
 					continue
 				}
-				t.peers.leechers.Range(func(key, value any) bool {
+				t.peers.Range(func(key, value any) bool {
 					if key.(string) == req.addr {
 						p := value.(*peer.Peer)
 
-						b, err := t.ReadRequest(&req.request)
-						if err != nil {
-							t.upload.requests[i].CompareAndSwap(req, nil)
-							return false
-						}
-						err = p.SendPiece(&messagesv1.Piece{
-							Index: req.request.Index,
-							Begin: req.request.Begin,
-							Block: b,
-						})
-						if err != nil {
+						if err := t.sendPiece(p, &req.request); err != nil {
 							t.upload.requests[i].CompareAndSwap(req, nil)
 							return false
 						}
 						t.upload.requests[i].CompareAndSwap(req, nil)
 
-						newUpload := t.Uploaded.Add(int64(len(b)))
+						newUpload := t.Uploaded.Add(int64(req.request.Length))
 						t.logger.Debug("uploaded piece",
 							slog.String("piece", fmt.Sprint(req.request.Index)),
 							slog.String("uploaded_bytes", fmt.Sprint(newUpload)),
@@ -98,6 +58,30 @@ func (t *Tracker) processUploadRequests() {
 	}
 }
 
+// sendPiece answers the request, sending the block straight from
+// the piece file over plaintext TCP connections and from memory
+// over encrypted or uTP connections.
+func (t *Tracker) sendPiece(p *peer.Peer, req *messagesv1.Request) error {
+	if p.ZeroCopy() {
+		f, err := t.OpenRequest(req)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return p.SendPieceFile(req.Index, req.Begin, f, int64(req.Begin), int64(req.Length))
+	}
+
+	b, err := t.ReadRequest(req)
+	if err != nil {
+		return err
+	}
+	return p.SendPiece(&messagesv1.Piece{
+		Index: req.Index,
+		Begin: req.Begin,
+		Block: b,
+	})
+}
+
 func (t *Tracker) handleRequests(p *peer.Peer, requests <-chan *messagesv1.Request, cancels <-chan *messagesv1.Cancel) {
 	logger := t.logger.With(slog.String("peer_ip", p.Addr), slog.String("pid", p.Id))
 	for {
@@ -105,7 +89,7 @@ func (t *Tracker) handleRequests(p *peer.Peer, requests <-chan *messagesv1.Reque
 		case c, ok := <-cancels:
 			if !ok {
 				logger.Debug("shutting request handler, channel closed")
-				t.upload.wg.Done()
+				t.wg.Done()
 				return
 			}
 			for i := range t.upload.requests {
@@ -123,13 +107,16 @@ func (t *Tracker) handleRequests(p *peer.Peer, requests <-chan *messagesv1.Reque
 		case r, ok := <-requests:
 			if !ok {
 				logger.Debug("shutting request handler, channel closed")
-				t.upload.wg.Done()
+				t.wg.Done()
 				return
 			}
 
 			if !t.BitField.Check(r.Index) {
 				continue // we don't have the piece.
 			}
+			if s := t.superSeed.Load(); s != nil && !s.allowed(p.Addr, r.Index) {
+				continue // the piece was not offered to the peer.
+			}
 
 			timedUpload := &timedUploadRequest{
 				request: messagesv1.Request{
@@ -161,43 +148,6 @@ func (t *Tracker) handleRequests(p *peer.Peer, requests <-chan *messagesv1.Reque
 	}
 }
 
-func (t *Tracker) keepAliveLeechers(p *peer.Peer) {
-	logger := t.logger.With(slog.String("peer_ip", p.Addr), slog.String("pid", p.Id))
-
-	defer func() {
-		if err := p.Close(); err != nil {
-			logger.Error("failed to close peer", slog.Any("err", err))
-		}
-		t.peers.leechers.Delete(p.Addr)
-		t.upload.wg.Done()
-	}()
-
-	refresh := time.NewTicker(2 * time.Minute)
-	for {
-		select {
-		case <-t.stop:
-			logger.Debug("shutting down peer refresher, stopped tracker")
-			return
-		case <-t.upload.cancel:
-			logger.Debug("shutting down peer refresher, canceled upload")
-			return
-		case <-refresh.C:
-			refresh.Reset(2 * time.Minute)
-			switch s := p.ConnectionStatus(); s {
-			case peer.ConnectionKilled:
-				logger.Info("shutting down peer refresher, connection closed")
-				return
-			case peer.ConnectionEstablished:
-				logger.Info("sending keep alive event on torrent peer")
-				if err := p.SendKeepAlive(); err != nil {
-					logger.Error("failed to keep alive", slog.Any("err", err))
-					return
-				}
-			}
-		}
-	}
-}
-
 func (t *Tracker) optimisticUnchoke() {
 	defer t.upload.wg.Done()
 
@@ -212,8 +162,12 @@ func (t *Tracker) optimisticUnchoke() {
 			return
 		case <-unchoke.C:
 			// select random peer to unchoke
-			t.peers.leechers.Range(func(_, value any) bool {
+			t.peers.Range(func(_, value any) bool {
 				p := value.(*peer.Peer)
+				// peers that only upload don't request any pieces.
+				if p.UploadOnly() {
+					return true
+				}
 				if p.Status.This.Load() == uint32(peer.Choked) && p.Interest.Remote.Load() == uint32(peer.Interested) {
 					if err := p.SendUnchoke(); err != nil {
 						t.logger.Error("failed to unchoke peer", slog.String("end_peer", p.Addr))
@@ -0,0 +1,156 @@
+// Package swarm provides what end-to-end tests need to run a swarm of
+// clients on the local machine: a tracker, deterministic content to share
+// and seeds of it.
+package swarm
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/Despire/tinytorrent/p2p/peer/bitfield"
+	"github.com/Despire/tinytorrent/torrent"
+)
+
+// WriteContent writes the files with the sizes, keyed by their paths
+// relative to the directory, filled with bytes generated from the seed
+// so that the content is the same on every run.
+func WriteContent(dir string, seed uint64, files map[string]int64) error {
+	r := rand.New(rand.NewPCG(seed, seed))
+	// the files are generated in a fixed order as maps are unordered.
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	for _, path := range paths {
+		full := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(full), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create directory of %s: %w", path, err)
+		}
+		b := make([]byte, files[path])
+		for i := range b {
+			b[i] = byte(r.Uint32())
+		}
+		if err := os.WriteFile(full, b, 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Seed stores the content at path, the file or the directory the torrent
+// was created from, in the download directory of a client in the layout
+// of downloaded pieces, so that the client seeds the torrent.
+func Seed(downloadDir string, t *torrent.MetaInfoFile, path string) error {
+	dir := filepath.Join(downloadDir, hex.EncodeToString(t.Metadata.Hash[:]))
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create torrent directory: %w", err)
+	}
+
+	var readers []io.Reader
+	switch {
+	case t.InfoSingleFile != nil:
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	default:
+		for _, fi := range t.InfoMultiFile.Files {
+			if fi.IsPadding() || fi.IsSymlink() {
+				readers = append(readers, io.LimitReader(zeros{}, fi.Length))
+				continue
+			}
+			f, err := os.Open(filepath.Join(path, fi.Path))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			readers = append(readers, f)
+		}
+	}
+
+	content := io.MultiReader(readers...)
+	bf := bitfield.NewBitfield(t.NumPieces())
+	for i := range uint32(t.NumPieces()) {
+		piece := make([]byte, min(t.PieceLength, t.BytesToDownload()-int64(i)*t.PieceLength))
+		if _, err := io.ReadFull(content, piece); err != nil {
+			return fmt.Errorf("failed to read piece %d: %w", i, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%v.bin", i)), piece, 0o644); err != nil {
+			return fmt.Errorf("failed to write piece %d: %w", i, err)
+		}
+		bf.Set(i)
+	}
+
+	f, err := os.Create(filepath.Join(dir, "bitfield.bin"))
+	if err != nil {
+		return fmt.Errorf("failed to create bitfield: %w", err)
+	}
+	if err := binary.Write(f, binary.LittleEndian, bf.Clone()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write bitfield: %w", err)
+	}
+	return f.Close()
+}
+
+// Compare returns an error naming the files that differ
+// between the file or the directory at want and at got.
+func Compare(want, got string) error {
+	var errAll error
+	err := filepath.WalkDir(want, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(want, path)
+		if err != nil {
+			return err
+		}
+		wantSum, err := sum(path)
+		if err != nil {
+			return err
+		}
+		gotSum, err := sum(filepath.Join(got, rel))
+		if err != nil {
+			errAll = errors.Join(errAll, err)
+			return nil
+		}
+		if !bytes.Equal(wantSum, gotSum) {
+			errAll = errors.Join(errAll, fmt.Errorf("%s differs: sha1 %x, want %x", filepath.Join(got, rel), gotSum, wantSum))
+		}
+		return nil
+	})
+	return errors.Join(err, errAll)
+}
+
+func sum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return h.Sum(nil), nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,103 @@
+package swarm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tracker is an HTTP tracker handing out all the peers
+// that announced a torrent in the compact format.
+type Tracker struct {
+	interval time.Duration
+
+	l sync.Mutex
+	// peers are the addresses of the peers by
+	// their peer id by the info hash.
+	peers map[string]map[string]netip.AddrPort
+	// completed are the peers that announced the
+	// completed event by the info hash.
+	completed map[string]map[string]bool
+}
+
+// NewTracker returns a tracker asking the clients to announce
+// again after the interval, which is at least a second.
+func NewTracker(interval time.Duration) *Tracker {
+	return &Tracker{
+		interval:  max(interval, time.Second),
+		peers:     make(map[string]map[string]netip.AddrPort),
+		completed: make(map[string]map[string]bool),
+	}
+}
+
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	infoHash, peerID := q.Get("info_hash"), q.Get("peer_id")
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || len(infoHash) != 20 || peerID == "" {
+		failure(w, "invalid announce")
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		failure(w, "invalid remote address")
+		return
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		failure(w, "invalid remote address")
+		return
+	}
+
+	t.l.Lock()
+	if t.peers[infoHash] == nil {
+		t.peers[infoHash] = make(map[string]netip.AddrPort)
+		t.completed[infoHash] = make(map[string]bool)
+	}
+	switch q.Get("event") {
+	case "stopped":
+		delete(t.peers[infoHash], peerID)
+	case "completed":
+		t.completed[infoHash][peerID] = true
+		fallthrough
+	default:
+		t.peers[infoHash][peerID] = netip.AddrPortFrom(ip.Unmap(), uint16(port))
+	}
+
+	var compact []byte
+	for id, addr := range t.peers[infoHash] {
+		if id == peerID || !addr.Addr().Is4() {
+			continue
+		}
+		ip := addr.Addr().As4()
+		compact = append(compact, ip[:]...)
+		compact = binary.BigEndian.AppendUint16(compact, addr.Port())
+	}
+	t.l.Unlock()
+
+	fmt.Fprintf(w, "d8:intervali%de5:peers%d:%se", int(t.interval/time.Second), len(compact), compact)
+}
+
+// Peers returns the number of peers announced for the info hash.
+func (t *Tracker) Peers(infoHash string) int {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return len(t.peers[infoHash])
+}
+
+// Completed returns the number of peers that announced
+// having completed the download of the info hash.
+func (t *Tracker) Completed(infoHash string) int {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return len(t.completed[infoHash])
+}
+
+func failure(w http.ResponseWriter, reason string) {
+	fmt.Fprintf(w, "d14:failure reason%d:%se", len(reason), reason)
+}
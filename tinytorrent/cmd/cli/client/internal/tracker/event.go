@@ -11,4 +11,9 @@ const (
 	EventStopped Event = "stopped"
 	// EventCompleted must be included when the download completes.
 	EventCompleted Event = "completed"
+	// EventPaused is included by partial seeds, that have all the pieces
+	// of the files they want and only upload. Trackers not supporting it
+	// may reject the request.
+	// BEP21: https://www.bittorrent.org/beps/bep_0021.html
+	EventPaused Event = "paused"
 )
@@ -42,6 +42,13 @@ type RequestParams struct {
 	// The true IP address of the client (Optional).
 	// Useful if client sits behind a proxy.
 	IP *string
+	// The IPv4 address of the client (Optional). Lets a tracker reached
+	// over IPv6 also hand out the client to IPv4 peers.
+	IPv4 *string
+	// The IPv6 address of the client, optionally with a port in the
+	// [addr]:port form (Optional). Lets a tracker reached over IPv4
+	// also hand out the client to IPv6 peers.
+	IPv6 *string
 	// Number of peers that the client would like to receive
 	// from tracker (Optional).
 	NumWant *int64
@@ -78,7 +85,7 @@ func (p RequestParams) Validate() error {
 	}
 	if p.Event != nil {
 		switch *p.Event {
-		case EventStarted, EventStopped, EventCompleted:
+		case EventStarted, EventStopped, EventCompleted, EventPaused:
 		default:
 			return fmt.Errorf("unknown event %v", *p.Event)
 		}
@@ -88,6 +95,16 @@ func (p RequestParams) Validate() error {
 			return fmt.Errorf("invalid ip %v", *p.IP)
 		}
 	}
+	if p.IPv4 != nil {
+		if ip := parseHost(*p.IPv4); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid ipv4 %v", *p.IPv4)
+		}
+	}
+	if p.IPv6 != nil {
+		if ip := parseHost(*p.IPv6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid ipv6 %v", *p.IPv6)
+		}
+	}
 	if p.NumWant != nil {
 		if *p.NumWant < 0 {
 			return fmt.Errorf("num_want %v cannot be negative", *p.NumWant)
@@ -118,6 +135,12 @@ func (p RequestParams) Encode() string {
 	if p.IP != nil && *p.IP != "" {
 		values.Set("ip", *p.IP)
 	}
+	if p.IPv4 != nil && *p.IPv4 != "" {
+		values.Set("ipv4", *p.IPv4)
+	}
+	if p.IPv6 != nil && *p.IPv6 != "" {
+		values.Set("ipv6", *p.IPv6)
+	}
 	if p.NumWant != nil {
 		values.Set("numwant", strconv.Itoa(int(*p.NumWant)))
 	}
@@ -130,7 +153,22 @@ func (p RequestParams) Encode() string {
 	return values.Encode()
 }
 
-func CreateRequest(ctx context.Context, announce string, params *RequestParams) (*Response, error) {
+// parseHost parses either a plain ip address or an
+// address with a port in the host:port form.
+func parseHost(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// CreateRequest announces to the tracker using the http client,
+// http.DefaultClient is used if the client is nil.
+func CreateRequest(ctx context.Context, client *http.Client, announce string, params *RequestParams) (*Response, error) {
 	if err := params.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid params: %w", err)
 	}
@@ -145,7 +183,11 @@ func CreateRequest(ctx context.Context, announce string, params *RequestParams)
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -158,29 +158,49 @@ func DecodeResponse(src io.Reader, out *Response) error {
 			}
 
 		case bencoding.ByteStringType: // compact
-			compact := []byte(*(*string)(peers.(*bencoding.ByteString)))
-			if len(compact)%6 != 0 {
-				return fmt.Errorf("expected length of compact to be a multiple of 6 but got %v", len(compact))
+			if err := decodeCompactPeers(peers.(*bencoding.ByteString), net.IPv4len, out); err != nil {
+				return fmt.Errorf("failed to decode peers: %w", err)
 			}
-			for i := 0; i < len(compact); i += 6 {
-				peer := compact[i : i+6]
+		default:
+			return fmt.Errorf("peers were nor dictionary or bytestring type, got %T", peers)
+		}
+	}
 
-				var peerData struct {
-					PeerID string
-					IP     string
-					Port   int64
-				}
+	// https://www.bittorrent.org/beps/bep_0007.html
+	if peers6 := dict["peers6"]; peers6 != nil {
+		l, ok := peers6.(*bencoding.ByteString)
+		if !ok {
+			return fmt.Errorf("expected peers6 to be of type Bytestring but was %T: ", peers6)
+		}
+		if err := decodeCompactPeers(l, net.IPv6len, out); err != nil {
+			return fmt.Errorf("failed to decode peers6: %w", err)
+		}
+	}
 
-				peerData.IP = net.IP(peer[:4]).String()
-				peerData.Port = int64(binary.BigEndian.Uint16(peer[4:]))
+	return nil
+}
 
-				out.Peers = append(out.Peers, peerData)
+// decodeCompactPeers decodes peers in the compact format where each
+// peer is represented by an ip of ipLen bytes followed by a 2 byte port.
+func decodeCompactPeers(b *bencoding.ByteString, ipLen int, out *Response) error {
+	compact := []byte(*(*string)(b))
+	size := ipLen + 2
+	if len(compact)%size != 0 {
+		return fmt.Errorf("expected length of compact to be a multiple of %v but got %v", size, len(compact))
+	}
+	for i := 0; i < len(compact); i += size {
+		peer := compact[i : i+size]
 
-			}
-		default:
-			return fmt.Errorf("peers were nor dictionary or bytestring type, got %T", peers)
+		var peerData struct {
+			PeerID string
+			IP     string
+			Port   int64
 		}
-	}
 
+		peerData.IP = net.IP(peer[:ipLen]).String()
+		peerData.Port = int64(binary.BigEndian.Uint16(peer[ipLen:]))
+
+		out.Peers = append(out.Peers, peerData)
+	}
 	return nil
 }
@@ -2,10 +2,17 @@ package tracker_test
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
+	"github.com/Despire/tinytorrent/bencoding"
 	"github.com/Despire/tinytorrent/cmd/cli/client/internal/tracker"
 	"github.com/stretchr/testify/assert"
 )
@@ -123,3 +130,85 @@ func TestDecodeTrackerResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateRequest_MixedAddressFamilies(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+
+		peers := bencoding.ByteString(string([]byte{
+			192, 168, 1, 10, 0x1a, 0xe1, // 192.168.1.10:6881
+			10, 0, 0, 1, 0x1a, 0xe2, // 10.0.0.1:6882
+		}))
+		ip6 := net.ParseIP("2001:db8::1")
+		peers6 := bencoding.ByteString(string(append(ip6, 0x1a, 0xe3))) // [2001:db8::1]:6883
+		interval := bencoding.Integer(900)
+
+		resp := bencoding.Dictionary{Dict: map[string]bencoding.Value{
+			"interval": &interval,
+			"peers":    &peers,
+			"peers6":   &peers6,
+		}}
+		w.Write([]byte(resp.Literal()))
+	}))
+	t.Cleanup(srv.Close)
+
+	resp, err := tracker.CreateRequest(context.Background(), srv.Client(), srv.URL, &tracker.RequestParams{
+		InfoHash: strings.Repeat("\x01", 20),
+		PeerID:   strings.Repeat("\x02", 20),
+		Port:     6881,
+		Compact:  tracker.Optional[int64](1),
+		IPv4:     tracker.Optional("192.168.1.2"),
+		IPv6:     tracker.Optional("[2001:db8::2]:6881"),
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "192.168.1.2", query.Get("ipv4"))
+	assert.Equal(t, "[2001:db8::2]:6881", query.Get("ipv6"))
+
+	var addrs []string
+	for _, p := range resp.Peers {
+		addrs = append(addrs, net.JoinHostPort(p.IP, fmt.Sprint(p.Port)))
+	}
+	assert.Equal(t, []string{"192.168.1.10:6881", "10.0.0.1:6882", "[2001:db8::1]:6883"}, addrs)
+}
+
+func TestDecodeTrackerResponse_InvalidPeers6(t *testing.T) {
+	err := tracker.DecodeResponse(strings.NewReader("d6:peers65:abcdee"), new(tracker.Response))
+	assert.NotNil(t, err)
+}
+
+func TestRequestParams_Validate(t *testing.T) {
+	base := tracker.RequestParams{InfoHash: "a", PeerID: "b", Port: 1}
+
+	tests := []struct {
+		name    string
+		ipv4    *string
+		ipv6    *string
+		wantErr bool
+	}{
+		{name: "no-addresses"},
+		{name: "valid", ipv4: tracker.Optional("1.2.3.4"), ipv6: tracker.Optional("2001:db8::1")},
+		{name: "ipv6-with-port", ipv6: tracker.Optional("[2001:db8::1]:80")},
+		{name: "ipv4-as-ipv6", ipv6: tracker.Optional("1.2.3.4"), wantErr: true},
+		{name: "ipv6-as-ipv4", ipv4: tracker.Optional("2001:db8::1"), wantErr: true},
+		{name: "garbage", ipv4: tracker.Optional("host"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := base
+			p.IPv4, p.IPv6 = tt.ipv4, tt.ipv6
+			assert.Equal(t, tt.wantErr, p.Validate() != nil)
+		})
+	}
+}
+
+func TestRequestParams_Event(t *testing.T) {
+	p := tracker.RequestParams{InfoHash: "a", PeerID: "b", Port: 1, Event: tracker.Optional(tracker.EventPaused)}
+	assert.Nil(t, p.Validate())
+	assert.Contains(t, p.Encode(), "event=paused")
+
+	p.Event = tracker.Optional(tracker.Event("bogus"))
+	assert.NotNil(t, p.Validate())
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/Despire/tinytorrent/cmd/cli/client/internal/status"
 	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/mse"
 )
 
 func (p *Client) handlePeer(conn net.Conn) {
@@ -23,6 +24,14 @@ func (p *Client) handlePeer(conn net.Conn) {
 		}
 	}()
 
+	if reason, blocked := p.filter.Blocked(addr); blocked {
+		p.logger.Info("rejected peer connection blocked by ip filter",
+			slog.String("leecher", addr),
+			slog.String("reason", reason),
+		)
+		return
+	}
+
 	p.logger.Info("accepted new peer connection", slog.String("addr", addr))
 
 	if err := conn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
@@ -33,6 +42,19 @@ func (p *Client) handlePeer(conn net.Conn) {
 		return
 	}
 
+	var enc *mse.Conn
+	if p.encryption != mse.PlaintextOnly {
+		var err error
+		if enc, err = mse.Accept(conn, p.infoHashes(), p.encryption); err != nil {
+			p.logger.Error("failed to negotiate connection encryption, closing connection",
+				slog.String("err", err.Error()),
+				slog.String("leecher", addr),
+			)
+			return
+		}
+		conn = enc
+	}
+
 	var req [messagesv1.HandshakeLength]byte
 	r, err := io.ReadFull(conn, req[:])
 	if err != nil {
@@ -58,16 +80,32 @@ func (p *Client) handlePeer(conn net.Conn) {
 		return
 	}
 
+	if enc != nil {
+		// the stream was set up for the torrent selected in
+		// the encryption handshake and is not used for another.
+		if enc.InfoHash != "" && enc.InfoHash != h.InfoHash {
+			p.logger.Error("handshake info hash differs from the one of the encryption handshake, closing connection",
+				slog.String("leecher", addr),
+			)
+			return
+		}
+		// unencrypted connections are used directly, so
+		// that the pieces can be uploaded with sendfile.
+		if plain, ok := enc.Unwrap(); ok {
+			conn = plain
+		}
+	}
+
 	p.torrentsDownloading.Range(func(key, value any) bool {
 		if key.(string) == h.InfoHash {
-			if err := value.(*status.Tracker).AddLeecher(h.PeerID, conn); err != nil {
-				p.logger.Error("failed to add new leecher",
+			if err := value.(*status.Tracker).AddPeer(&h, conn); err != nil {
+				p.logger.Error("failed to add new peer",
 					slog.String("leecher", addr),
 					slog.String("err", err.Error()),
 				)
 				return false
 			}
-			p.logger.Info("successfully added leecher.", slog.String("leecher", addr))
+			p.logger.Info("successfully added peer.", slog.String("leecher", addr))
 			closeConn = false
 			return false
 		}
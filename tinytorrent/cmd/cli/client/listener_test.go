@@ -2,13 +2,20 @@ package client
 
 import (
 	"bytes"
+	"io"
 	"log/slog"
 	"math/rand/v2"
+	"net"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/ipfilter"
 	"github.com/Despire/tinytorrent/cmd/cli/client/internal/status"
 	tracker2 "github.com/Despire/tinytorrent/cmd/cli/client/internal/tracker"
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/mse"
 	"github.com/Despire/tinytorrent/torrent"
 	"github.com/stretchr/testify/assert"
 )
@@ -57,3 +64,77 @@ func TestAddNewPeer(t *testing.T) {
 
 	<-tracker.WaitUntilDownloaded()
 }
+
+func TestHandlePeer_Filtered(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("failed to listen on loopback: %v", err)
+	}
+	defer l.Close()
+
+	remote, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer remote.Close()
+
+	conn, err := l.Accept()
+	assert.Nil(t, err)
+
+	ranges, err := ipfilter.Parse(strings.NewReader("loopback:127.0.0.0-127.255.255.255"))
+	assert.Nil(t, err)
+
+	c := &Client{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		filter: ipfilter.New(ranges),
+	}
+
+	c.wg.Add(1)
+	c.handlePeer(conn)
+
+	// the connection is closed without reading the handshake.
+	assert.Nil(t, remote.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = remote.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHandlePeer_InfoHashMismatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("failed to listen on loopback: %v", err)
+	}
+	defer l.Close()
+
+	remote, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer remote.Close()
+
+	conn, err := l.Accept()
+	assert.Nil(t, err)
+
+	c := &Client{
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		filter:     ipfilter.New(nil),
+		encryption: mse.PreferEncrypted,
+	}
+	a, b := strings.Repeat("a", 20), strings.Repeat("b", 20)
+	// the torrents are never reached, the connection is closed before.
+	c.torrentsDownloading.Store(a, (*status.Tracker)(nil))
+	c.torrentsDownloading.Store(b, (*status.Tracker)(nil))
+
+	done := make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer close(done)
+		c.handlePeer(conn)
+	}()
+
+	// the stream encrypted for the torrent a is not attached to b.
+	assert.Nil(t, remote.SetDeadline(time.Now().Add(5*time.Second)))
+	enc, err := mse.Initiate(remote, a, mse.CryptoRC4)
+	assert.Nil(t, err)
+	_, err = enc.Write((&messagesv1.Handshake{Pstr: messagesv1.ProtocolV1, InfoHash: b, PeerID: strings.Repeat("r", 20)}).Serialize())
+	assert.Nil(t, err)
+
+	<-done
+	_, err = enc.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,241 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/diskio"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/status"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/tracker"
+	"github.com/Despire/tinytorrent/torrent"
+)
+
+const (
+	// SessionFile is the name of the file within the download directory
+	// listing the torrents worked on, which are resumed once restarted.
+	SessionFile = "session.json"
+	// SessionInterval is how often the session is saved while running,
+	// it is also saved once the client is closed.
+	SessionInterval = time.Minute
+	// RatioInterval is how often the share ratios of the
+	// seeded torrents are checked against the ratio limit.
+	RatioInterval = 10 * time.Second
+)
+
+// torrentFile is the name of the copy of the torrent file
+// kept within the download directory of the torrent.
+const torrentFile = "metainfo.torrent"
+
+// session are the torrents worked on, the state of each torrent is kept
+// in the download directory of the torrent along with its torrent file.
+type session struct {
+	Saved    time.Time        `json:"saved"`
+	Torrents []sessionTorrent `json:"torrents"`
+}
+
+type sessionTorrent struct {
+	// InfoHash is hex encoded, as is the name of
+	// the download directory of the torrent.
+	InfoHash string `json:"info_hash"`
+	// Finished is set once the torrent stopped
+	// seeding after reaching the ratio limit.
+	Finished bool `json:"finished,omitempty"`
+}
+
+// maintainSession saves the session periodically, if enabled, and
+// stops seeding the torrents reaching the ratio limit.
+func (p *Client) maintainSession() {
+	defer p.wg.Done()
+
+	var save <-chan time.Time
+	if p.sessionEnabled {
+		ticker := time.NewTicker(SessionInterval)
+		defer ticker.Stop()
+		save = ticker.C
+	}
+	ratio := time.NewTicker(RatioInterval)
+	defer ratio.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-save:
+			p.torrentsDownloading.Range(func(key, value any) bool {
+				if err := value.(*status.Tracker).SaveState(); err != nil {
+					p.logger.Warn("failed to save torrent state", slog.String("infoHash", key.(string)), slog.Any("err", err))
+				}
+				return true
+			})
+			if err := p.saveSession(); err != nil {
+				p.logger.Warn("failed to save session", slog.Any("err", err))
+			}
+		case <-ratio.C:
+			p.checkRatios()
+		}
+	}
+}
+
+// saveSession writes the torrents worked on to the session file.
+func (p *Client) saveSession() error {
+	s := session{Saved: time.Now()}
+	p.torrentsDownloading.Range(func(key, _ any) bool {
+		s.Torrents = append(s.Torrents, sessionTorrent{InfoHash: hex.EncodeToString([]byte(key.(string)))})
+		return true
+	})
+	p.finished.Range(func(key, _ any) bool {
+		s.Torrents = append(s.Torrents, sessionTorrent{InfoHash: hex.EncodeToString([]byte(key.(string))), Finished: true})
+		return true
+	})
+
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+	if err := diskio.WriteFile(filepath.Join(p.downloadDir, SessionFile), b); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	return nil
+}
+
+// resume starts work on the torrents of the previous session, in the
+// state they were left in. The finished torrents are not seeded again.
+func (p *Client) resume() error {
+	b, err := os.ReadFile(filepath.Join(p.downloadDir, SessionFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read session: %w", err)
+	}
+	var s session
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("failed to decode session: %w", err)
+	}
+
+	for _, st := range s.Torrents {
+		hash, err := hex.DecodeString(st.InfoHash)
+		if err != nil {
+			p.logger.Warn("skipping torrent of session with invalid info hash", slog.String("infoHash", st.InfoHash))
+			continue
+		}
+		if st.Finished {
+			p.finished.Store(string(hash), struct{}{})
+			continue
+		}
+
+		dir := filepath.Join(p.downloadDir, st.InfoHash)
+		b, err := os.ReadFile(filepath.Join(dir, torrentFile))
+		if err != nil {
+			p.logger.Error("failed to resume torrent", slog.String("infoHash", st.InfoHash), slog.Any("err", err))
+			continue
+		}
+		t, err := torrent.From(bytes.NewReader(b))
+		if err != nil {
+			p.logger.Error("failed to resume torrent", slog.String("infoHash", st.InfoHash), slog.Any("err", fmt.Errorf("failed to read torrent file: %w", err)))
+			continue
+		}
+
+		var files []string
+		if state := p.savedState(dir); state != nil {
+			files = state.Files
+		}
+		id, err := p.WorkOnFiles(t, files)
+		if err != nil {
+			p.logger.Error("failed to resume torrent", slog.String("infoHash", st.InfoHash), slog.Any("err", err))
+			continue
+		}
+		p.logger.Info("resumed torrent", slog.String("name", t.Name()))
+		p.waitInBackground(id, t.Name())
+	}
+	return nil
+}
+
+// savedState returns the state of the torrent with the download
+// directory dir kept by a previous session, nil if there is none.
+func (p *Client) savedState(dir string) *status.State {
+	state, err := status.ReadState(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			p.logger.Warn("ignoring state of previous session", slog.String("dir", dir), slog.Any("err", err))
+		}
+		return nil
+	}
+	return state
+}
+
+// RatioLimit returns the share ratio at which
+// seeding stops, 0 if there is no limit.
+func (p *Client) RatioLimit() float64 {
+	return math.Float64frombits(p.ratioLimit.Load())
+}
+
+// SetRatioLimit changes the share ratio at which seeding stops,
+// 0 seeds the torrents until the client is closed.
+func (p *Client) SetRatioLimit(ratio float64) {
+	p.ratioLimit.Store(math.Float64bits(ratio))
+}
+
+// checkRatios stops seeding the torrents that have all the wanted
+// pieces and whose share ratio reached the ratio limit.
+func (p *Client) checkRatios() {
+	limit := p.RatioLimit()
+	if limit <= 0 {
+		return
+	}
+	p.torrentsDownloading.Range(func(key, value any) bool {
+		tr := value.(*status.Tracker)
+		if tr.UploadOnly() && tr.Ratio() >= limit {
+			p.stopSeeding(key.(string), tr)
+		}
+		return true
+	})
+}
+
+// stopSeeding stops work on the torrent, which is kept in the
+// session as finished so that it is not seeded once restarted.
+func (p *Client) stopSeeding(id string, tr *status.Tracker) {
+	if _, ok := p.torrentsDownloading.LoadAndDelete(id); !ok {
+		return
+	}
+	p.finished.Store(id, struct{}{})
+	if p.lsd != nil {
+		p.lsd.Remove(id)
+	}
+
+	logger := p.logger.With(slog.String("name", tr.Torrent.Name()))
+	logger.Info("stopping seeding, reached ratio limit", slog.Float64("ratio", tr.Ratio()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := tracker.CreateRequest(ctx, p.httpClient, tr.Torrent.Announce, &tracker.RequestParams{
+		InfoHash:   id,
+		PeerID:     p.id,
+		Port:       p.announcePort(),
+		Uploaded:   tr.Uploaded.Load(),
+		Downloaded: tr.Downloaded.Load(),
+		Left:       tr.Torrent.BytesToDownload() - tr.Downloaded.Load(),
+		Compact:    tracker.Optional[int64](1),
+		Event:      tracker.Optional(tracker.EventStopped),
+		IP:         p.externalIP(),
+		IPv4:       p.announceIPv4(),
+		IPv6:       p.ipv6,
+	})
+	tr.Announced(resp, err)
+	if err != nil {
+		logger.Error("failed announce stop to tracker", slog.Any("err", err))
+	}
+
+	if err := tr.Close(); err != nil {
+		logger.Error("failed to stop torrent", slog.Any("err", err))
+	}
+}
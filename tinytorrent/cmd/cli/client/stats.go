@@ -0,0 +1,185 @@
+package client
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/build"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/status"
+)
+
+type (
+	// TorrentStats is a snapshot of the statistics of a torrent.
+	TorrentStats = status.Stats
+	// PeerInfo describes a peer connected for a torrent.
+	PeerInfo = status.PeerInfo
+)
+
+// Stats is a snapshot of the statistics of the client.
+type Stats struct {
+	Build build.Info
+
+	// Connections and HalfOpen are the peer connections
+	// established and being established across all torrents.
+	Connections int
+	HalfOpen    int
+
+	// BannedPeers are the peers banned for sending corrupt
+	// data, which in total sent CorruptBytes.
+	BannedPeers  int
+	CorruptBytes int64
+
+	// Torrents are ordered by their info hash.
+	Torrents []TorrentStats
+}
+
+// Stats returns a snapshot of the statistics of the
+// client and of all the torrents it works on.
+func (p *Client) Stats() Stats {
+	s := Stats{Build: build.Information()}
+	s.Connections, s.HalfOpen = p.limiter.Connections()
+
+	corrupt := p.bans.CorruptBytes()
+	s.BannedPeers = len(corrupt)
+	for _, n := range corrupt {
+		s.CorruptBytes += n
+	}
+
+	p.torrentsDownloading.Range(func(_, value any) bool {
+		s.Torrents = append(s.Torrents, value.(*status.Tracker).Stats())
+		return true
+	})
+	slices.SortFunc(s.Torrents, func(a, b status.Stats) int { return cmp.Compare(a.InfoHash, b.InfoHash) })
+	return s
+}
+
+// serveMetrics writes the statistics in the Prometheus text format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func (p *Client) serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, p.Stats())
+}
+
+func writeMetrics(w io.Writer, s Stats) {
+	m := metricsWriter{w: w}
+
+	m.family("tinytorrent_build_info", "gauge", "Build information of the client.")
+	m.sample("tinytorrent_build_info", 1,
+		"client_id", s.Build.ClientID,
+		"version", s.Build.ClientVersion,
+		"build_date", s.Build.BuildDate.Format(time.DateOnly),
+		"build_hash", s.Build.BuildHash,
+		"go_version", s.Build.GoVersion,
+		"compiler", s.Build.Compiler,
+		"platform", s.Build.Platform,
+		"architecture", s.Build.Architecture,
+	)
+
+	m.family("tinytorrent_connections", "gauge", "Peer connections across all torrents.")
+	m.sample("tinytorrent_connections", int64(s.Connections), "state", "established")
+	m.sample("tinytorrent_connections", int64(s.HalfOpen), "state", "half_open")
+
+	m.family("tinytorrent_banned_peers", "gauge", "Peers banned for sending corrupt data.")
+	m.sample("tinytorrent_banned_peers", int64(s.BannedPeers))
+
+	m.family("tinytorrent_corrupt_bytes_total", "counter", "Bytes sent by banned peers that failed the hash check.")
+	m.sample("tinytorrent_corrupt_bytes_total", s.CorruptBytes)
+
+	perTorrent := []struct {
+		name, typ, help string
+		value           func(*status.Stats) int64
+	}{
+		{"tinytorrent_torrent_size_bytes", "gauge", "Size of the torrent.", func(t *status.Stats) int64 { return t.Size }},
+		{"tinytorrent_downloaded_bytes", "gauge", "Bytes downloaded and not discarded.", func(t *status.Stats) int64 { return t.Downloaded }},
+		{"tinytorrent_uploaded_bytes_total", "counter", "Bytes uploaded.", func(t *status.Stats) int64 { return t.Uploaded }},
+		{"tinytorrent_left_bytes", "gauge", "Bytes left to download.", func(t *status.Stats) int64 { return t.Left }},
+		{"tinytorrent_download_rate_bytes", "gauge", "Bytes downloaded in the last second.", func(t *status.Stats) int64 { return t.DownloadRate }},
+		{"tinytorrent_upload_rate_bytes", "gauge", "Bytes uploaded in the last second.", func(t *status.Stats) int64 { return t.UploadRate }},
+		{"tinytorrent_pieces", "gauge", "Pieces of the torrent.", func(t *status.Stats) int64 { return t.Pieces }},
+		{"tinytorrent_pieces_have", "gauge", "Pieces verified and stored.", func(t *status.Stats) int64 { return t.PiecesHave }},
+		{"tinytorrent_pieces_verified_total", "counter", "Pieces that passed the hash check.", func(t *status.Stats) int64 { return t.PiecesVerified }},
+		{"tinytorrent_pieces_failed_total", "counter", "Pieces that failed the hash check.", func(t *status.Stats) int64 { return t.PiecesFailed }},
+		{"tinytorrent_wasted_bytes_total", "counter", "Bytes received that were discarded.", func(t *status.Stats) int64 { return t.WastedBytes }},
+		{"tinytorrent_announce_peers", "gauge", "Peers returned by the last successful announce.", func(t *status.Stats) int64 { return int64(t.Announces.LastPeers) }},
+	}
+	for _, f := range perTorrent {
+		m.family(f.name, f.typ, f.help)
+		for i := range s.Torrents {
+			t := &s.Torrents[i]
+			m.sample(f.name, f.value(t), "info_hash", t.InfoHash, "name", t.Name)
+		}
+	}
+
+	m.family("tinytorrent_peers", "gauge", "Peers of the torrent by state.")
+	for i := range s.Torrents {
+		t := &s.Torrents[i]
+		for _, st := range []struct {
+			state string
+			n     int
+		}{
+			{"connected", t.Peers.Connected},
+			{"incoming", t.Peers.Incoming},
+			{"outgoing", t.Peers.Outgoing},
+			{"dialing", t.Peers.Dialing},
+			{"candidate", t.Peers.Candidates},
+			{"interested", t.Peers.Interested},
+			{"interesting", t.Peers.Interesting},
+		} {
+			m.sample("tinytorrent_peers", int64(st.n), "info_hash", t.InfoHash, "name", t.Name, "state", st.state)
+		}
+	}
+
+	m.family("tinytorrent_unchoked_peers", "gauge", "Connected peers not choked, by who unchoked whom.")
+	for i := range s.Torrents {
+		t := &s.Torrents[i]
+		m.sample("tinytorrent_unchoked_peers", int64(t.Peers.Unchoked), "info_hash", t.InfoHash, "name", t.Name, "direction", "by_client")
+		m.sample("tinytorrent_unchoked_peers", int64(t.Peers.UnchokedBy), "info_hash", t.InfoHash, "name", t.Name, "direction", "by_peer")
+	}
+
+	m.family("tinytorrent_announces_total", "counter", "Announces to the tracker by result.")
+	for i := range s.Torrents {
+		t := &s.Torrents[i]
+		m.sample("tinytorrent_announces_total", t.Announces.Succeeded, "info_hash", t.InfoHash, "name", t.Name, "result", "success")
+		m.sample("tinytorrent_announces_total", t.Announces.Failed, "info_hash", t.InfoHash, "name", t.Name, "result", "failure")
+	}
+
+	m.family("tinytorrent_last_announce_timestamp_seconds", "gauge", "Unix time of the last announce to the tracker.")
+	for i := range s.Torrents {
+		t := &s.Torrents[i]
+		if !t.Announces.Last.IsZero() {
+			m.sample("tinytorrent_last_announce_timestamp_seconds", t.Announces.Last.Unix(), "info_hash", t.InfoHash, "name", t.Name)
+		}
+	}
+}
+
+// metricsWriter writes the samples in the Prometheus text format.
+type metricsWriter struct{ w io.Writer }
+
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes the value of the metric with the labels given as name, value pairs.
+func (m *metricsWriter) sample(name string, value int64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(&b, " %d\n", value)
+	io.WriteString(m.w, b.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/build"
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/status"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	var b strings.Builder
+	writeMetrics(&b, Stats{
+		Build:       build.Information(),
+		Connections: 3,
+		Torrents: []status.Stats{{
+			InfoHash:   "ab",
+			Name:       `a "quoted" name`,
+			Downloaded: 42,
+			Peers:      status.PeerStats{Connected: 2, Unchoked: 1},
+			Announces:  status.AnnounceStats{Succeeded: 4},
+		}},
+	})
+	out := b.String()
+
+	assert.Contains(t, out, `tinytorrent_build_info{client_id="`+build.ClientID+`",version="`+build.Version+`"`)
+	assert.Contains(t, out, "# TYPE tinytorrent_connections gauge\n")
+	assert.Contains(t, out, `tinytorrent_connections{state="established"} 3`+"\n")
+	assert.Contains(t, out, `tinytorrent_downloaded_bytes{info_hash="ab",name="a \"quoted\" name"} 42`+"\n")
+	assert.Contains(t, out, `tinytorrent_peers{info_hash="ab",name="a \"quoted\" name",state="connected"} 2`+"\n")
+	assert.Contains(t, out, `tinytorrent_unchoked_peers{info_hash="ab",name="a \"quoted\" name",direction="by_client"} 1`+"\n")
+	assert.Contains(t, out, `tinytorrent_announces_total{info_hash="ab",name="a \"quoted\" name",result="success"} 4`+"\n")
+	assert.NotContains(t, out, "tinytorrent_last_announce_timestamp_seconds{")
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client/internal/swarm"
+	"github.com/Despire/tinytorrent/torrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// swarmTest is a swarm of clients sharing the content of a torrent.
+type swarmTest struct {
+	seeders, leechers int
+	// files are the sizes of the files of the torrent, which
+	// is a single file torrent if there is only "file.bin".
+	files       map[string]int64
+	pieceLength int64
+	opts        []torrent.CreateOption
+}
+
+// run starts a tracker and the clients on loopback and waits until all
+// leechers downloaded the torrent, checking that the content matches.
+func (s swarmTest) run(t *testing.T) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tr := swarm.NewTracker(time.Second)
+	srv := httptest.NewServer(tr)
+	t.Cleanup(srv.Close)
+
+	content := filepath.Join(t.TempDir(), "content")
+	require.NoError(t, swarm.WriteContent(content, 1, s.files))
+	path := content
+	if _, single := s.files["file.bin"]; single && len(s.files) == 1 {
+		path = filepath.Join(content, "file.bin")
+	}
+
+	b, err := torrent.Create(path, append(s.opts, torrent.WithAnnounce(srv.URL+"/announce"), torrent.WithPieceLength(s.pieceLength))...)
+	require.NoError(t, err)
+	mf, err := torrent.From(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	start := func(seed bool) (*Client, string, string) {
+		dir := t.TempDir()
+		if seed {
+			require.NoError(t, swarm.Seed(dir, mf, path))
+		}
+		c, err := New(
+			WithLogger(logger),
+			WithAction(Both),
+			WithPort(0),
+			WithDownloadDir(dir),
+			WithLocalServiceDiscovery(false),
+			WithPortMapping(false),
+			WithUTP(false),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		id, err := c.WorkOn(mf)
+		require.NoError(t, err)
+		return c, id, filepath.Join(dir, hex.EncodeToString(mf.Metadata.Hash[:]), mf.Name())
+	}
+
+	for range s.seeders {
+		start(true)
+	}
+
+	type leecher struct {
+		done <-chan error
+		dir  string
+	}
+	var leechers []leecher
+	for range s.leechers {
+		c, id, dir := start(false)
+		leechers = append(leechers, leecher{done: c.WaitFor(id), dir: dir})
+	}
+
+	timeout := time.After(2 * time.Minute)
+	for i, l := range leechers {
+		select {
+		case err := <-l.done:
+			require.NoError(t, err, "leecher %d", i)
+		case <-timeout:
+			t.Fatalf("leecher %d did not complete the download", i)
+		}
+		assert.NoError(t, swarm.Compare(path, l.dir), "leecher %d", i)
+	}
+
+	h := string(mf.Metadata.Hash[:])
+	assert.Equal(t, s.seeders+s.leechers, tr.Peers(h))
+	assert.GreaterOrEqual(t, tr.Completed(h), s.leechers)
+}
+
+func TestSwarm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end swarm test in short mode")
+	}
+
+	tests := map[string]swarmTest{
+		"single file, one seeder": {
+			seeders:     1,
+			leechers:    1,
+			files:       map[string]int64{"file.bin": 300<<10 + 123},
+			pieceLength: 32 << 10,
+		},
+		"single file, leechers sharing": {
+			seeders:     1,
+			leechers:    3,
+			files:       map[string]int64{"file.bin": 512 << 10},
+			pieceLength: 16 << 10,
+		},
+		"multi file, many seeders": {
+			seeders:  2,
+			leechers: 2,
+			files: map[string]int64{
+				"a.bin":        100<<10 + 7,
+				"dir/b.bin":    3,
+				"dir/c/d.bin":  200 << 10,
+				"dir/c/e.bin":  50<<10 + 1,
+				"z/z/last.bin": 17,
+			},
+			pieceLength: 32 << 10,
+		},
+		"hybrid, aligned files": {
+			seeders:  1,
+			leechers: 2,
+			files: map[string]int64{
+				"a.bin": 40<<10 + 5,
+				"b.bin": 70 << 10,
+			},
+			pieceLength: 16 << 10,
+			opts:        []torrent.CreateOption{torrent.WithVersion(torrent.Hybrid)},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tt.run(t)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Despire/tinytorrent/torrent"
+)
+
+// WatchInterval is how often the watch directory is scanned for torrent files.
+const WatchInterval = 2 * time.Second
+
+// watchTorrents adds the torrent files dropped into the watch directory.
+func (p *Client) watchTorrents() {
+	defer p.wg.Done()
+
+	logger := p.logger.With(slog.String("dir", p.watchDir))
+	logger.Info("watching directory for torrent files")
+
+	// sizes are the sizes of the torrent files found by the last scan, files
+	// are only added once their size is the same in two consecutive scans,
+	// so that files still being written are not read. failed are the
+	// modification times of the files that failed to be added, which
+	// are retried once modified.
+	sizes := make(map[string]int64)
+	failed := make(map[string]time.Time)
+
+	ticker := time.NewTicker(WatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		entries, err := os.ReadDir(p.watchDir)
+		if err != nil {
+			logger.Warn("failed to read watch directory", slog.Any("err", err))
+			continue
+		}
+
+		next := make(map[string]int64)
+		for _, e := range entries {
+			if e.IsDir() || !strings.EqualFold(filepath.Ext(e.Name()), ".torrent") {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			if mod, ok := failed[e.Name()]; ok && mod.Equal(info.ModTime()) {
+				continue
+			}
+			if size, ok := sizes[e.Name()]; !ok || size != info.Size() {
+				next[e.Name()] = info.Size()
+				continue
+			}
+
+			delete(failed, e.Name())
+			if err := p.addWatched(e.Name()); err != nil {
+				logger.Error("failed to add torrent file", slog.String("file", e.Name()), slog.Any("err", err))
+				failed[e.Name()] = info.ModTime()
+			}
+		}
+		sizes = next
+	}
+}
+
+// addWatched starts work on the torrent file in the watch
+// directory and moves the file to the done directory.
+func (p *Client) addWatched(name string) error {
+	path := filepath.Join(p.watchDir, name)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	t, err := torrent.From(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read torrent file: %w", err)
+	}
+
+	// a torrent already worked on, or finished by reaching the
+	// ratio limit, is moved all the same.
+	hash := string(t.Metadata.Hash[:])
+	_, tracked := p.torrentsDownloading.Load(hash)
+	_, finished := p.finished.Load(hash)
+	if !tracked && !finished {
+		id, err := p.WorkOn(t)
+		if err != nil {
+			return fmt.Errorf("failed to start work on torrent: %w", err)
+		}
+		p.logger.Info("added torrent from watch directory", slog.String("file", name), slog.String("name", t.Name()))
+		p.waitInBackground(id, t.Name())
+	}
+
+	if err := os.MkdirAll(p.doneDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create done directory: %w", err)
+	}
+	if err := os.Rename(path, filepath.Join(p.doneDir, name)); err != nil {
+		return fmt.Errorf("failed to move torrent file to done directory: %w", err)
+	}
+	return nil
+}
+
+// waitInBackground waits for the torrent with the id to be downloaded
+// and assembled into its files, logging the error if it failed.
+func (p *Client) waitInBackground(id, name string) {
+	done := p.WaitFor(id)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if err := <-done; err != nil && !errors.Is(err, errClientClosed) {
+			p.logger.Error("failed to download torrent", slog.String("name", name), slog.Any("err", err))
+		}
+	}()
+}
@@ -0,0 +1,464 @@
+// Package config reads the configuration file of the client, a TOML file
+// mapping onto the options of the client, and reloads it once modified:
+//
+//	log_level = "info"
+//	download_dir = "/srv/torrents"
+//	port = 6882
+//	action = "both"
+//	session = true
+//
+//	[network]
+//	encryption = "prefer" # plaintext, prefer or require
+//	utp = true
+//	local_discovery = true
+//	port_mapping = true
+//	proxy = "socks5://127.0.0.1:1080"
+//	proxy_strict = false
+//
+//	[limits]
+//	max_connections = 200
+//	max_connections_per_torrent = 50
+//	max_half_open = 20
+//	ratio = 2.0 # stop seeding once uploaded twice the torrent.
+//
+//	[peers]
+//	ip_filter = ["/etc/tinytorrent/blocklist.p2p"]
+//	blocked_clients = ["Xunlei"]
+//
+//	[watch]
+//	dir = "/srv/torrents/watch"
+//	done_dir = "/srv/torrents/watch/done"
+//
+//	[debug]
+//	metrics = ":9090"
+//	record = "/tmp/peers.rec"
+//
+// Settings that are left out keep the defaults of the client.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client"
+	"github.com/Despire/tinytorrent/p2p/mse"
+)
+
+// Config are the settings of the client read from the config file.
+type Config struct {
+	// LogLevel is one of debug, info, warn or error.
+	LogLevel    string
+	DownloadDir string
+	// Port is the port the client listens on, 0 for the default one.
+	Port   int
+	Action client.Action
+	// Session resumes the torrents once restarted, see client.WithSession.
+	Session *bool
+
+	Encryption     *mse.Policy
+	UTP            *bool
+	LocalDiscovery *bool
+	PortMapping    *bool
+	Proxy          string
+	ProxyStrict    bool
+
+	// MaxConnections, MaxConnectionsPerTorrent and MaxHalfOpen
+	// limit the peer connections, 0 for the default limits.
+	MaxConnections           int
+	MaxConnectionsPerTorrent int
+	MaxHalfOpen              int
+	// RatioLimit is the share ratio at which seeding stops, 0 for no limit.
+	RatioLimit float64
+
+	IPFilter       []string
+	BlockedClients []string
+
+	WatchDir string
+	DoneDir  string
+
+	Metrics string
+	Record  string
+}
+
+// unsupported are the settings other clients have, which
+// are rejected with the reason they are not supported.
+var unsupported = map[string]string{
+	"dht":      "the client does not implement DHT",
+	"trackers": "torrents are only announced to the tracker of their torrent file",
+}
+
+// Parse parses the config file.
+func Parse(data []byte) (*Config, error) {
+	values, err := parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(Config)
+	fields := map[string]func(v any) error{
+		"log_level":    stringValue(&c.LogLevel, "debug", "info", "warn", "error"),
+		"download_dir": stringValue(&c.DownloadDir),
+		"port":         intValue(&c.Port, 0, 65535),
+		"action": func(v any) error {
+			var action string
+			if err := stringValue(&action, client.Leech, client.Both)(v); err != nil {
+				return err
+			}
+			c.Action = client.Action(action)
+			return nil
+		},
+		"session": optionalBool(&c.Session),
+
+		"network.encryption": func(v any) error {
+			var policy string
+			if err := stringValue(&policy, "plaintext", "prefer", "require")(v); err != nil {
+				return err
+			}
+			p := map[string]mse.Policy{
+				"plaintext": mse.PlaintextOnly,
+				"prefer":    mse.PreferEncrypted,
+				"require":   mse.RequireEncrypted,
+			}[policy]
+			c.Encryption = &p
+			return nil
+		},
+		"network.utp":             optionalBool(&c.UTP),
+		"network.local_discovery": optionalBool(&c.LocalDiscovery),
+		"network.port_mapping":    optionalBool(&c.PortMapping),
+		"network.proxy":           stringValue(&c.Proxy),
+		"network.proxy_strict":    boolValue(&c.ProxyStrict),
+
+		"limits.max_connections":             intValue(&c.MaxConnections, 1, 1<<16),
+		"limits.max_connections_per_torrent": intValue(&c.MaxConnectionsPerTorrent, 1, 1<<16),
+		"limits.max_half_open":               intValue(&c.MaxHalfOpen, 1, 1<<16),
+		"limits.ratio":                       floatValue(&c.RatioLimit, 0),
+
+		"peers.ip_filter":       stringsValue(&c.IPFilter),
+		"peers.blocked_clients": stringsValue(&c.BlockedClients),
+
+		"watch.dir":      stringValue(&c.WatchDir),
+		"watch.done_dir": stringValue(&c.DoneDir),
+
+		"debug.metrics": stringValue(&c.Metrics),
+		"debug.record":  stringValue(&c.Record),
+	}
+
+	// the keys are decoded in a fixed order, so
+	// that the same error is reported each time.
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		name := k[strings.LastIndexByte(k, '.')+1:]
+		if reason, ok := unsupported[name]; ok {
+			return nil, fmt.Errorf("unsupported setting %q: %s", k, reason)
+		}
+		decode, ok := fields[k]
+		if !ok {
+			return nil, fmt.Errorf("unknown setting %q", k)
+		}
+		if err := decode(values[k]); err != nil {
+			return nil, fmt.Errorf("invalid setting %q: %w", k, err)
+		}
+	}
+
+	if c.DoneDir != "" && c.WatchDir == "" {
+		return nil, errors.New("done directory set without a watch directory")
+	}
+	return c, nil
+}
+
+// Load reads the config file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %w", path, err)
+	}
+	return c, nil
+}
+
+// Level returns the log level, info if none is set.
+func (c *Config) Level() slog.Level {
+	switch c.LogLevel {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// Options returns the options of the client for the settings.
+func (c *Config) Options() []client.Option {
+	var opts []client.Option
+	if c.DownloadDir != "" {
+		opts = append(opts, client.WithDownloadDir(c.DownloadDir))
+	}
+	if c.Port != 0 {
+		opts = append(opts, client.WithPort(c.Port))
+	}
+	if c.Action != "" {
+		opts = append(opts, client.WithAction(c.Action))
+	}
+	if c.Session != nil {
+		opts = append(opts, client.WithSession(*c.Session))
+	}
+	if c.Encryption != nil {
+		opts = append(opts, client.WithEncryption(*c.Encryption))
+	}
+	if c.UTP != nil {
+		opts = append(opts, client.WithUTP(*c.UTP))
+	}
+	if c.LocalDiscovery != nil {
+		opts = append(opts, client.WithLocalServiceDiscovery(*c.LocalDiscovery))
+	}
+	if c.PortMapping != nil {
+		opts = append(opts, client.WithPortMapping(*c.PortMapping))
+	}
+	if c.Proxy != "" || c.ProxyStrict {
+		opts = append(opts, client.WithProxy(c.Proxy, c.ProxyStrict))
+	}
+	if c.MaxConnections != 0 || c.MaxConnectionsPerTorrent != 0 {
+		opts = append(opts, client.WithMaxConnections(c.maxConnections(), c.maxConnectionsPerTorrent()))
+	}
+	if c.MaxHalfOpen != 0 {
+		opts = append(opts, client.WithMaxHalfOpen(c.MaxHalfOpen))
+	}
+	if c.RatioLimit != 0 {
+		opts = append(opts, client.WithRatioLimit(c.RatioLimit))
+	}
+	if len(c.IPFilter) > 0 {
+		opts = append(opts, client.WithIPFilter(c.IPFilter...))
+	}
+	if len(c.BlockedClients) > 0 {
+		opts = append(opts, client.WithBlockedClients(c.BlockedClients...))
+	}
+	if c.WatchDir != "" {
+		opts = append(opts, client.WithWatchDir(c.WatchDir, c.DoneDir))
+	}
+	if c.Metrics != "" {
+		opts = append(opts, client.WithMetrics(c.Metrics))
+	}
+	if c.Record != "" {
+		opts = append(opts, client.WithRecording(c.Record))
+	}
+	return opts
+}
+
+func (c *Config) maxConnections() int {
+	if c.MaxConnections == 0 {
+		return client.DefaultMaxConnections
+	}
+	return c.MaxConnections
+}
+
+func (c *Config) maxConnectionsPerTorrent() int {
+	if c.MaxConnectionsPerTorrent == 0 {
+		return client.DefaultMaxConnectionsPerTorrent
+	}
+	return c.MaxConnectionsPerTorrent
+}
+
+func (c *Config) maxHalfOpen() int {
+	if c.MaxHalfOpen == 0 {
+		return client.DefaultMaxHalfOpen
+	}
+	return c.MaxHalfOpen
+}
+
+func stringValue(dst *string, allowed ...string) func(v any) error {
+	return func(v any) error {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %v", v)
+		}
+		if len(allowed) > 0 && !slices.Contains(allowed, s) {
+			return fmt.Errorf("expected one of %s, got %q", strings.Join(allowed, ", "), s)
+		}
+		*dst = s
+		return nil
+	}
+}
+
+func stringsValue(dst *[]string) func(v any) error {
+	return func(v any) error {
+		values, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("expected an array of strings, got %v", v)
+		}
+		*dst = nil
+		for _, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("expected an array of strings, got %v", v)
+			}
+			*dst = append(*dst, s)
+		}
+		return nil
+	}
+}
+
+func intValue(dst *int, lowest, highest int) func(v any) error {
+	return func(v any) error {
+		n, ok := v.(int64)
+		if !ok {
+			return fmt.Errorf("expected an integer, got %v", v)
+		}
+		if n < int64(lowest) || n > int64(highest) {
+			return fmt.Errorf("expected an integer between %d and %d, got %d", lowest, highest, n)
+		}
+		*dst = int(n)
+		return nil
+	}
+}
+
+// floatValue also accepts integers, such as ratio = 2.
+func floatValue(dst *float64, lowest float64) func(v any) error {
+	return func(v any) error {
+		var f float64
+		switch n := v.(type) {
+		case float64:
+			f = n
+		case int64:
+			f = float64(n)
+		default:
+			return fmt.Errorf("expected a number, got %v", v)
+		}
+		if f < lowest || math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("expected a number of at least %v, got %v", lowest, f)
+		}
+		*dst = f
+		return nil
+	}
+}
+
+func boolValue(dst *bool) func(v any) error {
+	return func(v any) error {
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("expected a boolean, got %v", v)
+		}
+		*dst = b
+		return nil
+	}
+}
+
+func optionalBool(dst **bool) func(v any) error {
+	return func(v any) error {
+		var b bool
+		if err := boolValue(&b)(v); err != nil {
+			return err
+		}
+		*dst = &b
+		return nil
+	}
+}
+
+// File is the config file, which is read again once modified.
+type File struct {
+	path    string
+	modTime time.Time
+	Config  *Config
+}
+
+// Open reads the config file at path.
+func Open(path string) (*File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, modTime: info.ModTime(), Config: c}, nil
+}
+
+// Reload reads the config file again if it was modified since it was last
+// read and returns the previous config if so, or nil if it was not. On
+// failure the previous config is kept and is not read again until the
+// file is modified once more.
+func (f *File) Reload() (*Config, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil, nil
+	}
+	f.modTime = info.ModTime()
+
+	c, err := Load(f.path)
+	if err != nil {
+		return nil, err
+	}
+	old := f.Config
+	f.Config = c
+	return old, nil
+}
+
+// Apply changes the running client from the old settings to the ones of c.
+// The log level, unless level is nil, the ip filter, the connection limits
+// across all torrents and the ratio limit are changed right away, the names
+// of the other changed settings, that only take effect once the client is
+// restarted, are returned.
+func (c *Config) Apply(cl *client.Client, level *slog.LevelVar, old *Config) ([]string, error) {
+	if level != nil {
+		level.Set(c.Level())
+	}
+
+	var errAll error
+	if !slices.Equal(c.IPFilter, old.IPFilter) {
+		if err := cl.SetIPFilter(c.IPFilter...); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("failed to change ip filter: %w", err))
+		}
+	}
+	if c.maxConnections() != old.maxConnections() || c.maxHalfOpen() != old.maxHalfOpen() {
+		cl.SetConnectionLimits(c.maxConnections(), c.maxHalfOpen())
+	}
+	if c.RatioLimit != old.RatioLimit {
+		cl.SetRatioLimit(c.RatioLimit)
+	}
+
+	var restart []string
+	changed := func(name string, differ bool) {
+		if differ {
+			restart = append(restart, name)
+		}
+	}
+	changed("download_dir", c.DownloadDir != old.DownloadDir)
+	changed("port", c.Port != old.Port)
+	changed("action", c.Action != old.Action)
+	changed("session", !equal(c.Session, old.Session))
+	changed("network.encryption", !equal(c.Encryption, old.Encryption))
+	changed("network.utp", !equal(c.UTP, old.UTP))
+	changed("network.local_discovery", !equal(c.LocalDiscovery, old.LocalDiscovery))
+	changed("network.port_mapping", !equal(c.PortMapping, old.PortMapping))
+	changed("network.proxy", c.Proxy != old.Proxy || c.ProxyStrict != old.ProxyStrict)
+	changed("limits.max_connections_per_torrent", c.maxConnectionsPerTorrent() != old.maxConnectionsPerTorrent())
+	changed("peers.blocked_clients", !slices.Equal(c.BlockedClients, old.BlockedClients))
+	changed("watch", c.WatchDir != old.WatchDir || c.DoneDir != old.DoneDir)
+	changed("debug.metrics", c.Metrics != old.Metrics)
+	changed("debug.record", c.Record != old.Record)
+	return restart, errAll
+}
+
+func equal[T comparable](a, b *T) bool {
+	return a == b || a != nil && b != nil && *a == *b
+}
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parse parses the subset of TOML used by the config file: tables, keys
+// with string, integer, float, boolean and array values, and comments. The values
+// are returned by their keys prefixed with the name of their table, such
+// as "limits.max_connections".
+func parse(data string) (map[string]any, error) {
+	p := &parser{data: data, line: 1}
+	values := make(map[string]any)
+	table := ""
+
+	for {
+		p.skip(true)
+		if p.eof() {
+			return values, nil
+		}
+
+		if p.peek() == '[' {
+			p.pos++
+			p.skip(false)
+			name, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skip(false)
+			if p.eof() || p.peek() != ']' {
+				return nil, p.errorf("expected ] closing the table %q", name)
+			}
+			p.pos++
+			if err := p.endOfLine(); err != nil {
+				return nil, err
+			}
+			table = name + "."
+			continue
+		}
+
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		p.skip(false)
+		if p.eof() || p.peek() != '=' {
+			return nil, p.errorf("expected = after the key %q", key)
+		}
+		p.pos++
+		p.skip(false)
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+
+		if _, ok := values[table+key]; ok {
+			return nil, p.errorf("duplicate key %q", table+key)
+		}
+		values[table+key] = v
+	}
+}
+
+type parser struct {
+	data string
+	pos  int
+	line int
+}
+
+func (p *parser) eof() bool  { return p.pos >= len(p.data) }
+func (p *parser) peek() byte { return p.data[p.pos] }
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skip skips spaces and comments, and also newlines if set.
+func (p *parser) skip(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) endOfLine() error {
+	p.skip(false)
+	if p.eof() {
+		return nil
+	}
+	if p.peek() != '\n' {
+		return p.errorf("unexpected %q at the end of the line", p.peek())
+	}
+	return nil
+}
+
+// key parses a bare key, quoted and dotted keys are not supported.
+func (p *parser) key() (string, error) {
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	if p.pos == start {
+		if p.eof() {
+			return "", p.errorf("expected a key")
+		}
+		return "", p.errorf("expected a key, found %q", p.peek())
+	}
+	return p.data[start:p.pos], nil
+}
+
+func (p *parser) value() (any, error) {
+	if p.eof() {
+		return nil, p.errorf("expected a value")
+	}
+
+	switch c := p.peek(); {
+	case c == '"':
+		return p.basicString()
+	case c == '\'':
+		p.pos++
+		end := strings.IndexAny(p.data[p.pos:], "'\n")
+		if end < 0 || p.data[p.pos+end] != '\'' {
+			return nil, p.errorf("unterminated string")
+		}
+		s := p.data[p.pos : p.pos+end]
+		p.pos += end + 1
+		return s, nil
+	case c == '[':
+		return p.array()
+	case strings.HasPrefix(p.data[p.pos:], "true"):
+		p.pos += len("true")
+		return true, nil
+	case strings.HasPrefix(p.data[p.pos:], "false"):
+		p.pos += len("false")
+		return false, nil
+	case c == '+' || c == '-' || c >= '0' && c <= '9':
+		return p.number()
+	default:
+		return nil, p.errorf("unsupported value starting with %q", c)
+	}
+}
+
+// number parses an integer, or a float if it has a fraction or an exponent.
+func (p *parser) number() (any, error) {
+	start := p.pos
+	p.pos++ // sign or first digit.
+	float := false
+	for ; !p.eof(); p.pos++ {
+		c := p.peek()
+		if c == '.' || c == 'e' || c == 'E' {
+			float = true
+			continue
+		}
+		exponentSign := (c == '+' || c == '-') && (p.data[p.pos-1] == 'e' || p.data[p.pos-1] == 'E')
+		if !(c >= '0' && c <= '9' || c == '_' || exponentSign) {
+			break
+		}
+	}
+
+	literal := strings.ReplaceAll(p.data[start:p.pos], "_", "")
+	if float {
+		f, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			return nil, p.errorf("invalid float %q", p.data[start:p.pos])
+		}
+		return f, nil
+	}
+	n, err := strconv.ParseInt(literal, 10, 64)
+	if err != nil {
+		return nil, p.errorf("invalid integer %q", p.data[start:p.pos])
+	}
+	return n, nil
+}
+
+func (p *parser) basicString() (string, error) {
+	p.pos++ // opening quote.
+	var b strings.Builder
+	for !p.eof() {
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\n':
+			return "", p.errorf("unterminated string")
+		case '\\':
+			if p.eof() {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.peek()
+			p.pos++
+			switch e {
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				return "", p.errorf("unsupported escape sequence \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// array parses an array, which may span multiple lines.
+func (p *parser) array() ([]any, error) {
+	p.pos++ // opening bracket.
+	var values []any
+	for {
+		p.skip(true)
+		if p.eof() {
+			return nil, p.errorf("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		p.skip(true)
+		if p.eof() {
+			return nil, p.errorf("unterminated array")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array, found %q", p.peek())
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Despire/tinytorrent/torrent"
+)
+
+// create makes a torrent file of a file or directory:
+//
+//	tinytorrent create -announce <url>[,<url>...] [-version 1|2|hybrid] [-piece-length n] [-align] [-file-hashes] [-o out.torrent] <path>
+func create(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	announce := flags.String("announce", "", "comma separated tracker urls, the first being the announce url")
+	version := flags.String("version", "1", "version of the torrent: 1, 2 or hybrid")
+	pieceLength := flags.Int64("piece-length", 0, "piece length in bytes, chosen from the size of the content by default")
+	comment := flags.String("comment", "", "comment of the torrent")
+	private := flags.Bool("private", false, "restrict the peers to the ones of the trackers")
+	align := flags.Bool("align", false, "align the files to piece boundaries with padding files")
+	fileHashes := flags.Bool("file-hashes", false, "record the sha1 of each file")
+	out := flags.String("o", "", "torrent file to write, <name>.torrent by default")
+	args = parseArgs(flags, args)
+
+	if len(args) != 1 {
+		return errors.New("expected exactly one file or directory to create the torrent of")
+	}
+	if *announce == "" {
+		return errors.New("no announce url specified")
+	}
+
+	opts := []torrent.CreateOption{
+		torrent.WithAnnounce(strings.Split(*announce, ",")...),
+		torrent.WithPieceLength(*pieceLength),
+		torrent.WithComment(*comment),
+		torrent.WithCreatedBy("tinytorrent"),
+	}
+	switch *version {
+	case "1":
+		opts = append(opts, torrent.WithVersion(torrent.V1))
+	case "2":
+		opts = append(opts, torrent.WithVersion(torrent.V2))
+	case "hybrid":
+		opts = append(opts, torrent.WithVersion(torrent.Hybrid))
+	default:
+		return fmt.Errorf("unsupported torrent version %v, supported only (1|2|hybrid)", *version)
+	}
+	if *private {
+		opts = append(opts, torrent.WithPrivate())
+	}
+	if *align {
+		opts = append(opts, torrent.WithAlignedFiles())
+	}
+	if *fileHashes {
+		opts = append(opts, torrent.WithFileHashes())
+	}
+
+	b, err := torrent.Create(args[0], opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create torrent of %q: %w", args[0], err)
+	}
+
+	if *out == "" {
+		*out = filepath.Base(filepath.Clean(args[0])) + ".torrent"
+	}
+	if err := os.WriteFile(*out, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write torrent file %q: %w", *out, err)
+	}
+	return nil
+}
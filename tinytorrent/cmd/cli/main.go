@@ -3,87 +3,285 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Despire/tinytorrent/cmd/cli/client"
+	"github.com/Despire/tinytorrent/cmd/cli/config"
+	"github.com/Despire/tinytorrent/cmd/cli/tui"
 	"github.com/Despire/tinytorrent/torrent"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "create" {
+		if err := create(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replay(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// the level is changed once the config file is reloaded,
+	// unless it is set with TINY_LOG_LEVEL.
+	level := new(slog.LevelVar)
 	opts := &slog.HandlerOptions{
 		AddSource: true,
+		Level:     level,
 	}
 
+	envLevel := true
 	switch e := os.Getenv("TINY_LOG_LEVEL"); e {
 	case "debug":
-		opts.Level = slog.LevelDebug
+		level.Set(slog.LevelDebug)
 	case "info":
-		opts.Level = slog.LevelInfo
+		level.Set(slog.LevelInfo)
 	case "warn":
-		opts.Level = slog.LevelWarn
+		level.Set(slog.LevelWarn)
 	case "error":
-		opts.Level = slog.LevelError
+		level.Set(slog.LevelError)
 	default:
-		opts.Level = slog.LevelInfo
+		level.Set(slog.LevelInfo)
+		envLevel = false
+	}
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	noTUI := flags.Bool("no-tui", false, "log to stdout instead of showing the terminal dashboard")
+	files := flags.String("files", "", "comma separated paths of the files to download, relative to the torrent directory, all by default")
+	configPath := flags.String("config", os.Getenv("TINY_CONFIG"), "config file of the client, reloaded once modified")
+	args := parseArgs(flags, os.Args[1:])
 
+	var cfg *config.File
+	if *configPath != "" {
+		var err error
+		if cfg, err = config.Open(*configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !envLevel {
+			level.Set(cfg.Config.Level())
+		}
 	}
+	if envLevel {
+		level = nil
+	}
+
+	// the logs are shown on the dashboard while it is running,
+	// which is not the case when running as a daemon.
+	var out io.Writer = os.Stdout
+	var dashboard *tui.Dashboard
+	if !*noTUI && len(args) > 0 && tui.IsTerminal(os.Stdout) {
+		dashboard = tui.New(os.Stdout)
+		out = dashboard
+	}
+
+	logger := slog.New(slog.NewTextHandler(out, opts))
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, opts))
+	var selected []string
+	if *files != "" {
+		selected = strings.Split(*files, ",")
+	}
 
-	if err := run(context.Background(), logger, os.Args[1:]); err != nil {
+	if err := run(context.Background(), logger, level, cfg, dashboard, args, selected); err != nil {
 		logger.Error("stopping tinytorrent client due to encountered error while executing", "error", err)
 		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context, logger *slog.Logger, args []string) error {
-	if len(args) < 1 {
-		return errors.New("no torrent file specified")
-	}
-	action := "leech"
-	if len(args) == 2 {
-		switch args[1] {
-		case "leech":
-		case "both":
-			action = "both"
-		default:
-			return fmt.Errorf("unsupported torrent action %v, supported only (leech|seed|both)", args[1])
+// parseArgs parses the flags, which may be given before,
+// after or in between the positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args) // exits on error.
+		if flags.NArg() == 0 {
+			return positional
 		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
 	}
+}
 
-	file, err := os.OpenFile(args[0], os.O_RDONLY, 0)
-	if err != nil {
-		return fmt.Errorf("failed to open torrent file %q: %w", args[0], err)
+// run works on the torrent file in args until it is interrupted. Without
+// a torrent file it runs as a daemon, adding the torrent files dropped into
+// the watch directory of the config file.
+func run(ctx context.Context, logger *slog.Logger, level *slog.LevelVar, cfg *config.File, dashboard *tui.Dashboard, args, files []string) error {
+	// the session is kept unless disabled in the config file or with TINY_SESSION=0.
+	opts := []client.Option{client.WithLogger(logger), client.WithSession(true)}
+	if cfg != nil {
+		opts = append(opts, cfg.Config.Options()...)
 	}
-	defer file.Close()
 
-	t, err := torrent.From(file)
-	if err != nil {
-		return fmt.Errorf("failed to read torrent file %q: %w", args[0], err)
+	var t *torrent.MetaInfoFile
+	switch {
+	case len(args) > 0:
+		if len(args) == 2 {
+			switch args[1] {
+			case "leech":
+			case "both":
+			default:
+				return fmt.Errorf("unsupported torrent action %v, supported only (leech|seed|both)", args[1])
+			}
+			opts = append(opts, client.WithAction(client.Action(args[1])))
+		}
+
+		file, err := os.OpenFile(args[0], os.O_RDONLY, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open torrent file %q: %w", args[0], err)
+		}
+		defer file.Close()
+
+		if t, err = torrent.From(file); err != nil {
+			return fmt.Errorf("failed to read torrent file %q: %w", args[0], err)
+		}
+	case cfg == nil || cfg.Config.WatchDir == "":
+		return errors.New("no torrent file specified nor a watch directory configured")
+	default:
+		logger.Info("running as daemon")
+	}
+
+	// TINY_IP_FILTER is a list of blocklists separated by the os path list separator.
+	if e := os.Getenv("TINY_IP_FILTER"); e != "" {
+		opts = append(opts, client.WithIPFilter(filepath.SplitList(e)...))
+	}
+
+	// TINY_PROXY is the url of a SOCKS5 or HTTP proxy, TINY_PROXY_STRICT=1
+	// refuses to make any connection around it.
+	if e := os.Getenv("TINY_PROXY"); e != "" {
+		opts = append(opts, client.WithProxy(e, os.Getenv("TINY_PROXY_STRICT") == "1"))
+	}
+
+	// TINY_BLOCKED_CLIENTS is a comma separated list of client
+	// names, as identified from the peer ids, to not connect to.
+	if e := os.Getenv("TINY_BLOCKED_CLIENTS"); e != "" {
+		opts = append(opts, client.WithBlockedClients(strings.Split(e, ",")...))
+	}
+
+	// TINY_METRICS_ADDR is the address the Prometheus metrics are served at.
+	if e := os.Getenv("TINY_METRICS_ADDR"); e != "" {
+		opts = append(opts, client.WithMetrics(e))
+	}
+
+	// TINY_PORT_MAPPING=0 disables mapping the listen port on the gateway.
+	if os.Getenv("TINY_PORT_MAPPING") == "0" {
+		opts = append(opts, client.WithPortMapping(false))
+	}
+
+	// TINY_RECORD is the file the sessions with peers are recorded to,
+	// shown and replayed with the replay command.
+	if e := os.Getenv("TINY_RECORD"); e != "" {
+		opts = append(opts, client.WithRecording(e))
+	}
+
+	if os.Getenv("TINY_SESSION") == "0" {
+		opts = append(opts, client.WithSession(false))
 	}
 
-	c, err := client.New(client.WithLogger(logger), client.WithAction(client.Action(action)))
+	// TINY_RATIO_LIMIT is the share ratio at which seeding stops.
+	if e := os.Getenv("TINY_RATIO_LIMIT"); e != "" {
+		ratio, err := strconv.ParseFloat(e, 64)
+		if err != nil || ratio < 0 {
+			return fmt.Errorf("invalid ratio limit %q", e)
+		}
+		opts = append(opts, client.WithRatioLimit(ratio))
+	}
+
+	c, err := client.New(opts...)
 	if err != nil {
 		return fmt.Errorf("failed to initialize the client: %w", err)
 	}
 
+	if dashboard != nil {
+		ctx, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			dashboard.Run(ctx, c.Stats)
+		}()
+		defer func() { stop(); <-done }()
+	}
+
+	// the ip filter and the config file are reloaded on SIGHUP.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	// the config file is also reloaded once modified.
+	var reloadConfig <-chan time.Time
+	if cfg != nil {
+		ticker := time.NewTicker(configInterval)
+		defer ticker.Stop()
+		reloadConfig = ticker.C
+	}
+
+	// super seeding is switched on and off on SIGUSR1.
+	superSeed := make(chan os.Signal, 1)
+	signal.Notify(superSeed, syscall.SIGUSR1)
+	defer signal.Stop(superSeed)
+
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
 	defer stop()
 
-	id, err := c.WorkOn(t)
-	if err != nil {
-		return fmt.Errorf("failed to start work on: %w", err)
+	// a daemon has no torrent to wait for.
+	var id string
+	var done <-chan error
+	if t != nil {
+		id = string(t.Metadata.Hash[:])
+		if c.Tracked(id) {
+			// the files selected in the previous session are kept.
+			logger.Info("torrent resumed from the previous session", "name", t.Name())
+		} else {
+			var err error
+			if id, err = c.WorkOnFiles(t, files); err != nil {
+				return fmt.Errorf("failed to start work on: %w", err)
+			}
+			done = c.WaitFor(id)
+		}
+
+		// TINY_SUPER_SEED=1 super seeds the torrent, if it is complete.
+		if os.Getenv("TINY_SUPER_SEED") == "1" {
+			if err := c.SetSuperSeeding(id, true); err != nil {
+				logger.Error("failed to start super seeding", "error", err)
+			}
+		}
 	}
 
-	done := c.WaitFor(id)
 	for {
 		select {
 		case <-ctx.Done():
 			logger.Warn("interrupt signal received")
 			return c.Close()
+		case <-reload:
+			if err := c.ReloadIPFilter(); err != nil {
+				logger.Error("failed to reload ip filter", "error", err)
+			}
+			if cfg != nil {
+				reloadConfigFile(logger, c, level, cfg)
+			}
+		case <-reloadConfig:
+			reloadConfigFile(logger, c, level, cfg)
+		case <-superSeed:
+			if id == "" {
+				continue
+			}
+			if err := c.SetSuperSeeding(id, !c.SuperSeeding(id)); err != nil {
+				logger.Error("failed to switch super seeding", "error", err)
+			}
 		case err, _ := <-done:
 			if err != nil {
 				if err := c.Close(); err != nil {
@@ -94,3 +292,27 @@ func run(ctx context.Context, logger *slog.Logger, args []string) error {
 		}
 	}
 }
+
+// configInterval is how often the config file is checked for modifications.
+const configInterval = 5 * time.Second
+
+// reloadConfigFile applies the config file to the client, if it was modified.
+func reloadConfigFile(logger *slog.Logger, c *client.Client, level *slog.LevelVar, cfg *config.File) {
+	old, err := cfg.Reload()
+	if err != nil {
+		logger.Error("failed to reload config file, keeping the previous settings", "error", err)
+		return
+	}
+	if old == nil {
+		return
+	}
+
+	restart, err := cfg.Config.Apply(c, level, old)
+	if err != nil {
+		logger.Error("failed to apply config file", "error", err)
+	}
+	logger.Info("reloaded config file")
+	if len(restart) > 0 {
+		logger.Warn("changed settings take effect once restarted", "settings", strings.Join(restart, ", "))
+	}
+}
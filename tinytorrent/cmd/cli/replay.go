@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/recorder"
+)
+
+// replay shows the timeline of the peer sessions of a recording, made with
+// TINY_RECORD, or replays the session of a peer against a local client:
+//
+//	tinytorrent replay [-peer host:port] [-connect host:port] [-speed n] [-linger d] <recording>
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	peer := flags.String("peer", "", "address of the peer whose session is shown or replayed, all peers by default")
+	connect := flags.String("connect", "", "address of the client to replay the session of the peer against")
+	speed := flags.Float64("speed", 1, "speed of the replay relative to the recorded timing")
+	linger := flags.Duration("linger", recorder.DefaultLinger, "how long to wait for responses after the last replayed message")
+	args = parseArgs(flags, args)
+
+	if len(args) != 1 {
+		return errors.New("expected exactly one recording")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open recording %q: %w", args[0], err)
+	}
+	defer f.Close()
+
+	r, err := recorder.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read recording %q: %w", args[0], err)
+	}
+	records, err := r.ReadAll()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// the client was killed while writing the last record.
+		fmt.Fprintln(os.Stderr, "recording ends with a truncated record")
+	} else if err != nil {
+		return fmt.Errorf("failed to read recording %q: %w", args[0], err)
+	}
+
+	if *peer != "" {
+		var filtered []*recorder.Record
+		for _, rec := range records {
+			if rec.Peer == *peer {
+				filtered = append(filtered, rec)
+			}
+		}
+		records = filtered
+	}
+	if len(records) == 0 {
+		return errors.New("no records to show")
+	}
+
+	if *connect == "" {
+		start := records[0].Time
+		for _, rec := range records {
+			printRecord(start, rec)
+		}
+		return nil
+	}
+
+	if *peer == "" {
+		return errors.New("the peer whose session to replay must be specified with -peer")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", *connect)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", *connect, err)
+	}
+
+	start := time.Now()
+	return recorder.Replay(ctx, conn, records,
+		recorder.WithSpeed(*speed),
+		recorder.WithLinger(*linger),
+		recorder.WithObserver(func(rec *recorder.Record) { printRecord(start, rec) }),
+	)
+}
+
+// printRecord prints a line of the timeline, the records received from the
+// peer are shown with "<-" and the ones sent to the peer with "->".
+func printRecord(start time.Time, rec *recorder.Record) {
+	arrow := "<-"
+	if rec.Direction == recorder.Sent {
+		arrow = "->"
+	}
+	fmt.Printf("%12.6f %-40s %s %s\n", rec.Time.Sub(start).Seconds(), rec.Peer, arrow, rec.Summary())
+}
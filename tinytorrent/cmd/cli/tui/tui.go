@@ -0,0 +1,298 @@
+// Package tui renders the statistics of the client as a live terminal dashboard.
+package tui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client"
+	"github.com/Despire/tinytorrent/p2p/peerid"
+)
+
+const (
+	// RefreshInterval is how often the dashboard is redrawn.
+	RefreshInterval = 1 * time.Second
+
+	// width is the number of columns the dashboard is laid out for.
+	width = 80
+	// maxPeers is the number of peers listed per torrent.
+	maxPeers = 10
+	// maxLogs is the number of log lines kept and shown.
+	maxLogs = 6
+)
+
+const (
+	enterScreen = "\x1b[?1049h\x1b[?25l" // alternate screen, hide cursor.
+	leaveScreen = "\x1b[?25h\x1b[?1049l" // show cursor, main screen.
+	home        = "\x1b[H"
+	clearLine   = "\x1b[K"
+	clearBelow  = "\x1b[J"
+)
+
+// IsTerminal reports whether the file is a terminal.
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Dashboard draws the progress of the torrents, their peers, tracker status
+// and piece availability. It is also a writer for the logger, showing the
+// last lines logged below the dashboard while it is running.
+type Dashboard struct {
+	out io.Writer
+
+	l       sync.Mutex
+	running bool
+	logs    []string
+	partial []byte
+
+	// prev are the bytes transferred with each peer at prevAt,
+	// used to derive the rates of the peers.
+	prev   map[string]transfer
+	prevAt time.Time
+}
+
+type transfer struct{ down, up int64 }
+
+func New(out io.Writer) *Dashboard {
+	return &Dashboard{out: out, prev: make(map[string]transfer)}
+}
+
+// Write keeps the logged lines to show them on the dashboard. While the
+// dashboard is not running the lines are written to the output as is.
+func (d *Dashboard) Write(b []byte) (int, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	if !d.running {
+		return d.out.Write(b)
+	}
+
+	d.partial = append(d.partial, b...)
+	for {
+		i := bytes.IndexByte(d.partial, '\n')
+		if i < 0 {
+			break
+		}
+		d.logs = append(d.logs, string(d.partial[:i]))
+		d.partial = d.partial[i+1:]
+	}
+	if len(d.logs) > maxLogs {
+		d.logs = d.logs[len(d.logs)-maxLogs:]
+	}
+	return len(b), nil
+}
+
+// Run redraws the dashboard from the statistics every
+// RefreshInterval until the context is cancelled.
+func (d *Dashboard) Run(ctx context.Context, stats func() client.Stats) {
+	d.l.Lock()
+	d.running = true
+	io.WriteString(d.out, enterScreen)
+	d.l.Unlock()
+
+	defer func() {
+		d.l.Lock()
+		defer d.l.Unlock()
+		io.WriteString(d.out, leaveScreen)
+		d.running = false
+	}()
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+	for {
+		var frame strings.Builder
+		frame.WriteString(home)
+		d.render(&frame, stats(), time.Now())
+		frame.WriteString(clearBelow)
+
+		d.l.Lock()
+		io.WriteString(d.out, frame.String())
+		d.l.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dashboard) render(w io.Writer, s client.Stats, now time.Time) {
+	elapsed := now.Sub(d.prevAt).Seconds()
+	current := make(map[string]transfer)
+	defer func() { d.prev, d.prevAt = current, now }()
+
+	line := func(format string, args ...any) {
+		fmt.Fprintf(w, format, args...)
+		io.WriteString(w, clearLine+"\n")
+	}
+
+	line("tinytorrent %s %s (%s)   connections %d (%d half-open)   banned %d",
+		s.Build.ClientID, s.Build.ClientVersion, s.Build.GoVersion, s.Connections, s.HalfOpen, s.BannedPeers)
+	line("")
+
+	if len(s.Torrents) == 0 {
+		line("no torrents")
+	}
+
+	for i := range s.Torrents {
+		t := &s.Torrents[i]
+
+		var progress float64
+		if t.Size > 0 {
+			progress = float64(t.Size-t.Left) / float64(t.Size)
+		}
+
+		line("%s  %s", truncate(t.Name, width-len(t.InfoHash)-2), t.InfoHash)
+		line("%s %5.1f%%  %s / %s", bar(progress, width-30), 100*progress, formatBytes(t.Size-t.Left), formatBytes(t.Size))
+		line("down %s  up %s  eta %s   pieces %d/%d (%d failed)   wasted %s",
+			formatRate(t.DownloadRate), formatRate(t.UploadRate), eta(t.Left, t.DownloadRate),
+			t.PiecesHave, t.Pieces, t.PiecesFailed, formatBytes(t.WastedBytes))
+
+		tracker := fmt.Sprintf("tracker  %d ok, %d failed", t.Announces.Succeeded, t.Announces.Failed)
+		if !t.Announces.Last.IsZero() {
+			tracker += fmt.Sprintf(", last %s ago with %d peers", now.Sub(t.Announces.Last).Truncate(time.Second), t.Announces.LastPeers)
+		}
+		if t.Announces.LastError != "" {
+			tracker += ", error: " + t.Announces.LastError
+		}
+		line("%s", truncate(tracker, width))
+		line("peers    %d connected (%d in, %d out), %d dialing, %d candidates",
+			t.Peers.Connected, t.Peers.Incoming, t.Peers.Outgoing, t.Peers.Dialing, t.Peers.Candidates)
+		line("")
+
+		line("pieces   %s", pieceMap(t.Have, t.Availability, width-9))
+		line("         █ have  ▓ 3+ peers  ▒ 2 peers  ░ 1 peer  . unavailable")
+		line("")
+
+		line("%-22s %-20s %-5s %8s %10s %10s", "ADDRESS", "CLIENT", "FLAGS", "PROGRESS", "DOWN", "UP")
+		for j := range t.Connections {
+			p := &t.Connections[j]
+
+			key := t.InfoHash + "/" + p.Addr
+			current[key] = transfer{down: p.Downloaded, up: p.Uploaded}
+
+			if j >= maxPeers {
+				continue
+			}
+
+			var down, up int64
+			if before, ok := d.prev[key]; ok && elapsed > 0 {
+				down = int64(float64(p.Downloaded-before.down) / elapsed)
+				up = int64(float64(p.Uploaded-before.up) / elapsed)
+			}
+			var have float64
+			if t.Pieces > 0 {
+				have = 100 * float64(p.Pieces) / float64(t.Pieces)
+			}
+			line("%-22s %-20s %-5s %7.1f%% %10s %10s",
+				truncate(p.Addr, 22), truncate(clientName(p), 20), p.Flags(), have, formatRate(down), formatRate(up))
+		}
+		if n := len(t.Connections) - maxPeers; n > 0 {
+			line("... and %d more", n)
+		}
+		line("")
+	}
+
+	d.l.Lock()
+	logs := append([]string(nil), d.logs...)
+	d.l.Unlock()
+	if len(logs) > 0 {
+		line("log")
+		for _, l := range logs {
+			line("%s", truncate(l, width))
+		}
+	}
+}
+
+// clientName returns the client the peer advertised or
+// the client derived from its peer id otherwise.
+func clientName(p *client.PeerInfo) string {
+	if p.Client != "" {
+		return p.Client
+	}
+	return peerid.Name(p.ID)
+}
+
+// pieceMap draws the pieces into cells of the width, each cell showing
+// the least available piece of those it covers that is still missing.
+func pieceMap(have []bool, availability []int, width int) string {
+	if len(have) == 0 {
+		return ""
+	}
+
+	cells := min(width, len(have))
+	var b strings.Builder
+	for c := range cells {
+		lo, hi := c*len(have)/cells, (c+1)*len(have)/cells
+
+		least := -1
+		for i := lo; i < hi; i++ {
+			if !have[i] && (least < 0 || availability[i] < least) {
+				least = availability[i]
+			}
+		}
+
+		switch {
+		case least < 0:
+			b.WriteRune('█')
+		case least >= 3:
+			b.WriteRune('▓')
+		case least == 2:
+			b.WriteRune('▒')
+		case least == 1:
+			b.WriteRune('░')
+		default:
+			b.WriteByte('.')
+		}
+	}
+	return b.String()
+}
+
+func bar(progress float64, width int) string {
+	done := int(progress * float64(width))
+	done = max(0, min(done, width))
+	return "[" + strings.Repeat("#", done) + strings.Repeat("-", width-done) + "]"
+}
+
+func eta(left, rate int64) string {
+	switch {
+	case left <= 0:
+		return "done"
+	case rate <= 0:
+		return "-"
+	default:
+		return (time.Duration(left/rate) * time.Second).String()
+	}
+}
+
+func formatRate(n int64) string { return formatBytes(n) + "/s" }
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:max(0, n-1)]) + "…"
+}
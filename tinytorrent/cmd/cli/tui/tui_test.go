@@ -0,0 +1,85 @@
+package tui
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/cmd/cli/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashboard_Render(t *testing.T) {
+	stats := func(downloaded int64) client.Stats {
+		return client.Stats{Torrents: []client.TorrentStats{{
+			InfoHash:     "abcd",
+			Name:         "debian.iso",
+			Size:         4096,
+			Left:         2048,
+			DownloadRate: 1024,
+			Pieces:       4,
+			PiecesHave:   2,
+			Have:         []bool{true, true, false, false},
+			Availability: []int{0, 0, 3, 0},
+			Connections: []client.PeerInfo{{
+				Addr:        "10.0.0.1:6881",
+				ID:          "-qB4630-\x01\x02",
+				Interesting: true,
+				Interested:  true,
+				Choked:      true,
+				ChokedBy:    true,
+				Downloaded:  downloaded,
+				Pieces:      4,
+			}},
+		}}}
+	}
+
+	d := New(new(bytes.Buffer))
+	now := time.Now()
+	d.render(new(bytes.Buffer), stats(0), now)
+
+	var b bytes.Buffer
+	d.render(&b, stats(2048), now.Add(2*time.Second))
+	out := b.String()
+
+	assert.Contains(t, out, "debian.iso  abcd")
+	assert.Contains(t, out, " 50.0%  2.0 KiB / 4.0 KiB")
+	assert.Contains(t, out, "eta 2s")
+	assert.Contains(t, out, "pieces   ██▓.")
+	assert.Contains(t, out, "qBittorrent 4.6.3")
+	assert.Contains(t, out, "du") // interested in each other, both choked.
+	assert.Contains(t, out, "1.0 KiB/s")
+}
+
+func TestDashboard_Write(t *testing.T) {
+	var out bytes.Buffer
+	d := New(&out)
+
+	d.Write([]byte("before\n"))
+	assert.Equal(t, "before\n", out.String())
+
+	d.running = true
+	for i := range maxLogs + 2 {
+		d.Write([]byte(strings.Repeat("x", i) + "\n"))
+	}
+	d.Write([]byte("partial"))
+	assert.Len(t, d.logs, maxLogs)
+	assert.Equal(t, strings.Repeat("x", maxLogs+1), d.logs[maxLogs-1])
+	assert.Equal(t, "partial", string(d.partial))
+}
+
+func TestPieceMap(t *testing.T) {
+	have := []bool{true, true, false, false, false, true}
+	availability := []int{0, 0, 1, 2, 0, 5}
+
+	assert.Equal(t, "██░▒.█", pieceMap(have, availability, 10))
+	assert.Equal(t, "█░.", pieceMap(have, availability, 3))
+	assert.Equal(t, "", pieceMap(nil, nil, 3))
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "3.0 GiB", formatBytes(3<<30))
+}
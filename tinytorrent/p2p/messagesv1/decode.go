@@ -23,6 +23,13 @@ const (
 	PieceType
 	CancelType
 	PortType
+	// ExtendedType is the message of the extension protocol (BEP10).
+	ExtendedType MessageType = 20
+	// HashRequestType, HashesType and HashRejectType exchange the
+	// merkle tree hashes of the files of v2 torrents (BEP52).
+	HashRequestType MessageType = 21
+	HashesType      MessageType = 22
+	HashRejectType  MessageType = 23
 )
 
 type Message struct {
@@ -69,7 +76,8 @@ func Identify(reader io.Reader) (*Message, error) {
 	switch typ := MessageType(messageID[0]); typ {
 	case ChokeType, UnChokeType, InterestType, NotInterestType:
 		return &Message{Type: typ}, nil
-	case HaveType, BitfieldType, RequestType, PieceType, CancelType, PortType:
+	case HaveType, BitfieldType, RequestType, PieceType, CancelType, PortType, ExtendedType,
+		HashRequestType, HashesType, HashRejectType:
 		return &Message{Type: typ, Payload: payload}, nil
 	default:
 		return nil, fmt.Errorf("unknown message id: %v", messageID[0])
@@ -0,0 +1,131 @@
+package messagesv1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Despire/tinytorrent/bencoding"
+)
+
+const (
+	// ExtensionReservedByte and ExtensionReservedBit locate the bit of the
+	// reserved handshake bytes signalling support of the extension protocol.
+	// BEP10: https://www.bittorrent.org/beps/bep_0010.html
+	ExtensionReservedByte = 5
+	ExtensionReservedBit  = 0x10
+)
+
+// ExtendedHandshakeID is the extended message id of the extension handshake.
+const ExtendedHandshakeID = 0
+
+// Extended is a message of the extension protocol.
+type Extended struct {
+	// ID is the extended message id, 0 for the extension handshake
+	// or the id the remote peer assigned to the extension otherwise.
+	ID      uint8
+	Payload []byte
+}
+
+func (e *Extended) Serialize() []byte {
+	msg := make([]byte, 4+1+1, 4+1+1+len(e.Payload)) // 4 for the length, 1 for id, 1 for extended id
+
+	binary.BigEndian.PutUint32(msg[:4], uint32(1+1+len(e.Payload)))
+	msg[4] = byte(ExtendedType)
+	msg[5] = e.ID
+
+	return append(msg, e.Payload...)
+}
+
+func (e *Extended) Deserialize(payload []byte) error {
+	if len(payload) < 1 {
+		return errors.New("extended message is missing the extended id")
+	}
+	e.ID = payload[0]
+	e.Payload = payload[1:]
+	return nil
+}
+
+// ExtendedHandshake is the payload of the extension handshake,
+// all of its fields are optional.
+type ExtendedHandshake struct {
+	// M maps the names of the supported extensions to the
+	// extended message ids they should be sent with.
+	M map[string]int64
+	// V is the name and version of the client.
+	V string
+	// Reqq is the number of outstanding requests the
+	// client handles without dropping any.
+	Reqq int64
+	// P is the port the client listens on.
+	P int64
+	// UploadOnly says whether the client only uploads, as it
+	// is a seed or has all the pieces of the files it wants.
+	// BEP21: https://www.bittorrent.org/beps/bep_0021.html
+	UploadOnly bool
+}
+
+func (h *ExtendedHandshake) Serialize() []byte {
+	m := make(map[string]bencoding.Value, len(h.M))
+	for name, id := range h.M {
+		m[name] = (*bencoding.Integer)(&id)
+	}
+
+	dict := map[string]bencoding.Value{
+		"m": &bencoding.Dictionary{Dict: m},
+	}
+	if h.V != "" {
+		dict["v"] = (*bencoding.ByteString)(&h.V)
+	}
+	if h.Reqq > 0 {
+		dict["reqq"] = (*bencoding.Integer)(&h.Reqq)
+	}
+	if h.P > 0 {
+		dict["p"] = (*bencoding.Integer)(&h.P)
+	}
+	if h.UploadOnly {
+		one := int64(1)
+		dict["upload_only"] = (*bencoding.Integer)(&one)
+	}
+
+	e := Extended{
+		ID:      ExtendedHandshakeID,
+		Payload: []byte((&bencoding.Dictionary{Dict: dict}).Literal()),
+	}
+	return e.Serialize()
+}
+
+// Deserialize decodes the bencoded payload of the extended message.
+func (h *ExtendedHandshake) Deserialize(payload []byte) error {
+	v, err := bencoding.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to decode extension handshake: %w", err)
+	}
+	d, ok := v.(*bencoding.Dictionary)
+	if !ok {
+		return fmt.Errorf("expected extension handshake to be a dictionary, got %s", v.Type())
+	}
+
+	if m, ok := d.Dict["m"].(*bencoding.Dictionary); ok {
+		h.M = make(map[string]int64, len(m.Dict))
+		for name, id := range m.Dict {
+			if id, ok := id.(*bencoding.Integer); ok {
+				h.M[name] = int64(*id)
+			}
+		}
+	}
+	if v, ok := d.Dict["v"].(*bencoding.ByteString); ok {
+		h.V = string(*v)
+	}
+	if reqq, ok := d.Dict["reqq"].(*bencoding.Integer); ok {
+		h.Reqq = int64(*reqq)
+	}
+	if p, ok := d.Dict["p"].(*bencoding.Integer); ok {
+		h.P = int64(*p)
+	}
+	if u, ok := d.Dict["upload_only"].(*bencoding.Integer); ok {
+		h.UploadOnly = *u != 0
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package messagesv1
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// V2ReservedByte and V2ReservedBit locate the bit of the reserved
+	// handshake bytes signalling support of the v2 protocol.
+	// BEP52: https://www.bittorrent.org/beps/bep_0052.html
+	V2ReservedByte = 7
+	V2ReservedBit  = 0x10
+)
+
+// hashRequestLength is the length of the payload of the hash request and
+// hash reject messages, the hashes message is followed by the hashes.
+const hashRequestLength = 32 + 4 + 4 + 4 + 4
+
+// HashRequest asks for the hashes of a layer of the merkle tree of
+// a file of a v2 torrent, along with the hashes needed to verify
+// them up to the pieces root of the file.
+type HashRequest struct {
+	// PiecesRoot is the root of the merkle tree of the file.
+	PiecesRoot [32]byte
+	// BaseLayer is the layer of the tree the hashes are requested
+	// from, 0 being the layer of the hashes of the 16KiB blocks.
+	BaseLayer uint32
+	// Index is the offset of the first hash within the layer and
+	// Length the number of hashes requested, a power of two.
+	Index  uint32
+	Length uint32
+	// ProofLayers is the number of layers above the requested
+	// hashes the uncle hashes are requested for.
+	ProofLayers uint32
+}
+
+func (h *HashRequest) Serialize() []byte { return serializeHash(HashRequestType, h, nil) }
+
+func (h *HashRequest) Deserialize(data []byte) error {
+	if len(data) != hashRequestLength {
+		return errors.New("wrong length")
+	}
+	deserializeHash(h, data)
+	return nil
+}
+
+// Hashes answers a HashRequest with the requested hashes
+// followed by the uncle hashes of the proof layers.
+type Hashes struct {
+	Request HashRequest
+	Hashes  [][32]byte
+}
+
+func (h *Hashes) Serialize() []byte { return serializeHash(HashesType, &h.Request, h.Hashes) }
+
+func (h *Hashes) Deserialize(data []byte) error {
+	if len(data) < hashRequestLength || (len(data)-hashRequestLength)%32 != 0 {
+		return errors.New("wrong length")
+	}
+	deserializeHash(&h.Request, data)
+
+	h.Hashes = make([][32]byte, (len(data)-hashRequestLength)/32)
+	for i := range h.Hashes {
+		copy(h.Hashes[i][:], data[hashRequestLength+32*i:])
+	}
+	return nil
+}
+
+// HashReject refuses a HashRequest the peer is unable to answer.
+type HashReject struct {
+	Request HashRequest
+}
+
+func (h *HashReject) Serialize() []byte { return serializeHash(HashRejectType, &h.Request, nil) }
+
+func (h *HashReject) Deserialize(data []byte) error { return h.Request.Deserialize(data) }
+
+func serializeHash(typ MessageType, h *HashRequest, hashes [][32]byte) []byte {
+	// Length (4) | id (1) | pieces root (32) | base layer (4) | index (4) | length (4) | proof layers (4) | hashes variable.
+	msg := make([]byte, 4+1+hashRequestLength+32*len(hashes))
+
+	binary.BigEndian.PutUint32(msg[:4], uint32(len(msg)-4))
+	msg[4] = byte(typ)
+	copy(msg[5:37], h.PiecesRoot[:])
+	binary.BigEndian.PutUint32(msg[37:41], h.BaseLayer)
+	binary.BigEndian.PutUint32(msg[41:45], h.Index)
+	binary.BigEndian.PutUint32(msg[45:49], h.Length)
+	binary.BigEndian.PutUint32(msg[49:53], h.ProofLayers)
+	for i, hash := range hashes {
+		copy(msg[53+32*i:], hash[:])
+	}
+
+	return msg
+}
+
+func deserializeHash(h *HashRequest, data []byte) {
+	copy(h.PiecesRoot[:], data[:32])
+	h.BaseLayer = binary.BigEndian.Uint32(data[32:36])
+	h.Index = binary.BigEndian.Uint32(data[36:40])
+	h.Length = binary.BigEndian.Uint32(data[40:44])
+	h.ProofLayers = binary.BigEndian.Uint32(data[44:48])
+}
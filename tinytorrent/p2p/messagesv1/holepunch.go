@@ -0,0 +1,89 @@
+package messagesv1
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// HolepunchExtension is the name of the holepunch extension and HolepunchID
+// the extended message id this client receives its messages with.
+// BEP55: https://www.bittorrent.org/beps/bep_0055.html
+const (
+	HolepunchExtension = "ut_holepunch"
+	HolepunchID        = 4
+)
+
+type HolepunchType uint8
+
+const (
+	// HolepunchRendezvous asks the relay to connect this
+	// client with the peer at the address.
+	HolepunchRendezvous HolepunchType = iota
+	// HolepunchConnect tells the peer to connect to the address,
+	// sent by the relay to both ends of a rendezvous.
+	HolepunchConnect
+	// HolepunchError tells that the rendezvous failed.
+	HolepunchError
+)
+
+// Error codes of HolepunchError messages.
+const (
+	// HolepunchNoSuchPeer says the address is invalid.
+	HolepunchNoSuchPeer uint32 = iota + 1
+	// HolepunchNotConnected says the relay isn't connected to the peer.
+	HolepunchNotConnected
+	// HolepunchNoSupport says the peer doesn't support the extension.
+	HolepunchNoSupport
+	// HolepunchNoSelf says the address is the one of the sender.
+	HolepunchNoSelf
+)
+
+// Holepunch coordinates peers, that are both connected to a relay peer,
+// to connect to each other at the same time, getting through their NATs.
+type Holepunch struct {
+	Type HolepunchType
+	Addr netip.AddrPort
+	// Err is the error code of HolepunchError messages.
+	Err uint32
+}
+
+// Payload returns the payload of the extended message.
+func (h *Holepunch) Payload() []byte {
+	// type (1) | address type (1) | ip (4 or 16) | port (2) | error code (4)
+	ip := h.Addr.Addr().Unmap()
+
+	b := []byte{byte(h.Type), 0}
+	if ip.Is6() {
+		b[1] = 1
+	}
+	b = appendCompact(b, h.Addr)
+	return binary.BigEndian.AppendUint32(b, h.Err)
+}
+
+// Deserialize decodes the payload of the extended message.
+func (h *Holepunch) Deserialize(payload []byte) error {
+	if len(payload) < 2 {
+		return errors.New("holepunch message too short")
+	}
+	size := 4
+	switch payload[1] {
+	case 0:
+	case 1:
+		size = 16
+	default:
+		return fmt.Errorf("unknown holepunch address type %d", payload[1])
+	}
+	if len(payload) != 2+size+2+4 {
+		return errors.New("wrong length")
+	}
+	if payload[0] > byte(HolepunchError) {
+		return fmt.Errorf("unknown holepunch message type %d", payload[0])
+	}
+
+	h.Type = HolepunchType(payload[0])
+	h.Addr = parseCompact(payload[2 : 2+size+2])
+	h.Err = binary.BigEndian.Uint32(payload[2+size+2:])
+	return nil
+}
@@ -19,16 +19,31 @@ func _() {
 	_ = x[PieceType-7]
 	_ = x[CancelType-8]
 	_ = x[PortType-9]
+	_ = x[ExtendedType-20]
+	_ = x[HashRequestType-21]
+	_ = x[HashesType-22]
+	_ = x[HashRejectType-23]
 }
 
-const _MessageType_name = "KeepAliveTypeChokeTypeUnChokeTypeInterestTypeNotInterestTypeHaveTypeBitfieldTypeRequestTypePieceTypeCancelTypePortType"
+const (
+	_MessageType_name_0 = "KeepAliveTypeChokeTypeUnChokeTypeInterestTypeNotInterestTypeHaveTypeBitfieldTypeRequestTypePieceTypeCancelTypePortType"
+	_MessageType_name_1 = "ExtendedTypeHashRequestTypeHashesTypeHashRejectType"
+)
 
-var _MessageType_index = [...]uint8{0, 13, 22, 33, 45, 60, 68, 80, 91, 100, 110, 118}
+var (
+	_MessageType_index_0 = [...]uint8{0, 13, 22, 33, 45, 60, 68, 80, 91, 100, 110, 118}
+	_MessageType_index_1 = [...]uint8{0, 12, 27, 37, 51}
+)
 
 func (i MessageType) String() string {
-	i -= -1
-	if i < 0 || i >= MessageType(len(_MessageType_index)-1) {
-		return "MessageType(" + strconv.FormatInt(int64(i+-1), 10) + ")"
+	switch {
+	case -1 <= i && i <= 9:
+		i -= -1
+		return _MessageType_name_0[_MessageType_index_0[i]:_MessageType_index_0[i+1]]
+	case 20 <= i && i <= 23:
+		i -= 20
+		return _MessageType_name_1[_MessageType_index_1[i]:_MessageType_index_1[i+1]]
+	default:
+		return "MessageType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _MessageType_name[_MessageType_index[i]:_MessageType_index[i+1]]
 }
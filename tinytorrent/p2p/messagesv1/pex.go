@@ -0,0 +1,135 @@
+package messagesv1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/Despire/tinytorrent/bencoding"
+)
+
+// PexExtension is the name of the peer exchange extension and PexID the
+// extended message id this client receives its messages with.
+// BEP11: https://www.bittorrent.org/beps/bep_0011.html
+const (
+	PexExtension = "ut_pex"
+	PexID        = 1
+)
+
+// Flags describing the peers of a Pex message.
+const (
+	PexEncryption = 0x01
+	PexSeed       = 0x02
+	PexUTP        = 0x04
+	PexHolepunch  = 0x08
+	PexReachable  = 0x10
+)
+
+// PexPeer is a peer exchanged in a Pex message.
+type PexPeer struct {
+	Addr  netip.AddrPort
+	Flags uint8
+}
+
+// Pex tells a peer about the peers this client connected
+// to and disconnected from since the last Pex message.
+type Pex struct {
+	Added   []PexPeer
+	Dropped []netip.AddrPort
+}
+
+// Payload returns the bencoded payload of the extended message.
+func (p *Pex) Payload() []byte {
+	var added, addedF, added6, added6F, dropped, dropped6 []byte
+	for _, a := range p.Added {
+		if a.Addr.Addr().Unmap().Is4() {
+			added = appendCompact(added, a.Addr)
+			addedF = append(addedF, a.Flags)
+		} else {
+			added6 = appendCompact(added6, a.Addr)
+			added6F = append(added6F, a.Flags)
+		}
+	}
+	for _, d := range p.Dropped {
+		if d.Addr().Unmap().Is4() {
+			dropped = appendCompact(dropped, d)
+		} else {
+			dropped6 = appendCompact(dropped6, d)
+		}
+	}
+
+	dict := make(map[string]bencoding.Value)
+	for k, v := range map[string][]byte{
+		"added": added, "added.f": addedF,
+		"added6": added6, "added6.f": added6F,
+		"dropped": dropped, "dropped6": dropped6,
+	} {
+		s := bencoding.ByteString(v)
+		dict[k] = &s
+	}
+	return []byte((&bencoding.Dictionary{Dict: dict}).Literal())
+}
+
+// Deserialize decodes the bencoded payload of the extended message.
+func (p *Pex) Deserialize(payload []byte) error {
+	v, err := bencoding.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to decode pex message: %w", err)
+	}
+	d, ok := v.(*bencoding.Dictionary)
+	if !ok {
+		return fmt.Errorf("expected pex message to be a dictionary, got %s", v.Type())
+	}
+	field := func(k string) []byte {
+		if b, ok := d.Dict[k].(*bencoding.ByteString); ok {
+			return []byte(*b)
+		}
+		return nil
+	}
+
+	p.Added, p.Dropped = nil, nil
+	for _, f := range []struct {
+		addrs, flags string
+		size         int
+	}{{"added", "added.f", 6}, {"added6", "added6.f", 18}} {
+		addrs, flags := field(f.addrs), field(f.flags)
+		if len(addrs)%f.size != 0 {
+			return fmt.Errorf("malformed %s field", f.addrs)
+		}
+		for i := 0; i < len(addrs)/f.size; i++ {
+			a := PexPeer{Addr: parseCompact(addrs[i*f.size : (i+1)*f.size])}
+			if i < len(flags) {
+				a.Flags = flags[i]
+			}
+			p.Added = append(p.Added, a)
+		}
+	}
+	for _, f := range []struct {
+		addrs string
+		size  int
+	}{{"dropped", 6}, {"dropped6", 18}} {
+		addrs := field(f.addrs)
+		if len(addrs)%f.size != 0 {
+			return fmt.Errorf("malformed %s field", f.addrs)
+		}
+		for i := 0; i < len(addrs)/f.size; i++ {
+			p.Dropped = append(p.Dropped, parseCompact(addrs[i*f.size:(i+1)*f.size]))
+		}
+	}
+	return nil
+}
+
+// appendCompact appends the address in the compact form, the 4 or 16
+// bytes of the ip followed by the 2 bytes of the port.
+func appendCompact(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	b = append(b, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// parseCompact parses an address in the compact form.
+func parseCompact(b []byte) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(b[:len(b)-2])
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(b[len(b)-2:]))
+}
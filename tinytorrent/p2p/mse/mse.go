@@ -0,0 +1,461 @@
+// Package mse implements the Message Stream Encryption, also known as
+// Protocol Encryption, used to obfuscate BitTorrent connections.
+//
+// Specification: https://wiki.vuze.com/w/Message_Stream_Encryption
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+)
+
+// Policy describes how connections to other peers are obfuscated.
+//
+//go:generate stringer -type=Policy
+type Policy uint8
+
+const (
+	// PlaintextOnly never encrypts connections and refuses
+	// incoming encrypted connections.
+	PlaintextOnly Policy = iota
+	// PreferEncrypted attempts to encrypt outgoing connections and
+	// falls back to plaintext if the remote peer does not support it.
+	// Both plaintext and encrypted incoming connections are accepted.
+	PreferEncrypted
+	// RequireEncrypted only allows RC4 encrypted connections.
+	RequireEncrypted
+)
+
+// Crypto methods that can be negotiated during the handshake.
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+var (
+	// ErrPlaintextRefused is returned when a plaintext handshake is
+	// received but the policy requires encryption.
+	ErrPlaintextRefused = errors.New("plaintext connection refused, encryption required")
+	// ErrEncryptedRefused is returned when an encrypted handshake is
+	// received but the policy only allows plaintext.
+	ErrEncryptedRefused = errors.New("encrypted connection refused, plaintext only")
+)
+
+const (
+	// keyLength is the length of the public DH keys in bytes.
+	keyLength = 96
+	// maxPadLength is the maximum length of the random padding.
+	maxPadLength = 512
+	// discard is the number of RC4 keystream bytes discarded after init.
+	discard = 1024
+)
+
+var (
+	prime = func() *big.Int {
+		p, ok := new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+		if !ok {
+			panic("invalid mse prime")
+		}
+		return p
+	}()
+	generator = big.NewInt(2)
+	vc        = [8]byte{}
+)
+
+// Conn is a net.Conn that transparently encrypts and decrypts
+// the stream with the negotiated crypto method.
+type Conn struct {
+	net.Conn
+
+	// Method is the negotiated crypto method.
+	Method uint32
+	// InfoHash is the raw 20 byte hash of the torrent the handshake
+	// was performed for, empty for plaintext BitTorrent handshakes
+	// passed through by Accept.
+	InfoHash string
+
+	// pending is already decrypted data that was received
+	// during the handshake and is read before the stream.
+	pending []byte
+	enc     *rc4.Cipher
+	dec     *rc4.Cipher
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	enc := make([]byte, len(b))
+	c.enc.XORKeyStream(enc, b)
+
+	n, err := c.Conn.Write(enc)
+	if err == nil && n != len(b) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// Unwrap returns the underlying connection if the stream is not encrypted
+// and all data received during the handshake was read, so that it can be
+// used directly, for example to send files with sendfile.
+func (c *Conn) Unwrap() (net.Conn, bool) {
+	if c.enc != nil || len(c.pending) > 0 {
+		return nil, false
+	}
+	return c.Conn, true
+}
+
+// rest returns the bytes left in the buffer of the handshake,
+// which are the first bytes of the stream, decrypted.
+func rest(buf *bytes.Reader, dec *rc4.Cipher) []byte {
+	b := make([]byte, buf.Len())
+	buf.Read(b)
+	if dec != nil {
+		dec.XORKeyStream(b, b)
+	}
+	return b
+}
+
+// Initiate performs the handshake as the connecting peer A offering
+// the crypto methods in provide. The infoHash is the raw 20 byte
+// hash of the torrent which is used as the shared secret SKEY.
+func Initiate(conn net.Conn, infoHash string, provide uint32) (*Conn, error) {
+	priv, pub, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	if err := write(conn, pub, padA); err != nil {
+		return nil, fmt.Errorf("failed to send public key: %w", err)
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	var yb [keyLength]byte
+	if _, err := io.ReadFull(conn, yb[:]); err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	s := secret(priv, yb[:])
+	enc := newCipher(hash([]byte("keyA"), s, []byte(infoHash)))
+	dec := newCipher(hash([]byte("keyB"), s, []byte(infoHash)))
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	req := xor(hash([]byte("req2"), []byte(infoHash)), hash([]byte("req3"), s))
+
+	padC, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 0, len(vc)+4+2+len(padC)+2)
+	payload = append(payload, vc[:]...)
+	payload = binary.BigEndian.AppendUint32(payload, provide)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(padC)))
+	payload = append(payload, padC...)
+	payload = binary.BigEndian.AppendUint16(payload, 0) // no initial payload.
+	enc.XORKeyStream(payload, payload)
+
+	if err := write(conn, hash([]byte("req1"), s), req, payload); err != nil {
+		return nil, fmt.Errorf("failed to send crypto provide: %w", err)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	encryptedVC := make([]byte, len(vc))
+	newCipher(hash([]byte("keyB"), s, []byte(infoHash))).XORKeyStream(encryptedVC, vc[:])
+
+	leftover, err := syncTo(conn, encryptedVC, maxPadLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to synchronize on verification constant: %w", err)
+	}
+	dec.XORKeyStream(encryptedVC, encryptedVC) // advance the keystream past VC.
+
+	buf := bytes.NewReader(leftover)
+	r := io.MultiReader(buf, conn)
+
+	var hdr [4 + 2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("failed to read crypto select: %w", err)
+	}
+	dec.XORKeyStream(hdr[:], hdr[:])
+
+	sel := binary.BigEndian.Uint32(hdr[:4])
+	if sel != CryptoPlaintext && sel != CryptoRC4 || sel&provide == 0 {
+		return nil, fmt.Errorf("remote peer selected unsupported crypto method %#x", sel)
+	}
+
+	padD := make([]byte, binary.BigEndian.Uint16(hdr[4:]))
+	if len(padD) > maxPadLength {
+		return nil, fmt.Errorf("padding of length %d exceeds the maximum", len(padD))
+	}
+	if _, err := io.ReadFull(r, padD); err != nil {
+		return nil, fmt.Errorf("failed to read padding: %w", err)
+	}
+	dec.XORKeyStream(padD, padD)
+
+	c := &Conn{Conn: conn, Method: sel, InfoHash: infoHash}
+	if sel == CryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	c.pending = rest(buf, c.dec)
+	return c, nil
+}
+
+// Accept inspects the first bytes received on the connection and either
+// performs the handshake as the receiving peer B, with the infoHashes being
+// the torrents this client is willing to serve, or passes through a plaintext
+// BitTorrent handshake depending on the policy.
+func Accept(conn net.Conn, infoHashes []string, policy Policy) (*Conn, error) {
+	prefix := make([]byte, 1+len(messagesv1.ProtocolV1))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, fmt.Errorf("failed to read connection prefix: %w", err)
+	}
+
+	if prefix[0] == byte(len(messagesv1.ProtocolV1)) && string(prefix[1:]) == messagesv1.ProtocolV1 {
+		if policy == RequireEncrypted {
+			return nil, ErrPlaintextRefused
+		}
+		return &Conn{Conn: conn, Method: CryptoPlaintext, pending: prefix}, nil
+	}
+
+	switch policy {
+	case PreferEncrypted:
+		return receive(conn, prefix, infoHashes, CryptoRC4|CryptoPlaintext)
+	case RequireEncrypted:
+		return receive(conn, prefix, infoHashes, CryptoRC4)
+	default:
+		return nil, ErrEncryptedRefused
+	}
+}
+
+func receive(conn net.Conn, prefix []byte, infoHashes []string, accept uint32) (*Conn, error) {
+	r := io.MultiReader(bytes.NewReader(prefix), conn)
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	var ya [keyLength]byte
+	if _, err := io.ReadFull(r, ya[:]); err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	priv, pub, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	padB, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	if err := write(conn, pub, padB); err != nil {
+		return nil, fmt.Errorf("failed to send public key: %w", err)
+	}
+
+	s := secret(priv, ya[:])
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	leftover, err := syncTo(r, hash([]byte("req1"), s), maxPadLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to synchronize on req1: %w", err)
+	}
+	// the prefix was read with the public key, the bytes past the
+	// handshake can only be left in the buffer of the leftover.
+	buf := bytes.NewReader(leftover)
+	r = io.MultiReader(buf, r)
+
+	var req [sha1.Size]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return nil, fmt.Errorf("failed to read obfuscated info hash: %w", err)
+	}
+
+	req3 := hash([]byte("req3"), s)
+	skey := ""
+	for _, h := range infoHashes {
+		if bytes.Equal(xor(hash([]byte("req2"), []byte(h)), req3), req[:]) {
+			skey = h
+			break
+		}
+	}
+	if skey == "" {
+		return nil, errors.New("remote peer requested an unknown info hash")
+	}
+
+	dec := newCipher(hash([]byte("keyA"), s, []byte(skey)))
+	enc := newCipher(hash([]byte("keyB"), s, []byte(skey)))
+
+	var hdr [len(vc) + 4 + 2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("failed to read crypto provide: %w", err)
+	}
+	dec.XORKeyStream(hdr[:], hdr[:])
+
+	if !bytes.Equal(hdr[:len(vc)], vc[:]) {
+		return nil, errors.New("invalid verification constant")
+	}
+
+	provide := binary.BigEndian.Uint32(hdr[len(vc) : len(vc)+4])
+
+	padC := make([]byte, binary.BigEndian.Uint16(hdr[len(vc)+4:]))
+	if len(padC) > maxPadLength {
+		return nil, fmt.Errorf("padding of length %d exceeds the maximum", len(padC))
+	}
+	if _, err := io.ReadFull(r, padC); err != nil {
+		return nil, fmt.Errorf("failed to read padding: %w", err)
+	}
+	dec.XORKeyStream(padC, padC)
+
+	var iaLen [2]byte
+	if _, err := io.ReadFull(r, iaLen[:]); err != nil {
+		return nil, fmt.Errorf("failed to read initial payload length: %w", err)
+	}
+	dec.XORKeyStream(iaLen[:], iaLen[:])
+
+	ia := make([]byte, binary.BigEndian.Uint16(iaLen[:]))
+	if _, err := io.ReadFull(r, ia); err != nil {
+		return nil, fmt.Errorf("failed to read initial payload: %w", err)
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var sel uint32
+	switch {
+	case provide&accept&CryptoRC4 != 0:
+		sel = CryptoRC4
+	case provide&accept&CryptoPlaintext != 0:
+		sel = CryptoPlaintext
+	default:
+		return nil, fmt.Errorf("no common crypto method, provided %#x, accepted %#x", provide, accept)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	padD, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 0, len(vc)+4+2+len(padD))
+	payload = append(payload, vc[:]...)
+	payload = binary.BigEndian.AppendUint32(payload, sel)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(padD)))
+	payload = append(payload, padD...)
+	enc.XORKeyStream(payload, payload)
+
+	if err := write(conn, payload); err != nil {
+		return nil, fmt.Errorf("failed to send crypto select: %w", err)
+	}
+
+	c := &Conn{Conn: conn, Method: sel, InfoHash: skey}
+	if sel == CryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	c.pending = append(ia, rest(buf, c.dec)...)
+	return c, nil
+}
+
+func newKeys() (*big.Int, []byte, error) {
+	var x [20]byte
+	if _, err := rand.Read(x[:]); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	priv := new(big.Int).SetBytes(x[:])
+	pub := new(big.Int).Exp(generator, priv, prime)
+	return priv, pub.FillBytes(make([]byte, keyLength)), nil
+}
+
+func secret(priv *big.Int, remote []byte) []byte {
+	s := new(big.Int).Exp(new(big.Int).SetBytes(remote), priv, prime)
+	return s.FillBytes(make([]byte, keyLength))
+}
+
+func randomPad() ([]byte, error) {
+	var l [2]byte
+	if _, err := rand.Read(l[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate padding: %w", err)
+	}
+	pad := make([]byte, binary.BigEndian.Uint16(l[:])%(maxPadLength+1))
+	if _, err := rand.Read(pad); err != nil {
+		return nil, fmt.Errorf("failed to generate padding: %w", err)
+	}
+	return pad, nil
+}
+
+func newCipher(key []byte) *rc4.Cipher {
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		panic(err) // a SHA1 digest is always a valid key.
+	}
+	var skip [discard]byte
+	c.XORKeyStream(skip[:], skip[:])
+	return c
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+func write(w io.Writer, parts ...[]byte) error {
+	_, err := w.Write(bytes.Join(parts, nil))
+	return err
+}
+
+// syncTo reads from r until the pattern is found within the first
+// maxSkip+len(pattern) bytes and returns the bytes read after the pattern.
+func syncTo(r io.Reader, pattern []byte, maxSkip int) ([]byte, error) {
+	buf := make([]byte, 0, maxSkip+len(pattern))
+	chunk := make([]byte, cap(buf))
+	for {
+		if i := bytes.Index(buf, pattern); i >= 0 {
+			return buf[i+len(pattern):], nil
+		}
+		if len(buf) == cap(buf) {
+			return nil, errors.New("pattern not found")
+		}
+		n, err := r.Read(chunk[:cap(buf)-len(buf)])
+		buf = append(buf, chunk[:n]...)
+		if err != nil && n == 0 {
+			return nil, err
+		}
+	}
+}
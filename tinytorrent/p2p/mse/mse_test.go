@@ -0,0 +1,159 @@
+package mse_test
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/mse"
+	"github.com/stretchr/testify/assert"
+)
+
+var infoHash = strings.Repeat("\x07", 20)
+
+// pipe returns both ends of a loopback TCP connection.
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		assert.Nil(t, err)
+		accepted <- c
+	}()
+
+	a, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	b := <-accepted
+
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	a.SetDeadline(time.Now().Add(10 * time.Second))
+	b.SetDeadline(time.Now().Add(10 * time.Second))
+	return a, b
+}
+
+type result struct {
+	conn *mse.Conn
+	err  error
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		provide uint32
+		policy  mse.Policy
+		want    uint32
+		wantErr bool
+	}{
+		{name: "rc4-preferred", provide: mse.CryptoRC4 | mse.CryptoPlaintext, policy: mse.PreferEncrypted, want: mse.CryptoRC4},
+		{name: "rc4-required", provide: mse.CryptoRC4, policy: mse.RequireEncrypted, want: mse.CryptoRC4},
+		{name: "plaintext-after-handshake", provide: mse.CryptoPlaintext, policy: mse.PreferEncrypted, want: mse.CryptoPlaintext},
+		{name: "plaintext-refused", provide: mse.CryptoPlaintext, policy: mse.RequireEncrypted, wantErr: true},
+		{name: "encryption-refused", provide: mse.CryptoRC4, policy: mse.PlaintextOnly, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := pipe(t)
+
+			received := make(chan result, 1)
+			go func() {
+				c, err := mse.Accept(b, []string{strings.Repeat("\x01", 20), infoHash}, tt.policy)
+				if err != nil {
+					b.Close() // signal failure to the initiator.
+				}
+				received <- result{c, err}
+			}()
+
+			initiated, err := mse.Initiate(a, infoHash, tt.provide)
+			r := <-received
+			if tt.wantErr {
+				assert.NotNil(t, r.err)
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Nil(t, r.err)
+			assert.Equal(t, tt.want, initiated.Method)
+			assert.Equal(t, tt.want, r.conn.Method)
+			assert.Equal(t, infoHash, initiated.InfoHash)
+			assert.Equal(t, infoHash, r.conn.InfoHash)
+
+			// exchange a handshake in both directions over the negotiated stream.
+			h := messagesv1.Handshake{Pstr: messagesv1.ProtocolV1, InfoHash: infoHash, PeerID: strings.Repeat("a", 20)}
+			msg := h.Serialize()
+
+			go func() { initiated.Write(msg) }()
+			got := make([]byte, len(msg))
+			_, err = io.ReadFull(r.conn, got)
+			assert.Nil(t, err)
+			assert.Equal(t, msg, got)
+
+			go func() { r.conn.Write(msg) }()
+			got = make([]byte, len(msg))
+			_, err = io.ReadFull(initiated, got)
+			assert.Nil(t, err)
+			assert.Equal(t, msg, got)
+
+			// only unencrypted streams are used directly.
+			_, ok := r.conn.Unwrap()
+			assert.Equal(t, tt.want == mse.CryptoPlaintext, ok)
+			_, ok = initiated.Unwrap()
+			assert.Equal(t, tt.want == mse.CryptoPlaintext, ok)
+		})
+	}
+}
+
+func TestHandshake_UnknownInfoHash(t *testing.T) {
+	a, b := pipe(t)
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := mse.Accept(b, []string{strings.Repeat("\x01", 20)}, mse.PreferEncrypted)
+		b.Close()
+		received <- err
+	}()
+
+	_, err := mse.Initiate(a, infoHash, mse.CryptoRC4)
+	assert.NotNil(t, err)
+	assert.NotNil(t, <-received)
+}
+
+func TestAccept_Plaintext(t *testing.T) {
+	h := messagesv1.Handshake{Pstr: messagesv1.ProtocolV1, InfoHash: infoHash, PeerID: strings.Repeat("b", 20)}
+	msg := h.Serialize()
+
+	for _, policy := range []mse.Policy{mse.PlaintextOnly, mse.PreferEncrypted, mse.RequireEncrypted} {
+		t.Run(policy.String(), func(t *testing.T) {
+			a, b := pipe(t)
+			go func() { a.Write(msg) }()
+
+			c, err := mse.Accept(b, []string{infoHash}, policy)
+			if policy == mse.RequireEncrypted {
+				assert.ErrorIs(t, err, mse.ErrPlaintextRefused)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Empty(t, c.InfoHash)
+
+			// the passed through prefix is read before the connection is used directly.
+			_, ok := c.Unwrap()
+			assert.False(t, ok)
+			got := make([]byte, len(msg))
+			_, err = io.ReadFull(c, got)
+			assert.Nil(t, err)
+			assert.Equal(t, msg, got)
+			plain, ok := c.Unwrap()
+			assert.True(t, ok)
+			assert.Equal(t, b, plain)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package peer
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -46,13 +47,9 @@ func (p *Peer) listener() {
 		}
 	}
 
-	switch p.typ {
-	case leecher:
-		close(p.leecher.requests)
-		close(p.leecher.cancels)
-	case seeder:
-		close(p.seeder.pieces)
-	}
+	close(p.pieces)
+	close(p.requests)
+	close(p.cancels)
 	p.wg.Done()
 	p.connectionStatus.Store(uint32(ConnectionKilled))
 	p.logger.Debug("peer connection shutting down")
@@ -84,6 +81,9 @@ func (p *Peer) process(msg *messagesv1.Message) error {
 			return fmt.Errorf("could not acknowledge piece %v: %w", h.Index, err)
 		}
 		p.logger.Debug("updated bitfield based on have message")
+		if p.haves != nil {
+			p.haves(p, h.Index)
+		}
 		return nil
 	case messagesv1.BitfieldType: // peer send what pieces he possesses.
 		b := new(messagesv1.Bitfield)
@@ -98,55 +98,120 @@ func (p *Peer) process(msg *messagesv1.Message) error {
 		p.logger.Debug("updated bitfield based on bitfield message")
 		return nil
 	case messagesv1.PieceType: // peer send a piece
-		if p.typ == seeder {
-			pc := new(messagesv1.Piece)
+		pc := new(messagesv1.Piece)
 
-			if err := pc.Deserialize(msg.Payload); err != nil {
-				return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
-			}
-			p.seeder.pieces <- pc
-			return nil
+		if err := pc.Deserialize(msg.Payload); err != nil {
+			return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
 		}
-		return fmt.Errorf("received piece message on leecher connection")
+		p.lastPiece.Store(time.Now().UnixNano())
+		p.downloaded.Add(int64(len(pc.Block)))
+		p.pieces <- pc
+		return nil
 	case messagesv1.PortType: // peer requested DHT extension.
 		return fmt.Errorf("dht is not supported")
 	case messagesv1.RequestType: //  peer send a request
-		if p.typ == leecher {
-			req := new(messagesv1.Request)
+		req := new(messagesv1.Request)
 
-			if err := req.Deserialize(msg.Payload); err != nil {
-				return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
-			}
-			if p.Status.This.Load() == uint32(Choked) {
-				return fmt.Errorf("dropped request as peer is choked")
+		if err := req.Deserialize(msg.Payload); err != nil {
+			return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
+		}
+		if p.Status.This.Load() == uint32(Choked) {
+			return fmt.Errorf("dropped request as peer is choked")
+		}
+		if p.Interest.Remote.Load() == uint32(NotInterested) {
+			return fmt.Errorf("dropped request a peer is not interested")
+		}
+
+		p.requests <- req
+		return nil
+	case messagesv1.CancelType:
+		cnc := new(messagesv1.Cancel)
+
+		if err := cnc.Deserialize(msg.Payload); err != nil {
+			return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
+		}
+
+		if p.Status.This.Load() == uint32(Choked) {
+			return fmt.Errorf("dropped request as peer is choked")
+		}
+		if p.Interest.Remote.Load() == uint32(NotInterested) {
+			return fmt.Errorf("dropped request a peer is not interested")
+		}
+
+		p.cancels <- cnc
+		return nil
+	case messagesv1.ExtendedType:
+		ext := new(messagesv1.Extended)
+		if err := ext.Deserialize(msg.Payload); err != nil {
+			return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
+		}
+		switch {
+		case ext.ID == messagesv1.PexID && p.pex != nil:
+			pex := new(messagesv1.Pex)
+			if err := pex.Deserialize(ext.Payload); err != nil {
+				return fmt.Errorf("could not deserialize pex message: %w", err)
 			}
-			if p.Interest.Remote.Load() == uint32(NotInterested) {
-				return fmt.Errorf("dropped request a peer is not interested")
+			p.pex(p, pex)
+			return nil
+		case ext.ID == messagesv1.HolepunchID && p.holepunch != nil:
+			h := new(messagesv1.Holepunch)
+			if err := h.Deserialize(ext.Payload); err != nil {
+				return fmt.Errorf("could not deserialize holepunch message: %w", err)
 			}
-
-			p.leecher.requests <- req
+			p.holepunch(p, h)
 			return nil
+		case ext.ID != messagesv1.ExtendedHandshakeID:
+			return fmt.Errorf("no implementation for processing extended message id: %v", ext.ID)
 		}
-		return fmt.Errorf("did not expect a request message on a seeder connection")
-	case messagesv1.CancelType:
-		if p.typ == leecher {
-			cnc := new(messagesv1.Cancel)
 
-			if err := cnc.Deserialize(msg.Payload); err != nil {
-				return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
-			}
+		h := new(messagesv1.ExtendedHandshake)
+		if err := h.Deserialize(ext.Payload); err != nil {
+			return fmt.Errorf("could not deserialize extension handshake: %w", err)
+		}
+		if h.Reqq > 0 {
+			p.setRemoteRequestQueue(int(min(h.Reqq, MaxRequestQueue)))
+		}
+		p.remoteExtensions.Store(h)
+		p.logger.Debug("received extension handshake", slog.String("client", h.V), slog.Int64("reqq", h.Reqq))
+		return nil
+	case messagesv1.HashRequestType:
+		req := new(messagesv1.HashRequest)
+		if err := req.Deserialize(msg.Payload); err != nil {
+			return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
+		}
 
-			if p.Status.This.Load() == uint32(Choked) {
-				return fmt.Errorf("dropped request as peer is choked")
+		if p.hashes != nil {
+			hashes, err := p.hashes(req)
+			if err == nil {
+				return p.SendHashes(&messagesv1.Hashes{Request: *req, Hashes: hashes})
+			}
+			p.logger.Debug("rejecting hash request", slog.Any("err", err))
+		}
+		return p.SendHashReject(&messagesv1.HashReject{Request: *req})
+	case messagesv1.HashesType, messagesv1.HashRejectType:
+		// hashes are never requested, the piece layers must be part of the
+		// torrent, so that the hashes and rejects received are discarded.
+		var req *messagesv1.HashRequest
+		if msg.Type == messagesv1.HashesType {
+			hashes := new(messagesv1.Hashes)
+			if err := hashes.Deserialize(msg.Payload); err != nil {
+				return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
 			}
-			if p.Interest.Remote.Load() == uint32(NotInterested) {
-				return fmt.Errorf("dropped request a peer is not interested")
+			req = &hashes.Request
+		} else {
+			reject := new(messagesv1.HashReject)
+			if err := reject.Deserialize(msg.Payload); err != nil {
+				return fmt.Errorf("could not deserialize message %s: %w", msg.Type, err)
 			}
-
-			p.leecher.cancels <- cnc
-			return nil
+			req = &reject.Request
 		}
-		return fmt.Errorf("did not expect a cancel message on a seeder connection")
+		p.logger.Info("discarding unrequested hashes message, requesting hashes is not supported",
+			slog.String("type", msg.Type.String()),
+			slog.String("pieces_root", hex.EncodeToString(req.PiecesRoot[:])),
+			slog.String("index", fmt.Sprint(req.Index)),
+			slog.String("length", fmt.Sprint(req.Length)),
+		)
+		return nil
 	default:
 		return fmt.Errorf("no implementation for processing message type: %s", msg.Type)
 	}
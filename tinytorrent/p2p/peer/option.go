@@ -0,0 +1,105 @@
+package peer
+
+import (
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/mse"
+	"github.com/Despire/tinytorrent/p2p/recorder"
+	"github.com/Despire/tinytorrent/p2p/transport"
+)
+
+type Option func(p *Peer)
+
+// WithEncryption sets the policy used to obfuscate
+// the connection to the remote peer.
+func WithEncryption(policy mse.Policy) Option {
+	return func(p *Peer) {
+		p.encryption = policy
+	}
+}
+
+// WithRequestQueue sets the number of outstanding requests
+// advertised to the remote peer in the extension handshake.
+func WithRequestQueue(n int) Option {
+	return func(p *Peer) {
+		p.requestQueue = n
+	}
+}
+
+// WithDialer sets the function used to establish outgoing
+// connections to the remote peer, by default TCP is used.
+func WithDialer(dial transport.DialFunc) Option {
+	return func(p *Peer) {
+		p.dialer = dial
+	}
+}
+
+// HashFunc returns the hashes answering the hash request
+// of a peer, or an error if the request is rejected.
+type HashFunc func(req *messagesv1.HashRequest) ([][32]byte, error)
+
+// WithHashes sets the function answering the hash requests
+// for v2 torrents, without it all hash requests are rejected.
+func WithHashes(hashes HashFunc) Option {
+	return func(p *Peer) {
+		p.hashes = hashes
+	}
+}
+
+// WithUploadOnly sets the function reporting whether this client only
+// uploads to the peer, advertised in the extension handshake.
+func WithUploadOnly(uploadOnly func() bool) Option {
+	return func(p *Peer) {
+		p.uploadOnly = uploadOnly
+	}
+}
+
+// WithListenPort sets the port this client accepts connections
+// at, advertised in the extension handshake.
+func WithListenPort(port int) Option {
+	return func(p *Peer) {
+		p.listenPort = port
+	}
+}
+
+// PexFunc is called with the peer exchange messages of the remote peer.
+type PexFunc func(p *Peer, pex *messagesv1.Pex)
+
+// WithPex enables the peer exchange extension, the
+// function is called with the received messages.
+func WithPex(pex PexFunc) Option {
+	return func(p *Peer) {
+		p.pex = pex
+	}
+}
+
+// HolepunchFunc is called with the holepunch messages of the remote peer.
+type HolepunchFunc func(p *Peer, h *messagesv1.Holepunch)
+
+// WithHolepunch enables the holepunch extension, the
+// function is called with the received messages.
+func WithHolepunch(holepunch HolepunchFunc) Option {
+	return func(p *Peer) {
+		p.holepunch = holepunch
+	}
+}
+
+// HaveFunc is called with the index of every piece
+// the remote peer announces to have completed.
+type HaveFunc func(p *Peer, index uint32)
+
+// WithHaves sets the function notified of the have
+// messages of the remote peer.
+func WithHaves(haves HaveFunc) Option {
+	return func(p *Peer) {
+		p.haves = haves
+	}
+}
+
+// WithRecorder records the handshakes and the messages exchanged
+// with the peer. Blocks are then sent without sendfile, as the
+// recorder has to see the messages written to the connection.
+func WithRecorder(r *recorder.Recorder) Option {
+	return func(p *Peer) {
+		p.recorder = r
+	}
+}
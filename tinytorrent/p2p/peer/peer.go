@@ -2,16 +2,25 @@ package peer
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net"
+	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/mse"
 	"github.com/Despire/tinytorrent/p2p/peer/bitfield"
+	"github.com/Despire/tinytorrent/p2p/recorder"
+	"github.com/Despire/tinytorrent/p2p/transport"
 )
 
 //go:generate stringer -type=Status
@@ -56,23 +65,57 @@ const (
 	ConnectionKilled
 )
 
-type peerType byte
-
-const (
-	leecher peerType = iota
-	seeder
-)
-
 // Peer represents a peer in the swarm for sharing a file.
 type Peer struct {
 	logger *slog.Logger
 	Id     string
 	Addr   string
 
-	wg               sync.WaitGroup
-	conn             net.Conn
+	wg   sync.WaitGroup
+	conn net.Conn
+	// writeL serializes the messages written to conn, as
+	// pieces sent from a file take more than a single write.
+	writeL           sync.Mutex
 	connectionStatus atomic.Uint32
-	typ              peerType
+	outgoing         bool
+	encryption       mse.Policy
+	dialer           transport.DialFunc
+
+	// establishedAt is when the handshake completed and
+	// lastPiece the unix nano time of the last received piece.
+	establishedAt time.Time
+	lastPiece     atomic.Int64
+
+	// downloaded and uploaded are the bytes of the blocks
+	// received from and sent to the peer.
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+
+	// extensions says whether the remote peer supports the extension
+	// protocol and remoteExtensions is its extension handshake, if any.
+	extensions       bool
+	remoteExtensions atomic.Pointer[messagesv1.ExtendedHandshake]
+	// requestQueue is the number of requests advertised
+	// in the extension handshake this client handles.
+	requestQueue int
+
+	pipeline pipeline
+
+	// hashes answers the hash requests of the remote peer.
+	hashes HashFunc
+	// haves is notified of the pieces the remote peer completed.
+	haves HaveFunc
+	// uploadOnly reports whether this client only uploads.
+	uploadOnly func() bool
+	// listenPort is the port this client accepts connections at.
+	listenPort int
+	// pex and holepunch handle the messages of the extensions,
+	// which are only advertised if set.
+	pex       PexFunc
+	holepunch HolepunchFunc
+	// recorder records the handshakes and messages
+	// exchanged with the peer, if set.
+	recorder *recorder.Recorder
 
 	Status struct {
 		Remote atomic.Uint32
@@ -84,24 +127,24 @@ type Peer struct {
 		This   atomic.Uint32
 	}
 
-	seeder struct {
-		pieces chan *messagesv1.Piece
-	}
-
-	leecher struct {
-		requests chan *messagesv1.Request
-		cancels  chan *messagesv1.Cancel
-	}
+	// pieces received from the remote peer and requests, cancels
+	// sent by the remote peer, a single session both downloads
+	// and uploads.
+	pieces   chan *messagesv1.Piece
+	requests chan *messagesv1.Request
+	cancels  chan *messagesv1.Cancel
 
 	Bitfield *bitfield.BitField
 }
 
-func NewSeederConnection(
+// NewOutgoingConnection dials the peer at addr and performs the handshake.
+func NewOutgoingConnection(
 	logger *slog.Logger,
 	addr string,
 	numPieces int64,
 	infoHash string,
 	clientId string,
+	opts ...Option,
 ) (*Peer, error) {
 	p := &Peer{
 		logger:   logger,
@@ -109,7 +152,11 @@ func NewSeederConnection(
 		conn:     nil,
 		wg:       sync.WaitGroup{},
 		Bitfield: bitfield.NewBitfield(numPieces),
-		typ:      seeder,
+		outgoing: true,
+	}
+
+	for _, o := range opts {
+		o(p)
 	}
 
 	p.Status.Remote.Store(uint32(Choked))
@@ -126,8 +173,12 @@ func NewSeederConnection(
 		}
 		return nil, err
 	}
+	p.conn = p.recorder.Conn(p.Addr, p.conn)
 
-	p.seeder.pieces = make(chan *messagesv1.Piece)
+	p.pieces = make(chan *messagesv1.Piece)
+	p.requests = make(chan *messagesv1.Request)
+	p.cancels = make(chan *messagesv1.Cancel)
+	p.establishedAt = time.Now()
 
 	p.wg.Add(1)
 	go p.listener()
@@ -137,21 +188,29 @@ func NewSeederConnection(
 	return p, nil
 }
 
-func NewLeecherConnection(
+// NewIncomingConnection completes the handshake with a peer that dialed
+// this client and whose handshake, remote, was already read from conn.
+func NewIncomingConnection(
 	logger *slog.Logger,
-	peerID, addr string,
+	remote *messagesv1.Handshake,
+	addr string,
 	numPieces int64,
 	conn net.Conn,
 	infoHash, clientId string,
+	opts ...Option,
 ) (*Peer, error) {
 	p := &Peer{
-		logger:   logger.With(slog.String("peer_id", peerID)),
-		Id:       peerID,
-		Addr:     addr,
-		conn:     conn,
-		wg:       sync.WaitGroup{},
-		Bitfield: bitfield.NewBitfield(numPieces),
-		typ:      leecher,
+		logger:     logger.With(slog.String("peer_id", remote.PeerID)),
+		Id:         remote.PeerID,
+		Addr:       addr,
+		conn:       conn,
+		wg:         sync.WaitGroup{},
+		Bitfield:   bitfield.NewBitfield(numPieces),
+		extensions: remote.Reserved[messagesv1.ExtensionReservedByte]&messagesv1.ExtensionReservedBit != 0,
+	}
+
+	for _, o := range opts {
+		o(p)
 	}
 
 	p.Status.Remote.Store(uint32(Choked))
@@ -160,15 +219,19 @@ func NewLeecherConnection(
 	p.Interest.Remote.Store(uint32(NotInterested))
 	p.Interest.This.Store(uint32(NotInterested))
 
+	p.recorder.Handshake(p.Addr, recorder.Received, remote)
 	if err := p.sendHandshakeV1(infoHash, clientId); err != nil {
 		if errClose := conn.Close(); errClose != nil {
 			return nil, fmt.Errorf("%w: %w", err, errClose)
 		}
 		return nil, err
 	}
+	p.conn = p.recorder.Conn(p.Addr, p.conn)
 
-	p.leecher.requests = make(chan *messagesv1.Request)
-	p.leecher.cancels = make(chan *messagesv1.Cancel)
+	p.pieces = make(chan *messagesv1.Piece)
+	p.requests = make(chan *messagesv1.Request)
+	p.cancels = make(chan *messagesv1.Cancel)
+	p.establishedAt = time.Now()
 
 	p.wg.Add(1)
 	go p.listener()
@@ -205,24 +268,89 @@ func (p *Peer) Close() error {
 	return err
 }
 
-func (p *Peer) Pieces() <-chan *messagesv1.Piece { return p.seeder.pieces }
+// EstablishedAt returns when the connection to the peer was established.
+func (p *Peer) EstablishedAt() time.Time { return p.establishedAt }
+
+// LastPiece returns when the last piece was received from
+// the peer, or the zero time if none were received yet.
+func (p *Peer) LastPiece() time.Time {
+	if n := p.lastPiece.Load(); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// Downloaded returns the bytes of the blocks received from the peer.
+func (p *Peer) Downloaded() int64 { return p.downloaded.Load() }
+
+// Uploaded returns the bytes of the blocks sent to the peer.
+func (p *Peer) Uploaded() int64 { return p.uploaded.Load() }
+
+// reserved are the reserved handshake bytes, signalling
+// the support of the extension protocol.
+var reserved = func() (r [8]byte) {
+	r[messagesv1.ExtensionReservedByte] |= messagesv1.ExtensionReservedBit
+	return r
+}()
+
+// SupportsExtensions reports whether the remote peer
+// supports the extension protocol (BEP10).
+func (p *Peer) SupportsExtensions() bool { return p.extensions }
+
+// RemoteExtensions returns the extension handshake of
+// the remote peer, or nil if none was received yet.
+func (p *Peer) RemoteExtensions() *messagesv1.ExtendedHandshake {
+	return p.remoteExtensions.Load()
+}
+
+// UploadOnly reports whether the remote peer announced to only upload,
+// being a seed or having all the pieces of the files it wants (BEP21).
+func (p *Peer) UploadOnly() bool {
+	h := p.remoteExtensions.Load()
+	return h != nil && h.UploadOnly
+}
+
+// SupportsExtension reports whether the remote peer advertised
+// the extension with the name in its extension handshake.
+func (p *Peer) SupportsExtension(name string) bool {
+	h := p.remoteExtensions.Load()
+	return h != nil && h.M[name] > 0
+}
+
+// ListenAddr returns the address the remote peer accepts connections
+// at. The port of incoming connections is replaced by the one the
+// peer advertised in its extension handshake, if any.
+func (p *Peer) ListenAddr() string {
+	if h := p.remoteExtensions.Load(); !p.outgoing && h != nil && h.P > 0 && h.P <= math.MaxUint16 {
+		if host, _, err := net.SplitHostPort(p.Addr); err == nil {
+			return net.JoinHostPort(host, strconv.FormatInt(h.P, 10))
+		}
+	}
+	return p.Addr
+}
+
+// Outgoing reports whether the connection was initiated by this client.
+func (p *Peer) Outgoing() bool { return p.outgoing }
+
+func (p *Peer) Pieces() <-chan *messagesv1.Piece { return p.pieces }
 
 func (p *Peer) Requests() (<-chan *messagesv1.Request, <-chan *messagesv1.Cancel) {
-	return p.leecher.requests, p.leecher.cancels
+	return p.requests, p.cancels
 }
 
 // InitiateHandshakeV1 performs the handshake according to the version 1.0
 // of the specifications. After a successful handshake a new goroutine
 // is spawned that actively listens, on the established BitTorrent
 // channel to decode incoming messages. Incoming pieces request will
-// be sent to the returned channel and it is expected that a goroutine
-// will be listening on that channel otherwise the peer deadlocks.
+// be sent to the pieces channel, requests and cancels to their channels,
+// and it is expected that goroutines are listening on all of them
+// otherwise the peer deadlocks.
 func (p *Peer) initiateHandshakeV1(infoHash, peerID string) error {
 	if p == nil {
 		return nil
 	}
 
-	conn, err := net.DialTimeout("tcp", p.Addr, 10*time.Second)
+	conn, err := p.dial(infoHash)
 	if err != nil {
 		return fmt.Errorf("failed to re-connect to peer at %s: %w", p.Addr, err)
 	}
@@ -231,7 +359,7 @@ func (p *Peer) initiateHandshakeV1(infoHash, peerID string) error {
 
 	h := messagesv1.Handshake{
 		Pstr:     messagesv1.ProtocolV1,
-		Reserved: [8]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -250,6 +378,7 @@ func (p *Peer) initiateHandshakeV1(infoHash, peerID string) error {
 	if int(w) != len(msg) {
 		return fmt.Errorf("failed to write all of the v1 handshake message")
 	}
+	p.recorder.Handshake(p.Addr, recorder.Sent, &h)
 
 	if err := p.conn.SetReadDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
@@ -268,14 +397,71 @@ func (p *Peer) initiateHandshakeV1(infoHash, peerID string) error {
 	if err := h.Deserialize(resp[:]); err != nil {
 		return fmt.Errorf("failed to deserialize v1 handshake message: %w", err)
 	}
+	p.recorder.Handshake(p.Addr, recorder.Received, &h)
 
 	// adjust peer information.
 	p.Id = h.PeerID
+	p.extensions = h.Reserved[messagesv1.ExtensionReservedByte]&messagesv1.ExtensionReservedBit != 0
 	p.logger = p.logger.With(slog.String("peer_id", p.Id))
 
 	return nil
 }
 
+// dial connects to the peer obfuscating the connection according to the
+// encryption policy. If encryption is only preferred and could not be
+// negotiated the peer is re-dialed using a plaintext connection.
+func (p *Peer) dial(infoHash string) (net.Conn, error) {
+	conn, err := p.dialTimeout(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.encryption == mse.PlaintextOnly {
+		return conn, nil
+	}
+
+	provide := mse.CryptoRC4
+	if p.encryption == mse.PreferEncrypted {
+		provide |= mse.CryptoPlaintext
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(15 * time.Second)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	enc, err := mse.Initiate(conn, infoHash, provide)
+	if err == nil {
+		// unencrypted connections are used directly, see ZeroCopy.
+		if plain, ok := enc.Unwrap(); ok {
+			return plain, nil
+		}
+		return enc, nil
+	}
+
+	if errClose := conn.Close(); errClose != nil {
+		p.logger.Debug("failed to close connection after failed encryption handshake", slog.Any("err", errClose))
+	}
+
+	if p.encryption == mse.RequireEncrypted {
+		return nil, fmt.Errorf("failed to negotiate encrypted connection: %w", err)
+	}
+
+	p.logger.Debug("failed to negotiate encrypted connection, falling back to plaintext", slog.Any("err", err))
+	return p.dialTimeout(10 * time.Second)
+}
+
+func (p *Peer) dialTimeout(timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	dial := p.dialer
+	if dial == nil {
+		dial = transport.TCP
+	}
+	return dial(ctx, p.Addr)
+}
+
 func (p *Peer) sendHandshakeV1(infoHash, peerID string) error {
 	if p == nil {
 		return nil
@@ -283,7 +469,7 @@ func (p *Peer) sendHandshakeV1(infoHash, peerID string) error {
 
 	h := messagesv1.Handshake{
 		Pstr:     messagesv1.ProtocolV1,
-		Reserved: [8]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -302,6 +488,7 @@ func (p *Peer) sendHandshakeV1(infoHash, peerID string) error {
 	if int(w) != len(msg) {
 		return fmt.Errorf("failed to write all of the v1 handshake message")
 	}
+	p.recorder.Handshake(p.Addr, recorder.Sent, &h)
 
 	return nil
 }
@@ -318,6 +505,9 @@ func (p *Peer) SendKeepAlive() error {
 		)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -346,6 +536,9 @@ func (p *Peer) SendUnchoke() error {
 		)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -374,6 +567,9 @@ func (p *Peer) SendChoke() error {
 		)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -402,6 +598,9 @@ func (p *Peer) SendInterested() error {
 		)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -429,6 +628,9 @@ func (p *Peer) SendNotInterested() error {
 		)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -457,6 +659,9 @@ func (p *Peer) SendBitfield(b []byte) error {
 		)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -488,6 +693,9 @@ func (p *Peer) SendRequest(req *messagesv1.Request) error {
 		return fmt.Errorf("invalid request: %w", err)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -519,6 +727,9 @@ func (p *Peer) SendCancel(cancel *messagesv1.Cancel) error {
 		return fmt.Errorf("invalid request: %w", err)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -546,6 +757,9 @@ func (p *Peer) SendHave(have *messagesv1.Have) error {
 		)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -573,6 +787,9 @@ func (p *Peer) SendPiece(piece *messagesv1.Piece) error {
 		)
 	}
 
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
 	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return err
 	}
@@ -585,5 +802,185 @@ func (p *Peer) SendPiece(piece *messagesv1.Piece) error {
 	if int(w) != len(msg) {
 		return fmt.Errorf("failed to write all of have message")
 	}
+	p.uploaded.Add(int64(len(piece.Block)))
+	return nil
+}
+
+// ZeroCopy reports whether the connection to the peer is a plaintext
+// TCP connection, for which SendPieceFile hands the block to the
+// kernel with sendfile instead of copying it through memory. It is
+// not while the connection is recorded.
+func (p *Peer) ZeroCopy() bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.conn.(*net.TCPConn)
+	return ok
+}
+
+// SendPieceFile sends length bytes at offset within the file as the block
+// at begin within the piece index. Over plaintext TCP connections the block
+// is copied from the file to the socket by the kernel, encrypted and uTP
+// connections fall back to reading the block and sending it with SendPiece.
+func (p *Peer) SendPieceFile(index, begin uint32, f *os.File, offset, length int64) error {
+	if p == nil {
+		return nil
+	}
+
+	conn, ok := p.conn.(*net.TCPConn)
+	if !ok {
+		block := make([]byte, length)
+		if _, err := f.ReadAt(block, offset); err != nil {
+			return fmt.Errorf("failed to read block: %w", err)
+		}
+		return p.SendPiece(&messagesv1.Piece{Index: index, Begin: begin, Block: block})
+	}
+
+	if p.connectionStatus.Load() != uint32(ConnectionEstablished) {
+		return fmt.Errorf("invalid connection status %s, needed %s",
+			ConnectionStatus(p.connectionStatus.Load()),
+			ConnectionEstablished,
+		)
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to block: %w", err)
+	}
+
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
+		return err
+	}
+
+	// a short write of the header or a short copy of the block
+	// corrupts the stream, so the connection is closed.
+	header := (&messagesv1.Piece{Index: index, Begin: begin}).Serialize()
+	binary.BigEndian.PutUint32(header[:4], uint32(len(header)-4+int(length)))
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to write piece header: %w", err)
+	}
+
+	// io.CopyN from the file ends up in (*net.TCPConn).ReadFrom,
+	// which uses sendfile for files.
+	w, err := io.CopyN(conn, f, length)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to write piece from file: %w", err)
+	}
+	p.uploaded.Add(w)
+	return nil
+}
+
+func (p *Peer) SendHashRequest(req *messagesv1.HashRequest) error {
+	return p.send("hash request", req.Serialize())
+}
+
+func (p *Peer) SendHashes(hashes *messagesv1.Hashes) error {
+	return p.send("hashes", hashes.Serialize())
+}
+
+func (p *Peer) SendHashReject(reject *messagesv1.HashReject) error {
+	return p.send("hash reject", reject.Serialize())
+}
+
+// SendPex sends the peer exchange message, if supported by the remote peer.
+func (p *Peer) SendPex(pex *messagesv1.Pex) error {
+	return p.sendExtended(messagesv1.PexExtension, pex.Payload())
+}
+
+// SendHolepunch sends the holepunch message, if supported by the remote peer.
+func (p *Peer) SendHolepunch(h *messagesv1.Holepunch) error {
+	return p.sendExtended(messagesv1.HolepunchExtension, h.Payload())
+}
+
+// sendExtended sends the payload of the extension with
+// the extended message id the remote peer assigned to it.
+func (p *Peer) sendExtended(name string, payload []byte) error {
+	h := p.remoteExtensions.Load()
+	if h == nil || h.M[name] <= 0 || h.M[name] > math.MaxUint8 {
+		return fmt.Errorf("peer does not support the %s extension", name)
+	}
+	return p.send(name, (&messagesv1.Extended{ID: uint8(h.M[name]), Payload: payload}).Serialize())
+}
+
+// send writes the serialized message of the kind to the established connection.
+func (p *Peer) send(kind string, msg []byte) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.connectionStatus.Load() != uint32(ConnectionEstablished) {
+		return fmt.Errorf("invalid connection status %s, needed %s",
+			ConnectionStatus(p.connectionStatus.Load()),
+			ConnectionEstablished,
+		)
+	}
+
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
+	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
+		return err
+	}
+
+	w, err := io.Copy(p.conn, bytes.NewReader(msg))
+	if err != nil {
+		return fmt.Errorf("failed to write %s message: %w", kind, err)
+	}
+	if int(w) != len(msg) {
+		return fmt.Errorf("failed to write all of %s message", kind)
+	}
+	return nil
+}
+
+// SendExtendedHandshake sends the extension handshake, advertising
+// the number of requests this client handles from the peer and
+// whether it only uploads. It is sent again once the latter changes.
+func (p *Peer) SendExtendedHandshake() error {
+	if p == nil {
+		return nil
+	}
+
+	if p.connectionStatus.Load() != uint32(ConnectionEstablished) {
+		return fmt.Errorf("invalid connection status %s, needed %s",
+			ConnectionStatus(p.connectionStatus.Load()),
+			ConnectionEstablished,
+		)
+	}
+
+	if !p.extensions {
+		return errors.New("peer does not support the extension protocol")
+	}
+
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
+	if err := p.conn.SetWriteDeadline(time.Now().Add(15 * time.Second)); err != nil {
+		return err
+	}
+
+	m := make(map[string]int64)
+	if p.pex != nil {
+		m[messagesv1.PexExtension] = messagesv1.PexID
+	}
+	if p.holepunch != nil {
+		m[messagesv1.HolepunchExtension] = messagesv1.HolepunchID
+	}
+	msg := (&messagesv1.ExtendedHandshake{
+		M:          m,
+		Reqq:       int64(p.requestQueue),
+		P:          int64(p.listenPort),
+		UploadOnly: p.uploadOnly != nil && p.uploadOnly(),
+	}).Serialize()
+	w, err := io.Copy(p.conn, bytes.NewReader(msg))
+	if err != nil {
+		return fmt.Errorf("failed to write extended handshake message: %w", err)
+	}
+	if int(w) != len(msg) {
+		return fmt.Errorf("failed to write all of extended handshake message")
+	}
 	return nil
 }
@@ -0,0 +1,469 @@
+package peer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/Despire/tinytorrent/p2p/mse"
+	"github.com/Despire/tinytorrent/p2p/recorder"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testInfoHash = strings.Repeat("\x03", 20)
+	testLogger   = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+)
+
+// remotePeer accepts connections on a loopback listener and answers
+// the handshake after negotiating the encryption with the given policy.
+func remotePeer(t *testing.T, listen string, policy mse.Policy) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Skipf("failed to listen on %s: %v", listen, err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+				c, err := mse.Accept(conn, []string{testInfoHash}, policy)
+				if err != nil {
+					conn.Close()
+					return
+				}
+
+				var req [messagesv1.HandshakeLength]byte
+				if _, err := io.ReadFull(c, req[:]); err != nil {
+					conn.Close()
+					return
+				}
+
+				h := messagesv1.Handshake{Pstr: messagesv1.ProtocolV1, InfoHash: testInfoHash, PeerID: strings.Repeat("r", 20)}
+				if _, err := c.Write(h.Serialize()); err != nil {
+					conn.Close()
+					return
+				}
+
+				// hold the connection open until the local peer closes it.
+				io.Copy(io.Discard, c)
+				conn.Close()
+			}(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestNewOutgoingConnection_Encryption(t *testing.T) {
+	tests := []struct {
+		name    string
+		remote  mse.Policy
+		local   mse.Policy
+		wantErr bool
+	}{
+		{name: "plaintext", remote: mse.PlaintextOnly, local: mse.PlaintextOnly},
+		{name: "encrypted", remote: mse.RequireEncrypted, local: mse.PreferEncrypted},
+		{name: "fallback-to-plaintext", remote: mse.PlaintextOnly, local: mse.PreferEncrypted},
+		{name: "required-but-unsupported", remote: mse.PlaintextOnly, local: mse.RequireEncrypted, wantErr: true},
+		{name: "required-but-plaintext", remote: mse.RequireEncrypted, local: mse.PlaintextOnly, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := remotePeer(t, "127.0.0.1:0", tt.remote)
+
+			p, err := NewOutgoingConnection(testLogger, addr, 8, testInfoHash, strings.Repeat("l", 20), WithEncryption(tt.local))
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			t.Cleanup(func() { p.Close() })
+
+			assert.Equal(t, strings.Repeat("r", 20), p.Id)
+			assert.Equal(t, ConnectionEstablished, p.ConnectionStatus())
+		})
+	}
+}
+
+func TestNewOutgoingConnection_IPv6(t *testing.T) {
+	addr := remotePeer(t, "[::1]:0", mse.PlaintextOnly)
+	assert.True(t, strings.HasPrefix(addr, "[::1]:"))
+
+	p, err := NewOutgoingConnection(testLogger, addr, 8, testInfoHash, strings.Repeat("l", 20))
+	assert.Nil(t, err)
+	t.Cleanup(func() { p.Close() })
+
+	assert.Equal(t, addr, p.Addr)
+	assert.Equal(t, ConnectionEstablished, p.ConnectionStatus())
+}
+
+// pair returns two peers sharing a single connection, the
+// first one dialed the second one.
+func pair(t testing.TB, opts ...Option) (*Peer, *Peer) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	incoming := make(chan *Peer, 1)
+	go func() {
+		defer close(incoming)
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		var req [messagesv1.HandshakeLength]byte
+		if _, err := io.ReadFull(conn, req[:]); err != nil {
+			conn.Close()
+			return
+		}
+		var h messagesv1.Handshake
+		if err := h.Deserialize(req[:]); err != nil {
+			conn.Close()
+			return
+		}
+
+		p, err := NewIncomingConnection(testLogger, &h, conn.RemoteAddr().String(), 8, conn, testInfoHash, strings.Repeat("b", 20), append(opts, WithRequestQueue(100))...)
+		if err != nil {
+			return
+		}
+		incoming <- p
+	}()
+
+	a, err := NewOutgoingConnection(testLogger, l.Addr().String(), 8, testInfoHash, strings.Repeat("a", 20), append(opts, WithRequestQueue(50))...)
+	assert.Nil(t, err)
+
+	b := <-incoming
+	assert.NotNil(t, b)
+
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a, b
+}
+
+func TestPeer_Bidirectional(t *testing.T) {
+	a, b := pair(t)
+
+	assert.True(t, a.Outgoing())
+	assert.False(t, b.Outgoing())
+	assert.Equal(t, strings.Repeat("b", 20), a.Id)
+	assert.Equal(t, strings.Repeat("a", 20), b.Id)
+
+	// download is the same in either direction of the connection.
+	download := func(t *testing.T, from, to *Peer) {
+		assert.Nil(t, to.SendInterested())
+		assert.Nil(t, from.SendUnchoke())
+		assert.Eventually(t, func() bool {
+			return from.Interest.Remote.Load() == uint32(Interested) && to.Status.Remote.Load() == uint32(UnChoked)
+		}, 5*time.Second, 10*time.Millisecond)
+
+		req := &messagesv1.Request{Index: 1, Begin: 0, Length: 4}
+		assert.Nil(t, to.SendRequest(req))
+
+		requests, _ := from.Requests()
+		select {
+		case got := <-requests:
+			assert.Equal(t, req, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("request not received")
+		}
+
+		assert.Nil(t, from.SendPiece(&messagesv1.Piece{Index: 1, Begin: 0, Block: []byte("data")}))
+
+		select {
+		case got := <-to.Pieces():
+			assert.Equal(t, []byte("data"), got.Block)
+		case <-time.After(5 * time.Second):
+			t.Fatal("piece not received")
+		}
+		assert.False(t, to.LastPiece().IsZero())
+	}
+
+	t.Run("outgoing-downloads", func(t *testing.T) { download(t, b, a) })
+	t.Run("incoming-downloads", func(t *testing.T) { download(t, a, b) })
+
+	// each side keeps its own choke and interest state.
+	assert.Equal(t, uint32(UnChoked), a.Status.This.Load())
+	assert.Equal(t, uint32(UnChoked), a.Status.Remote.Load())
+	assert.Nil(t, a.SendChoke())
+	assert.Eventually(t, func() bool { return b.Status.Remote.Load() == uint32(Choked) }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(UnChoked), b.Status.This.Load())
+}
+
+func TestPeer_ExtensionHandshake(t *testing.T) {
+	a, b := pair(t)
+
+	assert.True(t, a.SupportsExtensions())
+	assert.True(t, b.SupportsExtensions())
+
+	uploadOnly := false
+	WithUploadOnly(func() bool { return uploadOnly })(a)
+
+	assert.Nil(t, a.SendExtendedHandshake())
+	assert.Nil(t, b.SendExtendedHandshake())
+
+	assert.Eventually(t, func() bool {
+		return a.RemoteExtensions() != nil && b.RemoteExtensions() != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, int64(100), a.RemoteExtensions().Reqq)
+	assert.Equal(t, int64(50), b.RemoteExtensions().Reqq)
+	assert.False(t, b.UploadOnly())
+
+	// the handshake is sent again once a only uploads.
+	uploadOnly = true
+	assert.Nil(t, a.SendExtendedHandshake())
+	assert.Eventually(t, b.UploadOnly, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, a.UploadOnly())
+}
+
+func TestPeer_ExtensionMessages(t *testing.T) {
+	pexes := make(chan *messagesv1.Pex, 1)
+	holepunches := make(chan *messagesv1.Holepunch, 1)
+	a, b := pair(t,
+		WithListenPort(6881),
+		WithPex(func(_ *Peer, pex *messagesv1.Pex) { pexes <- pex }),
+		WithHolepunch(func(_ *Peer, h *messagesv1.Holepunch) { holepunches <- h }),
+	)
+
+	// nothing can be sent before the extension handshake.
+	assert.Error(t, a.SendPex(new(messagesv1.Pex)))
+
+	assert.Nil(t, a.SendExtendedHandshake())
+	assert.Nil(t, b.SendExtendedHandshake())
+	assert.Eventually(t, func() bool {
+		return a.RemoteExtensions() != nil && b.RemoteExtensions() != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.True(t, a.SupportsExtension(messagesv1.PexExtension))
+	assert.True(t, b.SupportsExtension(messagesv1.HolepunchExtension))
+	assert.False(t, b.SupportsExtension("ut_metadata"))
+
+	// the port of the incoming connection is replaced by the advertised one.
+	assert.Equal(t, a.Addr, a.ListenAddr())
+	assert.Equal(t, "127.0.0.1:6881", b.ListenAddr())
+
+	pex := &messagesv1.Pex{
+		Added: []messagesv1.PexPeer{
+			{Addr: netip.MustParseAddrPort("10.0.0.1:6881"), Flags: messagesv1.PexHolepunch | messagesv1.PexReachable},
+			{Addr: netip.MustParseAddrPort("[2001:db8::1]:6881"), Flags: messagesv1.PexUTP},
+		},
+		Dropped: []netip.AddrPort{netip.MustParseAddrPort("10.0.0.2:1")},
+	}
+	assert.Nil(t, a.SendPex(pex))
+	select {
+	case got := <-pexes:
+		assert.Equal(t, pex, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pex message not received")
+	}
+
+	for _, h := range []*messagesv1.Holepunch{
+		{Type: messagesv1.HolepunchRendezvous, Addr: netip.MustParseAddrPort("10.0.0.1:6881")},
+		{Type: messagesv1.HolepunchError, Addr: netip.MustParseAddrPort("[2001:db8::1]:1"), Err: messagesv1.HolepunchNotConnected},
+	} {
+		assert.Nil(t, b.SendHolepunch(h))
+		select {
+		case got := <-holepunches:
+			assert.Equal(t, h, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("holepunch message not received")
+		}
+	}
+}
+
+func TestPeer_Pipeline(t *testing.T) {
+	p := new(Peer)
+
+	// nothing measured yet.
+	assert.Equal(t, MinRequestQueue, p.RequestQueue())
+	assert.Equal(t, InitialRequestTimeout, p.RequestTimeout())
+
+	// 2 blocks per 50ms round trip.
+	for range 20 {
+		p.RequestSent()
+		p.RequestSent()
+		time.Sleep(50 * time.Millisecond)
+		p.BlockReceived(50*time.Millisecond, messagesv1.RequestSize)
+		p.BlockReceived(50*time.Millisecond, messagesv1.RequestSize)
+	}
+	assert.Equal(t, 0, p.Outstanding())
+
+	// the queue is sized to more than the bandwidth-delay product of 2 blocks.
+	queue := p.RequestQueue()
+	assert.Greater(t, queue, 2)
+	assert.LessOrEqual(t, queue, DefaultRemoteRequestQueue)
+
+	// the timeout follows the measured round trip time.
+	assert.Equal(t, MinRequestTimeout, p.RequestTimeout())
+
+	// the queue is capped by the advertised reqq of the remote peer.
+	p.setRemoteRequestQueue(3)
+	assert.Equal(t, 3, p.RequestQueue())
+
+	// timeouts shrink the queue.
+	p.setRemoteRequestQueue(0)
+	p.RequestSent()
+	p.RequestDropped(true)
+	assert.Less(t, p.RequestQueue(), queue)
+}
+
+func TestPeer_SendPieceFile(t *testing.T) {
+	a, b := pair(t)
+	assert.True(t, a.ZeroCopy())
+
+	f, err := os.CreateTemp(t.TempDir(), "piece")
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.WriteString("0123456789")
+	assert.Nil(t, err)
+
+	assert.Nil(t, a.SendPieceFile(2, 4, f, 4, 3))
+	// the next message follows the block.
+	assert.Nil(t, a.SendPiece(&messagesv1.Piece{Index: 3, Block: []byte("x")}))
+
+	for _, want := range []*messagesv1.Piece{
+		{Index: 2, Begin: 4, Block: []byte("456")},
+		{Index: 3, Block: []byte("x")},
+	} {
+		select {
+		case got := <-b.Pieces():
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("piece not received")
+		}
+	}
+	assert.Equal(t, int64(4), a.Uploaded())
+}
+
+// BenchmarkPeer_SendPiece compares sending 16 KiB blocks of a piece
+// file read into memory against sending them with sendfile.
+func BenchmarkPeer_SendPiece(b *testing.B) {
+	const pieceSize = 1 << 20
+
+	f, err := os.CreateTemp(b.TempDir(), "piece")
+	assert.Nil(b, err)
+	defer f.Close()
+	_, err = f.Write(make([]byte, pieceSize))
+	assert.Nil(b, err)
+
+	bench := func(b *testing.B, send func(p *Peer, begin uint32) error) {
+		from, to := pair(b)
+		go func() {
+			for range to.Pieces() {
+			}
+		}()
+
+		b.SetBytes(messagesv1.RequestSize)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := range b.N {
+			begin := uint32(i*messagesv1.RequestSize) % pieceSize
+			if err := send(from, begin); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("buffered", func(b *testing.B) {
+		bench(b, func(p *Peer, begin uint32) error {
+			block := make([]byte, messagesv1.RequestSize)
+			if _, err := f.ReadAt(block, int64(begin)); err != nil {
+				return err
+			}
+			return p.SendPiece(&messagesv1.Piece{Begin: begin, Block: block})
+		})
+	})
+	b.Run("sendfile", func(b *testing.B) {
+		bench(b, func(p *Peer, begin uint32) error {
+			return p.SendPieceFile(0, begin, f, int64(begin), messagesv1.RequestSize)
+		})
+	})
+}
+
+func TestPeer_Recorder(t *testing.T) {
+	var buf bytes.Buffer
+	rec, err := recorder.New(&buf)
+	assert.Nil(t, err)
+
+	a, b := pair(t, WithRecorder(rec))
+	assert.False(t, b.ZeroCopy())
+
+	assert.Nil(t, a.SendInterested())
+	assert.Eventually(t, func() bool { return b.Interest.Remote.Load() == uint32(Interested) }, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, b.SendUnchoke())
+	assert.Eventually(t, func() bool { return a.Status.Remote.Load() == uint32(UnChoked) }, 5*time.Second, 10*time.Millisecond)
+
+	req := &messagesv1.Request{Index: 1, Begin: 16, Length: 4}
+	assert.Nil(t, a.SendRequest(req))
+	requests, _ := b.Requests()
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not received")
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "piece")
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.WriteString("..data..")
+	assert.Nil(t, err)
+
+	// the block is recorded when sent from a file as well.
+	assert.Nil(t, b.SendPieceFile(1, 16, f, 2, 4))
+	select {
+	case got := <-a.Pieces():
+		assert.Equal(t, []byte("data"), got.Block)
+	case <-time.After(5 * time.Second):
+		t.Fatal("piece not received")
+	}
+	assert.Nil(t, rec.Close())
+
+	r, err := recorder.NewReader(&buf)
+	assert.Nil(t, err)
+	records, err := r.ReadAll()
+	assert.Nil(t, err)
+
+	type entry struct {
+		dir     recorder.Direction
+		summary string
+	}
+	var got []entry
+	for _, r := range records {
+		if r.Peer == a.Addr {
+			got = append(got, entry{r.Direction, r.Summary()})
+		}
+	}
+
+	handshake := func(id string) string {
+		return fmt.Sprintf("Handshake info_hash=%x peer_id=%q reserved=%x", testInfoHash, id, reserved)
+	}
+	assert.Equal(t, []entry{
+		{recorder.Sent, handshake(strings.Repeat("a", 20))},
+		{recorder.Received, handshake(strings.Repeat("b", 20))},
+		{recorder.Sent, "Interest"},
+		{recorder.Received, "UnChoke"},
+		{recorder.Sent, "Request index=1 begin=16 length=4"},
+		{recorder.Received, "Piece index=1 begin=16 length=4"},
+	}, got)
+}
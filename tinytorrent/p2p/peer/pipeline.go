@@ -0,0 +1,153 @@
+package peer
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+)
+
+const (
+	// MinRequestQueue is the least number of outstanding requests
+	// to a peer, regardless of its measured throughput.
+	MinRequestQueue = 2
+	// DefaultRemoteRequestQueue caps the outstanding requests to peers
+	// that do not advertise how many requests they handle.
+	DefaultRemoteRequestQueue = 64
+	// MaxRequestQueue caps the outstanding requests to any peer.
+	MaxRequestQueue = 500
+
+	// InitialRequestTimeout is the timeout of requests to
+	// a peer before any round trip time was measured.
+	InitialRequestTimeout = 8 * time.Second
+	// MinRequestTimeout and MaxRequestTimeout bound the
+	// timeout derived from the measured round trip times.
+	MinRequestTimeout = 1 * time.Second
+	MaxRequestTimeout = 60 * time.Second
+
+	// queueGain scales the bandwidth-delay product, so that the
+	// queue keeps growing until the throughput stops increasing.
+	queueGain = 2
+)
+
+// pipeline estimates how many block requests should be outstanding to
+// the peer to keep the connection busy, from the bandwidth-delay product
+// of its measured throughput and round trip time.
+type pipeline struct {
+	l sync.Mutex
+
+	outstanding int
+	// remoteReqq is the number of requests the peer advertised
+	// to handle, or 0 if it did not advertise any.
+	remoteReqq int
+
+	// srtt and rttvar are the smoothed round trip time and its
+	// variation (RFC 6298), minRTT the lowest round trip time seen.
+	srtt, rttvar, minRTT time.Duration
+
+	// rate is the smoothed throughput in bytes per second, measured
+	// over windows of at least a round trip time.
+	rate        float64
+	window      time.Time
+	windowBytes int
+}
+
+// RequestSent records a block request sent to the peer.
+func (p *Peer) RequestSent() {
+	p.pipeline.l.Lock()
+	defer p.pipeline.l.Unlock()
+	p.pipeline.outstanding++
+}
+
+// RequestDropped records a request to the peer that will no longer be
+// answered, either being cancelled or timed out. Timeouts halve the
+// estimated throughput and thus the number of outstanding requests.
+func (p *Peer) RequestDropped(timedOut bool) {
+	p.pipeline.l.Lock()
+	defer p.pipeline.l.Unlock()
+	p.pipeline.outstanding = max(0, p.pipeline.outstanding-1)
+	if timedOut {
+		p.pipeline.rate /= 2
+	}
+}
+
+// BlockReceived records the block answering a request sent rtt ago. A zero
+// rtt records the block without sampling the round trip time, as for blocks
+// that were requested more than once.
+func (p *Peer) BlockReceived(rtt time.Duration, n int) {
+	p.pipeline.l.Lock()
+	defer p.pipeline.l.Unlock()
+
+	pl := &p.pipeline
+	pl.outstanding = max(0, pl.outstanding-1)
+
+	switch {
+	case rtt <= 0:
+	case pl.srtt == 0:
+		pl.srtt, pl.rttvar, pl.minRTT = rtt, rtt/2, rtt
+	default:
+		pl.rttvar = (3*pl.rttvar + (pl.srtt - rtt).Abs()) / 4
+		pl.srtt = (7*pl.srtt + rtt) / 8
+		pl.minRTT = min(pl.minRTT, rtt)
+	}
+
+	now := time.Now()
+	if pl.window.IsZero() {
+		pl.window = now.Add(-rtt)
+	}
+	pl.windowBytes += n
+
+	if elapsed := now.Sub(pl.window); elapsed >= max(pl.srtt, 100*time.Millisecond) {
+		sample := float64(pl.windowBytes) / elapsed.Seconds()
+		if pl.rate == 0 {
+			pl.rate = sample
+		} else {
+			pl.rate = 0.75*pl.rate + 0.25*sample
+		}
+		pl.window, pl.windowBytes = now, 0
+	}
+}
+
+// Outstanding returns the number of requests sent to the peer not yet answered.
+func (p *Peer) Outstanding() int {
+	p.pipeline.l.Lock()
+	defer p.pipeline.l.Unlock()
+	return p.pipeline.outstanding
+}
+
+// RequestQueue returns the number of requests that should be outstanding
+// to the peer, capped by the number of requests the peer handles.
+func (p *Peer) RequestQueue() int {
+	p.pipeline.l.Lock()
+	defer p.pipeline.l.Unlock()
+
+	limit := DefaultRemoteRequestQueue
+	if p.pipeline.remoteReqq > 0 {
+		limit = p.pipeline.remoteReqq
+	}
+	limit = min(limit, MaxRequestQueue)
+
+	bdp := p.pipeline.rate * p.pipeline.minRTT.Seconds() / messagesv1.RequestSize
+	n := MinRequestQueue + int(math.Ceil(queueGain*bdp))
+	return max(MinRequestQueue, min(n, limit))
+}
+
+// RequestTimeout returns after how long a request to the peer
+// is considered lost, derived from the measured round trip times.
+func (p *Peer) RequestTimeout() time.Duration {
+	p.pipeline.l.Lock()
+	defer p.pipeline.l.Unlock()
+
+	if p.pipeline.srtt == 0 {
+		return InitialRequestTimeout
+	}
+	rto := p.pipeline.srtt + 4*p.pipeline.rttvar
+	return max(MinRequestTimeout, min(rto, MaxRequestTimeout))
+}
+
+func (p *Peer) setRemoteRequestQueue(n int) {
+	p.pipeline.l.Lock()
+	defer p.pipeline.l.Unlock()
+	p.pipeline.remoteReqq = n
+}
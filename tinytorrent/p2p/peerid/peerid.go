@@ -0,0 +1,353 @@
+// Package peerid generates the peer id of this client and identifies
+// the client software of remote peers from their peer ids.
+// https://wiki.theory.org/BitTorrentSpecification#peer_id
+package peerid
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Len is the length of a peer id.
+const Len = 20
+
+// alphabet are the characters of the random part of generated peer ids.
+const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// New returns an Azureus-style peer id, such as -MM0001-xxxxxxxxxxxx,
+// for the two character client id and four character version, with
+// a random suffix so that every session has a different peer id.
+// Versions shorter than four characters are padded with zeros.
+func New(clientID, version string) (string, error) {
+	if len(clientID) != 2 {
+		return "", fmt.Errorf("client id %q must be exactly 2 characters", clientID)
+	}
+	if len(version) > 4 {
+		return "", fmt.Errorf("version %q must be at most 4 characters", version)
+	}
+	version += strings.Repeat("0", 4-len(version))
+
+	prefix := "-" + clientID + version + "-"
+
+	suffix := make([]byte, 0, Len-len(prefix))
+	var b [Len]byte
+	for len(suffix) < cap(suffix) {
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", fmt.Errorf("failed to generate peer id: %w", err)
+		}
+		for _, c := range b {
+			// bytes beyond the largest multiple of the alphabet length are
+			// rejected, so that every character is equally likely.
+			if int(c) < maxByte && len(suffix) < cap(suffix) {
+				suffix = append(suffix, alphabet[int(c)%len(alphabet)])
+			}
+		}
+	}
+
+	return prefix + string(suffix), nil
+}
+
+// maxByte is the largest multiple of the length of the
+// alphabet not exceeding the number of values of a byte.
+const maxByte = 256 - 256%len(alphabet)
+
+// Client is the software a peer id was generated by.
+type Client struct {
+	Name    string
+	Version string
+}
+
+func (c Client) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// Parse identifies the client that generated the peer id, trying the
+// Azureus, Shadow and Mainline styles and a few other known formats.
+// It reports false for peer ids of unknown clients.
+func Parse(id string) (Client, bool) {
+	for _, parse := range []func(string) (Client, bool){
+		parseAzureus,
+		parseOther,
+		parseMainline,
+		parseShadow,
+	} {
+		if c, ok := parse(id); ok {
+			return c, true
+		}
+	}
+	return Client{}, false
+}
+
+// Name returns the client that generated the peer id as in Client.String
+// or, for unknown clients, the peer id with non-printable bytes replaced.
+func Name(id string) string {
+	if c, ok := Parse(id); ok {
+		return c.String()
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '.'
+		}
+		return r
+	}, id)
+}
+
+// azureus are the two character client ids of the Azureus style.
+var azureus = map[string]string{
+	"7T": "aTorrent",
+	"AG": "Ares",
+	"AR": "Arctic",
+	"AT": "Artemis",
+	"AV": "Avicora",
+	"AX": "BitPump",
+	"AZ": "Vuze",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BE": "BitTorrent SDK",
+	"BF": "Bitflu",
+	"BG": "BTG",
+	"BI": "BiglyBT",
+	"BL": "BitBlinder",
+	"BP": "BitTorrent Pro",
+	"BR": "BitRocket",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"BX": "Bittorrent X",
+	"CD": "Enhanced CTorrent",
+	"CT": "CTorrent",
+	"DE": "DelugeTorrent",
+	"DP": "Propagate Data Client",
+	"EB": "EBit",
+	"ES": "electric sheep",
+	"FC": "FileCroc",
+	"FD": "Free Download Manager",
+	"FT": "FoxTorrent",
+	"FX": "Freebox BitTorrent",
+	"GS": "GSTorrent",
+	"HK": "Hekate",
+	"HL": "Halite",
+	"HM": "hMule",
+	"HN": "Hydranode",
+	"IL": "iLivid",
+	"JS": "Justseed.it",
+	"JT": "JavaTorrent",
+	"KG": "KGet",
+	"KT": "KTorrent",
+	"LC": "LeechCraft",
+	"LH": "LH-ABC",
+	"LP": "Lphant",
+	"LT": "libtorrent",
+	"LW": "LimeWire",
+	"MK": "Meerkat",
+	"MM": "tinytorrent",
+	"MO": "MonoTorrent",
+	"MP": "MooPolice",
+	"MR": "Miro",
+	"MT": "MoonlightTorrent",
+	"NB": "Net::BitTorrent",
+	"NX": "Net Transport",
+	"OS": "OneSwarm",
+	"OT": "OmegaTorrent",
+	"PB": "Protocol::BitTorrent",
+	"PD": "Pando",
+	"PI": "PicoTorrent",
+	"PT": "PHPTracker",
+	"qB": "qBittorrent",
+	"QD": "QQDownload",
+	"QT": "Qt 4 Torrent example",
+	"RT": "Retriever",
+	"RZ": "RezTorrent",
+	"SB": "Swiftbit",
+	"SD": "Thunder",
+	"SM": "SoMud",
+	"SP": "BitSpirit",
+	"SS": "SwarmScope",
+	"ST": "SymTorrent",
+	"st": "sharktorrent",
+	"SZ": "Shareaza",
+	"TB": "Torch",
+	"TE": "terasaur Seed Bank",
+	"TL": "Tribler",
+	"TN": "TorrentDotNET",
+	"TR": "Transmission",
+	"TS": "Torrentstorm",
+	"TT": "TuoTu",
+	"UL": "uLeecher!",
+	"UM": "µTorrent for Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WD": "WebTorrent Desktop",
+	"WT": "BitLet",
+	"WW": "WebTorrent",
+	"WY": "FireTorrent",
+	"XF": "Xfplay",
+	"XL": "Xunlei",
+	"XS": "XSwifter",
+	"XT": "XanTorrent",
+	"XX": "Xtorrent",
+	"ZT": "ZipTorrent",
+	"ZO": "Zona",
+}
+
+// parseAzureus parses the -XXvvvv- style, where XX is the client
+// id and vvvv the version.
+func parseAzureus(id string) (Client, bool) {
+	if len(id) < 8 || id[0] != '-' || id[7] != '-' {
+		return Client{}, false
+	}
+	name, ok := azureus[id[1:3]]
+	if !ok {
+		return Client{}, false
+	}
+
+	v := id[3:7]
+	switch id[1:3] {
+	case "TR":
+		// Transmission uses a major and a two digit minor version
+		// with an optional letter for pre-releases, e.g. 4040 as 4.04.
+		major, minor, suffix := v[:1], v[1:3], v[3:]
+		if suffix == "0" {
+			suffix = ""
+		}
+		return Client{Name: name, Version: major + "." + minor + suffix}, true
+	case "UT", "UM", "UW":
+		// µTorrent uses three digits and a letter for the build
+		// type, e.g. 355S as 3.5.5 stable.
+		return Client{Name: name, Version: dotted(v[:3], 3) + v[3:]}, true
+	default:
+		return Client{Name: name, Version: dotted(v, 3)}, true
+	}
+}
+
+// dotted joins the characters of the version with dots, trimming
+// trailing zero components beyond the first keep. Letters are
+// version numbers above 9, as in A for 10.
+func dotted(v string, keep int) string {
+	var parts []string
+	for _, r := range v {
+		switch {
+		case r >= '0' && r <= '9':
+			parts = append(parts, string(r))
+		case r >= 'A' && r <= 'Z':
+			parts = append(parts, strconv.Itoa(int(r-'A')+10))
+		case r >= 'a' && r <= 'z':
+			parts = append(parts, strconv.Itoa(int(r-'a')+36))
+		default:
+			parts = append(parts, string(r))
+		}
+	}
+	for len(parts) > keep && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+// shadow are the single character client ids of the Shadow style.
+var shadow = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowVersion is the alphabet of the version characters of the Shadow style.
+const shadowVersion = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// parseShadow parses the Xvvvvv style, where X is the client id and
+// up to five characters encode the version, padded with dashes.
+func parseShadow(id string) (Client, bool) {
+	if len(id) < 6 {
+		return Client{}, false
+	}
+	name, ok := shadow[id[0]]
+	if !ok {
+		return Client{}, false
+	}
+
+	// the version is padded with dashes or, if it takes all
+	// five characters, followed by three dashes.
+	v := id[1:6]
+	if end := strings.IndexByte(v, '-'); end >= 0 {
+		v = v[:end]
+	} else if len(id) < 9 || id[6:9] != "---" {
+		return Client{}, false
+	}
+	if v == "" {
+		return Client{}, false
+	}
+
+	var parts []string
+	for i := 0; i < len(v); i++ {
+		n := strings.IndexByte(shadowVersion, v[i])
+		if n < 0 {
+			return Client{}, false
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return Client{Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+// parseMainline parses the style of the original client, Mx-y-z--
+// or Mx-yy-z-, the version being separated by dashes.
+func parseMainline(id string) (Client, bool) {
+	if len(id) < 8 || (id[0] != 'M' && id[0] != 'Q') {
+		return Client{}, false
+	}
+
+	fields := strings.SplitN(id[1:8], "-", 4)
+	if len(fields) < 3 {
+		return Client{}, false
+	}
+	version := fields[:3]
+	for _, f := range version {
+		if f == "" || strings.Trim(f, "0123456789") != "" {
+			return Client{}, false
+		}
+	}
+
+	name := "Mainline"
+	if id[0] == 'Q' {
+		name = "Queen Bee"
+	}
+	return Client{Name: name, Version: strings.Join(version, ".")}, true
+}
+
+// parseOther identifies clients with formats of their own.
+func parseOther(id string) (Client, bool) {
+	switch {
+	case strings.HasPrefix(id, "exbc") && len(id) >= 6:
+		name := "BitComet"
+		if id[6:min(len(id), 10)] == "LORD" {
+			name = "BitLord"
+		}
+		return Client{Name: name, Version: fmt.Sprintf("%d.%02d", id[4], id[5])}, true
+	case strings.HasPrefix(id, "OP") && len(id) >= 6:
+		return Client{Name: "Opera", Version: id[2:6]}, true
+	case strings.HasPrefix(id, "XBT") && len(id) >= 6:
+		return Client{Name: "XBT Client", Version: dotted(id[3:6], 3)}, true
+	case strings.HasPrefix(id, "-BOW") && len(id) >= 7:
+		return Client{Name: "Bits on Wheels", Version: id[4:7]}, true
+	case strings.HasPrefix(id, "Plus---"):
+		return Client{Name: "Plus!"}, true
+	case strings.HasPrefix(id, "turbobt"):
+		return Client{Name: "TurboBT", Version: strings.TrimRight(id[7:min(len(id), 12)], "-\x00")}, true
+	case strings.HasPrefix(id, "btpd/") && len(id) >= 8:
+		return Client{Name: "BT Protocol Daemon", Version: id[5:8]}, true
+	case strings.HasPrefix(id, "BLZ"):
+		return Client{Name: "Blizzard Downloader"}, true
+	case strings.HasPrefix(id, "Deadman Walking-"):
+		return Client{Name: "Deadman"}, true
+	case strings.HasPrefix(id, "martini"):
+		return Client{Name: "Martini Man"}, true
+	}
+	return Client{}, false
+}
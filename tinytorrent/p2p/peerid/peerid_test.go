@@ -0,0 +1,81 @@
+package peerid_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Despire/tinytorrent/p2p/peerid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	a, err := peerid.New("MM", "0001")
+	require.NoError(t, err)
+	b, err := peerid.New("MM", "0001")
+	require.NoError(t, err)
+
+	assert.Len(t, a, peerid.Len)
+	assert.True(t, strings.HasPrefix(a, "-MM0001-"))
+	assert.NotEqual(t, a, b)
+
+	c, err := peerid.New("MM", "1")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(c, "-MM1000-"))
+
+	// the random suffix is drawn from the alphanumeric characters.
+	for range 100 {
+		id, err := peerid.New("MM", "0001")
+		require.NoError(t, err)
+		assert.Regexp(t, "^-MM0001-[0-9a-zA-Z]{12}$", id)
+	}
+
+	_, err = peerid.New("MMM", "0001")
+	assert.Error(t, err)
+	_, err = peerid.New("MM", "00001")
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"-qB4630-abcdefghijkl", "qBittorrent 4.6.3"},
+		{"-TR4040-abcdefghijkl", "Transmission 4.04"},
+		{"-TR294Z-abcdefghijkl", "Transmission 2.94Z"},
+		{"-UT355S-abcdefghijkl", "µTorrent 3.5.5S"},
+		{"-LT1240-abcdefghijkl", "libtorrent 1.2.4"},
+		{"-AZ5770-abcdefghijkl", "Vuze 5.7.7"},
+		{"-DE13F0-abcdefghijkl", "DelugeTorrent 1.3.15"},
+		{"M4-3-6--abcdefghijkl", "Mainline 4.3.6"},
+		{"M7-10-2-abcdefghijkl", "Mainline 7.10.2"},
+		{"T03I-----abcdefghijk", "BitTornado 0.3.18"},
+		{"S58B-----abcdefghijk", "Shadow's client 5.8.11"},
+		{"A2345---abcdefghijkl", "ABC 2.3.4.5"},
+		{"exbc\x00\x38LORDabcdefghij", "BitLord 0.56"},
+		{"XBT054d-abcdefghijkl", "XBT Client 0.5.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			c, ok := peerid.Parse(tt.id)
+			require.True(t, ok)
+			assert.Equal(t, tt.want, c.String())
+		})
+	}
+
+	for _, id := range []string{
+		"",
+		"-ZZ1234-abcdefghijkl",
+		"Tabcdefghijklmnopqrs",
+		"\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13",
+	} {
+		_, ok := peerid.Parse(id)
+		assert.False(t, ok, id)
+	}
+}
+
+func TestName(t *testing.T) {
+	assert.Equal(t, "qBittorrent 4.6.3", peerid.Name("-qB4630-abcdefghijkl"))
+	assert.Equal(t, "-ZZ1234-ab..", peerid.Name("-ZZ1234-ab\x00\xff"))
+}
@@ -0,0 +1,223 @@
+// Package proxy routes connections through a SOCKS5 (RFC 1928) or an
+// HTTP CONNECT proxy. TCP connections are tunneled with the CONNECT
+// command of either proxy type, while UDP traffic is relayed with the
+// SOCKS5 UDP ASSOCIATE command.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//go:generate stringer -type=Type
+type Type uint8
+
+const (
+	SOCKS5 Type = iota
+	HTTP
+)
+
+var (
+	ErrUnsupportedNetwork = errors.New("network not supported by proxy")
+	ErrUDPNotSupported    = errors.New("proxy does not support relaying udp")
+)
+
+// Proxy is a proxy server that connections are routed through.
+type Proxy struct {
+	Type Type
+	// Addr is the address of the proxy server in the host:port format.
+	Addr string
+	// Username and Password authenticate to the proxy, if set.
+	Username string
+	Password string
+}
+
+// Parse parses a proxy url in the socks5://[user:password@]host:port
+// or http://[user:password@]host:port format.
+func Parse(raw string) (*Proxy, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+
+	p := new(Proxy)
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		p.Type = SOCKS5
+	case "http":
+		p.Type = HTTP
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, supported only (socks5|http)", u.Scheme)
+	}
+
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy url %q is missing port", raw)
+	}
+	p.Addr = u.Host
+
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+// Dial establishes a TCP connection to the remote address through
+// the proxy. It has the signature of the transport.DialFunc.
+func (p *Proxy) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return p.DialContext(ctx, "tcp", addr)
+}
+
+// DialContext establishes a connection to the remote address through
+// the proxy. Only the tcp networks are supported. Hostnames are resolved
+// by the proxy, so that no DNS queries leak around it.
+func (p *Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedNetwork, network)
+	}
+
+	conn, err := p.connect(ctx, func(conn net.Conn) (net.Conn, error) {
+		switch p.Type {
+		case SOCKS5:
+			if err := p.socksAuthenticate(conn); err != nil {
+				return nil, err
+			}
+			if _, err := socksRequest(conn, cmdConnect, addr); err != nil {
+				return nil, err
+			}
+			return conn, nil
+		default:
+			return p.httpConnect(conn, addr)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s through proxy %s: %w", addr, p.Addr, err)
+	}
+	return conn, nil
+}
+
+// HTTPClient returns a http client which tunnels all of its requests
+// through the proxy, including plain http ones.
+func (p *Proxy) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         p.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// ListenPacket opens a UDP socket whose datagrams are relayed by the
+// proxy. Only SOCKS5 proxies are able to relay UDP. The association is
+// kept for as long as the returned connection is open.
+func (p *Proxy) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if p.Type != SOCKS5 {
+		return nil, ErrUDPNotSupported
+	}
+
+	var relay *net.UDPAddr
+	ctrl, err := p.connect(ctx, func(conn net.Conn) (net.Conn, error) {
+		if err := p.socksAuthenticate(conn); err != nil {
+			return nil, err
+		}
+		// the address the datagrams will be sent from is not known
+		// upfront, thus the proxy should accept them from any.
+		bound, err := socksRequest(conn, cmdUDPAssociate, "0.0.0.0:0")
+		if err != nil {
+			return nil, err
+		}
+		if relay, err = relayAddr(bound, conn.RemoteAddr()); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to associate udp with proxy %s: %w", p.Addr, err)
+	}
+
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("failed to open udp socket: %w", err)
+	}
+
+	return newPacketConn(ctrl, pc, relay), nil
+}
+
+// connect dials the proxy and performs the handshake,
+// aborting it once the context is done.
+func (p *Proxy) connect(ctx context.Context, handshake func(net.Conn) (net.Conn, error)) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the deadline of the context is not copied onto the connection, as the
+	// handshake could then time out before the context reports the error.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+
+	tunnel, err := handshake(conn)
+	if !stop() || err != nil {
+		conn.Close()
+		return nil, errors.Join(err, ctx.Err())
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+func (p *Proxy) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.Username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send connect request: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connect response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused connect: %s", strings.TrimSpace(resp.Status))
+	}
+
+	// the remote peer could have already sent data after the response.
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+)
+
+const socksVersion = 0x05
+
+const (
+	authNone         = 0x00
+	authPassword     = 0x02
+	authNoAcceptable = 0xff
+
+	// authPasswordVersion is the version of the
+	// username/password sub-negotiation (RFC 1929).
+	authPasswordVersion = 0x01
+)
+
+const (
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+)
+
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// replies are the messages of the SOCKS5 reply codes.
+var replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+func (p *Proxy) socksAuthenticate(conn net.Conn) error {
+	methods := []byte{authNone}
+	if p.Username != "" {
+		methods = []byte{authPassword}
+	}
+
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("failed to send greeting: %w", err)
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("failed to read greeting response: %w", err)
+	}
+	if resp[0] != socksVersion {
+		return fmt.Errorf("unexpected socks version %v", resp[0])
+	}
+
+	switch resp[1] {
+	case authNone:
+		return nil
+	case authPassword:
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := []byte{authPasswordVersion, byte(len(p.Username))}
+		req = append(req, p.Username...)
+		req = append(req, byte(len(p.Password)))
+		req = append(req, p.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return fmt.Errorf("failed to send credentials: %w", err)
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return fmt.Errorf("failed to read authentication response: %w", err)
+		}
+		if resp[1] != 0x00 {
+			return errors.New("proxy rejected credentials")
+		}
+		return nil
+	case authNoAcceptable:
+		return errors.New("proxy accepts none of the offered authentication methods")
+	default:
+		return fmt.Errorf("proxy selected unoffered authentication method %v", resp[1])
+	}
+}
+
+// socksRequest sends the command for the address and
+// returns the address bound by the proxy in the reply.
+func socksRequest(conn net.Conn, cmd byte, addr string) (string, error) {
+	req := []byte{socksVersion, cmd, 0x00}
+	req, err := appendAddr(req, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+
+	var resp [3]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return "", fmt.Errorf("failed to read reply: %w", err)
+	}
+	if resp[0] != socksVersion {
+		return "", fmt.Errorf("unexpected socks version %v", resp[0])
+	}
+	if resp[1] != 0x00 {
+		if msg, ok := replies[resp[1]]; ok {
+			return "", fmt.Errorf("proxy replied: %s", msg)
+		}
+		return "", fmt.Errorf("proxy replied with unknown code %v", resp[1])
+	}
+
+	return readAddr(conn)
+}
+
+// appendAddr appends the address in the host:port
+// format as the SOCKS5 address and port fields.
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip = ip.Unmap(); ip.Is4() {
+			b = append(b, atypIPv4)
+		} else {
+			b = append(b, atypIPv6)
+		}
+		b = append(b, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname %q too long", host)
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(p)), nil
+}
+
+// readAddr reads the SOCKS5 address and port fields.
+func readAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		b := make([]byte, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			b = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		ip, _ := netip.AddrFromSlice(b)
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", fmt.Errorf("unknown address type %v", atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// relayAddr returns the address datagrams are relayed through. Proxies
+// may reply with the unspecified address, meaning the proxy host itself.
+func relayAddr(bound string, proxy net.Addr) (*net.UDPAddr, error) {
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address %q: %w", bound, err)
+	}
+	if relay.IP.IsUnspecified() {
+		if tcp, ok := proxy.(*net.TCPAddr); ok {
+			relay.IP = tcp.IP
+		}
+	}
+	return relay, nil
+}
+
+// packetConn relays the datagrams through the proxy by prefixing each
+// with the SOCKS5 UDP request header holding the remote address.
+type packetConn struct {
+	*net.UDPConn
+
+	ctrl  net.Conn
+	relay *net.UDPAddr
+
+	// buf holds the datagram with its header while reading.
+	readL sync.Mutex
+	buf   []byte
+
+	once sync.Once
+}
+
+func newPacketConn(ctrl net.Conn, pc *net.UDPConn, relay *net.UDPAddr) *packetConn {
+	c := &packetConn{UDPConn: pc, ctrl: ctrl, relay: relay, buf: make([]byte, 64*1024)}
+
+	// the association ends once the control connection is closed
+	// by the proxy, after which no more datagrams are relayed.
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		c.Close()
+	}()
+
+	return c
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readL.Lock()
+	defer c.readL.Unlock()
+
+	buf := c.buf
+	for {
+		n, from, err := c.UDPConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if from.String() != c.relay.String() {
+			continue // only the relay may send datagrams.
+		}
+
+		// RSV(2) FRAG(1) ADDR PORT DATA, fragments are not supported.
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		r := &countingReader{b: buf[3:n]}
+		src, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		// sources are never resolved, to not leak any dns queries.
+		ap, err := netip.ParseAddrPort(src)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[3+r.n:n]), net.UDPAddrFromAddrPort(ap), nil
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	datagram, err := appendAddr([]byte{0x00, 0x00, 0x00}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	datagram = append(datagram, b...)
+	if _, err := c.UDPConn.WriteTo(datagram, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = errors.Join(c.UDPConn.Close(), c.ctrl.Close())
+	})
+	return err
+}
+
+type countingReader struct {
+	b []byte
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.n >= len(r.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[r.n:])
+	r.n += n
+	return n, nil
+}
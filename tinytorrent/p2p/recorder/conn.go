@@ -0,0 +1,116 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+)
+
+// maxMessage is the longest message the stream buffers to record it,
+// longer ones are not a valid message and stop the recording of
+// the stream as the messages can no longer be told apart.
+const maxMessage = 16 << 20
+
+// recordingConn records the messages read from and written to the connection.
+// Recording is done on the bytes passing through, so that the messages are
+// recorded exactly as exchanged regardless of how they are read or written.
+type recordingConn struct {
+	net.Conn
+	r    *Recorder
+	peer string
+
+	in, out stream
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.feed(b[:n], func(msg *messagesv1.Message, elided uint32) {
+		c.r.Message(c.peer, Received, msg, elided)
+	})
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.feed(b[:n], func(msg *messagesv1.Message, elided uint32) {
+		c.r.Message(c.peer, Sent, msg, elided)
+	})
+	return n, err
+}
+
+// stream splits the bytes of one direction of a connection into messages.
+type stream struct {
+	l   sync.Mutex
+	buf []byte
+	// skip is the rest of the block of the piece message being elided.
+	skip int
+	// broken is set once the stream is no longer recorded.
+	broken bool
+}
+
+// feed appends the bytes to the stream and emits the messages completed by them.
+func (s *stream) feed(b []byte, emit func(msg *messagesv1.Message, elided uint32)) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.broken {
+		return
+	}
+
+	if s.skip > 0 {
+		n := min(s.skip, len(b))
+		s.skip -= n
+		b = b[n:]
+	}
+	s.buf = append(s.buf, b...)
+
+	// msg is the rest of the buffer, which is kept
+	// once it does not hold a complete message.
+	msg := s.buf
+	for s.skip == 0 && len(msg) >= 4 {
+		length := binary.BigEndian.Uint32(msg[:4])
+		if length == 0 {
+			emit(&messagesv1.Message{Type: messagesv1.KeepAliveType}, 0)
+			msg = msg[4:]
+			continue
+		}
+		if length > maxMessage {
+			s.broken = true
+			s.buf = nil
+			return
+		}
+		if len(msg) < 5 {
+			break
+		}
+
+		typ := messagesv1.MessageType(msg[4])
+		if typ == messagesv1.PieceType && length > 1+8 {
+			// only the index and the begin of the block are kept.
+			if len(msg) < 4+1+8 {
+				break
+			}
+			elided := int(length) - 1 - 8
+			emit(&messagesv1.Message{Type: typ, Payload: clone(msg[5 : 5+8])}, uint32(elided))
+			msg = msg[4+1+8:]
+			n := min(elided, len(msg))
+			msg = msg[n:]
+			s.skip = elided - n
+			continue
+		}
+
+		if len(msg) < 4+int(length) {
+			break
+		}
+		emit(&messagesv1.Message{Type: typ, Payload: clone(msg[5 : 4+length])}, 0)
+		msg = msg[4+length:]
+	}
+	s.buf = append(s.buf[:0], msg...)
+}
+
+func clone(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
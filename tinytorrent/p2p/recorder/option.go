@@ -0,0 +1,31 @@
+package recorder
+
+import "time"
+
+type ReplayOption func(r *replay)
+
+// WithSpeed scales the recorded timing of the replayed
+// messages, 2 replays the session twice as fast.
+func WithSpeed(speed float64) ReplayOption {
+	return func(r *replay) {
+		if speed > 0 {
+			r.speed = speed
+		}
+	}
+}
+
+// WithLinger sets how long the responses of the peer are read
+// after the last record was replayed, DefaultLinger by default.
+func WithLinger(d time.Duration) ReplayOption {
+	return func(r *replay) {
+		r.linger = d
+	}
+}
+
+// WithObserver sets the function reporting the replayed records and
+// the responses of the peer, as Received and Sent records respectively.
+func WithObserver(observe func(*Record)) ReplayOption {
+	return func(r *replay) {
+		r.observe = observe
+	}
+}
@@ -0,0 +1,73 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxRecord bounds the length of a record read from a log, as the
+// blocks of piece messages are elided records are rather small.
+const maxRecord = 16 << 20
+
+// Reader reads the records of a log.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader checks the header of the log read from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	var header [len(magic)]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if string(header[:]) != magic {
+		return nil, errors.New("not a recording or of an unsupported version")
+	}
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next record of the log, or io.EOF once all were read.
+// A record cut short, by the client being killed while writing it, is
+// reported as io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*Record, error) {
+	l, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxRecord {
+		return nil, fmt.Errorf("record of %d bytes exceeds the limit", l)
+	}
+
+	body := make([]byte, l)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read record: %w", err)
+	}
+
+	rec := new(Record)
+	if err := rec.unmarshalBinary(body); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// ReadAll returns all the records of the log.
+func (r *Reader) ReadAll() ([]*Record, error) {
+	var records []*Record
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
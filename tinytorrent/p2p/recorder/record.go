@@ -0,0 +1,181 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+)
+
+//go:generate stringer -type=Direction
+type Direction uint8
+
+const (
+	// Received is a record read from the peer.
+	Received Direction = iota
+	// Sent is a record written to the peer.
+	Sent
+)
+
+// kinds of the records in the log.
+const (
+	kindMessage   = 0
+	kindHandshake = 1
+)
+
+// Record is a handshake or a message exchanged with a peer.
+type Record struct {
+	Time      time.Time
+	Peer      string
+	Direction Direction
+
+	// Handshake is set for the handshakes, Message otherwise.
+	Handshake *messagesv1.Handshake
+	Message   *messagesv1.Message
+	// Elided is the length of the block of a piece message, whose
+	// payload only consists of the index and the begin of the block.
+	Elided uint32
+}
+
+// appendBinary appends the record in the format of the log, without the length prefix.
+func (r *Record) appendBinary(b []byte) []byte {
+	b = binary.AppendVarint(b, r.Time.UnixNano())
+	b = append(b, byte(r.Direction))
+	if r.Handshake != nil {
+		b = append(b, kindHandshake)
+	} else {
+		b = append(b, kindMessage)
+	}
+	b = binary.AppendUvarint(b, uint64(len(r.Peer)))
+	b = append(b, r.Peer...)
+
+	if r.Handshake != nil {
+		return append(b, r.Handshake.Serialize()...)
+	}
+	b = append(b, byte(r.Message.Type))
+	b = binary.AppendUvarint(b, uint64(r.Elided))
+	return append(b, r.Message.Payload...)
+}
+
+// unmarshalBinary parses the record from the body of a record in the log.
+func (r *Record) unmarshalBinary(b []byte) error {
+	nanos, n := binary.Varint(b)
+	if n <= 0 {
+		return errors.New("invalid record time")
+	}
+	b = b[n:]
+	r.Time = time.Unix(0, nanos)
+
+	if len(b) < 2 {
+		return errors.New("record too short")
+	}
+	r.Direction = Direction(b[0])
+	kind := b[1]
+	b = b[2:]
+
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return errors.New("invalid record peer")
+	}
+	r.Peer = string(b[n : n+int(l)])
+	b = b[n+int(l):]
+
+	switch kind {
+	case kindHandshake:
+		r.Handshake = new(messagesv1.Handshake)
+		if err := r.Handshake.Deserialize(b); err != nil {
+			return fmt.Errorf("invalid record handshake: %w", err)
+		}
+	case kindMessage:
+		if len(b) < 1 {
+			return errors.New("record message is missing the type")
+		}
+		r.Message = &messagesv1.Message{Type: messagesv1.MessageType(b[0])}
+		elided, n := binary.Uvarint(b[1:])
+		if n <= 0 {
+			return errors.New("invalid record elided length")
+		}
+		r.Elided = uint32(elided)
+		if payload := b[1+n:]; len(payload) > 0 {
+			r.Message.Payload = payload
+		}
+	default:
+		return fmt.Errorf("unknown record kind %d", kind)
+	}
+	return nil
+}
+
+// Serialize returns the message of the record as sent over
+// the wire, with an elided block filled with zeros.
+func (r *Record) Serialize() []byte {
+	if r.Handshake != nil {
+		return r.Handshake.Serialize()
+	}
+	if r.Message.Type == messagesv1.KeepAliveType {
+		return messagesv1.KeepAlive{}.Serialize()
+	}
+	msg := make([]byte, 4+1, 4+1+len(r.Message.Payload)+int(r.Elided))
+	binary.BigEndian.PutUint32(msg[:4], uint32(1+len(r.Message.Payload)+int(r.Elided)))
+	msg[4] = byte(r.Message.Type)
+	msg = append(msg, r.Message.Payload...)
+	return append(msg, make([]byte, r.Elided)...)
+}
+
+// Summary describes the handshake or the message of the record.
+func (r *Record) Summary() string {
+	if r.Handshake != nil {
+		return fmt.Sprintf("Handshake info_hash=%x peer_id=%q reserved=%x", r.Handshake.InfoHash, r.Handshake.PeerID, r.Handshake.Reserved)
+	}
+
+	m := r.Message
+	name := strings.TrimSuffix(m.Type.String(), "Type")
+	switch m.Type {
+	case messagesv1.HaveType:
+		h := new(messagesv1.Have)
+		if err := h.Deserialize(m.Payload); err == nil {
+			return fmt.Sprintf("%s index=%d", name, h.Index)
+		}
+	case messagesv1.BitfieldType:
+		return fmt.Sprintf("%s %d bytes", name, len(m.Payload))
+	case messagesv1.RequestType:
+		req := new(messagesv1.Request)
+		if err := req.Deserialize(m.Payload); err == nil {
+			return fmt.Sprintf("%s index=%d begin=%d length=%d", name, req.Index, req.Begin, req.Length)
+		}
+	case messagesv1.CancelType:
+		c := new(messagesv1.Cancel)
+		if err := c.Deserialize(m.Payload); err == nil {
+			return fmt.Sprintf("%s index=%d begin=%d length=%d", name, c.Index, c.Begin, c.Length)
+		}
+	case messagesv1.PieceType:
+		if len(m.Payload) >= 8 {
+			return fmt.Sprintf("%s index=%d begin=%d length=%d", name,
+				binary.BigEndian.Uint32(m.Payload[:4]),
+				binary.BigEndian.Uint32(m.Payload[4:8]),
+				len(m.Payload)-8+int(r.Elided),
+			)
+		}
+	case messagesv1.PortType:
+		p := new(messagesv1.Port)
+		if err := p.Deserialize(m.Payload); err == nil {
+			return fmt.Sprintf("%s port=%d", name, p.Port)
+		}
+	case messagesv1.ExtendedType:
+		e := new(messagesv1.Extended)
+		if err := e.Deserialize(m.Payload); err == nil {
+			return fmt.Sprintf("%s id=%d %d bytes", name, e.ID, len(e.Payload))
+		}
+	case messagesv1.HashRequestType, messagesv1.HashesType, messagesv1.HashRejectType:
+		// the hashes of a Hashes message follow the request.
+		h := new(messagesv1.HashRequest)
+		if err := h.Deserialize(m.Payload[:min(len(m.Payload), 48)]); err == nil {
+			return fmt.Sprintf("%s root=%x index=%d length=%d", name, h.PiecesRoot[:4], h.Index, h.Length)
+		}
+	default:
+		return name
+	}
+	return fmt.Sprintf("%s malformed %d bytes", name, len(m.Payload))
+}
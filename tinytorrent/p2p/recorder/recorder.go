@@ -0,0 +1,131 @@
+// Package recorder records the handshakes and messages exchanged with peers
+// to a compact log and reads them back, to inspect or replay a session when
+// debugging interoperability problems with other clients.
+//
+// The log starts with a magic header followed by the records, each prefixed
+// by its length as an uvarint. The blocks of piece messages are not recorded,
+// only their length, which keeps the log small while downloading.
+package recorder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+)
+
+// magic identifies the log and the version of its format.
+const magic = "TTREC\x01"
+
+// Recorder writes the records of the sessions with peers to a log,
+// it is safe for concurrent use by the connections of many peers.
+type Recorder struct {
+	l sync.Mutex
+	w io.Writer
+	// err is the first error writing to w, after
+	// which nothing more is recorded.
+	err    error
+	closed bool
+}
+
+// New starts a log of records written to w.
+func New(w io.Writer) (*Recorder, error) {
+	if _, err := io.WriteString(w, magic); err != nil {
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+	return &Recorder{w: w}, nil
+}
+
+// Create starts a log of records in the file at path, which is truncated.
+func Create(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+	r, err := New(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Handshake records the handshake exchanged with the peer.
+func (r *Recorder) Handshake(peer string, dir Direction, h *messagesv1.Handshake) {
+	if r == nil {
+		return
+	}
+	r.record(&Record{Time: time.Now(), Peer: peer, Direction: dir, Handshake: h})
+}
+
+// Message records the message exchanged with the peer, elided
+// being the length of the block of a piece message left out.
+func (r *Recorder) Message(peer string, dir Direction, msg *messagesv1.Message, elided uint32) {
+	if r == nil {
+		return
+	}
+	r.record(&Record{Time: time.Now(), Peer: peer, Direction: dir, Message: msg, Elided: elided})
+}
+
+// Conn returns conn recording the messages read from and written to it,
+// conn must be past the handshake. A nil recorder returns conn as is.
+func (r *Recorder) Conn(peer string, conn net.Conn) net.Conn {
+	if r == nil {
+		return conn
+	}
+	return &recordingConn{Conn: conn, r: r, peer: peer}
+}
+
+// Err returns the error that stopped the recording, if any.
+func (r *Recorder) Err() error {
+	if r == nil {
+		return nil
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.err
+}
+
+// Close stops recording and closes the underlying
+// writer if it is an io.Closer.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	err := r.err
+	if c, ok := r.w.(io.Closer); ok {
+		if errClose := c.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
+
+func (r *Recorder) record(rec *Record) {
+	body := rec.appendBinary(nil)
+	b := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(body)), uint64(len(body)))
+	b = append(b, body...)
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.err != nil || r.closed {
+		return
+	}
+	// each record is a single write, so that the log
+	// is not interleaved by concurrent connections.
+	if _, err := r.w.Write(b); err != nil {
+		r.err = fmt.Errorf("failed to write record: %w", err)
+	}
+}
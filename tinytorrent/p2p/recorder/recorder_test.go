@@ -0,0 +1,148 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testHandshake = &messagesv1.Handshake{
+	Pstr:     messagesv1.ProtocolV1,
+	InfoHash: strings.Repeat("\x03", 20),
+	PeerID:   strings.Repeat("r", 20),
+}
+
+func TestRecorder_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := New(&buf)
+	require.NoError(t, err)
+
+	r.Handshake("1.2.3.4:6881", Received, testHandshake)
+	r.Message("1.2.3.4:6881", Sent, &messagesv1.Message{Type: messagesv1.UnChokeType}, 0)
+	r.Message("[::1]:6881", Received, &messagesv1.Message{Type: messagesv1.KeepAliveType}, 0)
+	r.Message("1.2.3.4:6881", Sent, &messagesv1.Message{Type: messagesv1.PieceType, Payload: make([]byte, 8)}, 16<<10)
+	require.NoError(t, r.Close())
+
+	// nothing is recorded once closed.
+	r.Message("1.2.3.4:6881", Sent, &messagesv1.Message{Type: messagesv1.ChokeType}, 0)
+
+	rd, err := NewReader(&buf)
+	require.NoError(t, err)
+	records, err := rd.ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+
+	assert.Equal(t, testHandshake, records[0].Handshake)
+	assert.Equal(t, Received, records[0].Direction)
+	assert.Equal(t, "1.2.3.4:6881", records[0].Peer)
+	assert.Equal(t, "UnChoke", records[1].Summary())
+	assert.Equal(t, Sent, records[1].Direction)
+	assert.Equal(t, "KeepAlive", records[2].Summary())
+	assert.Equal(t, "[::1]:6881", records[2].Peer)
+	assert.Equal(t, "Piece index=0 begin=0 length=16384", records[3].Summary())
+	assert.Len(t, records[3].Serialize(), 4+1+8+16<<10)
+	assert.False(t, records[3].Time.Before(records[0].Time))
+}
+
+func TestReader_Truncated(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := New(&buf)
+	require.NoError(t, err)
+	r.Handshake("1.2.3.4:6881", Sent, testHandshake)
+	r.Handshake("1.2.3.4:6881", Received, testHandshake)
+
+	rd, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-10]))
+	require.NoError(t, err)
+	records, err := rd.ReadAll()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Len(t, records, 1)
+
+	_, err = NewReader(strings.NewReader("d8:announce"))
+	assert.Error(t, err)
+}
+
+func TestStream(t *testing.T) {
+	var wire []byte
+	wire = append(wire, messagesv1.KeepAlive{}.Serialize()...)
+	wire = append(wire, (&messagesv1.Have{Index: 7}).Serialize()...)
+	wire = append(wire, (&messagesv1.Piece{Index: 1, Begin: 2, Block: bytes.Repeat([]byte{1}, 100)}).Serialize()...)
+	wire = append(wire, (&messagesv1.Request{Index: 3, Begin: 4, Length: 5}).Serialize()...)
+
+	// the messages are the same no matter how the bytes are split.
+	for _, size := range []int{1, 3, 13, 50, len(wire)} {
+		var s stream
+		var got []string
+		for b := wire; len(b) > 0; b = b[min(size, len(b)):] {
+			s.feed(b[:min(size, len(b))], func(msg *messagesv1.Message, elided uint32) {
+				got = append(got, (&Record{Message: msg, Elided: elided}).Summary())
+			})
+		}
+		assert.Equal(t, []string{
+			"KeepAlive",
+			"Have index=7",
+			"Piece index=1 begin=2 length=100",
+			"Request index=3 begin=4 length=5",
+		}, got, "split in %d bytes", size)
+		assert.Empty(t, s.buf)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	records := []*Record{
+		{Time: at(0), Direction: Sent, Handshake: testHandshake},
+		{Time: at(time.Millisecond), Direction: Received, Handshake: testHandshake},
+		{Time: at(2 * time.Millisecond), Direction: Received, Message: &messagesv1.Message{Type: messagesv1.InterestType}},
+		{Time: at(3 * time.Millisecond), Direction: Sent, Message: &messagesv1.Message{Type: messagesv1.UnChokeType}},
+		{Time: at(40 * time.Millisecond), Direction: Received, Message: &messagesv1.Message{Type: messagesv1.RequestType, Payload: (&messagesv1.Request{Length: 4}).Serialize()[5:]}},
+		// a later session is not replayed.
+		{Time: at(time.Second), Direction: Received, Handshake: testHandshake},
+		{Time: at(time.Second), Direction: Received, Message: &messagesv1.Message{Type: messagesv1.ChokeType}},
+	}
+
+	local, remote := net.Pipe()
+	go func() {
+		defer local.Close()
+		var h [messagesv1.HandshakeLength]byte
+		if _, err := io.ReadFull(local, h[:]); err != nil {
+			return
+		}
+		local.Write((&messagesv1.Handshake{Pstr: messagesv1.ProtocolV1, InfoHash: testHandshake.InfoHash, PeerID: strings.Repeat("l", 20)}).Serialize())
+		for range 2 {
+			msg, err := messagesv1.Identify(local)
+			if err != nil {
+				return
+			}
+			if msg.Type == messagesv1.InterestType {
+				local.Write(messagesv1.Unchoke{}.Serialize())
+			}
+		}
+		// the peer under test closes the connection, which ends the replay.
+	}()
+
+	var got []string
+	begin := time.Now()
+	err := Replay(context.Background(), remote, records, WithObserver(func(r *Record) {
+		got = append(got, r.Direction.String()+" "+strings.Fields(r.Summary())[0])
+	}))
+	require.NoError(t, err)
+
+	assert.Less(t, time.Since(begin), DefaultLinger)
+	assert.GreaterOrEqual(t, time.Since(begin), 35*time.Millisecond)
+	assert.ElementsMatch(t, []string{
+		"Received Handshake",
+		"Sent Handshake",
+		"Received Interest",
+		"Sent UnChoke",
+		"Received Request",
+	}, got)
+}
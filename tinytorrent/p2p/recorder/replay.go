@@ -0,0 +1,139 @@
+package recorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/messagesv1"
+)
+
+// DefaultLinger is how long the responses of the peer are
+// read after the last record was replayed.
+const DefaultLinger = 5 * time.Second
+
+// Replay plays the remote peer of a recorded session against conn: the
+// handshake and the messages received from the peer in the session are
+// written to conn with their recorded timing, while the responses read
+// from conn are reported to the observer, as are the replayed records.
+//
+// The session starts at the first handshake received in the records, which
+// are expected to be of a single peer, and ends before the next one.
+func Replay(ctx context.Context, conn net.Conn, records []*Record, opts ...ReplayOption) error {
+	r := &replay{speed: 1, linger: DefaultLinger, observe: func(*Record) {}}
+	for _, o := range opts {
+		o(r)
+	}
+
+	session := r.session(records)
+	if len(session) == 0 {
+		return errors.New("no handshake received from the peer in the records")
+	}
+
+	peer := conn.RemoteAddr().String()
+	// done is closed once the peer closed the connection.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.responses(conn, peer)
+	}()
+	defer func() { <-done }()
+	defer conn.Close()
+
+	start, first := time.Now(), session[0].Time
+	for _, rec := range session {
+		at := start.Add(time.Duration(float64(rec.Time.Sub(first)) / r.speed))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(at)):
+		}
+
+		if _, err := conn.Write(rec.Serialize()); err != nil {
+			return fmt.Errorf("failed to replay %s: %w", rec.Summary(), err)
+		}
+		r.report(&Record{
+			Time:      time.Now(),
+			Peer:      peer,
+			Direction: Received,
+			Handshake: rec.Handshake,
+			Message:   rec.Message,
+			Elided:    rec.Elided,
+		})
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-done:
+	case <-time.After(r.linger):
+	}
+	return nil
+}
+
+// replay holds the options of Replay.
+type replay struct {
+	speed   float64
+	linger  time.Duration
+	observe func(*Record)
+
+	// l serializes the records reported to the observer.
+	l sync.Mutex
+}
+
+func (r *replay) report(rec *Record) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.observe(rec)
+}
+
+// session returns the records received from the peer
+// from its first handshake until the next one.
+func (r *replay) session(records []*Record) []*Record {
+	var session []*Record
+	for _, rec := range records {
+		if rec.Direction != Received {
+			continue
+		}
+		if rec.Handshake != nil {
+			if len(session) > 0 {
+				break
+			}
+			session = append(session, rec)
+			continue
+		}
+		if len(session) > 0 {
+			session = append(session, rec)
+		}
+	}
+	return session
+}
+
+// responses reports the handshake and the messages read from
+// conn, as sent by the peer under test, until it is closed.
+func (r *replay) responses(conn net.Conn, peer string) {
+	var resp [messagesv1.HandshakeLength]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return
+	}
+	h := new(messagesv1.Handshake)
+	if err := h.Deserialize(resp[:]); err != nil {
+		return
+	}
+	r.report(&Record{Time: time.Now(), Peer: peer, Direction: Sent, Handshake: h})
+
+	var s stream
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := conn.Read(buf)
+		s.feed(buf[:n], func(msg *messagesv1.Message, elided uint32) {
+			r.report(&Record{Time: time.Now(), Peer: peer, Direction: Sent, Message: msg, Elided: elided})
+		})
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package transport abstracts over the transports
+// used to establish connections to remote peers.
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// DialFunc establishes a connection to the remote address.
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// TCP dials the remote address over TCP.
+func TCP(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Race returns a DialFunc that dials the address with all dialers
+// concurrently, the first established connection wins and the
+// remaining attempts are cancelled or closed.
+func Race(dialers ...DialFunc) DialFunc {
+	if len(dialers) == 1 {
+		return dialers[0]
+	}
+
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+
+		results := make(chan result, len(dialers))
+		for _, dial := range dialers {
+			go func() {
+				conn, err := dial(ctx, addr)
+				results <- result{conn, err}
+			}()
+		}
+
+		var (
+			winner net.Conn
+			errs   []error
+		)
+		for range dialers {
+			r := <-results
+			if r.err != nil {
+				errs = append(errs, r.err)
+				continue
+			}
+			if winner != nil {
+				r.conn.Close()
+				continue
+			}
+			winner = r.conn
+			cancel()
+		}
+
+		if winner != nil {
+			return winner, nil
+		}
+		return nil, errors.Join(errs...)
+	}
+}
@@ -0,0 +1,59 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/p2p/transport"
+	"github.com/Despire/tinytorrent/p2p/utp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRace(t *testing.T) {
+	// remote peer only reachable over uTP.
+	remote, err := utp.Listen("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { remote.Close() })
+
+	go func() {
+		for {
+			c, err := remote.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("utp"))
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	local := utp.NewSocket(pc)
+	t.Cleanup(func() { local.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dial := transport.Race(transport.TCP, local.DialContext)
+
+	conn, err := dial(ctx, remote.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	var b [3]byte
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(b[:])
+	assert.Nil(t, err)
+	assert.Equal(t, "utp", string(b[:]))
+}
+
+func TestRace_AllFail(t *testing.T) {
+	failA := func(context.Context, string) (net.Conn, error) { return nil, errors.New("a") }
+	failB := func(context.Context, string) (net.Conn, error) { return nil, errors.New("b") }
+
+	_, err := transport.Race(failA, failB)(context.Background(), "127.0.0.1:1")
+	assert.ErrorContains(t, err, "a")
+	assert.ErrorContains(t, err, "b")
+}
@@ -0,0 +1,632 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxPayload is the largest payload of a single packet, chosen
+	// so that the datagram fits into the MTU of most links.
+	maxPayload = 1200
+	// minCwnd is the lower bound of the congestion window.
+	minCwnd = 2 * maxPayload
+	// initialCwnd is the congestion window a new connection starts with.
+	initialCwnd = 4 * maxPayload
+	// maxCwnd is the upper bound of the congestion window.
+	maxCwnd = 1024 * 1024
+	// recvWindow is the maximum of bytes buffered on the receiving side.
+	recvWindow = 1024 * 1024
+	// maxSendBuffer is the maximum of bytes buffered by Write before blocking.
+	maxSendBuffer = 256 * 1024
+	// maxOutOfOrder is the maximum distance of a packet from the last
+	// in-order packet for it to be buffered.
+	maxOutOfOrder = 2048
+
+	// targetDelay is the queuing delay LEDBAT aims for.
+	targetDelay = 100 * time.Millisecond
+	// gain of the LEDBAT controller.
+	gain = 1.0
+	// baseDelayWindow is the period after which the base delay is refreshed.
+	baseDelayWindow = 2 * time.Minute
+
+	minRTO = 500 * time.Millisecond
+	maxRTO = 30 * time.Second
+
+	// synRetries is the number of SYN transmissions before giving up.
+	synRetries = 3
+	// maxTransmissions is the number of transmissions of a packet
+	// before the connection is considered dead.
+	maxTransmissions = 8
+
+	keepAliveInterval = 29 * time.Second
+	idleTimeout       = 90 * time.Second
+)
+
+// ErrTimeout is returned when the remote peer stopped responding.
+var ErrTimeout = errors.New("utp: connection timed out")
+
+type connState uint8
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+type outPacket struct {
+	packet
+	sentAt        time.Time
+	transmissions int
+	acked         bool
+	fastResent    bool
+}
+
+// Conn is a single uTP connection, it implements the net.Conn interface.
+type Conn struct {
+	socket *Socket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	connected chan struct{}
+	connOnce  sync.Once
+	readable  chan struct{}
+	writable  chan struct{}
+
+	// l guards the fields below.
+	l     sync.Mutex
+	state connState
+	err   error
+	// closed is set once Close was called.
+	closed  bool
+	closing bool
+	finSent bool
+
+	seqNr uint16
+	ackNr uint16
+
+	// receiving side.
+	readBuf      []byte
+	inbound      map[uint16][]byte
+	inboundBytes int
+	finReceived  bool
+	eofSeq       uint16
+	eof          bool
+
+	// sending side.
+	sendBuf    []byte
+	outbound   []*outPacket
+	flight     int
+	cwnd       float64
+	slowStart  bool
+	peerWnd    uint32
+	replyMicro uint32
+
+	// timing.
+	rtt, rttVar time.Duration
+	rto         time.Duration
+	lastSend    time.Time
+	lastRecv    time.Time
+	baseDelay   struct {
+		current, previous uint32
+		since             time.Time
+	}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		socket:    s,
+		remote:    remote,
+		recvID:    recvID,
+		sendID:    sendID,
+		connected: make(chan struct{}),
+		readable:  make(chan struct{}, 1),
+		writable:  make(chan struct{}, 1),
+		inbound:   make(map[uint16][]byte),
+		cwnd:      initialCwnd,
+		slowStart: true,
+		peerWnd:   recvWindow,
+		rto:       time.Second,
+		lastRecv:  time.Now(),
+		lastSend:  time.Now(),
+	}
+	c.baseDelay.current = ^uint32(0)
+	c.baseDelay.previous = ^uint32(0)
+	c.baseDelay.since = time.Now()
+	return c
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.l.Lock()
+		if len(c.readBuf) > 0 {
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			c.l.Unlock()
+			return n, nil
+		}
+
+		var err error
+		switch {
+		case c.closed:
+			err = net.ErrClosed
+		case c.eof:
+			err = io.EOF
+		case c.err != nil:
+			err = c.err
+		}
+		deadline := c.readDeadline
+		c.l.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		wait(c.readable, deadline)
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.l.Lock()
+
+		var err error
+		switch {
+		case c.closed:
+			err = net.ErrClosed
+		case c.err != nil:
+			err = c.err
+		}
+		if err != nil {
+			c.l.Unlock()
+			return written, err
+		}
+
+		if space := maxSendBuffer - len(c.sendBuf); space > 0 {
+			n := min(space, len(b)-written)
+			c.sendBuf = append(c.sendBuf, b[written:written+n]...)
+			written += n
+			c.flushLocked()
+			c.l.Unlock()
+			continue
+		}
+
+		deadline := c.writeDeadline
+		c.l.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		wait(c.writable, deadline)
+	}
+	return written, nil
+}
+
+// Close sends any buffered data followed by a FIN packet and
+// returns without waiting for the remote peer to acknowledge it.
+func (c *Conn) Close() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	signal(c.readable)
+	signal(c.writable)
+
+	switch c.state {
+	case stateSynSent:
+		c.failLocked(net.ErrClosed)
+	case stateConnected:
+		c.closing = true
+		c.flushLocked()
+		c.maybeDoneLocked()
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.socket.Addr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.l.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.l.Unlock()
+	signal(c.readable)
+	signal(c.writable)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.l.Lock()
+	c.readDeadline = t
+	c.l.Unlock()
+	signal(c.readable)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.l.Lock()
+	c.writeDeadline = t
+	c.l.Unlock()
+	signal(c.writable)
+	return nil
+}
+
+func (c *Conn) fail(err error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.failLocked(err)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = err
+	}
+	c.connOnce.Do(func() { close(c.connected) })
+	c.socket.remove(c)
+	signal(c.readable)
+	signal(c.writable)
+}
+
+func (c *Conn) handle(p *packet) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	c.lastRecv = time.Now()
+	c.replyMicro = now() - p.Timestamp
+	c.peerWnd = p.WindowSize
+
+	switch p.Type {
+	case ResetType:
+		c.failLocked(syscall.ECONNRESET)
+		return
+	case SynType:
+		c.sendStateLocked() // our ack of the syn was lost.
+		return
+	}
+
+	if c.state == stateSynSent {
+		// the first packet from the remote acknowledges our SYN,
+		// its sequence number is the first one we will receive.
+		c.state = stateConnected
+		c.ackNr = p.SeqNr - 1
+		c.connOnce.Do(func() { close(c.connected) })
+	}
+
+	c.ackLocked(p)
+
+	switch p.Type {
+	case DataType:
+		c.receiveLocked(p.SeqNr, p.Payload)
+		c.sendStateLocked()
+	case FinType:
+		if !c.finReceived {
+			c.finReceived = true
+			c.eofSeq = p.SeqNr
+		}
+		c.advanceLocked()
+		c.sendStateLocked()
+	}
+
+	c.flushLocked()
+	c.maybeDoneLocked()
+}
+
+func (c *Conn) receiveLocked(seq uint16, payload []byte) {
+	if !seqLess(c.ackNr, seq) {
+		return // duplicate.
+	}
+	if seq-c.ackNr > maxOutOfOrder {
+		return // too far ahead.
+	}
+	if _, ok := c.inbound[seq]; !ok {
+		c.inbound[seq] = payload
+		c.inboundBytes += len(payload)
+	}
+	c.advanceLocked()
+}
+
+func (c *Conn) advanceLocked() {
+	for {
+		next := c.ackNr + 1
+		if b, ok := c.inbound[next]; ok {
+			delete(c.inbound, next)
+			c.inboundBytes -= len(b)
+			c.readBuf = append(c.readBuf, b...)
+			c.ackNr = next
+			signal(c.readable)
+			continue
+		}
+		if c.finReceived && !c.eof && c.eofSeq == next {
+			c.ackNr = next
+			c.eof = true
+			signal(c.readable)
+		}
+		return
+	}
+}
+
+func (c *Conn) ackLocked(p *packet) {
+	acked := 0
+	for _, o := range c.outbound {
+		if o.acked {
+			continue
+		}
+		if seqLess(p.AckNr, o.SeqNr) && !selectivelyAcked(p.SelectiveAck, p.AckNr, o.SeqNr) {
+			continue
+		}
+		o.acked = true
+		acked += len(o.Payload)
+		c.flight -= len(o.Payload)
+		if o.transmissions == 1 {
+			c.sampleRTTLocked(time.Since(o.sentAt))
+		}
+	}
+
+	for len(c.outbound) > 0 && c.outbound[0].acked {
+		c.outbound[0] = nil
+		c.outbound = c.outbound[1:]
+	}
+
+	if acked > 0 {
+		c.congestionControlLocked(acked, p.TimestampDif)
+		signal(c.writable)
+	}
+
+	// fast retransmit, if 3 or more packets past the next
+	// expected packet were received it is considered lost.
+	if len(p.SelectiveAck) > 0 && len(c.outbound) > 0 {
+		first := c.outbound[0]
+		received := 0
+		for _, b := range p.SelectiveAck {
+			received += bits.OnesCount8(b)
+		}
+		if first.SeqNr == p.AckNr+1 && !first.fastResent && received >= 3 {
+			first.fastResent = true
+			c.cwnd = max(c.cwnd/2, minCwnd)
+			c.slowStart = false
+			c.transmitLocked(first)
+		}
+	}
+}
+
+func (c *Conn) sampleRTTLocked(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = min(max(c.rtt+4*c.rttVar, minRTO), maxRTO)
+}
+
+// congestionControlLocked adjusts the congestion window according
+// to LEDBAT based on the one way delay measured by the remote peer.
+func (c *Conn) congestionControlLocked(acked int, delay uint32) {
+	if time.Since(c.baseDelay.since) > baseDelayWindow {
+		c.baseDelay.previous = c.baseDelay.current
+		c.baseDelay.current = ^uint32(0)
+		c.baseDelay.since = time.Now()
+	}
+	if delay != 0 {
+		c.baseDelay.current = min(c.baseDelay.current, delay)
+	}
+
+	base := min(c.baseDelay.current, c.baseDelay.previous)
+
+	queuing := time.Duration(0)
+	if delay != 0 && base != ^uint32(0) {
+		queuing = time.Duration(delay-base) * time.Microsecond
+	}
+
+	if c.slowStart && queuing < targetDelay/2 {
+		c.cwnd += float64(acked)
+	} else {
+		c.slowStart = false
+		offTarget := float64(targetDelay-queuing) / float64(targetDelay)
+		c.cwnd += gain * offTarget * float64(acked) * maxPayload / c.cwnd
+	}
+
+	c.cwnd = min(max(c.cwnd, minCwnd), maxCwnd)
+}
+
+func (c *Conn) flushLocked() {
+	if c.state != stateConnected {
+		return
+	}
+
+	for len(c.sendBuf) > 0 {
+		n := min(len(c.sendBuf), maxPayload)
+		window := min(int(c.cwnd), int(c.peerWnd))
+		if c.flight > 0 && c.flight+n > window {
+			break
+		}
+
+		payload := make([]byte, n)
+		copy(payload, c.sendBuf)
+		c.sendBuf = c.sendBuf[n:]
+		c.sendLocked(&packet{header: header{Type: DataType}, Payload: payload}, true)
+	}
+
+	if len(c.sendBuf) == 0 {
+		c.sendBuf = nil
+	}
+	if len(c.sendBuf) < maxSendBuffer {
+		signal(c.writable)
+	}
+
+	if c.closing && len(c.sendBuf) == 0 && !c.finSent {
+		c.finSent = true
+		c.sendLocked(&packet{header: header{Type: FinType}}, true)
+	}
+}
+
+func (c *Conn) maybeDoneLocked() {
+	if c.closing && c.finSent && len(c.outbound) == 0 {
+		c.failLocked(net.ErrClosed)
+	}
+}
+
+func (c *Conn) sendStateLocked() {
+	c.sendLocked(&packet{header: header{Type: StateType}}, false)
+}
+
+// sendLocked sends the packet, if reliable the packet consumes a
+// sequence number and is retransmitted until acknowledged.
+func (c *Conn) sendLocked(p *packet, reliable bool) {
+	p.SeqNr = c.seqNr
+	if !reliable {
+		c.transmitLocked(&outPacket{packet: *p})
+		return
+	}
+
+	c.seqNr++
+	o := &outPacket{packet: *p}
+	c.outbound = append(c.outbound, o)
+	c.flight += len(p.Payload)
+	c.transmitLocked(o)
+}
+
+func (c *Conn) transmitLocked(o *outPacket) {
+	o.ConnectionID = c.sendID
+	o.AckNr = c.ackNr
+	if o.Type == SynType {
+		o.ConnectionID = c.recvID
+		o.AckNr = 0
+	}
+	o.Timestamp = now()
+	o.TimestampDif = c.replyMicro
+	o.WindowSize = uint32(max(0, recvWindow-len(c.readBuf)-c.inboundBytes))
+	o.SelectiveAck = c.selectiveAckLocked()
+
+	o.transmissions++
+	o.sentAt = time.Now()
+	c.lastSend = o.sentAt
+
+	// errors are handled as packet loss.
+	_ = c.socket.write(o.Serialize(), c.remote)
+}
+
+// selectiveAckLocked builds the bitmask of out of order packets received.
+func (c *Conn) selectiveAckLocked() []byte {
+	if len(c.inbound) == 0 {
+		return nil
+	}
+
+	last := 0
+	for seq := range c.inbound {
+		if d := int(seq - c.ackNr - 2); d >= 0 && d < 32*8 {
+			last = max(last, d)
+		}
+	}
+
+	mask := make([]byte, (last/32+1)*4)
+	for seq := range c.inbound {
+		if d := int(seq - c.ackNr - 2); d >= 0 && d < len(mask)*8 {
+			mask[d/8] |= 1 << (d % 8)
+		}
+	}
+	return mask
+}
+
+func selectivelyAcked(mask []byte, ackNr, seq uint16) bool {
+	d := int(seq - ackNr - 2)
+	if d < 0 || d >= len(mask)*8 {
+		return false
+	}
+	return mask[d/8]&(1<<(d%8)) != 0
+}
+
+func (c *Conn) tick(t time.Time) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	if len(c.outbound) > 0 {
+		first := c.outbound[0]
+		if t.Sub(first.sentAt) > c.rto {
+			limit := maxTransmissions
+			if c.state == stateSynSent {
+				limit = synRetries
+			}
+			if first.transmissions >= limit {
+				c.failLocked(ErrTimeout)
+				return
+			}
+
+			rto := c.rto
+			c.rto = min(c.rto*2, maxRTO)
+			c.cwnd = minCwnd
+			c.slowStart = false
+
+			for _, o := range c.outbound {
+				if !o.acked && t.Sub(o.sentAt) > rto {
+					c.transmitLocked(o)
+				}
+			}
+		}
+	}
+
+	if t.Sub(c.lastRecv) > idleTimeout {
+		c.failLocked(ErrTimeout)
+		return
+	}
+
+	if c.state == stateConnected && t.Sub(c.lastSend) > keepAliveInterval {
+		c.sendStateLocked()
+	}
+
+	c.flushLocked()
+	c.maybeDoneLocked()
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func wait(ch <-chan struct{}, deadline time.Time) {
+	if deadline.IsZero() {
+		<-ch
+		return
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-ch:
+	case <-t.C:
+	}
+}
@@ -0,0 +1,129 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// PacketType represents the uTP packet types.
+//
+//go:generate stringer -type=PacketType
+type PacketType uint8
+
+const (
+	// DataType is a regular data packet.
+	DataType PacketType = iota
+	// FinType finalizes the connection, it is the last packet sent.
+	FinType
+	// StateType is used to transmit an ACK with no data.
+	StateType
+	// ResetType terminates the connection forcefully.
+	ResetType
+	// SynType initiates a connection.
+	SynType
+)
+
+const (
+	version = 1
+
+	// HeaderLength is the length of the uTP header without extensions.
+	HeaderLength = 20
+
+	// extensions
+	extensionNone          = 0
+	extensionSelectiveAcks = 1
+)
+
+type header struct {
+	Type         PacketType
+	Extension    uint8
+	ConnectionID uint16
+	Timestamp    uint32
+	TimestampDif uint32
+	WindowSize   uint32
+	SeqNr        uint16
+	AckNr        uint16
+}
+
+type packet struct {
+	header
+	// SelectiveAck is a bitmask of received packets past AckNr+1,
+	// where the first bit represents AckNr+2.
+	SelectiveAck []byte
+	Payload      []byte
+}
+
+func (p *packet) Serialize() []byte {
+	l := HeaderLength + len(p.Payload)
+	if len(p.SelectiveAck) > 0 {
+		l += 2 + len(p.SelectiveAck)
+	}
+
+	msg := make([]byte, HeaderLength, l)
+	msg[0] = byte(p.Type)<<4 | version
+	msg[1] = extensionNone
+	if len(p.SelectiveAck) > 0 {
+		msg[1] = extensionSelectiveAcks
+	}
+	binary.BigEndian.PutUint16(msg[2:4], p.ConnectionID)
+	binary.BigEndian.PutUint32(msg[4:8], p.Timestamp)
+	binary.BigEndian.PutUint32(msg[8:12], p.TimestampDif)
+	binary.BigEndian.PutUint32(msg[12:16], p.WindowSize)
+	binary.BigEndian.PutUint16(msg[16:18], p.SeqNr)
+	binary.BigEndian.PutUint16(msg[18:20], p.AckNr)
+
+	if len(p.SelectiveAck) > 0 {
+		msg = append(msg, extensionNone, byte(len(p.SelectiveAck)))
+		msg = append(msg, p.SelectiveAck...)
+	}
+
+	return append(msg, p.Payload...)
+}
+
+func (p *packet) Deserialize(b []byte) error {
+	if len(b) < HeaderLength {
+		return errors.New("packet shorter than header")
+	}
+	if v := b[0] & 0x0f; v != version {
+		return fmt.Errorf("unsupported uTP version %d", v)
+	}
+
+	p.Type = PacketType(b[0] >> 4)
+	if p.Type > SynType {
+		return fmt.Errorf("unknown packet type %d", p.Type)
+	}
+	p.Extension = b[1]
+	p.ConnectionID = binary.BigEndian.Uint16(b[2:4])
+	p.Timestamp = binary.BigEndian.Uint32(b[4:8])
+	p.TimestampDif = binary.BigEndian.Uint32(b[8:12])
+	p.WindowSize = binary.BigEndian.Uint32(b[12:16])
+	p.SeqNr = binary.BigEndian.Uint16(b[16:18])
+	p.AckNr = binary.BigEndian.Uint16(b[18:20])
+
+	rest := b[HeaderLength:]
+	for next := p.Extension; next != extensionNone; {
+		if len(rest) < 2 {
+			return errors.New("truncated extension header")
+		}
+		typ, l := next, int(rest[1])
+		next = rest[0]
+		if len(rest) < 2+l {
+			return errors.New("truncated extension payload")
+		}
+		if typ == extensionSelectiveAcks {
+			if l < 4 || l%4 != 0 {
+				return fmt.Errorf("invalid selective ack length %d", l)
+			}
+			p.SelectiveAck = rest[2 : 2+l]
+		}
+		rest = rest[2+l:]
+	}
+	p.Payload = rest
+
+	return nil
+}
+
+// seqLess reports whether the sequence number a precedes b,
+// taking wrap around into account.
+func seqLess(a, b uint16) bool { return int16(a-b) < 0 }
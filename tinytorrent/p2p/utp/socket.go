@@ -0,0 +1,292 @@
+// Package utp implements the Micro Transport Protocol, a reliable
+// transport over UDP with LEDBAT congestion control.
+//
+// Specification: https://www.bittorrent.org/beps/bep_0029.html
+package utp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// tickInterval is how often connections are checked
+// for timed out packets and keep alives.
+const tickInterval = 25 * time.Millisecond
+
+// acceptBacklog is the number of connections waiting to be accepted,
+// new connections are refused once the backlog is full.
+const acceptBacklog = 64
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket.
+// If created via Listen it also implements the net.Listener
+// interface accepting incoming connections.
+type Socket struct {
+	pc net.PacketConn
+
+	l     sync.Mutex
+	conns map[connKey]*Conn
+
+	accept chan *Conn
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// Listen creates a socket on the local address that
+// accepts incoming uTP connections.
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newSocket(pc, true), nil
+}
+
+// NewSocket creates a socket that only dials outgoing
+// connections over the passed in packet connection.
+func NewSocket(pc net.PacketConn) *Socket { return newSocket(pc, false) }
+
+// NewListener is like NewSocket but also accepts incoming connections.
+func NewListener(pc net.PacketConn) *Socket { return newSocket(pc, true) }
+
+func newSocket(pc net.PacketConn, listen bool) *Socket {
+	s := &Socket{
+		pc:    pc,
+		conns: make(map[connKey]*Conn),
+		done:  make(chan struct{}),
+	}
+	if listen {
+		s.accept = make(chan *Conn, acceptBacklog)
+	}
+
+	s.wg.Add(2)
+	go s.read()
+	go s.tick()
+
+	return s
+}
+
+// Accept waits for and returns the next incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	if s.accept == nil {
+		return nil, errors.New("socket is not listening for incoming connections")
+	}
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr { return s.pc.LocalAddr() }
+
+// Close closes the underlying packet connection
+// and all connections multiplexed over it.
+func (s *Socket) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.pc.Close()
+
+		s.l.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.l.Unlock()
+
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+		s.wg.Wait()
+	})
+	return err
+}
+
+// DialContext establishes a uTP connection to the remote address.
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", addr, err)
+	}
+
+	s.l.Lock()
+	var id uint16
+	for {
+		id = uint16(rand.Uint32())
+		_, used := s.conns[connKey{raddr.String(), id}]
+		if !used {
+			break
+		}
+	}
+	c := newConn(s, raddr, id, id+1)
+	s.conns[connKey{raddr.String(), id}] = c
+	s.l.Unlock()
+
+	c.l.Lock()
+	c.state = stateSynSent
+	c.seqNr = 1
+	c.sendLocked(&packet{header: header{Type: SynType}}, true)
+	c.l.Unlock()
+
+	select {
+	case <-c.connected:
+		c.l.Lock()
+		err := c.err
+		c.l.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case <-ctx.Done():
+		c.fail(ctx.Err())
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.conns[connKey{c.remote.String(), c.recvID}] == c {
+		delete(s.conns, connKey{c.remote.String(), c.recvID})
+	}
+}
+
+func (s *Socket) write(b []byte, addr net.Addr) error {
+	_, err := s.pc.WriteTo(b, addr)
+	return err
+}
+
+func (s *Socket) read() {
+	defer s.wg.Done()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case <-s.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		var p packet
+		if err := p.Deserialize(buf[:n]); err != nil {
+			continue // not a uTP packet.
+		}
+		// the buffer is reused, copy the data that outlives this iteration.
+		p.Payload = append([]byte(nil), p.Payload...)
+		p.SelectiveAck = append([]byte(nil), p.SelectiveAck...)
+
+		if p.Type == SynType {
+			s.handleSyn(&p, from)
+			continue
+		}
+
+		s.l.Lock()
+		c := s.conns[connKey{from.String(), p.ConnectionID}]
+		s.l.Unlock()
+
+		if c == nil {
+			if p.Type != ResetType && p.Type != StateType {
+				s.reset(&p, from)
+			}
+			continue
+		}
+
+		c.handle(&p)
+	}
+}
+
+func (s *Socket) handleSyn(p *packet, from net.Addr) {
+	key := connKey{from.String(), p.ConnectionID + 1}
+
+	s.l.Lock()
+	c, exists := s.conns[key]
+	if !exists && s.accept != nil {
+		c = newConn(s, from, p.ConnectionID+1, p.ConnectionID)
+		c.state = stateConnected
+		c.seqNr = uint16(rand.Uint32())
+		c.ackNr = p.SeqNr
+		c.connOnce.Do(func() { close(c.connected) })
+		s.conns[key] = c
+	}
+	s.l.Unlock()
+
+	if c == nil {
+		s.reset(p, from)
+		return
+	}
+
+	if exists {
+		c.handle(p) // retransmitted syn, ack again.
+		return
+	}
+
+	c.l.Lock()
+	c.sendStateLocked()
+	c.l.Unlock()
+
+	select {
+	case s.accept <- c:
+	default:
+		s.remove(c)
+		s.reset(p, from)
+	}
+}
+
+func (s *Socket) reset(p *packet, to net.Addr) {
+	r := packet{header: header{
+		Type:         ResetType,
+		ConnectionID: p.ConnectionID,
+		Timestamp:    now(),
+		AckNr:        p.SeqNr,
+	}}
+	_ = s.write(r.Serialize(), to)
+}
+
+func (s *Socket) tick() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case t := <-ticker.C:
+			s.l.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.l.Unlock()
+
+			for _, c := range conns {
+				c.tick(t)
+			}
+		}
+	}
+}
+
+// now returns the current time in microseconds truncated to 32 bits.
+func now() uint32 { return uint32(time.Now().UnixMicro()) }
@@ -0,0 +1,213 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lossyConn simulates an unreliable network by dropping
+// and delaying outgoing datagrams.
+type lossyConn struct {
+	net.PacketConn
+	loss  float64
+	delay time.Duration
+
+	l   sync.Mutex
+	rng *rand.Rand
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.l.Lock()
+	drop := c.rng.Float64() < c.loss
+	jitter := time.Duration(0)
+	if c.delay > 0 {
+		jitter = time.Duration(c.rng.Int64N(int64(c.delay) / 2))
+	}
+	c.l.Unlock()
+
+	if drop {
+		return len(b), nil
+	}
+	if c.delay == 0 {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+
+	buf := bytes.Clone(b)
+	time.AfterFunc(c.delay+jitter, func() { c.PacketConn.WriteTo(buf, addr) })
+	return len(b), nil
+}
+
+func newLossyConn(t *testing.T, loss float64, delay time.Duration) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	return &lossyConn{PacketConn: pc, loss: loss, delay: delay, rng: rand.New(rand.NewPCG(1, 2))}
+}
+
+func TestPacket_SerializeDeserialize(t *testing.T) {
+	p := packet{
+		header: header{
+			Type:         DataType,
+			ConnectionID: 42,
+			Timestamp:    1,
+			TimestampDif: 2,
+			WindowSize:   3,
+			SeqNr:        4,
+			AckNr:        5,
+		},
+		SelectiveAck: []byte{0x1, 0x0, 0x0, 0x80},
+		Payload:      []byte("payload"),
+	}
+
+	var got packet
+	assert.Nil(t, got.Deserialize(p.Serialize()))
+	assert.Equal(t, extensionSelectiveAcks, int(got.Extension))
+	got.Extension = 0
+	assert.Equal(t, p, got)
+
+	assert.True(t, selectivelyAcked(got.SelectiveAck, 5, 7))
+	assert.False(t, selectivelyAcked(got.SelectiveAck, 5, 8))
+	assert.True(t, selectivelyAcked(got.SelectiveAck, 5, 7+31))
+
+	assert.NotNil(t, new(packet).Deserialize([]byte{0x41, 0x0}))
+	assert.NotNil(t, new(packet).Deserialize(append([]byte{0x42}, make([]byte, 19)...)))
+}
+
+func TestSeqLess(t *testing.T) {
+	assert.True(t, seqLess(1, 2))
+	assert.False(t, seqLess(2, 1))
+	assert.True(t, seqLess(65535, 0))
+	assert.False(t, seqLess(3, 3))
+}
+
+func pair(t *testing.T, loss float64, delay time.Duration) (net.Conn, net.Conn) {
+	t.Helper()
+
+	listener := NewListener(newLossyConn(t, loss, delay))
+	dialer := NewSocket(newLossyConn(t, loss, delay))
+	t.Cleanup(func() { listener.Close(); dialer.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := listener.Accept()
+		assert.Nil(t, err)
+		accepted <- c
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a, err := dialer.DialContext(ctx, listener.Addr().String())
+	assert.Nil(t, err)
+
+	return a, <-accepted
+}
+
+func TestConn_Transfer(t *testing.T) {
+	tests := []struct {
+		name  string
+		loss  float64
+		delay time.Duration
+	}{
+		{name: "reliable"},
+		{name: "delay", delay: 20 * time.Millisecond},
+		{name: "loss-and-delay", loss: 0.05, delay: 10 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := pair(t, tt.loss, tt.delay)
+
+			up := make([]byte, 512*1024)
+			down := make([]byte, 128*1024)
+			for i := range up {
+				up[i] = byte(i * 7)
+			}
+			for i := range down {
+				down[i] = byte(i * 13)
+			}
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				n, err := a.Write(up)
+				assert.Nil(t, err)
+				assert.Equal(t, len(up), n)
+			}()
+			go func() {
+				defer wg.Done()
+				n, err := b.Write(down)
+				assert.Nil(t, err)
+				assert.Equal(t, len(down), n)
+			}()
+
+			a.SetReadDeadline(time.Now().Add(30 * time.Second))
+			b.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+			gotUp := make([]byte, len(up))
+			_, err := io.ReadFull(b, gotUp)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(up, gotUp))
+
+			gotDown := make([]byte, len(down))
+			_, err = io.ReadFull(a, gotDown)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(down, gotDown))
+
+			wg.Wait()
+
+			// closing one side delivers EOF after all data to the other.
+			_, err = a.Write([]byte("bye"))
+			assert.Nil(t, err)
+			assert.Nil(t, a.Close())
+
+			rest, err := io.ReadAll(b)
+			assert.Nil(t, err)
+			assert.Equal(t, "bye", string(rest))
+
+			_, err = a.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, net.ErrClosed)
+		})
+	}
+}
+
+func TestConn_ReadDeadline(t *testing.T) {
+	a, _ := pair(t, 0, 0)
+
+	assert.Nil(t, a.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := a.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+func TestDial_Refused(t *testing.T) {
+	remote := NewSocket(newLossyConn(t, 0, 0)) // not listening.
+	dialer := NewSocket(newLossyConn(t, 0, 0))
+	t.Cleanup(func() { remote.Close(); dialer.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := dialer.DialContext(ctx, remote.Addr().String())
+	assert.NotNil(t, err)
+	assert.Nil(t, ctx.Err())
+}
+
+func TestSocket_CloseFailsConnections(t *testing.T) {
+	a, _ := pair(t, 0, 0)
+
+	a.(*Conn).socket.Close()
+
+	_, err := a.Write([]byte("x"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,48 @@
+package torrent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Despire/tinytorrent/bencoding"
+)
+
+// Attributes of files.
+// BEP47: https://www.bittorrent.org/beps/bep_0047.html
+const (
+	AttrPadding    = 'p'
+	AttrExecutable = 'x'
+	AttrHidden     = 'h'
+	AttrSymlink    = 'l'
+)
+
+// IsPadding reports whether the file only aligns the next file to a piece
+// boundary. Its content are zeros that are not stored.
+func (f *FileInfo) IsPadding() bool { return strings.ContainsRune(f.Attr, AttrPadding) }
+
+// IsExecutable reports whether the file should be stored as an executable.
+func (f *FileInfo) IsExecutable() bool { return strings.ContainsRune(f.Attr, AttrExecutable) }
+
+// IsHidden reports whether the file should be hidden, only
+// meaningful on filesystems having such an attribute.
+func (f *FileInfo) IsHidden() bool { return strings.ContainsRune(f.Attr, AttrHidden) }
+
+// IsSymlink reports whether the file is a symlink to SymlinkPath.
+func (f *FileInfo) IsSymlink() bool { return strings.ContainsRune(f.Attr, AttrSymlink) }
+
+// IsExecutable reports whether the file should be stored as an executable.
+func (f *InfoSingleFile) IsExecutable() bool { return strings.ContainsRune(f.Attr, AttrExecutable) }
+
+// joinPath joins the components of a path given as a list.
+func joinPath(l *bencoding.List) (string, error) {
+	var path string
+	for _, v := range *l {
+		p, ok := v.(*bencoding.ByteString)
+		if !ok {
+			return "", fmt.Errorf("expected path component to be of type ByteString but was %T", v)
+		}
+		path = filepath.Join(path, string(*p))
+	}
+	return path, nil
+}
@@ -0,0 +1,462 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Despire/tinytorrent/bencoding"
+)
+
+// Version is the version of the specification torrents are created for.
+type Version int
+
+const (
+	// V1 torrents hash their pieces with SHA1 (BEP3).
+	V1 Version = iota + 1
+	// V2 torrents hash the blocks of each file into a merkle tree (BEP52).
+	V2
+	// Hybrid torrents are both V1 and V2 torrents, with padding
+	// files aligning the files to piece boundaries (BEP47).
+	Hybrid
+)
+
+// DefaultPieceLength is the smallest piece length chosen for new torrents,
+// larger contents get larger pieces to keep the number of pieces low.
+const DefaultPieceLength = 256 << 10
+
+// maxPieces is the number of pieces above which the piece
+// length of new torrents is increased, up to 16MiB.
+const maxPieces = 2000
+
+type CreateOption func(c *creator)
+
+type creator struct {
+	announce    []string
+	pieceLength int64
+	version     Version
+	comment     string
+	createdBy   string
+	private     bool
+	date        time.Time
+	align       bool
+	fileHashes  bool
+}
+
+// WithAnnounce sets the tracker urls, the first being the
+// announce url and all of them the announce-list.
+func WithAnnounce(urls ...string) CreateOption {
+	return func(c *creator) {
+		c.announce = urls
+	}
+}
+
+// WithPieceLength sets the piece length, by default it is chosen
+// from the size of the content. V2 and Hybrid torrents require
+// a power of two of at least 16KiB.
+func WithPieceLength(n int64) CreateOption {
+	return func(c *creator) {
+		c.pieceLength = n
+	}
+}
+
+// WithVersion sets the version of the torrent, V1 by default.
+func WithVersion(v Version) CreateOption {
+	return func(c *creator) {
+		c.version = v
+	}
+}
+
+func WithComment(comment string) CreateOption {
+	return func(c *creator) {
+		c.comment = comment
+	}
+}
+
+func WithCreatedBy(createdBy string) CreateOption {
+	return func(c *creator) {
+		c.createdBy = createdBy
+	}
+}
+
+// WithPrivate marks the torrent as private to its trackers.
+func WithPrivate() CreateOption {
+	return func(c *creator) {
+		c.private = true
+	}
+}
+
+// WithCreationDate sets the creation date, the current time by default.
+func WithCreationDate(t time.Time) CreateOption {
+	return func(c *creator) {
+		c.date = t
+	}
+}
+
+// WithAlignedFiles starts every file of V1 torrents at a piece boundary
+// by inserting padding files, as V2 and Hybrid torrents always do.
+func WithAlignedFiles() CreateOption {
+	return func(c *creator) {
+		c.align = true
+	}
+}
+
+// WithFileHashes records the SHA1 hash of every file.
+func WithFileHashes() CreateOption {
+	return func(c *creator) {
+		c.fileHashes = true
+	}
+}
+
+type sourceFile struct {
+	path string
+	// components of the path relative to the torrent directory.
+	components []string
+	length     int64
+	attr       string
+	// symlink are the components of the target of a symlink,
+	// relative to the torrent directory.
+	symlink []string
+}
+
+// Create makes a torrent of the file or the directory at path and returns
+// the bencoded torrent file. The files of a directory are ordered by their
+// paths, empty files and anything but regular files and symlinks to files
+// within the directory are left out.
+func Create(path string, opts ...CreateOption) ([]byte, error) {
+	c := creator{version: V1, date: time.Now()}
+	for _, o := range opts {
+		o(&c)
+	}
+
+	if len(c.announce) == 0 {
+		return nil, errors.New("missing announce url")
+	}
+	if c.version < V1 || c.version > Hybrid {
+		return nil, fmt.Errorf("unknown torrent version %d", c.version)
+	}
+
+	files, single, err := sourceFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to create a torrent of in %s", path)
+	}
+
+	if c.pieceLength == 0 {
+		var total int64
+		for _, f := range files {
+			total += f.length
+		}
+		c.pieceLength = DefaultPieceLength
+		for total/c.pieceLength > maxPieces && c.pieceLength < 16<<20 {
+			c.pieceLength *= 2
+		}
+	}
+	v1, v2 := c.version != V2, c.version != V1
+	if c.pieceLength <= 0 || (v2 && (c.pieceLength < BlockSize || c.pieceLength&(c.pieceLength-1) != 0)) {
+		return nil, fmt.Errorf("invalid piece length %d", c.pieceLength)
+	}
+
+	info := &bencoding.Dictionary{Dict: map[string]bencoding.Value{
+		"name":         str(filepath.Base(filepath.Clean(path))),
+		"piece length": integer(c.pieceLength),
+	}}
+	if c.private {
+		info.Dict["private"] = integer(1)
+	}
+
+	var (
+		pieces    []byte
+		piece     = sha1.New()
+		pieceSize int64
+
+		v1Files bencoding.List
+		tree    = &bencoding.Dictionary{Dict: make(map[string]bencoding.Value)}
+		layers  = &bencoding.Dictionary{Dict: make(map[string]bencoding.Value)}
+	)
+
+	// hashV1 hashes the data into the pieces of the v1 torrent.
+	hashV1 := func(data []byte) {
+		for len(data) > 0 {
+			n := min(int64(len(data)), c.pieceLength-pieceSize)
+			piece.Write(data[:n])
+			pieceSize += n
+			data = data[n:]
+			if pieceSize == c.pieceLength {
+				pieces = piece.Sum(pieces)
+				piece.Reset()
+				pieceSize = 0
+			}
+		}
+	}
+
+	// the last file holding data is not followed by padding.
+	last := len(files) - 1
+	for last > 0 && files[last].symlink != nil {
+		last--
+	}
+
+	blocks := int(c.pieceLength / BlockSize)
+	buf := make([]byte, c.pieceLength)
+	for i, f := range files {
+		var (
+			layer    [][32]byte
+			leaves   [][32]byte
+			read     int64
+			fileHash = sha1.New()
+		)
+
+		err := func() error {
+			if f.symlink != nil {
+				return nil
+			}
+			src, err := os.Open(f.path)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+
+			for {
+				n, err := io.ReadFull(src, buf)
+				if n > 0 {
+					read += int64(n)
+					if v1 {
+						hashV1(buf[:n])
+					}
+					if v2 {
+						leaves = leafHashes(buf[:n])
+						layer = append(layer, merkleRoot(leaves, blocks, [32]byte{}))
+					}
+					if c.fileHashes {
+						fileHash.Write(buf[:n])
+					}
+				}
+				if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}()
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", f.path, err)
+		}
+		if read != f.length {
+			return nil, fmt.Errorf("%s changed while being hashed", f.path)
+		}
+
+		entry := fileEntry(f)
+		if c.fileHashes && f.symlink == nil {
+			entry.Dict["sha1"] = str(string(fileHash.Sum(nil)))
+		}
+
+		if v1 && single {
+			for k, v := range entry.Dict {
+				if k != "path" {
+					info.Dict[k] = v
+				}
+			}
+		}
+		if v1 && !single {
+			v1Files = append(v1Files, entry)
+
+			// the files of hybrid torrents start at piece boundaries.
+			pad := (c.pieceLength - pieceSize) % c.pieceLength
+			if (c.version == Hybrid || c.align) && pad > 0 && i < last {
+				hashV1(make([]byte, pad))
+				v1Files = append(v1Files, fileEntry(sourceFile{
+					components: []string{".pad", strconv.FormatInt(pad, 10)},
+					length:     pad,
+					attr:       string(AttrPadding),
+				}))
+			}
+		}
+
+		if v2 {
+			leaf := &bencoding.Dictionary{Dict: map[string]bencoding.Value{
+				"length": integer(f.length),
+			}}
+			if f.attr != "" {
+				leaf.Dict["attr"] = entry.Dict["attr"]
+			}
+			if f.symlink != nil {
+				leaf.Dict["symlink path"] = entry.Dict["symlink path"]
+			} else {
+				var root [32]byte
+				if len(layer) == 1 {
+					root = merkleRoot(leaves, nextPow2(len(leaves)), [32]byte{})
+				} else {
+					root = merkleRoot(layer, nextPow2(len(layer)), padHash(blocks))
+
+					hashes := make([]byte, 0, 32*len(layer))
+					for _, h := range layer {
+						hashes = append(hashes, h[:]...)
+					}
+					layers.Dict[string(root[:])] = str(string(hashes))
+				}
+				leaf.Dict["pieces root"] = str(string(root[:]))
+			}
+
+			node := tree
+			for _, name := range f.components {
+				next, ok := node.Dict[name].(*bencoding.Dictionary)
+				if !ok {
+					next = &bencoding.Dictionary{Dict: make(map[string]bencoding.Value)}
+					node.Dict[name] = next
+				}
+				node = next
+			}
+			node.Dict[""] = leaf
+		}
+	}
+
+	if v1 {
+		if pieceSize > 0 {
+			pieces = piece.Sum(pieces)
+		}
+		info.Dict["pieces"] = str(string(pieces))
+		if !single {
+			info.Dict["files"] = &v1Files
+		}
+	}
+	if v2 {
+		info.Dict["meta version"] = integer(2)
+		info.Dict["file tree"] = tree
+	}
+
+	t := &bencoding.Dictionary{Dict: map[string]bencoding.Value{
+		"announce":      str(c.announce[0]),
+		"creation date": integer(c.date.Unix()),
+		"info":          info,
+	}}
+	if len(c.announce) > 1 {
+		var tiers bencoding.List
+		for _, u := range c.announce {
+			tiers = append(tiers, &bencoding.List{str(u)})
+		}
+		t.Dict["announce-list"] = &tiers
+	}
+	if c.comment != "" {
+		t.Dict["comment"] = str(c.comment)
+	}
+	if c.createdBy != "" {
+		t.Dict["created by"] = str(c.createdBy)
+	}
+	if v2 && len(layers.Dict) > 0 {
+		t.Dict["piece layers"] = layers
+	}
+
+	return []byte(t.Literal()), nil
+}
+
+// sourceFiles returns the files of the torrent of the file or directory
+// at path and whether it is a single file torrent.
+func sourceFiles(path string) ([]sourceFile, bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if fi.Mode().IsRegular() {
+		return []sourceFile{{
+			path:       path,
+			components: []string{fi.Name()},
+			length:     fi.Size(),
+			attr:       attrOf(fi.Mode()),
+		}}, true, nil
+	}
+	if !fi.IsDir() {
+		return nil, false, fmt.Errorf("%s is neither a file nor a directory", path)
+	}
+
+	var files []sourceFile
+	// WalkDir visits the files in lexical order, as the file tree orders them.
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		components := strings.Split(filepath.ToSlash(rel), "/")
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(p), target)
+			}
+			target, err = filepath.Rel(path, target)
+			if err != nil || !filepath.IsLocal(target) {
+				return nil // only links within the torrent are kept.
+			}
+			files = append(files, sourceFile{
+				path:       p,
+				components: components,
+				attr:       string(AttrSymlink),
+				symlink:    strings.Split(filepath.ToSlash(target), "/"),
+			})
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Size() == 0 {
+			return nil
+		}
+		files = append(files, sourceFile{path: p, components: components, length: fi.Size(), attr: attrOf(fi.Mode())})
+		return nil
+	})
+	return files, false, err
+}
+
+// attrOf returns the attributes of a regular file.
+func attrOf(mode fs.FileMode) string {
+	if mode&0o111 != 0 {
+		return string(AttrExecutable)
+	}
+	return ""
+}
+
+func fileEntry(f sourceFile) *bencoding.Dictionary {
+	d := &bencoding.Dictionary{Dict: map[string]bencoding.Value{
+		"length": integer(f.length),
+		"path":   list(f.components),
+	}}
+	if f.attr != "" {
+		d.Dict["attr"] = str(f.attr)
+	}
+	if f.symlink != nil {
+		d.Dict["symlink path"] = list(f.symlink)
+	}
+	return d
+}
+
+func list(strs []string) *bencoding.List {
+	l := make(bencoding.List, 0, len(strs))
+	for _, s := range strs {
+		l = append(l, str(s))
+	}
+	return &l
+}
+
+func str(s string) *bencoding.ByteString { return (*bencoding.ByteString)(&s) }
+
+func integer(n int64) *bencoding.Integer { return (*bencoding.Integer)(&n) }
@@ -0,0 +1,318 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Despire/tinytorrent/bencoding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPieceLength = 32 << 10
+
+// testContent writes files spanning several pieces, a single piece
+// and less than a block, and returns their contents by path.
+func testContent(t *testing.T) (string, map[string][]byte) {
+	t.Helper()
+
+	r := rand.New(rand.NewSource(1))
+	content := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+
+	dir := filepath.Join(t.TempDir(), "content")
+	files := map[string][]byte{
+		"a.bin":                     content(100 << 10),
+		filepath.Join("b", "c.bin"): content(20 << 10),
+		filepath.Join("b", "d.txt"): content(5),
+	}
+	for p, b := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), os.ModePerm))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, p), b, 0o644))
+	}
+	return dir, files
+}
+
+// stream returns the data of the torrent as it is split into pieces.
+func stream(t *testing.T, m *MetaInfoFile, files map[string][]byte) []byte {
+	t.Helper()
+
+	if m.InfoSingleFile != nil {
+		return files[m.InfoSingleFile.Name]
+	}
+	var b []byte
+	for _, f := range m.InfoMultiFile.Files {
+		if f.Attr == "p" {
+			b = append(b, make([]byte, f.Length)...)
+			continue
+		}
+		require.Contains(t, files, f.Path)
+		b = append(b, files[f.Path]...)
+	}
+	return b
+}
+
+func TestCreate(t *testing.T) {
+	dir, files := testContent(t)
+
+	tests := []struct {
+		version Version
+		v2      bool
+		hybrid  bool
+		pieces  int64
+	}{
+		// 100KiB + 20KiB + 5B in a single stream.
+		{version: V1, pieces: 4},
+		// 4 pieces, 1 piece and 1 piece each starting a new piece.
+		{version: V2, v2: true, pieces: 6},
+		{version: Hybrid, v2: true, hybrid: true, pieces: 6},
+	}
+	for _, tt := range tests {
+		b, err := Create(dir,
+			WithAnnounce("http://tracker/announce", "http://backup/announce"),
+			WithPieceLength(testPieceLength),
+			WithVersion(tt.version),
+			WithCreationDate(time.Unix(1, 0)),
+		)
+		require.NoError(t, err)
+
+		m, err := From(bytes.NewReader(b))
+		require.NoError(t, err)
+
+		assert.Equal(t, tt.v2, m.IsV2())
+		assert.Equal(t, tt.hybrid, m.IsHybrid())
+		assert.Equal(t, "content", m.Name())
+		assert.Equal(t, "http://tracker/announce", m.Announce)
+		assert.Equal(t, []string{"http://tracker/announce", "http://backup/announce"}, m.AnnounceList)
+		assert.Equal(t, tt.pieces, m.NumPieces())
+
+		data := stream(t, m, files)
+		assert.Equal(t, int64(len(data)), m.BytesToDownload())
+
+		if tt.v2 {
+			v2 := sha256.Sum256([]byte(infoOf(t, b)))
+			assert.Equal(t, v2, m.Metadata.HashV2)
+			if !tt.hybrid {
+				assert.Equal(t, v2[:20], m.Metadata.Hash[:])
+			}
+			assert.Len(t, m.FileTree, 3)
+		}
+
+		for i := range m.NumPieces() {
+			piece := data[i*m.PieceLength : min(int64(len(data)), (i+1)*m.PieceLength)]
+			assert.True(t, m.VerifyPiece(uint32(i), piece), "version %d piece %d", tt.version, i)
+
+			corrupt := bytes.Clone(piece)
+			corrupt[0] ^= 0xff
+			assert.False(t, m.VerifyPiece(uint32(i), corrupt), "version %d piece %d", tt.version, i)
+		}
+	}
+}
+
+func TestCreate_SingleFile(t *testing.T) {
+	dir, files := testContent(t)
+
+	b, err := Create(filepath.Join(dir, "a.bin"), WithAnnounce("http://tracker/announce"), WithPieceLength(testPieceLength), WithVersion(V2))
+	require.NoError(t, err)
+
+	m, err := From(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	require.NotNil(t, m.InfoSingleFile)
+	assert.Equal(t, "a.bin", m.InfoSingleFile.Name)
+	assert.Equal(t, int64(100<<10), m.BytesToDownload())
+	assert.True(t, m.VerifyPiece(3, files["a.bin"][3*testPieceLength:]))
+}
+
+func TestCreate_Attributes(t *testing.T) {
+	dir, files := testContent(t)
+	require.NoError(t, os.Chmod(filepath.Join(dir, "a.bin"), 0o755))
+	require.NoError(t, os.Symlink(filepath.Join("b", "d.txt"), filepath.Join(dir, "e.txt")))
+
+	for _, version := range []Version{V1, V2, Hybrid} {
+		b, err := Create(dir,
+			WithAnnounce("http://tracker/announce"),
+			WithPieceLength(testPieceLength),
+			WithVersion(version),
+			WithAlignedFiles(),
+			WithFileHashes(),
+		)
+		require.NoError(t, err)
+
+		m, err := From(bytes.NewReader(b))
+		require.NoError(t, err)
+
+		// every file starts at a piece boundary.
+		assert.Equal(t, int64(6), m.NumPieces(), "version %d", version)
+
+		var offset int64
+		var paths []string
+		for _, f := range m.InfoMultiFile.Files {
+			if f.IsPadding() {
+				offset += f.Length
+				continue
+			}
+			paths = append(paths, f.Path)
+			if f.Length > 0 {
+				assert.Zero(t, offset%testPieceLength, "version %d file %s", version, f.Path)
+			}
+			offset += f.Length
+
+			assert.Equal(t, f.Path == "a.bin", f.IsExecutable(), "version %d file %s", version, f.Path)
+			assert.Equal(t, f.Path == "e.txt", f.IsSymlink(), "version %d file %s", version, f.Path)
+			if f.IsSymlink() {
+				assert.Equal(t, filepath.Join("b", "d.txt"), f.SymlinkPath)
+				assert.Zero(t, f.Length)
+			} else if version != V2 {
+				h := sha1.Sum(files[f.Path])
+				assert.Equal(t, h[:], f.Sha1, "version %d file %s", version, f.Path)
+			}
+		}
+		assert.Equal(t, []string{"a.bin", filepath.Join("b", "c.bin"), filepath.Join("b", "d.txt"), "e.txt"}, paths)
+
+		files["e.txt"] = nil
+		data := stream(t, m, files)
+		for i := range m.NumPieces() {
+			piece := data[i*m.PieceLength : min(int64(len(data)), (i+1)*m.PieceLength)]
+			assert.True(t, m.VerifyPiece(uint32(i), piece), "version %d piece %d", version, i)
+		}
+		delete(files, "e.txt")
+	}
+}
+
+func TestFrom_SymlinkEscaping(t *testing.T) {
+	dir, _ := testContent(t)
+	require.NoError(t, os.Symlink(filepath.Join("b", "d.txt"), filepath.Join(dir, "e.txt")))
+
+	b, err := Create(dir, WithAnnounce("http://tracker/announce"), WithPieceLength(testPieceLength))
+	require.NoError(t, err)
+
+	v, err := bencoding.Decode(bytes.NewReader(b))
+	require.NoError(t, err)
+	info := v.(*bencoding.Dictionary).Dict["info"].(*bencoding.Dictionary)
+	for _, f := range *info.Dict["files"].(*bencoding.List) {
+		if d := f.(*bencoding.Dictionary); d.Dict["symlink path"] != nil {
+			d.Dict["symlink path"] = list([]string{"..", "..", "etc", "passwd"})
+		}
+	}
+
+	_, err = From(bytes.NewReader([]byte(v.Literal())))
+	assert.Error(t, err)
+}
+
+func TestFrom_PathThroughSymlink(t *testing.T) {
+	dir, _ := testContent(t)
+	require.NoError(t, os.Symlink(filepath.Join("b", "d.txt"), filepath.Join(dir, "e.txt")))
+
+	b, err := Create(dir, WithAnnounce("http://tracker/announce"), WithPieceLength(testPieceLength))
+	require.NoError(t, err)
+
+	// the symlink a points to the directory of the torrent, a/b/l
+	// would be created through it, pointing to c.
+	v, err := bencoding.Decode(bytes.NewReader(b))
+	require.NoError(t, err)
+	info := v.(*bencoding.Dictionary).Dict["info"].(*bencoding.Dictionary)
+	files := info.Dict["files"].(*bencoding.List)
+	for _, f := range *files {
+		if d := f.(*bencoding.Dictionary); d.Dict["symlink path"] != nil {
+			d.Dict["path"] = list([]string{"a"})
+			d.Dict["symlink path"] = list([]string{"."})
+		}
+	}
+	*files = append(*files, &bencoding.Dictionary{Dict: map[string]bencoding.Value{
+		"length":       integer(0),
+		"attr":         str("l"),
+		"path":         list([]string{"a", "b", "l"}),
+		"symlink path": list([]string{"c"}),
+	}})
+
+	_, err = From(bytes.NewReader([]byte(v.Literal())))
+	assert.ErrorContains(t, err, "goes through symlink a")
+}
+
+func TestFrom_PathEscaping(t *testing.T) {
+	dir, _ := testContent(t)
+
+	b, err := Create(dir, WithAnnounce("http://tracker/announce"), WithPieceLength(testPieceLength))
+	require.NoError(t, err)
+
+	v, err := bencoding.Decode(bytes.NewReader(b))
+	require.NoError(t, err)
+	info := v.(*bencoding.Dictionary).Dict["info"].(*bencoding.Dictionary)
+	f := (*info.Dict["files"].(*bencoding.List))[0].(*bencoding.Dictionary)
+	f.Dict["path"] = list([]string{"..", "..", "x"})
+
+	_, err = From(bytes.NewReader([]byte(v.Literal())))
+	assert.ErrorContains(t, err, "points outside of the torrent")
+}
+
+func TestFrom_V2Invalid(t *testing.T) {
+	dir, _ := testContent(t)
+
+	b, err := Create(dir, WithAnnounce("http://tracker/announce"), WithPieceLength(testPieceLength), WithVersion(V2))
+	require.NoError(t, err)
+
+	// a piece layer not matching the pieces root of its file.
+	v, err := bencoding.Decode(bytes.NewReader(b))
+	require.NoError(t, err)
+	layers := v.(*bencoding.Dictionary).Dict["piece layers"].(*bencoding.Dictionary)
+	for k, h := range layers.Dict {
+		tampered := []byte(*h.(*bencoding.ByteString))
+		tampered[0] ^= 0xff
+		layers.Dict[k] = str(string(tampered))
+	}
+
+	_, err = From(bytes.NewReader([]byte(v.Literal())))
+	assert.ErrorContains(t, err, "do not match")
+
+	// the piece layers are not requested from peers.
+	delete(v.(*bencoding.Dictionary).Dict, "piece layers")
+	_, err = From(bytes.NewReader([]byte(v.Literal())))
+	assert.ErrorContains(t, err, "requesting them from peers is not supported")
+}
+
+func TestHashes(t *testing.T) {
+	dir, _ := testContent(t)
+
+	b, err := Create(dir, WithAnnounce("http://tracker/announce"), WithPieceLength(testPieceLength), WithVersion(V2))
+	require.NoError(t, err)
+	m, err := From(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	// a.bin has 4 pieces of 2 blocks each, the piece layer is layer 1.
+	f := m.FileTree[0]
+	require.Equal(t, "a.bin", f.Path)
+	root := [32]byte(f.PiecesRoot)
+
+	hashes, err := m.Hashes(root, 1, 0, 2, 8)
+	require.NoError(t, err)
+	require.Len(t, hashes, 3)
+
+	// the requested hashes and the uncle hash prove the pieces root.
+	assert.Equal(t, root, hashPair(hashPair(hashes[0], hashes[1]), hashes[2]))
+
+	_, err = m.Hashes(root, 0, 0, 2, 0)
+	assert.Error(t, err)
+	_, err = m.Hashes(root, 1, 1, 2, 0)
+	assert.Error(t, err)
+	_, err = m.Hashes([32]byte{}, 1, 0, 2, 0)
+	assert.Error(t, err)
+}
+
+// infoOf returns the bencoded info dictionary of the torrent.
+func infoOf(t *testing.T, torrent []byte) string {
+	t.Helper()
+
+	v, err := bencoding.Decode(bytes.NewReader(torrent))
+	require.NoError(t, err)
+	return v.(*bencoding.Dictionary).Dict["info"].Literal()
+}
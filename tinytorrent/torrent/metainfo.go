@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -20,6 +21,12 @@ type InfoSingleFile struct {
 	// Optional
 	// 32-character hex string corresponding to the MD5 sum of the file.
 	Md5sum *string
+	// Optional
+	// Attributes of the file, see FileInfo.
+	Attr string
+	// Optional
+	// SHA1 hash of the content of the file.
+	Sha1 []byte
 }
 
 type (
@@ -32,6 +39,18 @@ type (
 		// Optional.
 		// 32-character hex string corresponding to the MD5 sum of the file.
 		Md5Sum *string
+		// Optional.
+		// Attributes of the file, any of "p" for padding files aligning
+		// the next file to a piece boundary, "x" for executables, "h"
+		// for hidden files and "l" for symlinks.
+		// BEP47: https://www.bittorrent.org/beps/bep_0047.html
+		Attr string
+		// Optional.
+		// Target of a symlink, relative to the directory of the torrent.
+		SymlinkPath string
+		// Optional.
+		// SHA1 hash of the content of the file.
+		Sha1 []byte
 	}
 
 	InfoMultiFile struct {
@@ -48,8 +67,12 @@ type Info struct {
 
 	Metadata struct {
 		// Hash is the SHA1 Hash of the value of the info key in the torrent file.
-		// Use this when communicating with the tracker.
+		// Use this when communicating with the tracker. For v2 only torrents it
+		// is HashV2 truncated to 20 bytes.
 		Hash [20]byte
+		// HashV2 is the SHA256 Hash of the value of the info key for v2 and
+		// hybrid torrents.
+		HashV2 [32]byte
 	}
 
 	// Number of bytes in each piece.
@@ -57,8 +80,17 @@ type Info struct {
 	// String consisting of the concatenation of all 20-byte SHA1 hash values,
 	// one per piece (byte string, i.e. not urlencoded).
 	// Is hexencoded for better readability.
+	// Empty for v2 only torrents.
 	Pieces string
 
+	// Optional
+	// MetaVersion is 2 for v2 and hybrid torrents.
+	// BEP52: https://www.bittorrent.org/beps/bep_0052.html
+	MetaVersion int64
+	// FileTree are the files of the file tree of v2 and hybrid torrents,
+	// in the order of their paths.
+	FileTree []TreeFile
+
 	// Optional
 	// If it is set to "1", the client MUST publish its presence to get other peers
 	//  ONLY via the trackers explicitly described in the metainfo file. If this field
@@ -87,6 +119,13 @@ type MetaInfoFile struct {
 	CreatedBy *string
 	// The string encoding format used to generate the pieces part of the info dictionary in the .torrent metafile.
 	Encoding *string
+	// Optional
+	// PieceLayers are the hashes of the pieces of the files of v2 and hybrid
+	// torrents larger than a single piece, keyed by the pieces root of the file.
+	PieceLayers map[[32]byte][]byte
+
+	// Raw is the bencoded torrent file the torrent was read from.
+	Raw []byte
 }
 
 func (m *MetaInfoFile) BytesToDownload() int64 {
@@ -104,8 +143,23 @@ func (m *MetaInfoFile) BytesToDownload() int64 {
 	}
 }
 
+// Name returns the suggested name of the file or
+// the directory the torrent is stored in.
+func (m *MetaInfoFile) Name() string {
+	switch {
+	case m.InfoSingleFile != nil:
+		return m.InfoSingleFile.Name
+	case m.InfoMultiFile != nil:
+		return m.InfoMultiFile.Name
+	default:
+		panic("malformed meta_info_file state")
+	}
+}
+
 func (m *MetaInfoFile) NumPieces() int64 {
 	switch {
+	case m.Pieces == "" && m.IsV2():
+		return (m.BytesToDownload() + m.PieceLength - 1) / m.PieceLength
 	case m.InfoSingleFile != nil, m.InfoMultiFile != nil:
 		b, err := hex.DecodeString(m.Pieces)
 		if err != nil {
@@ -117,7 +171,11 @@ func (m *MetaInfoFile) NumPieces() int64 {
 	}
 }
 
+// PieceHash returns the SHA1 hash of the piece, nil for v2 only torrents.
 func (m *MetaInfoFile) PieceHash(piece uint32) []byte {
+	if m.Pieces == "" {
+		return nil
+	}
 	b, err := hex.DecodeString(m.Pieces)
 	if err != nil {
 		panic(err) // This should never happen as we always hexencode.
@@ -125,6 +183,10 @@ func (m *MetaInfoFile) PieceHash(piece uint32) []byte {
 	return b[piece*20 : piece*20+20]
 }
 
+// IsPrivate reports whether peers may only be obtained via the trackers
+// listed in the torrent file.
+func (m *MetaInfoFile) IsPrivate() bool { return m.Private != nil && *m.Private == 1 }
+
 func From(bencoded io.Reader) (*MetaInfoFile, error) {
 	v, err := bencoding.Decode(bencoded)
 	if err != nil {
@@ -137,7 +199,7 @@ func From(bencoded io.Reader) (*MetaInfoFile, error) {
 
 	d := v.(*bencoding.Dictionary)
 
-	info := MetaInfoFile{}
+	info := MetaInfoFile{Raw: []byte(d.Literal())}
 
 	for k, v := range d.Dict {
 		if err := apply(k, v, &info); err != nil {
@@ -175,6 +237,33 @@ func apply(key string, value bencoding.Value, info *MetaInfoFile) error {
 			}
 		}
 
+		if info.MetaVersion == 2 {
+			info.Metadata.HashV2 = sha256.Sum256([]byte(l.Literal()))
+			if info.Pieces == "" {
+				// v2 only torrents are identified by the truncated v2 hash.
+				copy(info.Metadata.Hash[:], info.Metadata.HashV2[:])
+				layoutV2(&info.Info)
+			}
+		}
+
+		return nil
+	case "piece layers":
+		l, ok := value.(*bencoding.Dictionary)
+		if !ok {
+			return fmt.Errorf("expected 'Piece Layers' to be of type Dictionary but was %T", value)
+		}
+
+		info.PieceLayers = make(map[[32]byte][]byte, len(l.Dict))
+		for k, v := range l.Dict {
+			hashes, ok := v.(*bencoding.ByteString)
+			if !ok {
+				return fmt.Errorf("expected item inside 'Piece Layers' to be of type ByteString but was %T", v)
+			}
+			if len(k) != 32 {
+				return fmt.Errorf("invalid pieces root of length %d inside 'Piece Layers'", len(k))
+			}
+			info.PieceLayers[[32]byte([]byte(k))] = []byte(*hashes)
+		}
 		return nil
 	case "announce":
 		l, ok := value.(*bencoding.ByteString)
@@ -290,6 +379,24 @@ func infoCommon(key string, value bencoding.Value, info *Info, isMultiFile bool)
 		}
 		info.InfoSingleFile.Md5sum = (*string)(l)
 		return nil
+	case "attr":
+		l, ok := value.(*bencoding.ByteString)
+		if !ok {
+			return fmt.Errorf("expected 'Attr' to be of type ByteString but was %T", value)
+		}
+		if info.InfoSingleFile != nil {
+			info.InfoSingleFile.Attr = string(*l)
+		}
+		return nil
+	case "sha1":
+		l, ok := value.(*bencoding.ByteString)
+		if !ok {
+			return fmt.Errorf("expected 'Sha1' to be of type ByteString but was %T", value)
+		}
+		if info.InfoSingleFile != nil {
+			info.InfoSingleFile.Sha1 = []byte(*l)
+		}
+		return nil
 	case "files":
 		l, ok := value.(*bencoding.List)
 		if !ok {
@@ -312,6 +419,34 @@ func infoCommon(key string, value bencoding.Value, info *Info, isMultiFile bool)
 				fi.Length = int64(*l)
 			}
 
+			if a, ok := dict.Dict["attr"]; ok {
+				a, ok := a.(*bencoding.ByteString)
+				if !ok {
+					return fmt.Errorf("expected 'Attr' inside of 'Files' to be of type ByteString but was %T", value)
+				}
+				fi.Attr = string(*a)
+			}
+
+			if s, ok := dict.Dict["symlink path"]; ok {
+				s, ok := s.(*bencoding.List)
+				if !ok {
+					return fmt.Errorf("expected 'Symlink Path' inside of 'Files' to be of type List but was %T", value)
+				}
+				path, err := joinPath(s)
+				if err != nil {
+					return fmt.Errorf("invalid 'Symlink Path' inside of 'Files': %w", err)
+				}
+				fi.SymlinkPath = path
+			}
+
+			if s, ok := dict.Dict["sha1"]; ok {
+				s, ok := s.(*bencoding.ByteString)
+				if !ok {
+					return fmt.Errorf("expected 'Sha1' inside of 'Files' to be of type ByteString but was %T", value)
+				}
+				fi.Sha1 = []byte(*s)
+			}
+
 			if s, ok := dict.Dict["md5sum"]; ok {
 				s, ok := s.(*bencoding.ByteString)
 				if !ok {
@@ -354,6 +489,24 @@ func infoCommon(key string, value bencoding.Value, info *Info, isMultiFile bool)
 		}
 		info.Pieces = hex.EncodeToString([]byte((*l)))
 		return nil
+	case "meta version":
+		l, ok := value.(*bencoding.Integer)
+		if !ok {
+			return fmt.Errorf("expected 'Meta Version' to be of type Integer but was %T", value)
+		}
+		info.MetaVersion = int64(*l)
+		return nil
+	case "file tree":
+		l, ok := value.(*bencoding.Dictionary)
+		if !ok {
+			return fmt.Errorf("expected 'File Tree' to be of type Dictionary but was %T", value)
+		}
+		files, err := parseFileTree(l, "")
+		if err != nil {
+			return fmt.Errorf("failed to parse 'File Tree': %w", err)
+		}
+		info.FileTree = files
+		return nil
 	case "private":
 		l, ok := value.(*bencoding.Integer)
 		if !ok {
@@ -373,7 +526,10 @@ func validate(i *MetaInfoFile) error {
 	if i.InfoSingleFile == nil && i.InfoMultiFile == nil {
 		return errors.New("neither single file nor multi file mode specified")
 	}
-	if len(i.Info.Pieces) == 0 {
+	if i.MetaVersion != 0 && i.MetaVersion != 2 {
+		return fmt.Errorf("unsupported 'meta version' %d", i.MetaVersion)
+	}
+	if len(i.Info.Pieces) == 0 && !i.IsV2() {
 		return errors.New("missing 'pieces' inside torrent file")
 	}
 	h, err := hex.DecodeString(i.Info.Pieces)
@@ -395,13 +551,37 @@ func validate(i *MetaInfoFile) error {
 		if i.InfoMultiFile.Name == "" {
 			return errors.New("missing directory 'name' for multi file torrent")
 		}
+		symlinks := make(map[string]bool)
 		for _, f := range i.InfoMultiFile.Files {
-			if f.Length == 0 {
+			if f.IsSymlink() {
+				symlinks[f.Path] = true
+			}
+		}
+		for _, f := range i.InfoMultiFile.Files {
+			// symlinks take no space within the pieces.
+			if f.Length == 0 && !f.IsSymlink() {
 				return fmt.Errorf("missing 'length' inside %s for multi file torrent", i.InfoMultiFile.Name)
 			}
 			if len(f.Path) == 0 {
 				return fmt.Errorf("missing 'Path' inside %s for multi file torrent", i.InfoMultiFile.Name)
 			}
+			if !filepath.IsLocal(f.Path) {
+				return fmt.Errorf("path %s inside %s points outside of the torrent", f.Path, i.InfoMultiFile.Name)
+			}
+			if f.IsSymlink() && !filepath.IsLocal(f.SymlinkPath) {
+				return fmt.Errorf("symlink %s inside %s points outside of the torrent", f.Path, i.InfoMultiFile.Name)
+			}
+			// a file beneath a symlink would be written wherever the symlink points to.
+			for dir := filepath.Dir(f.Path); dir != "."; dir = filepath.Dir(dir) {
+				if symlinks[dir] {
+					return fmt.Errorf("path %s inside %s goes through symlink %s", f.Path, i.InfoMultiFile.Name, dir)
+				}
+			}
+		}
+	}
+	if i.IsV2() {
+		if err := validateV2(i); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -11,6 +11,11 @@ import (
 )
 
 func TestFrom(t *testing.T) {
+	debian, err := os.ReadFile("./test_data/debian.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	type args struct {
 		bencoded io.Reader
 	}
@@ -23,18 +28,13 @@ func TestFrom(t *testing.T) {
 		{
 			name: "pass",
 			args: args{
-				bencoded: func() io.Reader {
-					b, err := os.ReadFile("./test_data/debian.torrent")
-					if err != nil {
-						t.Fatal(err)
-					}
-					return bytes.NewBuffer(b)
-				}(),
+				bencoded: bytes.NewBuffer(debian),
 			},
 			want: &MetaInfoFile{
 				Info: Info{
 					Metadata: struct {
-						Hash [20]byte
+						Hash   [20]byte
+						HashV2 [32]byte
 					}{
 						Hash: [20]byte{0xe3, 0x7b, 0x64, 0xd8, 0x5c, 0xf4, 0xaa, 0x93, 0xe0, 0xec, 0x4a, 0xee, 0x2b, 0x44, 0x73, 0x5b, 0x7c, 0xb6, 0x39, 0x67},
 					},
@@ -57,6 +57,7 @@ func TestFrom(t *testing.T) {
 				CreationDate: ptrFor(time.Unix(1725106229, 0)),
 				Comment:      ptrFor("\"Debian CD from cdimage.debian.org\""),
 				CreatedBy:    ptrFor("mktorrent 1.1"),
+				Raw:          debian,
 			},
 			wantErr: false,
 		},
@@ -0,0 +1,378 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/Despire/tinytorrent/bencoding"
+)
+
+// BlockSize is the size of the blocks the leaves of the
+// merkle trees of the files of v2 torrents are hashed from.
+const BlockSize = 16 << 10
+
+// TreeFile is a file of the file tree of a v2 torrent.
+type TreeFile struct {
+	// Path to the file, relative to the directory of multi file torrents.
+	Path string
+	// Length of the file in bytes.
+	Length int64
+	// PiecesRoot is the root of the merkle tree of the 16KiB
+	// blocks of the file, nil for empty files.
+	PiecesRoot []byte
+	// Attr and SymlinkPath are as in FileInfo.
+	Attr        string
+	SymlinkPath string
+}
+
+// IsV2 reports whether the torrent is a v2 or hybrid torrent.
+func (m *MetaInfoFile) IsV2() bool { return m.MetaVersion == 2 }
+
+// IsHybrid reports whether the torrent is both a v1 and v2 torrent.
+func (m *MetaInfoFile) IsHybrid() bool { return m.IsV2() && m.Pieces != "" }
+
+// VerifyPiece reports whether the data of the piece matches its hash,
+// the merkle tree hashes for v2 and hybrid torrents, SHA1 otherwise.
+func (m *MetaInfoFile) VerifyPiece(piece uint32, data []byte) bool {
+	if !m.IsV2() {
+		sum := sha1.Sum(data)
+		return bytes.Equal(sum[:], m.PieceHash(piece))
+	}
+
+	f, k := m.pieceFile(piece)
+	if f == nil {
+		return false
+	}
+
+	// the data past the end of the file is padding.
+	n := min(m.PieceLength, f.Length-k*m.PieceLength)
+	if int64(len(data)) < n || !isZero(data[n:]) {
+		return false
+	}
+	leaves := leafHashes(data[:n])
+
+	if f.Length <= m.PieceLength {
+		root := merkleRoot(leaves, nextPow2(len(leaves)), [32]byte{})
+		return bytes.Equal(root[:], f.PiecesRoot)
+	}
+
+	layer := m.PieceLayers[[32]byte(f.PiecesRoot)]
+	root := merkleRoot(leaves, int(m.PieceLength/BlockSize), [32]byte{})
+	return bytes.Equal(root[:], layer[32*k:32*k+32])
+}
+
+// Hashes returns the hashes of the layer of the merkle tree of the file
+// with the pieces root as requested by a peer, followed by the uncle
+// hashes of up to proofLayers layers above them. Only the hashes of the
+// piece layer, which is part of the torrent, are available.
+//
+// Only the serving side of hash requests (BEP52) is supported, hashes are
+// never requested from peers. Torrents without the piece layers of their
+// files spanning more than a piece are thus refused, as their pieces
+// could not be verified.
+func (m *MetaInfoFile) Hashes(root [32]byte, baseLayer, index, length, proofLayers uint32) ([][32]byte, error) {
+	layer, ok := m.PieceLayers[root]
+	if !ok {
+		return nil, errors.New("no piece layer for the pieces root")
+	}
+	if baseLayer != uint32(bits.TrailingZeros64(uint64(m.PieceLength/BlockSize))) {
+		return nil, fmt.Errorf("only the piece layer %d is available", baseLayer)
+	}
+
+	hashes := make([][32]byte, len(layer)/32)
+	for i := range hashes {
+		copy(hashes[i][:], layer[32*i:])
+	}
+
+	width := nextPow2(len(hashes))
+	if length == 0 || length&(length-1) != 0 || index%length != 0 || int(index)+int(length) > width {
+		return nil, fmt.Errorf("invalid range of %d hashes at %d", length, index)
+	}
+
+	// the layer is padded with the roots of the subtrees of zero blocks.
+	pad := padHash(int(m.PieceLength / BlockSize))
+	for len(hashes) < width {
+		hashes = append(hashes, pad)
+	}
+
+	result := slices.Clone(hashes[index : index+length])
+
+	// the uncle hashes start at the layer of the root of the requested hashes.
+	for range bits.TrailingZeros32(length) {
+		hashes = nextLayer(hashes)
+		index /= 2
+	}
+	for ; proofLayers > 0 && len(hashes) > 1; proofLayers-- {
+		result = append(result, hashes[index^1])
+		hashes = nextLayer(hashes)
+		index /= 2
+	}
+	return result, nil
+}
+
+// pieceFile returns the file the piece belongs to and the
+// index of the piece within the file, nil if there is none.
+func (m *MetaInfoFile) pieceFile(piece uint32) (*TreeFile, int64) {
+	var start int64
+	for i := range m.FileTree {
+		f := &m.FileTree[i]
+		n := (f.Length + m.PieceLength - 1) / m.PieceLength
+		if int64(piece) < start+n {
+			return f, int64(piece) - start
+		}
+		start += n
+	}
+	return nil, 0
+}
+
+// parseFileTree flattens the file tree, the files are
+// ordered by their paths as the dictionary keys are.
+func parseFileTree(d *bencoding.Dictionary, dir string) ([]TreeFile, error) {
+	keys := make([]string, 0, len(d.Dict))
+	for k := range d.Dict {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var files []TreeFile
+	for _, k := range keys {
+		v, ok := d.Dict[k].(*bencoding.Dictionary)
+		if !ok {
+			return nil, fmt.Errorf("expected %q to be of type Dictionary but was %T", k, d.Dict[k])
+		}
+
+		if k != "" {
+			sub, err := parseFileTree(v, filepath.Join(dir, k))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+			continue
+		}
+
+		// the empty key holds the properties of the file named by its parent.
+		if dir == "" {
+			return nil, errors.New("file without a name")
+		}
+		f := TreeFile{Path: dir}
+		l, ok := v.Dict["length"].(*bencoding.Integer)
+		if !ok {
+			return nil, fmt.Errorf("expected 'Length' of %s to be of type Integer but was %T", dir, v.Dict["length"])
+		}
+		f.Length = int64(*l)
+		if r, ok := v.Dict["pieces root"]; ok {
+			r, ok := r.(*bencoding.ByteString)
+			if !ok {
+				return nil, fmt.Errorf("expected 'Pieces Root' of %s to be of type ByteString but was %T", dir, v.Dict["pieces root"])
+			}
+			f.PiecesRoot = []byte(*r)
+		}
+		if a, ok := v.Dict["attr"]; ok {
+			a, ok := a.(*bencoding.ByteString)
+			if !ok {
+				return nil, fmt.Errorf("expected 'Attr' of %s to be of type ByteString but was %T", dir, v.Dict["attr"])
+			}
+			f.Attr = string(*a)
+		}
+		if l, ok := v.Dict["symlink path"]; ok {
+			l, ok := l.(*bencoding.List)
+			if !ok {
+				return nil, fmt.Errorf("expected 'Symlink Path' of %s to be of type List but was %T", dir, v.Dict["symlink path"])
+			}
+			path, err := joinPath(l)
+			if err != nil {
+				return nil, fmt.Errorf("invalid 'Symlink Path' of %s: %w", dir, err)
+			}
+			f.SymlinkPath = path
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// layoutV2 describes the files of the file tree of a v2 only torrent as
+// a v1 torrent with padding files, as each file starts at a piece boundary.
+// Empty files, except symlinks, take no pieces and are left out.
+func layoutV2(info *Info) {
+	name := info.InfoSingleFile.Name
+	if len(info.FileTree) == 1 && info.FileTree[0].Path == name {
+		info.InfoSingleFile.Length = info.FileTree[0].Length
+		info.InfoSingleFile.Attr = info.FileTree[0].Attr
+		return
+	}
+
+	info.InfoSingleFile = nil
+	info.InfoMultiFile = &InfoMultiFile{Name: name}
+
+	var files []FileInfo
+	for _, f := range info.FileTree {
+		fi := FileInfo{Length: f.Length, Path: f.Path, Attr: f.Attr, SymlinkPath: f.SymlinkPath}
+		if fi.IsSymlink() {
+			files = append(files, fi)
+			continue
+		}
+		if f.Length == 0 {
+			continue
+		}
+		if pad := padding(files, info.PieceLength); pad > 0 {
+			files = append(files, FileInfo{
+				Length: pad,
+				Path:   filepath.Join(".pad", strconv.FormatInt(pad, 10)),
+				Attr:   string(AttrPadding),
+			})
+		}
+		files = append(files, fi)
+	}
+	info.InfoMultiFile.Files = files
+}
+
+// padding returns the bytes needed after the files to reach a piece boundary.
+func padding(files []FileInfo, pieceLength int64) int64 {
+	var total int64
+	for _, f := range files {
+		total += f.Length
+	}
+	if r := total % pieceLength; r != 0 {
+		return pieceLength - r
+	}
+	return 0
+}
+
+func validateV2(i *MetaInfoFile) error {
+	if i.PieceLength < BlockSize || i.PieceLength&(i.PieceLength-1) != 0 {
+		return fmt.Errorf("invalid 'piece length' %d for v2 torrent, must be a power of two of at least 16KiB", i.PieceLength)
+	}
+	if len(i.FileTree) == 0 {
+		return errors.New("missing 'file tree' inside v2 torrent file")
+	}
+
+	for _, f := range i.FileTree {
+		if f.Length == 0 {
+			continue
+		}
+		if len(f.PiecesRoot) != 32 {
+			return fmt.Errorf("invalid 'pieces root' of %s", f.Path)
+		}
+		if f.Length <= i.PieceLength {
+			continue
+		}
+
+		layer, ok := i.PieceLayers[[32]byte(f.PiecesRoot)]
+		if !ok {
+			return fmt.Errorf("missing 'piece layers' of %s, requesting them from peers is not supported", f.Path)
+		}
+		pieces := (f.Length + i.PieceLength - 1) / i.PieceLength
+		if int64(len(layer)) != 32*pieces {
+			return fmt.Errorf("invalid length of 'piece layers' of %s", f.Path)
+		}
+
+		hashes := make([][32]byte, pieces)
+		for k := range hashes {
+			copy(hashes[k][:], layer[32*k:])
+		}
+		root := merkleRoot(hashes, nextPow2(len(hashes)), padHash(int(i.PieceLength/BlockSize)))
+		if !bytes.Equal(root[:], f.PiecesRoot) {
+			return fmt.Errorf("'piece layers' of %s do not match its 'pieces root'", f.Path)
+		}
+	}
+
+	if !i.IsHybrid() {
+		return nil
+	}
+
+	// the v1 files, without the padding, must be the files of the file tree.
+	var v1 []TreeFile
+	switch {
+	case i.InfoSingleFile != nil:
+		v1 = append(v1, TreeFile{Path: i.InfoSingleFile.Name, Length: i.InfoSingleFile.Length})
+	case i.InfoMultiFile != nil:
+		for _, f := range i.InfoMultiFile.Files {
+			if !f.IsPadding() && f.Length > 0 {
+				v1 = append(v1, TreeFile{Path: f.Path, Length: f.Length})
+			}
+		}
+	}
+	var v2 []TreeFile
+	for _, f := range i.FileTree {
+		if f.Length > 0 {
+			v2 = append(v2, TreeFile{Path: f.Path, Length: f.Length})
+		}
+	}
+	if !slices.EqualFunc(v1, v2, func(a, b TreeFile) bool { return a.Path == b.Path && a.Length == b.Length }) {
+		return errors.New("the v1 files of the hybrid torrent do not match its 'file tree'")
+	}
+	return nil
+}
+
+// leafHashes returns the SHA256 hashes of the 16KiB blocks of the data.
+func leafHashes(data []byte) [][32]byte {
+	leaves := make([][32]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+	for len(data) > 0 {
+		n := min(len(data), BlockSize)
+		leaves = append(leaves, sha256.Sum256(data[:n]))
+		data = data[n:]
+	}
+	return leaves
+}
+
+// merkleRoot returns the root of the merkle tree of the leaves,
+// padded with the pad hash to width leaves, a power of two.
+func merkleRoot(leaves [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, max(1, width))
+	copy(layer, leaves)
+	for i := len(leaves); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		layer = nextLayer(layer)
+	}
+	return layer[0]
+}
+
+// nextLayer hashes the pairs of the layer into the layer above it.
+func nextLayer(layer [][32]byte) [][32]byte {
+	next := make([][32]byte, len(layer)/2)
+	for i := range next {
+		next[i] = hashPair(layer[2*i], layer[2*i+1])
+	}
+	return next
+}
+
+func hashPair(a, b [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], a[:])
+	copy(buf[32:], b[:])
+	return sha256.Sum256(buf[:])
+}
+
+// padHash returns the root of the merkle tree of the number of zero leaves.
+func padHash(leaves int) [32]byte {
+	var h [32]byte
+	for ; leaves > 1; leaves /= 2 {
+		h = hashPair(h, h)
+	}
+	return h
+}
+
+func nextPow2(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}